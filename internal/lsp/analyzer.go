@@ -2,8 +2,11 @@ package lsp
 
 import (
 	"fmt"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 // CrystalAnalyzer provides Crystal language analysis capabilities
@@ -14,21 +17,176 @@ type CrystalAnalyzer struct {
 	// Built-in types and classes
 	builtinTypes []string
 
-	// Standard library methods
-	stdlibMethods map[string][]string
-
 	// Document-specific class and method tracking
 	documentClasses map[string]*ClassInfo
-	documentMethods map[string][]string
+	documentMethods map[string][]*MethodInfo
+	// Top-level constants
+	documentConstants map[string]*ConstantInfo
+	// Types declared with `alias`, by alias name
+	documentAliases map[string]string
+	// Top-level macros
+	documentMacros map[string]*MacroInfo
+
+	// Parsed documents by URI, reused until the version changes
+	contexts map[string]*DocumentContext
+
+	// Types defined in other workspace files, if an index is attached
+	index *WorkspaceIndex
+
+	// Whether the client accepts snippet completion items
+	snippetSupport bool
+
+	// Which checks AnalyzeDocument runs
+	diagnosticOptions DiagnosticOptions
 }
 
-// ClassInfo holds information about a class
+// ClassInfo holds information about a class, struct, module, enum or
+// annotation
 type ClassInfo struct {
-	Name     string
-	Methods  []string
-	Location Position
+	Name          string
+	QualifiedName string // e.g. Outer::Inner
+	SuperClass    string
+	IsStruct      bool // structs are value types
+	IsModule      bool
+	IsEnum        bool
+	IsAnnotation  bool
+	Methods       map[string][]*MethodInfo // overloads share a name
+	Properties    map[string]*PropertyInfo
+	Constants     map[string]*ConstantInfo
+	Members       []*ConstantInfo // enum members in declaration order
+	Macros        map[string]*MacroInfo
+	InstanceVars  map[string]Position // first assignment or declaration, keyed without the @
+	Documentation string
+	Location      Position
+	EndLine       int
+	Declarations  []ClassDeclaration // the first declaration and any reopenings
+}
+
+// ClassDeclaration is one `class Foo ... end` block declaring or reopening
+// a type
+type ClassDeclaration struct {
+	Keyword    string // "class", "struct", "module", "enum" or "annotation"
+	SuperClass string
+	Location   Position
+	EndLine    int
+}
+
+// MethodInfo holds information about a method definition
+type MethodInfo struct {
+	Name          string
+	Visibility    string // "public", "private" or "protected"
+	Parameters    []ParameterInfo
+	ReturnType    string
+	Documentation string
+	IsProperty    bool // generated by a property or record macro rather than def
+	IsClassMethod bool // `def self.name` or a class_property accessor
+	Location      Position
+	EndLine       int
+}
+
+// PropertyInfo holds information about a property, getter or setter declaration
+type PropertyInfo struct {
+	Name          string
+	Type          string
+	DefaultValue  string
+	Documentation string
+	HasGetter     bool
+	HasSetter     bool
+	IsReadOnly    bool // declared with `getter`
+	IsClassLevel  bool // declared with `class_property` and friends
+	Location      Position
+}
+
+// MacroInfo holds information about a macro definition
+type MacroInfo struct {
+	Name          string
+	Parameters    []ParameterInfo
+	Documentation string
+	Location      Position
+	EndLine       int
+}
+
+// ConstantInfo holds information about a constant assignment such as
+// `MAX_SIZE = 100`
+type ConstantInfo struct {
+	Name          string
+	QualifiedName string // e.g. Config::MAX_SIZE
+	Value         string
+	Documentation string
+	Location      Position
+}
+
+// ParameterInfo holds information about a method parameter
+type ParameterInfo struct {
+	Name          string
+	ExternalName  string // call-site name when it differs, e.g. `to` in `to target`
+	Type          string
+	DefaultValue  string
+	IsSplat       bool // *args
+	IsDoubleSplat bool // **opts
+	IsBlock       bool // &block
+}
+
+// SymbolKind returns the LSP symbol kind for this type
+func (c *ClassInfo) SymbolKind() int {
+	switch {
+	case c.IsStruct:
+		return SymbolKindStruct
+	case c.IsModule:
+		return SymbolKindModule
+	case c.IsEnum:
+		return SymbolKindEnum
+	}
+	return SymbolKindClass
+}
+
+// KindName returns the Crystal keyword used to declare this type
+func (c *ClassInfo) KindName() string {
+	switch {
+	case c.IsStruct:
+		return "struct"
+	case c.IsModule:
+		return "module"
+	case c.IsEnum:
+		return "enum"
+	case c.IsAnnotation:
+		return "annotation"
+	}
+	return "class"
+}
+
+// SetWorkspaceIndex attaches an index of the workspace's files so that types
+// defined in other files can be completed
+func (a *CrystalAnalyzer) SetWorkspaceIndex(index *WorkspaceIndex) {
+	a.index = index
+}
+
+// SetSnippetSupport enables snippet completions for clients that support them
+func (a *CrystalAnalyzer) SetSnippetSupport(enabled bool) {
+	a.snippetSupport = enabled
+}
+
+// DiagnosticOptions returns the checks AnalyzeDocument currently runs
+func (a *CrystalAnalyzer) DiagnosticOptions() DiagnosticOptions {
+	return a.diagnosticOptions
+}
+
+// SetDiagnosticOptions chooses which checks AnalyzeDocument runs
+func (a *CrystalAnalyzer) SetDiagnosticOptions(options DiagnosticOptions) {
+	a.diagnosticOptions = options
 }
 
+var (
+	methodCallRegexp   = regexp.MustCompile(`([\p{L}\p{N}_]+[\?!]?)\s*$`)
+	classSymbolRegexp  = regexp.MustCompile(`^\s*(?:abstract\s+)?(class|struct)\s+([\p{L}\p{N}_]+)`)
+	methodSymbolRegexp = regexp.MustCompile(`^\s*def\s+([\p{L}\p{N}_]+[\?!]?)`)
+	moduleSymbolRegexp = regexp.MustCompile(`^\s*module\s+([\p{L}\p{N}_]+)`)
+	enumSymbolRegexp   = regexp.MustCompile(`^\s*(?:private\s+)?enum\s+([\p{L}\p{N}_]+)`)
+	macroSymbolRegexp  = regexp.MustCompile(`^\s*macro\s+([\p{L}\p{N}_]+[\?!=]?)`)
+	// Annotations have no symbol kind of their own and are listed as classes
+	annotationSymbolRegexp = regexp.MustCompile(`^\s*annotation\s+([\p{L}\p{N}_]+)`)
+)
+
 // NewCrystalAnalyzer creates a new Crystal language analyzer
 func NewCrystalAnalyzer() *CrystalAnalyzer {
 	return &CrystalAnalyzer{
@@ -49,33 +207,13 @@ func NewCrystalAnalyzer() *CrystalAnalyzer {
 			"String", "Symbol", "Tuple", "UInt8", "UInt16", "UInt32",
 			"UInt64", "UInt128", "Union", "Value", "Void",
 		},
-		stdlibMethods: map[string][]string{
-			"String": {
-				"size", "length", "empty?", "blank?", "downcase", "upcase",
-				"capitalize", "strip", "lstrip", "rstrip", "split", "gsub",
-				"sub", "match", "includes?", "starts_with?", "ends_with?",
-				"to_i", "to_f", "to_s", "chars", "bytes", "lines",
-			},
-			"Array": {
-				"size", "length", "empty?", "first", "last", "push", "pop",
-				"shift", "unshift", "insert", "delete", "delete_at", "clear",
-				"concat", "join", "map", "select", "reject", "find", "each",
-				"sort", "reverse", "shuffle", "uniq", "flatten", "compact",
-			},
-			"Hash": {
-				"size", "length", "empty?", "keys", "values", "has_key?",
-				"has_value?", "fetch", "merge", "delete", "clear", "each",
-				"each_key", "each_value", "select", "reject", "transform_keys",
-				"transform_values", "invert", "to_a",
-			},
-			"Int32": {
-				"abs", "ceil", "floor", "round", "to_i", "to_f", "to_s",
-				"times", "upto", "downto", "step", "even?", "odd?", "+", "-",
-				"*", "/", "%", "**", "==", "!=", "<", ">", "<=", ">=",
-			},
-		},
-		documentClasses: make(map[string]*ClassInfo),
-		documentMethods: make(map[string][]string),
+		documentClasses:   make(map[string]*ClassInfo),
+		documentMethods:   make(map[string][]*MethodInfo),
+		documentConstants: make(map[string]*ConstantInfo),
+		documentAliases:   make(map[string]string),
+		documentMacros:    make(map[string]*MacroInfo),
+		contexts:          make(map[string]*DocumentContext),
+		diagnosticOptions: defaultDiagnosticOptions(),
 	}
 }
 
@@ -85,139 +223,320 @@ func (a *CrystalAnalyzer) AnalyzeDocument(doc *TextDocumentItem) []Diagnostic {
 
 	// Parse classes and methods in the document first
 	a.parseDocumentStructure(doc)
-
-	// Create lexer for this document
-	lexer := NewCrystalLexer(doc.Text)
-	tokens := lexer.Tokenize()
+	tokens := a.documentContext(doc).Tokens
 
 	lines := strings.Split(doc.Text, "\n")
 
+	options := a.diagnosticOptions
+	literalQuotes := quotesInLiterals(tokens)
+
 	for lineNum, line := range lines {
 		// Check for syntax errors
-		if diag := a.checkSyntaxError(line, lineNum); diag != nil {
-			diagnostics = append(diagnostics, *diag)
+		if options.SyntaxErrors {
+			if diag := a.checkSyntaxError(line, lineNum, literalQuotes[lineNum]); diag != nil {
+				diagnostics = append(diagnostics, *diag)
+			}
 		}
 
 		// Check for undefined variables (simple heuristic)
-		if diag := a.checkUndefinedVariable(line, lineNum); diag != nil {
-			diagnostics = append(diagnostics, *diag)
+		if options.UndefinedVariable {
+			if diag := a.checkUndefinedVariable(line, lineNum); diag != nil {
+				diagnostics = append(diagnostics, *diag)
+			}
 		}
 	}
 
+	// Check that every block opener has a matching end, and every bracket
+	// a matching closer. A broken structure still holds back brace errors
+	// when its own diagnostics are switched off.
+	structureDiagnostics := a.checkStructureBalance(tokens)
+	if options.StructureBalance {
+		diagnostics = append(diagnostics, structureDiagnostics...)
+	}
+	if options.BracketBalance {
+		diagnostics = append(diagnostics, a.checkBracketBalance(tokens, len(structureDiagnostics) > 0)...)
+	}
+
+	if options.AssignmentInCondition {
+		diagnostics = append(diagnostics, a.checkAssignmentInCondition(tokens)...)
+	}
+
+	diagnostics = append(diagnostics, checkMissingRequires(doc)...)
+
+	// Redefinitions that replace an earlier method or reopen a type
+	diagnostics = append(diagnostics, a.checkDuplicateMethods(doc.URI)...)
+	diagnostics = append(diagnostics, a.checkDuplicateClasses(doc.URI)...)
+
+	// Calls to methods a locally defined type doesn't have
+	diagnostics = append(diagnostics, a.checkUndefinedMethods(doc, tokens)...)
+	diagnostics = append(diagnostics, a.checkArityMismatch(doc, tokens)...)
+
 	// Use tokens for additional analysis
 	diagnostics = append(diagnostics, a.analyzeTokens(tokens, doc.URI)...)
 
 	return diagnostics
 }
 
-// parseDocumentStructure parses classes and methods in the document
-func (a *CrystalAnalyzer) parseDocumentStructure(doc *TextDocumentItem) {
-	// Clear previous data
-	a.documentClasses = make(map[string]*ClassInfo)
-	a.documentMethods = make(map[string][]string)
+// GetCompletions provides completion suggestions
+func (a *CrystalAnalyzer) GetCompletions(doc *TextDocumentItem, pos Position) CompletionList {
+	var items []CompletionItem
+	var scopes map[string]int
 
-	lines := strings.Split(doc.Text, "\n")
-	var currentClass string
+	// Nothing to complete inside comments, strings or declared names
+	context := a.analyzeCompletionContext(doc, pos)
+	if context.Kind == completionContextNone {
+		return CompletionList{Items: []CompletionItem{}}
+	}
 
-	for lineNum, line := range lines {
-		// Find class definitions
-		if match := regexp.MustCompile(`^\s*class\s+(\w+)`).FindStringSubmatch(line); match != nil {
-			className := match[1]
-			currentClass = className
-			a.documentClasses[className] = &ClassInfo{
-				Name:     className,
-				Methods:  []string{},
-				Location: Position{Line: lineNum, Character: 0},
+	// Parse document structure first
+	a.parseDocumentStructure(doc)
+
+	switch context.Kind {
+	case completionContextMethod:
+		// Completing after a dot
+		items = append(items, a.getMethodCompletions(context.Prefix, doc, pos)...)
+		if isSpecDocument(doc) {
+			items = append(items, specCompletions(context.Word, specExpectations)...)
+		}
+	case completionContextSuperclass:
+		items = append(items, a.typeCompletions(doc, context.Word, true, func(classInfo *ClassInfo) bool {
+			return !classInfo.IsModule && !classInfo.IsEnum && !classInfo.IsAnnotation
+		})...)
+	case completionContextModule:
+		items = append(items, a.typeCompletions(doc, context.Word, false, func(classInfo *ClassInfo) bool {
+			return classInfo.IsModule
+		})...)
+	case completionContextNamespace:
+		items = append(items, a.namespaceCompletions(doc, context.Namespace)...)
+	case completionContextException:
+		for _, name := range exceptionTypes {
+			if fuzzyMatch(context.Word, name) {
+				items = append(items, CompletionItem{
+					Label: name,
+					Kind:  CompletionItemKindClass,
+				})
 			}
 		}
-
-		// Find method definitions
-		if match := regexp.MustCompile(`^\s*def\s+(\w+[\?!]?)`).FindStringSubmatch(line); match != nil {
-			methodName := match[1]
-			if currentClass != "" {
-				// Add to current class
-				if classInfo, exists := a.documentClasses[currentClass]; exists {
-					classInfo.Methods = append(classInfo.Methods, methodName)
+		items = append(items, a.typeCompletions(doc, context.Word, false, func(classInfo *ClassInfo) bool {
+			return isExceptionName(classInfo.Name)
+		})...)
+	default:
+		// Get the word being typed
+		lastWord := context.Word
+
+		// Items of each source are ranked by how far their scope is
+		scopes = make(map[string]int)
+		add := func(scope int, added ...CompletionItem) {
+			for _, item := range added {
+				if _, seen := scopes[item.Label]; !seen {
+					scopes[item.Label] = scope
 				}
 			}
-			// Also track globally
-			if methods, exists := a.documentMethods[currentClass]; exists {
-				a.documentMethods[currentClass] = append(methods, methodName)
-			} else {
-				a.documentMethods[currentClass] = []string{methodName}
-			}
+			items = append(items, added...)
 		}
 
-		// Reset current class on 'end'
-		if strings.TrimSpace(line) == "end" && currentClass != "" {
-			currentClass = ""
+		// Closing the innermost unclosed block comes first
+		if context.CloseBlock != "" && strings.HasPrefix("end", lastWord) {
+			add(scopeBlock, CompletionItem{
+				Label:     "end",
+				Kind:      CompletionItemKindKeyword,
+				Detail:    fmt.Sprintf("Close '%s'", context.CloseBlock),
+				Preselect: true,
+			})
 		}
-	}
-}
 
-// GetCompletions provides completion suggestions
-func (a *CrystalAnalyzer) GetCompletions(doc *TextDocumentItem, pos Position) CompletionList {
-	var items []CompletionItem
-
-	// Parse document structure first
-	a.parseDocumentStructure(doc)
+		// Add local variables visible at the cursor, the current block's first
+		tokens := a.documentContext(doc).Tokens
+		inBlock := blockLocals(tokens, pos)
+		for _, name := range a.variablesInScope(tokens, pos) {
+			if name != lastWord && fuzzyMatch(lastWord, name) {
+				scope := scopeEnclosing
+				if inBlock == nil || inBlock[name] {
+					scope = scopeBlock
+				}
+				add(scope, CompletionItem{
+					Label:  name,
+					Kind:   CompletionItemKindVariable,
+					Detail: a.inferTypeOfExpression(name, doc, pos),
+				})
+			}
+		}
 
-	// Get the current line
-	lines := strings.Split(doc.Text, "\n")
-	if pos.Line >= len(lines) {
-		return CompletionList{Items: items}
-	}
+		// Add the methods of the enclosing type, callable without a receiver
+		if classInfo := a.findEnclosingClass(pos.Line); classInfo != nil {
+			classLevel := false
+			if method := a.findEnclosingMethod(pos.Line); method != nil {
+				classLevel = method.IsClassMethod
+			}
+			for _, item := range a.getMethodsForType(classInfo.QualifiedName, true, classLevel) {
+				if fuzzyMatch(lastWord, item.Label) {
+					add(scopeMember, item)
+				}
+			}
+		}
 
-	currentLine := lines[pos.Line]
-	if pos.Character > len(currentLine) {
-		pos.Character = len(currentLine)
-	}
+		// Add methods defined outside of any type
+		for _, method := range a.documentMethods[""] {
+			if fuzzyMatch(lastWord, method.Name) {
+				documentation := "Top-level method"
+				if method.Documentation != "" {
+					documentation = method.Documentation
+				}
+				add(scopeMember, CompletionItem{
+					Label:         method.Name,
+					Kind:          CompletionItemKindFunction,
+					Detail:        generateMethodSignature(method),
+					Documentation: documentation,
+				})
+			}
+		}
 
-	prefix := currentLine[:pos.Character]
+		// Add macros visible at the cursor
+		for _, macro := range a.macrosInScope(pos.Line) {
+			if fuzzyMatch(lastWord, macro.Name) {
+				add(scopeMember, CompletionItem{
+					Label:         macro.Name,
+					Kind:          CompletionItemKindFunction,
+					Detail:        generateMacroSignature(macro),
+					Documentation: macro.Documentation,
+				})
+			}
+		}
 
-	// Check if we're completing after a dot (method completion)
-	if strings.Contains(prefix, ".") {
-		items = append(items, a.getMethodCompletions(prefix, doc)...)
-	} else {
-		// Get the word being typed
-		lastWord := getLastWord(prefix)
+		// Add constants visible at the cursor
+		for _, constant := range a.constantsInScope(pos.Line) {
+			if fuzzyMatch(lastWord, constant.Name) {
+				add(scopeMember, CompletionItem{
+					Label:         constant.Name,
+					Kind:          CompletionItemKindConstant,
+					Detail:        a.constantDetail(constant, doc),
+					Documentation: constant.Documentation,
+				})
+			}
+		}
 
 		// Add keywords
 		for _, keyword := range a.keywords {
-			if lastWord == "" || strings.HasPrefix(keyword, lastWord) {
-				items = append(items, CompletionItem{
+			if fuzzyMatch(lastWord, keyword) {
+				add(scopeGlobal, CompletionItem{
 					Label: keyword,
 					Kind:  CompletionItemKindKeyword,
 				})
 			}
 		}
 
-		// Add built-in types
+		// Add block snippets
+		if a.snippetSupport {
+			add(scopeGlobal, snippetCompletions(lastWord)...)
+		}
+
+		// Add the spec DSL in spec files
+		if isSpecDocument(doc) {
+			add(scopeGlobal, specCompletions(lastWord, specMethods)...)
+		}
+
+		// Add built-in, local and workspace types
+		add(scopeGlobal, a.typeCompletions(doc, lastWord, true, func(*ClassInfo) bool { return true })...)
+
+		// Add type aliases
+		for _, name := range sortedAliasNames(a.documentAliases) {
+			if fuzzyMatch(lastWord, name) {
+				add(scopeGlobal, CompletionItem{
+					Label:  name,
+					Kind:   CompletionItemKindClass,
+					Detail: "alias of " + a.documentAliases[name],
+				})
+			}
+		}
+	}
+
+	return CompletionList{
+		IsIncomplete: false,
+		Items:        rankCompletionItems(dedupeCompletionItems(items), context.Word, scopes),
+	}
+}
+
+// typeCompletions returns the types whose name starts with word: the
+// built-in ones if requested, then the local and workspace types accept
+// allows
+func (a *CrystalAnalyzer) typeCompletions(doc *TextDocumentItem, word string, builtins bool, accept func(*ClassInfo) bool) []CompletionItem {
+	var items []CompletionItem
+	matches := func(name string) bool {
+		return fuzzyMatch(word, name)
+	}
+
+	if builtins {
 		for _, typ := range a.builtinTypes {
-			if lastWord == "" || strings.HasPrefix(strings.ToLower(typ), strings.ToLower(lastWord)) {
+			if matches(typ) {
 				items = append(items, CompletionItem{
 					Label: typ,
 					Kind:  CompletionItemKindClass,
 				})
 			}
 		}
+	}
 
-		// Add local class names
-		for className := range a.documentClasses {
-			if lastWord == "" || strings.HasPrefix(strings.ToLower(className), strings.ToLower(lastWord)) {
-				items = append(items, CompletionItem{
-					Label:  className,
-					Kind:   CompletionItemKindClass,
-					Detail: "Local class",
-				})
+	// Local class, struct and module names
+	for _, classInfo := range a.documentClasses {
+		if accept(classInfo) && matches(classInfo.Name) {
+			items = append(items, classCompletionItem(classInfo, "Local "+classInfo.KindName()))
+		}
+	}
+
+	// Types defined in other workspace files
+	if a.index != nil {
+		for _, indexed := range a.index.Classes() {
+			if indexed.URI == doc.URI {
+				continue
+			}
+			classInfo := indexed.Class
+			if accept(classInfo) && matches(classInfo.Name) {
+				detail := classInfo.KindName() + " from " + filepath.Base(uriToPath(indexed.URI))
+				items = append(items, classCompletionItem(classInfo, detail))
 			}
 		}
 	}
 
-	return CompletionList{
-		IsIncomplete: false,
-		Items:        items,
+	return items
+}
+
+// dedupeCompletionItems removes items that share a label and kind, keeping
+// the position of the first occurrence and the content of the richest one
+func dedupeCompletionItems(items []CompletionItem) []CompletionItem {
+	type key struct {
+		label string
+		kind  int
+	}
+
+	seen := make(map[key]int)
+	result := make([]CompletionItem, 0, len(items))
+
+	for _, item := range items {
+		k := key{item.Label, item.Kind}
+		idx, exists := seen[k]
+		if !exists {
+			seen[k] = len(result)
+			result = append(result, item)
+			continue
+		}
+		if completionRichness(item) > completionRichness(result[idx]) {
+			result[idx] = item
+		}
+	}
+
+	return result
+}
+
+// completionRichness ranks items by how much information they carry
+func completionRichness(item CompletionItem) int {
+	score := len(item.Detail) + len(item.Documentation)
+	if item.Detail != "" {
+		score += 1000
+	}
+	if item.Documentation != "" {
+		score += 1000
 	}
+	return score
 }
 
 // GetHover provides hover information
@@ -228,7 +547,7 @@ func (a *CrystalAnalyzer) GetHover(doc *TextDocumentItem, pos Position) *Hover {
 	}
 
 	currentLine := lines[pos.Line]
-	word := getWordAtPosition(currentLine, pos.Character)
+	word := getWordAtPosition(currentLine, byteOffset(currentLine, pos.Character))
 
 	if word == "" {
 		return nil
@@ -237,11 +556,101 @@ func (a *CrystalAnalyzer) GetHover(doc *TextDocumentItem, pos Position) *Hover {
 	// Parse document structure
 	a.parseDocumentStructure(doc)
 
-	// Check if it's a local class
-	if classInfo, exists := a.documentClasses[word]; exists {
-		methodList := strings.Join(classInfo.Methods, ", ")
+	// Check if it's a local class or struct
+	if classInfo := a.findClass(word); classInfo != nil {
+		header := fmt.Sprintf("**%s** - Local %s", classInfo.QualifiedName, classInfo.KindName())
+		if classInfo.SuperClass != "" {
+			header += fmt.Sprintf(" < %s", classInfo.SuperClass)
+		}
+		if classInfo.Documentation != "" {
+			header += "\n\n" + classInfo.Documentation
+		}
+		content := fmt.Sprintf("%s\n\nMethods: %s", header, strings.Join(sortedMethodNames(classInfo), ", "))
+		for _, ancestor := range a.ancestors(classInfo) {
+			var inherited []string
+			for _, name := range sortedMethodNames(ancestor) {
+				for _, method := range ancestor.Methods[name] {
+					if method.Visibility != "private" {
+						inherited = append(inherited, name)
+						break
+					}
+				}
+			}
+			if len(inherited) > 0 {
+				content += fmt.Sprintf("\n\nInherited from %s: %s", ancestor.QualifiedName, strings.Join(inherited, ", "))
+			}
+		}
+		return &Hover{
+			Contents: []string{content},
+		}
+	}
+
+	// Check if it's a constant
+	qualifier := wordQualifier(currentLine, byteOffset(currentLine, pos.Character))
+	if constant := a.findConstant(word, qualifier, pos.Line); constant != nil {
+		content := fmt.Sprintf("**%s** - constant", constant.QualifiedName)
+		if typeName := a.inferTypeOfExpression(constant.Value, doc, constant.Location); typeName != "" {
+			content = fmt.Sprintf("**%s** - %s constant", constant.QualifiedName, typeName)
+		}
+		content += fmt.Sprintf("\n\n`%s = %s`", constant.Name, constant.Value)
+		if constant.Documentation != "" {
+			content += "\n\n" + constant.Documentation
+		}
+		return &Hover{
+			Contents: []string{content},
+		}
+	}
+
+	// Local variables shadow methods of the same name
+	for _, name := range a.variablesInScope(a.documentContext(doc).Tokens, pos) {
+		if name != word {
+			continue
+		}
+		content := fmt.Sprintf("**%s** - local variable", word)
+		if typeName := a.inferTypeOfExpression(word, doc, pos); typeName != "" {
+			content = fmt.Sprintf("**%s** : %s - local variable", word, typeName)
+		}
+		return &Hover{
+			Contents: []string{content},
+		}
+	}
+
+	// A method called on a known type is described by the type that
+	// defines it, which may be an ancestor of the receiver's type
+	if receiverClass, set, ok := a.calledMethod(doc, currentLine, pos, word); ok {
+		owner := fmt.Sprintf("method defined in %s %s", set.Owner.KindName(), set.Owner.QualifiedName)
+		if set.Owner != receiverClass {
+			owner += fmt.Sprintf(", inherited by %s", receiverClass.QualifiedName)
+		}
+		var contents []string
+		for _, methodInfo := range set.Overloads {
+			content := fmt.Sprintf("**%s** - %s %s", generateMethodSignature(methodInfo), methodInfo.Visibility, owner)
+			if methodInfo.Documentation != "" {
+				content += "\n\n" + methodInfo.Documentation
+			}
+			contents = append(contents, content)
+		}
 		return &Hover{
-			Contents: []string{fmt.Sprintf("**%s** - Local class\n\nMethods: %s", word, methodList)},
+			Contents: contents,
+		}
+	}
+
+	// Check if it's a local method
+	if classInfo, overloads := a.findMethod(word); len(overloads) > 0 {
+		owner := "top-level method"
+		if classInfo != nil {
+			owner = fmt.Sprintf("method defined in %s %s", classInfo.KindName(), classInfo.QualifiedName)
+		}
+		var contents []string
+		for _, methodInfo := range overloads {
+			content := fmt.Sprintf("**%s** - %s %s", generateMethodSignature(methodInfo), methodInfo.Visibility, owner)
+			if methodInfo.Documentation != "" {
+				content += "\n\n" + methodInfo.Documentation
+			}
+			contents = append(contents, content)
+		}
+		return &Hover{
+			Contents: contents,
 		}
 	}
 
@@ -266,6 +675,57 @@ func (a *CrystalAnalyzer) GetHover(doc *TextDocumentItem, pos Position) *Hover {
 	return nil
 }
 
+// calledMethod resolves the method named word at pos through the type of its
+// receiver, or through the enclosing type when it is called without one. It
+// returns the receiver's type and the overloads the call reaches, which for
+// a type-name receiver are its class methods.
+func (a *CrystalAnalyzer) calledMethod(doc *TextDocumentItem, line string, pos Position, word string) (*ClassInfo, methodSet, bool) {
+	start := byteOffset(line, pos.Character)
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:start])
+		if !isWordChar(r) {
+			break
+		}
+		start -= size
+	}
+
+	var classInfo *ClassInfo
+	classLevel := false
+	before := strings.TrimRight(line[:start], " \t")
+	if strings.HasSuffix(before, ".") && !strings.HasSuffix(before, "..") {
+		switch receiver := extractReceiver(before[:len(before)-1]); {
+		case receiver == "":
+		case receiver == "self":
+			classInfo = a.findEnclosingClass(pos.Line)
+		case typeNameRegexp.MatchString(receiver):
+			classInfo, classLevel = a.resolveClass(receiver, pos.Line), true
+		default:
+			typeName := a.resolveAlias(a.inferTypeOfExpression(receiver, doc, pos))
+			classInfo = a.resolveClass(baseTypeName(typeName), pos.Line)
+		}
+	} else {
+		classInfo = a.findEnclosingClass(pos.Line)
+	}
+	if classInfo == nil {
+		return nil, methodSet{}, false
+	}
+
+	set, exists := a.resolveMethods(classInfo)[word]
+	if !exists {
+		return nil, methodSet{}, false
+	}
+	var overloads []*MethodInfo
+	for _, method := range set.Overloads {
+		if method.IsClassMethod == classLevel {
+			overloads = append(overloads, method)
+		}
+	}
+	if len(overloads) > 0 {
+		set.Overloads = overloads
+	}
+	return classInfo, set, true
+}
+
 // GetSignatureHelp provides signature help
 func (a *CrystalAnalyzer) GetSignatureHelp(doc *TextDocumentItem, pos Position) *SignatureHelp {
 	lines := strings.Split(doc.Text, "\n")
@@ -274,24 +734,57 @@ func (a *CrystalAnalyzer) GetSignatureHelp(doc *TextDocumentItem, pos Position)
 	}
 
 	currentLine := lines[pos.Line]
-	prefix := currentLine[:pos.Character]
+	prefix := currentLine[:byteOffset(currentLine, pos.Character)]
 
 	// Simple heuristic: look for method calls
-	methodCall := a.findMethodCall(prefix)
-	if methodCall != "" {
-		return &SignatureHelp{
-			Signatures: []SignatureInformation{
-				{
-					Label:         fmt.Sprintf("%s(args)", methodCall),
-					Documentation: fmt.Sprintf("Method call: %s", methodCall),
-				},
-			},
-			ActiveSignature: 0,
-			ActiveParameter: 0,
+	methodCall, activeParameter := a.findMethodCall(prefix)
+	if methodCall == "" {
+		return nil
+	}
+
+	a.parseDocumentStructure(doc)
+
+	if _, overloads := a.findMethod(methodCall); len(overloads) > 0 {
+		help := &SignatureHelp{
+			ActiveSignature: -1,
+			ActiveParameter: activeParameter,
+		}
+		for i, methodInfo := range overloads {
+			var parameters []ParameterInformation
+			for _, param := range methodInfo.Parameters {
+				parameters = append(parameters, ParameterInformation{Label: formatParameter(param)})
+			}
+			documentation := methodInfo.Documentation
+			if documentation == "" {
+				documentation = fmt.Sprintf("Method call: %s", methodCall)
+			}
+			help.Signatures = append(help.Signatures, SignatureInformation{
+				Label:         generateMethodSignature(methodInfo),
+				Documentation: documentation,
+				Parameters:    parameters,
+			})
+
+			// The first overload that can take the argument being typed is active
+			if help.ActiveSignature < 0 && acceptsArgument(methodInfo, activeParameter) {
+				help.ActiveSignature = i
+			}
+		}
+		if help.ActiveSignature < 0 {
+			help.ActiveSignature = 0
 		}
+		return help
 	}
 
-	return nil
+	return &SignatureHelp{
+		Signatures: []SignatureInformation{
+			{
+				Label:         fmt.Sprintf("%s(args)", methodCall),
+				Documentation: fmt.Sprintf("Method call: %s", methodCall),
+			},
+		},
+		ActiveSignature: 0,
+		ActiveParameter: activeParameter,
+	}
 }
 
 // GetDefinition provides go-to-definition
@@ -302,51 +795,178 @@ func (a *CrystalAnalyzer) GetDefinition(doc *TextDocumentItem, pos Position) []L
 	}
 
 	currentLine := lines[pos.Line]
-	word := getWordAtPosition(currentLine, pos.Character)
+	word := getWordAtPosition(currentLine, byteOffset(currentLine, pos.Character))
 
 	// Parse document structure
 	a.parseDocumentStructure(doc)
 
-	// Check if it's a local class
-	if classInfo, exists := a.documentClasses[word]; exists {
-		return []Location{
-			{
-				URI: doc.URI,
-				Range: Range{
-					Start: classInfo.Location,
-					End:   Position{Line: classInfo.Location.Line, Character: classInfo.Location.Character + len(word)},
-				},
-			},
+	// `@name` leads to the property declaring it or its first assignment
+	if isInstanceVariableAt(currentLine, byteOffset(currentLine, pos.Character)) {
+		if location, found := a.findInstanceVariable(word, pos.Line); found {
+			return []Location{definitionLocation(doc.URI, location, word)}
+		}
+		return []Location{}
+	}
+
+	// Definitions in the current document win over the rest of the
+	// workspace. A qualified name like `Foo::Bar` resolves through Foo.
+	qualifier := wordQualifier(currentLine, byteOffset(currentLine, pos.Character))
+	qualifiedName := word
+	if qualifier != "" {
+		qualifiedName = qualifier + "::" + word
+	}
+	if classInfo := a.resolveClass(qualifiedName, pos.Line); classInfo != nil {
+		return []Location{definitionLocation(doc.URI, classInfo.Location, classInfo.Name)}
+	}
+	if constant := a.findConstant(word, qualifier, pos.Line); constant != nil {
+		return []Location{definitionLocation(doc.URI, constant.Location, constant.Name)}
+	}
+	if _, overloads := a.findMethod(word); len(overloads) > 0 {
+		locations := make([]Location, 0, len(overloads))
+		for _, method := range overloads {
+			locations = append(locations, definitionLocation(doc.URI, method.Location, method.Name))
+		}
+		return locations
+	}
+
+	if a.index != nil {
+		if indexed, ok := a.index.FindClass(strings.TrimPrefix(qualifiedName, "::"), doc.URI); ok {
+			return []Location{definitionLocation(indexed.URI, indexed.Class.Location, indexed.Class.Name)}
+		}
+		if methods := a.index.FindMethods(word, doc.URI); len(methods) > 0 {
+			locations := make([]Location, 0, len(methods))
+			for _, indexed := range methods {
+				locations = append(locations, definitionLocation(indexed.URI, indexed.Method.Location, indexed.Method.Name))
+			}
+			return locations
+		}
+	}
+
+	return []Location{}
+}
+
+// GetTypeDefinition resolves the type of the variable or call at pos and
+// returns the declaration of that type. Builtin types have no declaration
+// in the workspace and yield no locations.
+func (a *CrystalAnalyzer) GetTypeDefinition(doc *TextDocumentItem, pos Position) []Location {
+	lines := strings.Split(doc.Text, "\n")
+	if pos.Line >= len(lines) {
+		return []Location{}
+	}
+
+	currentLine := lines[pos.Line]
+	if getWordAtPosition(currentLine, byteOffset(currentLine, pos.Character)) == "" {
+		return []Location{}
+	}
+
+	// Extend to the end of the word so `user.na|me` infers `user.name`
+	end := byteOffset(currentLine, pos.Character)
+	for end < len(currentLine) {
+		r, size := utf8.DecodeRuneInString(currentLine[end:])
+		if !isWordChar(r) {
+			break
+		}
+		end += size
+	}
+
+	a.parseDocumentStructure(doc)
+
+	expr := extractReceiver(currentLine[:end])
+	typeName := baseTypeName(a.inferTypeOfExpression(expr, doc, pos))
+	if typeName == "" {
+		return []Location{}
+	}
+
+	if classInfo := a.findClass(typeName); classInfo != nil {
+		return []Location{definitionLocation(doc.URI, classInfo.Location, classInfo.Name)}
+	}
+	if a.index != nil {
+		if indexed, ok := a.index.FindClass(typeName, doc.URI); ok {
+			return []Location{definitionLocation(indexed.URI, indexed.Class.Location, indexed.Class.Name)}
 		}
 	}
 
 	return []Location{}
 }
 
+// definitionLocation returns the location of a declared name
+func definitionLocation(uri string, start Position, name string) Location {
+	return Location{
+		URI: uri,
+		Range: Range{
+			Start: start,
+			End:   Position{Line: start.Line, Character: start.Character + encodedLen(name)},
+		},
+	}
+}
+
 // GetDocumentSymbols provides document symbols
 func (a *CrystalAnalyzer) GetDocumentSymbols(doc *TextDocumentItem) []SymbolInformation {
 	var symbols []SymbolInformation
 
+	a.parseDocumentStructure(doc)
 	lines := strings.Split(doc.Text, "\n")
 
 	for lineNum, line := range lines {
-		// Find class definitions
-		if match := regexp.MustCompile(`^\s*class\s+(\w+)`).FindStringSubmatch(line); match != nil {
+		// Find class and struct definitions
+		if match := classSymbolRegexp.FindStringSubmatch(line); match != nil {
+			kind := SymbolKindClass
+			if match[1] == "struct" {
+				kind = SymbolKindStruct
+			}
+			symbols = append(symbols, SymbolInformation{
+				Name: match[2],
+				Kind: kind,
+				Location: Location{
+					URI: doc.URI,
+					Range: Range{
+						Start: Position{Line: lineNum, Character: 0},
+						End:   Position{Line: lineNum, Character: encodedLen(line)},
+					},
+				},
+			})
+		}
+
+		// Find records and the fields they declare
+		if match := recordDefRegexp.FindStringSubmatch(line); match != nil {
 			symbols = append(symbols, SymbolInformation{
 				Name: match[1],
-				Kind: SymbolKindClass,
+				Kind: SymbolKindStruct,
 				Location: Location{
 					URI: doc.URI,
 					Range: Range{
 						Start: Position{Line: lineNum, Character: 0},
-						End:   Position{Line: lineNum, Character: len(line)},
+						End:   Position{Line: lineNum, Character: encodedLen(line)},
 					},
 				},
 			})
+			// The fields are the parameters of the constructor the record
+			// generates on this line
+			var fields []*PropertyInfo
+			if classInfo := a.findClass(match[1]); classInfo != nil {
+				for _, constructor := range classInfo.Methods["initialize"] {
+					if !constructor.IsProperty || constructor.Location.Line != lineNum {
+						continue
+					}
+					for _, param := range constructor.Parameters {
+						if property := classInfo.Properties[param.Name]; property != nil {
+							fields = append(fields, property)
+						}
+					}
+				}
+			}
+			for _, property := range fields {
+				symbols = append(symbols, SymbolInformation{
+					Name:          property.Name,
+					Kind:          SymbolKindProperty,
+					Location:      definitionLocation(doc.URI, property.Location, property.Name),
+					ContainerName: match[1],
+				})
+			}
 		}
 
 		// Find method definitions
-		if match := regexp.MustCompile(`^\s*def\s+(\w+[\?!]?)`).FindStringSubmatch(line); match != nil {
+		if match := methodSymbolRegexp.FindStringSubmatch(line); match != nil {
 			symbols = append(symbols, SymbolInformation{
 				Name: match[1],
 				Kind: SymbolKindMethod,
@@ -354,14 +974,52 @@ func (a *CrystalAnalyzer) GetDocumentSymbols(doc *TextDocumentItem) []SymbolInfo
 					URI: doc.URI,
 					Range: Range{
 						Start: Position{Line: lineNum, Character: 0},
-						End:   Position{Line: lineNum, Character: len(line)},
+						End:   Position{Line: lineNum, Character: encodedLen(line)},
 					},
 				},
 			})
 		}
 
+		// Find constant declarations, skipping reassignments and enum members
+		if match := constantDefRegexp.FindStringSubmatch(line); match != nil {
+			if constant := a.findConstant(match[1], "", lineNum); constant != nil && constant.Location.Line == lineNum {
+				symbols = append(symbols, SymbolInformation{
+					Name: match[1],
+					Kind: SymbolKindConstant,
+					Location: Location{
+						URI: doc.URI,
+						Range: Range{
+							Start: Position{Line: lineNum, Character: 0},
+							End:   Position{Line: lineNum, Character: encodedLen(line)},
+						},
+					},
+				})
+			}
+		}
+
+		// Find property, getter and setter declarations
+		if match := propertyRegexp.FindStringSubmatch(line); match != nil {
+			for _, declaration := range splitTopLevel(match[4], ',') {
+				declared := propertyDeclarationRegexp.FindStringSubmatch(strings.TrimSpace(declaration))
+				if declared == nil {
+					continue
+				}
+				symbols = append(symbols, SymbolInformation{
+					Name: declared[1],
+					Kind: SymbolKindProperty,
+					Location: Location{
+						URI: doc.URI,
+						Range: Range{
+							Start: Position{Line: lineNum, Character: 0},
+							End:   Position{Line: lineNum, Character: encodedLen(line)},
+						},
+					},
+				})
+			}
+		}
+
 		// Find module definitions
-		if match := regexp.MustCompile(`^\s*module\s+(\w+)`).FindStringSubmatch(line); match != nil {
+		if match := moduleSymbolRegexp.FindStringSubmatch(line); match != nil {
 			symbols = append(symbols, SymbolInformation{
 				Name: match[1],
 				Kind: SymbolKindModule,
@@ -369,28 +1027,285 @@ func (a *CrystalAnalyzer) GetDocumentSymbols(doc *TextDocumentItem) []SymbolInfo
 					URI: doc.URI,
 					Range: Range{
 						Start: Position{Line: lineNum, Character: 0},
-						End:   Position{Line: lineNum, Character: len(line)},
+						End:   Position{Line: lineNum, Character: encodedLen(line)},
+					},
+				},
+			})
+		}
+
+		// Find enum definitions and their members
+		if match := enumSymbolRegexp.FindStringSubmatch(line); match != nil {
+			symbols = append(symbols, SymbolInformation{
+				Name: match[1],
+				Kind: SymbolKindEnum,
+				Location: Location{
+					URI: doc.URI,
+					Range: Range{
+						Start: Position{Line: lineNum, Character: 0},
+						End:   Position{Line: lineNum, Character: encodedLen(line)},
 					},
 				},
 			})
+			if classInfo := a.findClass(match[1]); classInfo != nil && classInfo.Location.Line == lineNum {
+				for _, member := range classInfo.Members {
+					symbols = append(symbols, SymbolInformation{
+						Name:          member.Name,
+						Kind:          SymbolKindEnumMember,
+						Location:      definitionLocation(doc.URI, member.Location, member.Name),
+						ContainerName: match[1],
+					})
+				}
+			}
 		}
+
+		// Find macro definitions
+		if match := macroSymbolRegexp.FindStringSubmatch(line); match != nil {
+			symbols = append(symbols, SymbolInformation{
+				Name: match[1],
+				Kind: SymbolKindFunction,
+				Location: Location{
+					URI: doc.URI,
+					Range: Range{
+						Start: Position{Line: lineNum, Character: 0},
+						End:   Position{Line: lineNum, Character: encodedLen(line)},
+					},
+				},
+			})
+		}
+
+		// Find annotation definitions
+		if match := annotationSymbolRegexp.FindStringSubmatch(line); match != nil {
+			symbols = append(symbols, SymbolInformation{
+				Name: match[1],
+				Kind: SymbolKindClass,
+				Location: Location{
+					URI: doc.URI,
+					Range: Range{
+						Start: Position{Line: lineNum, Character: 0},
+						End:   Position{Line: lineNum, Character: encodedLen(line)},
+					},
+				},
+			})
+		}
+	}
+
+	// Spec groups and examples, named by their description
+	if isSpecDocument(doc) {
+		symbols = append(symbols, flattenSymbols(doc.URI, "", specSymbols(a.documentContext(doc).Tokens, lines))...)
+	}
+
+	return symbols
+}
+
+// flattenSymbols lists nested symbols depth first, each naming its parent
+// as container
+func flattenSymbols(uri, container string, nested []DocumentSymbol) []SymbolInformation {
+	var symbols []SymbolInformation
+	for _, symbol := range nested {
+		symbols = append(symbols, SymbolInformation{
+			Name:          symbol.Name,
+			Kind:          symbol.Kind,
+			Location:      Location{URI: uri, Range: symbol.Range},
+			ContainerName: container,
+		})
+		symbols = append(symbols, flattenSymbols(uri, symbol.Name, symbol.Children)...)
+	}
+	return symbols
+}
+
+// GetDocumentSymbolTree provides hierarchical document symbols, nesting
+// methods and inner types under the type that defines them
+func (a *CrystalAnalyzer) GetDocumentSymbolTree(doc *TextDocumentItem) []DocumentSymbol {
+	a.parseDocumentStructure(doc)
+	lines := strings.Split(doc.Text, "\n")
+
+	symbols := a.buildSymbolChildren("", lines)
+	for _, method := range a.documentMethods[""] {
+		symbols = append(symbols, methodSymbol(method, lines))
+	}
+	for _, constant := range a.documentConstants {
+		symbols = append(symbols, constantSymbol(constant))
+	}
+	for _, macro := range a.documentMacros {
+		symbols = append(symbols, macroSymbol(macro, lines))
+	}
+	// Spec files list their groups and examples
+	if isSpecDocument(doc) {
+		symbols = append(symbols, specSymbols(a.documentContext(doc).Tokens, lines)...)
+	}
+	sortSymbols(symbols)
+
+	return symbols
+}
+
+// buildSymbolChildren returns the symbols for the types directly nested in
+// parent ("" for the top level), each with its own children
+func (a *CrystalAnalyzer) buildSymbolChildren(parent string, lines []string) []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+
+	for qualifiedName, classInfo := range a.documentClasses {
+		if parentNamespace(qualifiedName, a.documentClasses) != parent {
+			continue
+		}
+
+		symbol := DocumentSymbol{
+			Name:   classInfo.Name,
+			Detail: classInfo.SuperClass,
+			Kind:   classInfo.SymbolKind(),
+			Range:  blockRange(classInfo.Location.Line, classInfo.EndLine, lines),
+			SelectionRange: Range{
+				Start: classInfo.Location,
+				End:   Position{Line: classInfo.Location.Line, Character: classInfo.Location.Character + encodedLen(classInfo.Name)},
+			},
+			Children: a.buildSymbolChildren(qualifiedName, lines),
+		}
+		for _, property := range classInfo.Properties {
+			symbol.Children = append(symbol.Children, propertySymbol(property))
+		}
+		for _, constant := range classInfo.Constants {
+			symbol.Children = append(symbol.Children, constantSymbol(constant))
+		}
+		for _, member := range classInfo.Members {
+			memberSymbol := constantSymbol(member)
+			memberSymbol.Kind = SymbolKindEnumMember
+			symbol.Children = append(symbol.Children, memberSymbol)
+		}
+		for _, macro := range classInfo.Macros {
+			symbol.Children = append(symbol.Children, macroSymbol(macro, lines))
+		}
+		for _, name := range sortedMethodNames(classInfo) {
+			for _, method := range classInfo.Methods[name] {
+				// Accessors are listed once, through their property
+				if method.IsProperty {
+					continue
+				}
+				symbol.Children = append(symbol.Children, methodSymbol(method, lines))
+			}
+		}
+		sortSymbols(symbol.Children)
+
+		symbols = append(symbols, symbol)
 	}
 
 	return symbols
 }
 
+// parentNamespace returns the qualified name of the closest parsed type that
+// encloses qualifiedName, or "" when it is top-level
+func parentNamespace(qualifiedName string, classes map[string]*ClassInfo) string {
+	for {
+		idx := strings.LastIndex(qualifiedName, "::")
+		if idx < 0 {
+			return ""
+		}
+		qualifiedName = qualifiedName[:idx]
+		if _, exists := classes[qualifiedName]; exists {
+			return qualifiedName
+		}
+	}
+}
+
+func methodSymbol(method *MethodInfo, lines []string) DocumentSymbol {
+	return DocumentSymbol{
+		Name:   method.Name,
+		Detail: generateMethodSignature(method),
+		Kind:   SymbolKindMethod,
+		Range:  blockRange(method.Location.Line, method.EndLine, lines),
+		SelectionRange: Range{
+			Start: method.Location,
+			End:   Position{Line: method.Location.Line, Character: method.Location.Character + encodedLen(method.Name)},
+		},
+	}
+}
+
+func macroSymbol(macro *MacroInfo, lines []string) DocumentSymbol {
+	return DocumentSymbol{
+		Name:   macro.Name,
+		Detail: generateMacroSignature(macro),
+		Kind:   SymbolKindFunction,
+		Range:  blockRange(macro.Location.Line, macro.EndLine, lines),
+		SelectionRange: Range{
+			Start: macro.Location,
+			End:   Position{Line: macro.Location.Line, Character: macro.Location.Character + encodedLen(macro.Name)},
+		},
+	}
+}
+
+func constantSymbol(constant *ConstantInfo) DocumentSymbol {
+	nameRange := Range{
+		Start: constant.Location,
+		End:   Position{Line: constant.Location.Line, Character: constant.Location.Character + encodedLen(constant.Name)},
+	}
+	return DocumentSymbol{
+		Name:           constant.Name,
+		Detail:         constant.Value,
+		Kind:           SymbolKindConstant,
+		Range:          nameRange,
+		SelectionRange: nameRange,
+	}
+}
+
+// constantDetail describes a constant by its inferred type, or by its value
+// when the type can't be inferred
+func (a *CrystalAnalyzer) constantDetail(constant *ConstantInfo, doc *TextDocumentItem) string {
+	if typeName := a.inferTypeOfExpression(constant.Value, doc, constant.Location); typeName != "" {
+		return typeName
+	}
+	return constant.Value
+}
+
+func propertySymbol(property *PropertyInfo) DocumentSymbol {
+	nameRange := Range{
+		Start: property.Location,
+		End:   Position{Line: property.Location.Line, Character: property.Location.Character + encodedLen(property.Name)},
+	}
+	return DocumentSymbol{
+		Name:           property.Name,
+		Detail:         property.Type,
+		Kind:           SymbolKindProperty,
+		Range:          nameRange,
+		SelectionRange: nameRange,
+	}
+}
+
+// blockRange spans whole lines from startLine through endLine
+func blockRange(startLine, endLine int, lines []string) Range {
+	if endLine < startLine {
+		endLine = startLine
+	}
+	endCharacter := 0
+	if endLine < len(lines) {
+		endCharacter = encodedLen(lines[endLine])
+	}
+	return Range{
+		Start: Position{Line: startLine, Character: 0},
+		End:   Position{Line: endLine, Character: endCharacter},
+	}
+}
+
+func sortSymbols(symbols []DocumentSymbol) {
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Range.Start.Line != symbols[j].Range.Start.Line {
+			return symbols[i].Range.Start.Line < symbols[j].Range.Start.Line
+		}
+		return symbols[i].Range.Start.Character < symbols[j].Range.Start.Character
+	})
+}
+
 // Helper methods
 
-func (a *CrystalAnalyzer) checkSyntaxError(line string, lineNum int) *Diagnostic {
+// checkSyntaxError reports a line whose double quotes don't pair up, not
+// counting the literalQuotes that belong to other literals on it
+func (a *CrystalAnalyzer) checkSyntaxError(line string, lineNum int, literalQuotes int) *Diagnostic {
 	// Simple syntax checks
 	trimmed := strings.TrimSpace(line)
 
 	// Check for mismatched quotes
-	if strings.Count(trimmed, `"`)%2 != 0 && !strings.Contains(trimmed, `\"`) {
+	if (strings.Count(trimmed, `"`)-literalQuotes)%2 != 0 && !strings.Contains(trimmed, `\"`) {
 		return &Diagnostic{
 			Range: Range{
 				Start: Position{Line: lineNum, Character: 0},
-				End:   Position{Line: lineNum, Character: len(line)},
+				End:   Position{Line: lineNum, Character: encodedLen(line)},
 			},
 			Severity: DiagnosticSeverityError,
 			Message:  "Mismatched quotes",
@@ -401,6 +1316,23 @@ func (a *CrystalAnalyzer) checkSyntaxError(line string, lineNum int) *Diagnostic
 	return nil
 }
 
+// quotesInLiterals counts, per line, the double quotes inside literals that
+// aren't delimited by them: heredocs, percent literals and regexes
+func quotesInLiterals(tokens []Token) map[int]int {
+	counts := make(map[int]int)
+	for _, token := range tokens {
+		switch {
+		case token.Type == TokenRegex:
+		case token.Type != TokenString, strings.HasPrefix(token.Value, `"`):
+			continue
+		}
+		for i, part := range strings.Split(token.Value, "\n") {
+			counts[token.Position.Line+i] += strings.Count(part, `"`)
+		}
+	}
+	return counts
+}
+
 func (a *CrystalAnalyzer) checkUndefinedVariable(line string, lineNum int) *Diagnostic {
 	// This is a very basic check - in practice you'd need proper scope analysis
 	return nil
@@ -416,88 +1348,347 @@ func (a *CrystalAnalyzer) analyzeTokens(tokens []Token, uri string) []Diagnostic
 	return diagnostics
 }
 
-func (a *CrystalAnalyzer) getMethodCompletions(prefix string, doc *TextDocumentItem) []CompletionItem {
+func (a *CrystalAnalyzer) getMethodCompletions(prefix string, doc *TextDocumentItem, pos Position) []CompletionItem {
 	var items []CompletionItem
 
-	// Extract the variable name before the dot
-	parts := strings.Split(prefix, ".")
-	if len(parts) < 2 {
+	// Extract the receiver expression before the dot
+	dot := strings.LastIndex(prefix, ".")
+	if dot < 0 {
+		return items
+	}
+	receiver := extractReceiver(prefix[:dot])
+	if receiver == "" {
 		return items
 	}
 
-	// Get the variable name (last part before the dot)
-	varName := strings.TrimSpace(parts[len(parts)-2])
+	// Methods called on self see everything the enclosing class defines
+	if receiver == "self" {
+		if classInfo := a.findEnclosingClass(pos.Line); classInfo != nil {
+			return a.getMethodsForType(classInfo.QualifiedName, true, false)
+		}
+	}
 
-	// Try to determine the type by looking for variable assignments
-	lines := strings.Split(doc.Text, "\n")
-	for _, line := range lines {
-		// Look for patterns like: varName = ClassName.new
-		if match := regexp.MustCompile(varName + `\s*=\s*(\w+)\.new`).FindStringSubmatch(line); match != nil {
-			className := match[1]
-
-			// Check if we have this class in our document
-			if classInfo, exists := a.documentClasses[className]; exists {
-				for _, method := range classInfo.Methods {
-					items = append(items, CompletionItem{
-						Label:  method,
-						Kind:   CompletionItemKindMethod,
-						Detail: fmt.Sprintf("Method of %s", className),
-					})
-				}
-				return items
-			}
+	// Calls on a type name reach its class methods
+	if typeNameRegexp.MatchString(receiver) {
+		if classInfo := a.findClass(receiver); classInfo != nil {
+			return a.getMethodsForType(classInfo.QualifiedName, false, true)
 		}
 	}
 
+	typeName := a.inferTypeOfExpression(receiver, doc, pos)
+
+	// `String?` and `Int32 | String` offer what every member responds to
+	if members, nilable := unionMembers(typeName); len(members) > 1 || nilable {
+		return a.unionMethodCompletions(members, nilable)
+	}
+
+	// Check if we have this class in our document
+	if classInfo := a.findClass(typeName); classInfo != nil {
+		return a.getMethodsForType(classInfo.QualifiedName, false, false)
+	}
+
+	// Standard library methods come from the builtin tables
+	if builtinItems := getBuiltInMethodsForType(typeName); builtinItems != nil {
+		return builtinItems
+	}
+
 	// Fallback to standard library methods for common patterns
-	if methods, exists := a.stdlibMethods["String"]; exists {
-		for _, method := range methods {
-			items = append(items, CompletionItem{
-				Label: method,
-				Kind:  CompletionItemKindMethod,
-			})
+	items = append(items, getBuiltInMethodsForType("String")...)
+
+	return items
+}
+
+// nilableMethods are offered on nilable receivers on top of the methods
+// their other members share
+var nilableMethods = []BuiltinMethod{
+	{"nil?", "nil? : Bool", "Returns true if this object is nil."},
+	{"not_nil!", "not_nil! : self", "Returns self, raising NilAssertionError if it is nil."},
+}
+
+// unionMembers splits a union type such as `Int32 | String` or `String?`
+// into its members other than Nil, and reports whether Nil is one of them
+func unionMembers(typeName string) ([]string, bool) {
+	var members []string
+	nilable := false
+	for _, member := range splitTopLevel(typeName, '|') {
+		member = strings.TrimSpace(member)
+		if strings.HasSuffix(member, "?") {
+			member, nilable = strings.TrimSuffix(member, "?"), true
+		}
+		switch member {
+		case "":
+		case "Nil":
+			nilable = true
+		default:
+			members = append(members, member)
+		}
+	}
+	return members, nilable
+}
+
+// unionMethodCompletions returns the methods every member of a union has.
+// When a member's methods aren't known only the methods of every object are
+// offered. Nilable unions add nil? and not_nil!.
+func (a *CrystalAnalyzer) unionMethodCompletions(members []string, nilable bool) []CompletionItem {
+	var items []CompletionItem
+	for i, member := range members {
+		var memberItems []CompletionItem
+		if classInfo := a.findClass(member); classInfo != nil {
+			memberItems = a.getMethodsForType(classInfo.QualifiedName, false, false)
+		} else {
+			memberItems = getBuiltInMethodsForType(member)
+		}
+		if memberItems == nil {
+			items = getBuiltInObjectMethods()
+			break
+		}
+
+		if i == 0 {
+			items = memberItems
+			continue
+		}
+		shared := make(map[string]bool)
+		for _, item := range memberItems {
+			shared[item.Label] = true
 		}
+		var common []CompletionItem
+		for _, item := range items {
+			if shared[item.Label] {
+				common = append(common, item)
+			}
+		}
+		items = common
+	}
+	if len(members) == 0 {
+		items = getBuiltInObjectMethods()
+	}
+	if nilable {
+		items = append(items, builtinCompletionItems(nilableMethods)...)
+	}
+
+	// Members sharing a method, or a table repeating an object method,
+	// would list it twice
+	seen := make(map[string]bool)
+	unique := make([]CompletionItem, 0, len(items))
+	for _, item := range items {
+		if !seen[item.Label] {
+			seen[item.Label] = true
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
+
+// classCompletionItem builds the completion item for a type
+func classCompletionItem(classInfo *ClassInfo, detail string) CompletionItem {
+	item := CompletionItem{
+		Label:  classInfo.Name,
+		Kind:   CompletionItemKindClass,
+		Detail: detail,
+	}
+	switch {
+	case classInfo.IsStruct:
+		item.Kind = CompletionItemKindStruct
+	case classInfo.IsModule:
+		item.Kind = CompletionItemKindModule
+	case classInfo.IsEnum:
+		item.Kind = CompletionItemKindEnum
+	}
+	if classInfo.QualifiedName != classInfo.Name {
+		item.Detail += " " + classInfo.QualifiedName
+	}
+	return item
+}
+
+// getMethodsForType returns completion items for the methods of a local type.
+// Private and protected methods are only included when includePrivate is set,
+// i.e. when the receiver is self inside the class. classLevel selects class
+// methods (receiver is the type itself) instead of instance methods.
+func (a *CrystalAnalyzer) getMethodsForType(typeName string, includePrivate, classLevel bool) []CompletionItem {
+	var items []CompletionItem
+
+	classInfo := a.findClass(a.resolveAlias(typeName))
+	if classInfo == nil {
+		return items
+	}
+
+	resolved := a.resolveMethods(classInfo)
+	names := make([]string, 0, len(resolved))
+	for name := range resolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Overloads share one item listing every signature
+	for _, name := range names {
+		owner := resolved[name].Owner
+		var signatures []string
+		documentation := ""
+		for _, method := range resolved[name].Overloads {
+			if method.Visibility != "public" && !includePrivate {
+				continue
+			}
+			// Private methods of ancestors aren't offered on subclasses
+			if method.Visibility == "private" && owner != classInfo {
+				continue
+			}
+			if method.IsClassMethod != classLevel {
+				continue
+			}
+
+			signatures = append(signatures, generateMethodSignature(method))
+			if documentation != "" {
+				continue
+			}
+			documentation = fmt.Sprintf("Method of %s", owner.QualifiedName)
+			if method.Visibility != "public" {
+				documentation = fmt.Sprintf("%s method of %s", method.Visibility, owner.QualifiedName)
+			}
+			if method.Documentation != "" {
+				documentation = method.Documentation
+			}
+		}
+		if len(signatures) == 0 {
+			continue
+		}
+
+		items = append(items, CompletionItem{
+			Label:         name,
+			Kind:          CompletionItemKindMethod,
+			Detail:        strings.Join(signatures, "\n"),
+			Documentation: documentation,
+		})
+	}
+
+	// Instances also respond to the methods every object has
+	if !classLevel {
+		items = append(items, getBuiltInObjectMethods()...)
 	}
 
 	return items
 }
 
-func (a *CrystalAnalyzer) findMethodCall(text string) string {
-	// Look for method calls like "method_name("
-	re := regexp.MustCompile(`(\w+)\s*\($`)
-	matches := re.FindStringSubmatch(text)
-	if len(matches) > 1 {
-		return matches[1]
+// findMethodCall finds the method whose argument list is open at the end of
+// text and returns its name and the index of the argument being typed
+func (a *CrystalAnalyzer) findMethodCall(text string) (string, int) {
+	depth := 0
+	activeParameter := 0
+
+	for i := len(text) - 1; i >= 0; i-- {
+		switch text[i] {
+		case ')', ']', '}':
+			depth++
+		case '[', '{':
+			depth--
+		case ',':
+			if depth == 0 {
+				activeParameter++
+			}
+		case '(':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			// Look for method calls like "method_name("
+			if matches := methodCallRegexp.FindStringSubmatch(text[:i]); matches != nil {
+				return matches[1], activeParameter
+			}
+			return "", 0
+		}
+	}
+
+	return "", 0
+}
+
+// sortedAliasNames returns the unqualified alias names in order
+func sortedAliasNames(aliases map[string]string) []string {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		if !strings.Contains(name, "::") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedMethodNames(classInfo *ClassInfo) []string {
+	names := make([]string, 0, len(classInfo.Methods))
+	for name := range classInfo.Methods {
+		names = append(names, name)
 	}
-	return ""
+	sort.Strings(names)
+	return names
 }
 
-func getLastWord(text string) string {
-	words := strings.Fields(text)
-	if len(words) == 0 {
+// isInstanceVariableAt reports whether the identifier around byte offset
+// char is an instance variable (`@name`) rather than a class variable
+func isInstanceVariableAt(line string, char int) bool {
+	if char > len(line) {
+		char = len(line)
+	}
+
+	start := char
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:start])
+		if !isWordChar(r) {
+			break
+		}
+		start -= size
+	}
+	return start > 0 && line[start-1] == '@' && (start < 2 || line[start-2] != '@')
+}
+
+// wordQualifier returns the namespace written before the identifier around
+// byte offset char, e.g. `Config` for `Config::MAX_SIZE`, or "" when the
+// identifier isn't qualified
+func wordQualifier(line string, char int) string {
+	if char > len(line) {
+		char = len(line)
+	}
+
+	start := char
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:start])
+		if !isWordChar(r) {
+			break
+		}
+		start -= size
+	}
+
+	if !strings.HasSuffix(line[:start], "::") {
 		return ""
 	}
-	return words[len(words)-1]
+	return extractReceiver(line[:start-2])
 }
 
+// getWordAtPosition returns the identifier around byte offset char
 func getWordAtPosition(line string, char int) string {
 	if len(line) == 0 || char < 0 {
 		return ""
 	}
 
-	if char >= len(line) {
-		char = len(line) - 1
+	if char > len(line) {
+		char = len(line)
 	}
 
 	// Find word boundaries
 	start := char
-	for start > 0 && isWordChar(rune(line[start-1])) {
-		start--
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:start])
+		if !isWordChar(r) {
+			break
+		}
+		start -= size
 	}
 
 	end := char
-	for end < len(line) && isWordChar(rune(line[end])) {
-		end++
+	for end < len(line) {
+		r, size := utf8.DecodeRuneInString(line[end:])
+		if !isWordChar(r) {
+			break
+		}
+		end += size
 	}
 
 	if start >= end {
@@ -508,5 +1699,5 @@ func getWordAtPosition(line string, char int) string {
 }
 
 func isWordChar(r rune) bool {
-	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '?' || r == '!'
+	return isIdentifierChar(r) || r == '?' || r == '!'
 }
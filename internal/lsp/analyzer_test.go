@@ -1,6 +1,9 @@
 package lsp
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -117,6 +120,12 @@ func TestGetWordAtPosition(t *testing.T) {
 		{"hello world", 7, "world"},
 		{"foo.bar", 5, "bar"},
 		{"", 0, ""},
+		// A cursor just past the last character still finds the word
+		{"hello world", 11, "world"},
+		{"x = value?", 10, "value?"},
+		{"foo ", 4, ""},
+		{"foo", 9, "foo"},
+		{"", 3, ""},
 	}
 
 	for _, test := range tests {
@@ -143,3 +152,3433 @@ func TestSplitLines(t *testing.T) {
 		}
 	}
 }
+
+func TestCrystalAnalyzer_ParseStruct(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `struct Point < Base
+  def x
+  end
+end`,
+	}
+
+	symbols := analyzer.GetDocumentSymbols(doc)
+
+	found := false
+	for _, symbol := range symbols {
+		if symbol.Name == "Point" && symbol.Kind == SymbolKindStruct {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Expected to find Point struct symbol")
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	point, exists := analyzer.documentClasses["Point"]
+	if !exists {
+		t.Fatal("Expected Point to be parsed")
+	}
+	if !point.IsStruct {
+		t.Error("Expected Point to be marked as a struct")
+	}
+	if point.SuperClass != "Base" {
+		t.Errorf("Expected superclass 'Base', got %q", point.SuperClass)
+	}
+	if _, exists := point.Methods["x"]; !exists || len(point.Methods) != 1 {
+		t.Errorf("Expected method 'x', got %v", point.Methods)
+	}
+}
+
+func TestCrystalAnalyzer_NestedDefinitions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `module Outer
+  class Middle
+    class Inner
+      def deep
+        if ready?
+          go
+        end
+      end
+    end
+
+    def mid
+      return 1 if done?
+    end
+  end
+
+  def outer_method
+  end
+end`,
+	}
+
+	analyzer.parseDocumentStructure(doc)
+
+	tests := []struct {
+		qualifiedName string
+		method        string
+	}{
+		{"Outer", "outer_method"},
+		{"Outer::Middle", "mid"},
+		{"Outer::Middle::Inner", "deep"},
+	}
+
+	for _, test := range tests {
+		classInfo, exists := analyzer.documentClasses[test.qualifiedName]
+		if !exists {
+			t.Errorf("Expected %s to be parsed", test.qualifiedName)
+			continue
+		}
+		if _, exists := classInfo.Methods[test.method]; !exists || len(classInfo.Methods) != 1 {
+			t.Errorf("Expected %s to have only method %q, got %v", test.qualifiedName, test.method, classInfo.Methods)
+		}
+	}
+
+	if classInfo := analyzer.findClass("Inner"); classInfo == nil || classInfo.QualifiedName != "Outer::Middle::Inner" {
+		t.Error("Expected findClass to resolve Inner by its simple name")
+	}
+
+	locations := analyzer.GetDefinition(doc, Position{Line: 2, Character: 12})
+	if len(locations) != 1 || locations[0].Range.Start.Line != 2 {
+		t.Errorf("Expected definition of Inner on line 2, got %v", locations)
+	}
+}
+
+func TestCrystalAnalyzer_InstanceVariableDefinition(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Person
+  property name : String
+
+  def initialize(@name, @age : Int32)
+    @nickname = @name
+  end
+
+  def greet
+    "Hi #{@name}, #{@nickname}" + @age.to_s
+  end
+end
+
+class Robot
+  property name : String = "R2"
+
+  def initialize
+    @@count = 1
+  end
+end
+`,
+	}
+
+	tests := []struct {
+		name     string
+		pos      Position
+		expected Range
+	}{
+		{
+			name:     "property wins over the parameter",
+			pos:      Position{Line: 8, Character: 12},
+			expected: Range{Start: Position{Line: 1, Character: 11}, End: Position{Line: 1, Character: 15}},
+		},
+		{
+			name:     "first assignment",
+			pos:      Position{Line: 8, Character: 23},
+			expected: Range{Start: Position{Line: 4, Character: 5}, End: Position{Line: 4, Character: 13}},
+		},
+		{
+			name:     "parameter assignment",
+			pos:      Position{Line: 8, Character: 36},
+			expected: Range{Start: Position{Line: 3, Character: 25}, End: Position{Line: 3, Character: 28}},
+		},
+		{
+			name:     "assignment target",
+			pos:      Position{Line: 4, Character: 6},
+			expected: Range{Start: Position{Line: 4, Character: 5}, End: Position{Line: 4, Character: 13}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locations := analyzer.GetDefinition(doc, tt.pos)
+			if len(locations) != 1 || locations[0].Range != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, locations)
+			}
+		})
+	}
+
+	// Class variables aren't instance variables
+	if locations := analyzer.GetDefinition(doc, Position{Line: 17, Character: 7}); len(locations) != 0 {
+		t.Errorf("Expected no definition for a class variable, got %+v", locations)
+	}
+}
+
+func TestCrystalAnalyzer_MethodVisibility(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Account
+  def balance
+    self.
+  end
+
+  private def audit
+  end
+
+  protected
+  def compare
+  end
+end
+
+account = Account.new
+account.`,
+	}
+
+	labels := func(items []CompletionItem) map[string]bool {
+		result := make(map[string]bool)
+		for _, item := range items {
+			result[item.Label] = true
+		}
+		return result
+	}
+
+	outside := labels(analyzer.GetCompletions(doc, Position{Line: 14, Character: 8}).Items)
+	if !outside["balance"] {
+		t.Error("Expected public method 'balance' in completions")
+	}
+	if outside["audit"] || outside["compare"] {
+		t.Errorf("Expected non-public methods to be hidden outside the class, got %v", outside)
+	}
+
+	inside := labels(analyzer.GetCompletions(doc, Position{Line: 2, Character: 9}).Items)
+	if !inside["audit"] || !inside["compare"] {
+		t.Errorf("Expected self completions to include non-public methods, got %v", inside)
+	}
+
+	hover := analyzer.GetHover(doc, Position{Line: 5, Character: 15})
+	if hover == nil || !strings.Contains(hover.Contents[0], "private") {
+		t.Errorf("Expected hover to show private visibility, got %v", hover)
+	}
+}
+
+func TestParseParameters(t *testing.T) {
+	params := parseParameters(`to target : Int32, *args : String, **opts, &block : Int32 -> Nil, scale = 1.0`)
+
+	if len(params) != 5 {
+		t.Fatalf("Expected 5 parameters, got %d", len(params))
+	}
+
+	tests := []struct {
+		param    ParameterInfo
+		expected string
+	}{
+		{params[0], "to target : Int32"},
+		{params[1], "*args : String"},
+		{params[2], "**opts"},
+		{params[3], "&block : Int32 -> Nil"},
+		{params[4], "scale = 1.0"},
+	}
+
+	for _, test := range tests {
+		if result := formatParameter(test.param); result != test.expected {
+			t.Errorf("formatParameter() = %q, expected %q", result, test.expected)
+		}
+	}
+
+	if params[0].ExternalName != "to" || params[0].Name != "target" {
+		t.Errorf("Expected external name 'to' and name 'target', got %q and %q", params[0].ExternalName, params[0].Name)
+	}
+	if !params[1].IsSplat || !params[2].IsDoubleSplat || !params[3].IsBlock {
+		t.Error("Expected splat, double-splat and block flags to be set")
+	}
+	if params[1].Name != "args" || params[2].Name != "opts" || params[3].Name != "block" {
+		t.Error("Expected prefixes to be stripped from parameter names")
+	}
+}
+
+func TestCrystalAnalyzer_GetSignatureHelp(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `def move(to target : Int32, *rest)
+end
+
+move(1, `,
+	}
+
+	help := analyzer.GetSignatureHelp(doc, Position{Line: 3, Character: 8})
+	if help == nil || len(help.Signatures) != 1 {
+		t.Fatal("Expected signature help for 'move'")
+	}
+	if help.Signatures[0].Label != "move(to target : Int32, *rest)" {
+		t.Errorf("Unexpected signature label %q", help.Signatures[0].Label)
+	}
+	if help.ActiveParameter != 1 {
+		t.Errorf("Expected active parameter 1, got %d", help.ActiveParameter)
+	}
+}
+
+func TestCrystalAnalyzer_ReturnTypes(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Store
+  def numbers : Array(Int32)
+  end
+
+  def counts(key : String) : Hash(String, Int32)
+  end
+
+  def label : String?
+  end
+end
+
+store = Store.new
+list = store.numbers
+list.`,
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	store := analyzer.findClass("Store")
+	if store == nil {
+		t.Fatal("Expected Store to be parsed")
+	}
+
+	tests := []struct {
+		method   string
+		expected string
+	}{
+		{"numbers", "Array(Int32)"},
+		{"counts", "Hash(String, Int32)"},
+		{"label", "String?"},
+	}
+
+	for _, test := range tests {
+		overloads, exists := store.Methods[test.method]
+		if !exists {
+			t.Errorf("Expected method %s to be parsed", test.method)
+			continue
+		}
+		if method := overloads[0]; method.ReturnType != test.expected {
+			t.Errorf("Return type of %s = %q, expected %q", test.method, method.ReturnType, test.expected)
+		}
+	}
+
+	completions := analyzer.GetCompletions(doc, Position{Line: 13, Character: 5})
+	found := false
+	for _, item := range completions.Items {
+		if item.Label == "push" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Expected Array methods for a variable assigned from an Array(Int32) method")
+	}
+}
+
+func TestCrystalAnalyzer_MultiLineSignature(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Mailer
+  def deliver(
+    to : String,
+    subject : String,
+    body : String = "",
+  ) : Bool
+  end
+end`,
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	mailer := analyzer.findClass("Mailer")
+	if mailer == nil {
+		t.Fatal("Expected Mailer to be parsed")
+	}
+
+	overloads, exists := mailer.Methods["deliver"]
+	if !exists {
+		t.Fatal("Expected method deliver to be parsed")
+	}
+	method := overloads[0]
+
+	expected := `deliver(to : String, subject : String, body : String = "") : Bool`
+	if signature := generateMethodSignature(method); signature != expected {
+		t.Errorf("Signature = %q, expected %q", signature, expected)
+	}
+}
+
+func TestCrystalAnalyzer_MethodOverloads(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Logger
+  def log(message : String)
+  end
+
+  def log(level : Symbol, message : String)
+  end
+end
+
+logger = Logger.new
+logger.log(:info, `,
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	if overloads := analyzer.findClass("Logger").Methods["log"]; len(overloads) != 2 {
+		t.Fatalf("Expected 2 overloads of log, got %d", len(overloads))
+	}
+
+	var logItems []CompletionItem
+	for _, item := range analyzer.GetCompletions(doc, Position{Line: 9, Character: 7}).Items {
+		if item.Label == "log" {
+			logItems = append(logItems, item)
+		}
+	}
+	if len(logItems) != 1 {
+		t.Fatalf("Expected overloads to share one completion item, got %d", len(logItems))
+	}
+	if !strings.Contains(logItems[0].Detail, "log(message : String)") || !strings.Contains(logItems[0].Detail, "log(level : Symbol, message : String)") {
+		t.Errorf("Expected every overload signature in the detail, got %q", logItems[0].Detail)
+	}
+
+	help := analyzer.GetSignatureHelp(doc, Position{Line: 9, Character: 18})
+	if help == nil || len(help.Signatures) != 2 {
+		t.Fatal("Expected signature help with both overloads")
+	}
+	if help.ActiveSignature != 1 {
+		t.Errorf("Expected the two-argument overload to be active, got %d", help.ActiveSignature)
+	}
+}
+
+func TestCrystalAnalyzer_DocComments(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `# A shopping cart.
+class Cart
+  # Adds an item to the cart.
+  #
+  # Returns the new item count.
+  def add(item : String) : Int32
+  end
+
+  # Detached comment
+
+  def clear
+  end
+end`,
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	cart := analyzer.findClass("Cart")
+	if cart == nil {
+		t.Fatal("Expected Cart to be parsed")
+	}
+
+	if cart.Documentation != "A shopping cart." {
+		t.Errorf("Unexpected class documentation %q", cart.Documentation)
+	}
+
+	expected := "Adds an item to the cart.\n\nReturns the new item count."
+	if documentation := cart.Methods["add"][0].Documentation; documentation != expected {
+		t.Errorf("Method documentation = %q, expected %q", documentation, expected)
+	}
+
+	if documentation := cart.Methods["clear"][0].Documentation; documentation != "" {
+		t.Errorf("Expected comment separated by a blank line to be ignored, got %q", documentation)
+	}
+
+	hover := analyzer.GetHover(doc, Position{Line: 5, Character: 7})
+	if hover == nil || !strings.Contains(hover.Contents[0], "Adds an item to the cart.") {
+		t.Errorf("Expected hover to include the doc comment, got %v", hover)
+	}
+
+	// Top-level methods carry their doc comment into completions
+	script := &TextDocumentItem{
+		URI:  "script.cr",
+		Text: "# Greets someone.\ndef greet(name)\nend\n\ndef wave\nend\n\n",
+	}
+	documentation := make(map[string]string)
+	for _, item := range analyzer.GetCompletions(script, Position{Line: 7, Character: 0}).Items {
+		documentation[item.Label] = item.Documentation
+	}
+	if documentation["greet"] != "Greets someone." || documentation["wave"] != "Top-level method" {
+		t.Errorf("Unexpected top-level method documentation %q and %q", documentation["greet"], documentation["wave"])
+	}
+
+	// and into signature help
+	script.Text += "greet("
+	help := analyzer.GetSignatureHelp(script, Position{Line: 7, Character: 6})
+	if help == nil || len(help.Signatures) != 1 || help.Signatures[0].Documentation != "Greets someone." {
+		t.Errorf("Expected the doc comment in signature help, got %+v", help)
+	}
+}
+
+func TestCrystalAnalyzer_GetDocumentSymbolTree(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `module Shop
+  class Cart
+    def add(item)
+    end
+
+    def total
+    end
+  end
+end
+
+def main
+end`,
+	}
+
+	symbols := analyzer.GetDocumentSymbolTree(doc)
+	if len(symbols) != 2 {
+		t.Fatalf("Expected 2 top-level symbols, got %d", len(symbols))
+	}
+
+	shop := symbols[0]
+	if shop.Name != "Shop" || shop.Kind != SymbolKindModule {
+		t.Errorf("Expected Shop module first, got %s (%d)", shop.Name, shop.Kind)
+	}
+	if shop.Range.End.Line != 8 {
+		t.Errorf("Expected Shop to end on line 8, got %d", shop.Range.End.Line)
+	}
+	if len(shop.Children) != 1 || shop.Children[0].Name != "Cart" {
+		t.Fatalf("Expected Cart nested under Shop, got %v", shop.Children)
+	}
+
+	cart := shop.Children[0]
+	if len(cart.Children) != 2 || cart.Children[0].Name != "add" || cart.Children[1].Name != "total" {
+		t.Errorf("Expected add and total nested under Cart, got %v", cart.Children)
+	}
+	if cart.Children[0].SelectionRange.Start.Line != 2 {
+		t.Errorf("Expected add's selection range on line 2, got %d", cart.Children[0].SelectionRange.Start.Line)
+	}
+
+	if symbols[1].Name != "main" || symbols[1].Kind != SymbolKindMethod {
+		t.Errorf("Expected top-level method main, got %s", symbols[1].Name)
+	}
+}
+
+func TestCrystalAnalyzer_PropertySymbols(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Person
+  property name : String
+  property age : Int32 = 0
+
+  def greet
+  end
+end`,
+	}
+
+	symbols := analyzer.GetDocumentSymbolTree(doc)
+	if len(symbols) != 1 {
+		t.Fatalf("Expected 1 top-level symbol, got %d", len(symbols))
+	}
+
+	children := symbols[0].Children
+	if len(children) != 3 {
+		t.Fatalf("Expected name, age and greet as children, got %v", children)
+	}
+
+	expected := []struct {
+		name   string
+		kind   int
+		detail string
+	}{
+		{"name", SymbolKindProperty, "String"},
+		{"age", SymbolKindProperty, "Int32"},
+		{"greet", SymbolKindMethod, "greet"},
+	}
+	for i, want := range expected {
+		if children[i].Name != want.name || children[i].Kind != want.kind || children[i].Detail != want.detail {
+			t.Errorf("Child %d = %s (%d, %q), expected %s (%d, %q)", i, children[i].Name, children[i].Kind, children[i].Detail, want.name, want.kind, want.detail)
+		}
+	}
+	if children[0].SelectionRange.Start.Character != 11 {
+		t.Errorf("Expected property location at its name, got character %d", children[0].SelectionRange.Start.Character)
+	}
+
+	flat := analyzer.GetDocumentSymbols(doc)
+	properties := 0
+	for _, symbol := range flat {
+		if symbol.Kind == SymbolKindProperty {
+			properties++
+		}
+	}
+	if properties != 2 {
+		t.Errorf("Expected 2 property symbols in the flat list, got %d", properties)
+	}
+}
+
+func TestCrystalAnalyzer_PropertyMacros(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Config
+  getter name, port : Int32 = 80
+  setter secret : String
+  getter? verbose : Bool
+  class_property instances : Int32
+end
+
+config = Config.new
+config.`,
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	config := analyzer.findClass("Config")
+	if config == nil {
+		t.Fatal("Expected Config to be parsed")
+	}
+
+	port, exists := config.Properties["port"]
+	if !exists {
+		t.Fatal("Expected port to be parsed from a comma-separated getter")
+	}
+	if !port.IsReadOnly || port.HasSetter || port.Type != "Int32" || port.DefaultValue != "80" {
+		t.Errorf("Unexpected port property %+v", port)
+	}
+	if port.Location.Character != 15 {
+		t.Errorf("Expected port location at character 15, got %d", port.Location.Character)
+	}
+	if secret := config.Properties["secret"]; secret == nil || secret.HasGetter || !secret.HasSetter {
+		t.Errorf("Expected secret to be write-only, got %+v", secret)
+	}
+	if instances := config.Properties["instances"]; instances == nil || !instances.IsClassLevel {
+		t.Errorf("Expected instances to be class-level, got %+v", instances)
+	}
+
+	labels := make(map[string]bool)
+	for _, item := range analyzer.GetCompletions(doc, Position{Line: 8, Character: 7}).Items {
+		labels[item.Label] = true
+	}
+	for _, expected := range []string{"name", "port", "secret=", "verbose?"} {
+		if !labels[expected] {
+			t.Errorf("Expected accessor %q in completions", expected)
+		}
+	}
+	for _, unexpected := range []string{"name=", "port=", "secret", "instances"} {
+		if labels[unexpected] {
+			t.Errorf("Did not expect accessor %q in completions", unexpected)
+		}
+	}
+}
+
+func TestGetBuiltInMethodsForType(t *testing.T) {
+	tests := []struct {
+		typeName string
+		method   string
+	}{
+		{"Int32", "times"},
+		{"Int64", "abs"},
+		{"Float64", "round"},
+		{"Bool", "to_s"},
+		{"Symbol", "to_s"},
+		{"Range", "includes?"},
+		{"Char", "ord"},
+		{"Set(String)", "add"},
+		{"Array(Int32)", "push"},
+	}
+
+	for _, test := range tests {
+		items := getBuiltInMethodsForType(test.typeName)
+		found := false
+		for _, item := range items {
+			if item.Label == test.method {
+				found = item.Detail != "" && item.Documentation != ""
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Expected %s to offer %q with a signature and doc", test.typeName, test.method)
+		}
+	}
+
+	if items := getBuiltInMethodsForType("Unknown"); items != nil {
+		t.Errorf("Expected no methods for an unknown type, got %d", len(items))
+	}
+
+	// Signatures name the element types of generic instances
+	signatures := []struct {
+		typeName, method, detail string
+	}{
+		{"Array(Int32)", "first", "first : Int32"},
+		{"Array(String)", "map", "map(&block : String -> U) : Array(U)"},
+		{"Hash(String, Int32)", "each", "each(&block : String, Int32 -> _) : Nil"},
+		{"Range(Int32, Int32)", "each", "each(&block : Int32 -> _) : Nil"},
+		{"Array", "first", "first : T"},
+	}
+	for _, tt := range signatures {
+		for _, item := range getBuiltInMethodsForType(tt.typeName) {
+			if item.Label == tt.method && item.Detail != tt.detail {
+				t.Errorf("Expected %s#%s to read %q, got %q", tt.typeName, tt.method, tt.detail, item.Detail)
+			}
+		}
+	}
+}
+
+func TestCrystalAnalyzer_InheritedMethods(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Animal
+  def speak
+  end
+
+  def name
+  end
+
+  private def secret
+  end
+end
+
+class Dog < Animal
+  def speak
+  end
+
+  def fetch
+  end
+end
+
+dog = Dog.new
+dog.`,
+	}
+
+	counts := make(map[string]int)
+	details := make(map[string]string)
+	for _, item := range analyzer.GetCompletions(doc, Position{Line: 20, Character: 4}).Items {
+		counts[item.Label]++
+		details[item.Label] = item.Documentation
+	}
+
+	for _, expected := range []string{"speak", "name", "fetch"} {
+		if counts[expected] != 1 {
+			t.Errorf("Expected %q exactly once in completions, got %d", expected, counts[expected])
+		}
+	}
+	if details["speak"] != "Method of Dog" {
+		t.Errorf("Expected the overriding speak from Dog, got %q", details["speak"])
+	}
+	if details["name"] != "Method of Animal" {
+		t.Errorf("Expected inherited name from Animal, got %q", details["name"])
+	}
+	if counts["secret"] != 0 {
+		t.Error("Did not expect the ancestor's private method in completions")
+	}
+}
+
+func TestCrystalAnalyzer_InheritanceCycle(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "class A < B\nend\n\nclass B < A\nend",
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	if chain := analyzer.ancestors(analyzer.findClass("A")); len(chain) != 1 {
+		t.Errorf("Expected the ancestor walk to stop at the cycle, got %d ancestors", len(chain))
+	}
+}
+
+func TestCrystalAnalyzer_NoDuplicateCompletions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: `greeting = "hello"` + "\ngreeting.",
+	}
+
+	seen := make(map[string]bool)
+	for _, item := range analyzer.GetCompletions(doc, Position{Line: 1, Character: 9}).Items {
+		if seen[item.Label] {
+			t.Errorf("Duplicate completion item %q", item.Label)
+		}
+		seen[item.Label] = true
+	}
+
+	if !seen["to_s"] || !seen["size"] {
+		t.Error("Expected String methods in completions")
+	}
+}
+
+func TestCrystalAnalyzer_CompletionContext(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	text := `class User
+  def name : String
+    "bob"
+  end
+end
+
+user = User.new
+# user.
+message = "user.na"
+greeting = "Hello #{user.`
+
+	doc := &TextDocumentItem{URI: "test.cr", Text: text}
+
+	tests := []struct {
+		name     string
+		pos      Position
+		expected bool
+	}{
+		{"inside comment", Position{Line: 7, Character: 7}, false},
+		{"inside string", Position{Line: 8, Character: 17}, false},
+		{"inside interpolation", Position{Line: 9, Character: 25}, true},
+		{"after dot", Position{Line: 6, Character: 11}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := analyzer.GetCompletions(doc, tt.pos).Items
+			if tt.expected && len(items) == 0 {
+				t.Errorf("Expected completions at %v", tt.pos)
+			}
+			if !tt.expected && len(items) != 0 {
+				t.Errorf("Expected no completions at %v, got %d", tt.pos, len(items))
+			}
+		})
+	}
+
+	items := analyzer.GetCompletions(doc, Position{Line: 9, Character: 25}).Items
+	found := false
+	for _, item := range items {
+		if item.Label == "name" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected User#name inside string interpolation")
+	}
+}
+
+func TestCrystalAnalyzer_SnippetCompletions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "de\nvalue.",
+	}
+
+	hasSnippet := func(items []CompletionItem) bool {
+		for _, item := range items {
+			if item.Kind == CompletionItemKindSnippet {
+				return true
+			}
+		}
+		return false
+	}
+
+	if hasSnippet(analyzer.GetCompletions(doc, Position{Line: 0, Character: 2}).Items) {
+		t.Error("Expected no snippets without client snippet support")
+	}
+
+	analyzer.SetSnippetSupport(true)
+
+	var def *CompletionItem
+	items := analyzer.GetCompletions(doc, Position{Line: 0, Character: 2}).Items
+	for i := range items {
+		if items[i].Kind == CompletionItemKindSnippet && items[i].Label == "def" {
+			def = &items[i]
+		}
+	}
+	if def == nil {
+		t.Fatal("Expected a def snippet")
+	}
+	if def.InsertTextFormat != InsertTextFormatSnippet || def.InsertText != "def ${1:name}\n  $0\nend" {
+		t.Errorf("Unexpected def snippet: %+v", *def)
+	}
+
+	if hasSnippet(analyzer.GetCompletions(doc, Position{Line: 1, Character: 6}).Items) {
+		t.Error("Expected no snippets after a dot")
+	}
+}
+
+func TestCrystalAnalyzer_StructureBalance(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "modifier if",
+			text:     "def check(done)\n  return 1 if done\n  puts \"x\" unless done\n  2\nend",
+			expected: nil,
+		},
+		{
+			name:     "one-line def",
+			text:     "def foo; end\ndef bar; 1; end",
+			expected: nil,
+		},
+		{
+			name:     "keywords in strings and comments",
+			text:     "def greet\n  puts \"if while class\"\n  # if we ever get here\nend",
+			expected: nil,
+		},
+		{
+			name:     "block with do",
+			text:     "[1, 2].each do |x|\n  if x > 1\n    puts x\n  end\nend",
+			expected: nil,
+		},
+		{
+			name:     "opener and end on one line",
+			text:     "if a then b end\n5.times do |i| end\n3.times { }\nvalue = friend.end",
+			expected: nil,
+		},
+		{
+			name:     "begin rescue ensure",
+			text:     "begin\n  risky\nrescue ex\n  puts ex\nelse\n  puts 1\nensure\n  cleanup\nend",
+			expected: nil,
+		},
+		{
+			name:     "if elsif else",
+			text:     "if a\n  1\nelsif b\n  2\nelse\n  3\nend",
+			expected: nil,
+		},
+		{
+			name:     "lib",
+			text:     "lib LibC\n  struct TimeVal\n    sec : Int64\n  end\n  union Data\n    i : Int32\n  end\n  fun getpid : Int32\nend",
+			expected: nil,
+		},
+		{
+			name:     "macro",
+			text:     "macro define(name)\n  {% if name %}\n    def {{name.id}}; end\n  {% end %}\nend",
+			expected: nil,
+		},
+		{
+			name:     "annotation",
+			text:     "annotation MyAnnotation\nend",
+			expected: nil,
+		},
+		{
+			name:     "missing end",
+			text:     "class Foo\n  def bar\n  end",
+			expected: []string{"Unclosed 'class' (missing 'end')"},
+		},
+		{
+			name:     "extra end",
+			text:     "def foo\nend\nend",
+			expected: []string{"Unexpected 'end'"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics := analyzer.checkStructureBalance(NewCrystalLexer(tt.text).Tokenize())
+			if len(diagnostics) != len(tt.expected) {
+				t.Fatalf("Expected %d diagnostics, got %d: %+v", len(tt.expected), len(diagnostics), diagnostics)
+			}
+			for i, message := range tt.expected {
+				if diagnostics[i].Message != message {
+					t.Errorf("Expected %q, got %q", message, diagnostics[i].Message)
+				}
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_BracketBalance(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	tests := []struct {
+		name     string
+		text     string
+		broken   bool
+		expected []string
+	}{
+		{
+			name:     "balanced",
+			text:     "foo(bar[0], {a: 1})\n[1, 2].map { |x| x * 2 }",
+			expected: nil,
+		},
+		{
+			name:     "brackets in strings and comments",
+			text:     "puts \"(]\" # {[\nputs 'x'",
+			expected: nil,
+		},
+		{
+			name:     "brackets in heredocs",
+			text:     "puts <<-TEXT\n  say \"(hi\n  ] if\n  TEXT\nfoo(1)",
+			expected: nil,
+		},
+		{
+			name:     "brackets in regexes",
+			text:     "matched = line =~ /foo(bar\\/\"[)/]/i\nfoo(1)",
+			expected: nil,
+		},
+		{
+			name:     "missing paren",
+			text:     "foo(bar, baz\nputs 1",
+			expected: []string{"Unmatched '('"},
+		},
+		{
+			name:     "stray closer",
+			text:     "values = [1, 2]]",
+			expected: []string{"Unexpected ']'"},
+		},
+		{
+			name:     "unclosed inside closed",
+			text:     "foo([1, 2)",
+			expected: []string{"Unmatched '['"},
+		},
+		{
+			name:     "brace explained by keyword balance",
+			text:     "items.each {\n  if x\n",
+			broken:   true,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics := analyzer.checkBracketBalance(NewCrystalLexer(tt.text).Tokenize(), tt.broken)
+			if len(diagnostics) != len(tt.expected) {
+				t.Fatalf("Expected %d diagnostics, got %d: %+v", len(tt.expected), len(diagnostics), diagnostics)
+			}
+			for i, message := range tt.expected {
+				if diagnostics[i].Message != message {
+					t.Errorf("Expected %q, got %q", message, diagnostics[i].Message)
+				}
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_LiteralDiagnostics(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "unpaired quote",
+			text:     "puts \"hello",
+			expected: []string{"Mismatched quotes"},
+		},
+		{
+			name:     "quote in a heredoc",
+			text:     "x = <<-TEXT\n  say \"hi\n  TEXT\nputs x",
+			expected: nil,
+		},
+		{
+			name:     "quote in a percent literal",
+			text:     "x = %(say \"hi)",
+			expected: nil,
+		},
+		{
+			name:     "regex",
+			text:     "x = /a.b/",
+			expected: nil,
+		},
+		{
+			name:     "quote and paren in a regex",
+			text:     "x = /\"(/",
+			expected: nil,
+		},
+		{
+			name:     "division",
+			text:     "a = 4\nb = 2\nputs a / b",
+			expected: nil,
+		},
+		{
+			name:     "division before a quote",
+			text:     "a = 4\nb = 2\nputs a / b, \"x",
+			expected: []string{"Mismatched quotes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var messages []string
+			for _, diagnostic := range analyzer.AnalyzeDocument(&TextDocumentItem{URI: "test.cr", Text: tt.text}) {
+				messages = append(messages, diagnostic.Message)
+			}
+			if !reflect.DeepEqual(messages, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, messages)
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_UnicodeCompletion(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "class Café\nend\n\nx = \"é\"; Ca",
+	}
+
+	// The cursor is after `Ca`; the string before it holds a two-byte
+	// character, so byte and UTF-16 offsets differ
+	found := false
+	for _, item := range analyzer.GetCompletions(doc, Position{Line: 3, Character: 11}).Items {
+		if item.Label == "Café" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected the Café class in completions")
+	}
+}
+
+func TestCrystalAnalyzer_DocumentContextCache(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:     "test.cr",
+		Version: 1,
+		Text:    "class Foo\n  def bar\n  end\nend",
+	}
+
+	first := analyzer.documentContext(doc)
+	analyzer.GetCompletions(doc, Position{Line: 3, Character: 3})
+	analyzer.GetDocumentSymbolTree(doc)
+	analyzer.AnalyzeDocument(doc)
+	if analyzer.documentContext(doc) != first {
+		t.Error("Expected repeated reads at the same version to reuse the parsed context")
+	}
+
+	doc.Text = "class Foo\nend"
+	doc.Version = 2
+	second := analyzer.documentContext(doc)
+	if second == first {
+		t.Error("Expected a new version to be parsed again")
+	}
+	if len(second.Classes["Foo"].Methods) != 0 {
+		t.Error("Expected the reparsed context to reflect the new text")
+	}
+
+	analyzer.ForgetDocument(doc.URI)
+	if analyzer.documentContext(doc) == second {
+		t.Error("Expected the context to be evicted")
+	}
+}
+
+func TestCrystalAnalyzer_SymbolSelectionRanges(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	// é is two bytes but one UTF-16 code unit
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "class Café\n  property crème : String\n\n  def décaf\n  end\nend\n\nmacro mémo(name)\nend",
+	}
+
+	symbols := analyzer.GetDocumentSymbolTree(doc)
+	if len(symbols) != 2 || len(symbols[0].Children) != 2 {
+		t.Fatalf("Expected Café with two children and a macro, got %+v", symbols)
+	}
+	tests := []struct {
+		symbol   DocumentSymbol
+		expected Range
+	}{
+		{symbols[0], Range{Start: Position{Line: 0, Character: 6}, End: Position{Line: 0, Character: 10}}},
+		{symbols[0].Children[0], Range{Start: Position{Line: 1, Character: 11}, End: Position{Line: 1, Character: 16}}},
+		{symbols[0].Children[1], Range{Start: Position{Line: 3, Character: 6}, End: Position{Line: 3, Character: 11}}},
+		{symbols[1], Range{Start: Position{Line: 7, Character: 6}, End: Position{Line: 7, Character: 10}}},
+	}
+	for _, tt := range tests {
+		if tt.symbol.SelectionRange != tt.expected {
+			t.Errorf("%s: expected selection range %+v, got %+v", tt.symbol.Name, tt.expected, tt.symbol.SelectionRange)
+		}
+	}
+
+	items := analyzer.PrepareTypeHierarchy(doc, Position{Line: 0, Character: 7})
+	if len(items) != 1 || items[0].SelectionRange != tests[0].expected {
+		t.Errorf("Expected the hierarchy item to select %+v, got %+v", tests[0].expected, items)
+	}
+}
+
+func TestCrystalAnalyzer_TypeHierarchy(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "class Animal\nend\n\nclass Dog < Animal\nend\n\nclass Cat < Animal\nend\n\nclass Puppy < Dog\nend",
+	}
+
+	items := analyzer.PrepareTypeHierarchy(doc, Position{Line: 3, Character: 7})
+	if len(items) != 1 || items[0].Name != "Dog" {
+		t.Fatalf("Expected Dog, got %+v", items)
+	}
+	dog := items[0]
+
+	supertypes := analyzer.GetSupertypes(doc, dog)
+	if len(supertypes) != 1 || supertypes[0].Name != "Animal" {
+		t.Errorf("Expected Animal as the supertype of Dog, got %+v", supertypes)
+	}
+
+	subtypes := analyzer.GetSubtypes(doc, dog)
+	if len(subtypes) != 1 || subtypes[0].Name != "Puppy" {
+		t.Errorf("Expected Puppy as the subtype of Dog, got %+v", subtypes)
+	}
+
+	animal := analyzer.PrepareTypeHierarchy(doc, Position{Line: 0, Character: 7})
+	if subtypes := analyzer.GetSubtypes(doc, animal[0]); len(subtypes) != 2 || subtypes[0].Name != "Cat" || subtypes[1].Name != "Dog" {
+		t.Errorf("Expected Cat and Dog as subtypes of Animal, got %+v", subtypes)
+	}
+}
+
+func TestCrystalAnalyzer_WorkspaceSymbols(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	docs := []*TextDocumentItem{
+		{URI: "file:///a.cr", Text: "module Shop\n  MAX_ITEMS = 10\n\n  class Cart\n    def add_item(item)\n    end\n  end\nend"},
+		{URI: "file:///b.cr", Text: "class ItemList\nend\n\ndef print_items\nend"},
+	}
+
+	symbols := analyzer.GetWorkspaceSymbols(docs, "item")
+	var names []string
+	for _, symbol := range symbols {
+		names = append(names, symbol.Name)
+	}
+
+	// Prefix matches come first, then other substring matches, each by name
+	expected := []string{"ItemList", "add_item", "MAX_ITEMS", "print_items"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	for _, symbol := range symbols {
+		switch symbol.Name {
+		case "MAX_ITEMS":
+			if symbol.Kind != SymbolKindConstant || symbol.ContainerName != "Shop" || symbol.Location.URI != "file:///a.cr" {
+				t.Errorf("Unexpected constant symbol %+v", symbol)
+			}
+		case "add_item":
+			if symbol.ContainerName != "Shop::Cart" || symbol.Location.Range.Start.Line != 4 {
+				t.Errorf("Unexpected method symbol %+v", symbol)
+			}
+		}
+	}
+
+	if all := analyzer.GetWorkspaceSymbols(docs, ""); len(all) != 6 {
+		t.Errorf("Expected every symbol for an empty query, got %d", len(all))
+	}
+}
+
+func TestCrystalAnalyzer_WorkspaceCompletion(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+	index := NewWorkspaceIndex()
+	analyzer.SetWorkspaceIndex(index)
+
+	index.Update("file:///src/models/user.cr", "class UserRecord\nend")
+	index.Update("file:///src/main.cr", "class UserView\nend")
+
+	doc := &TextDocumentItem{URI: "file:///src/main.cr", Text: "class UserView\nend\n\nUser"}
+
+	details := make(map[string]string)
+	for _, item := range analyzer.GetCompletions(doc, Position{Line: 3, Character: 4}).Items {
+		details[item.Label] = item.Detail
+	}
+
+	if details["UserRecord"] != "class from user.cr" {
+		t.Errorf("Expected UserRecord from the workspace index, got %q", details["UserRecord"])
+	}
+	if details["UserView"] != "Local class" {
+		t.Errorf("Expected UserView to come from the open document, got %q", details["UserView"])
+	}
+}
+
+func TestCrystalAnalyzer_CrossFileDefinition(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+	index := NewWorkspaceIndex()
+	analyzer.SetWorkspaceIndex(index)
+
+	fileA := &TextDocumentItem{
+		URI:  "file:///src/a.cr",
+		Text: "class Greeter\n  def greet(name)\n  end\nend\n\ndef shared_helper\nend",
+	}
+	fileB := &TextDocumentItem{
+		URI:  "file:///src/b.cr",
+		Text: "greeter = Greeter.new\nshared_helper\n\nclass Local\nend\nLocal.new",
+	}
+	index.Update(fileA.URI, fileA.Text)
+	index.Update(fileB.URI, fileB.Text)
+
+	tests := []struct {
+		name     string
+		pos      Position
+		expected Location
+	}{
+		{"class in other file", Position{Line: 0, Character: 12}, Location{
+			URI:   fileA.URI,
+			Range: Range{Start: Position{Line: 0, Character: 6}, End: Position{Line: 0, Character: 13}},
+		}},
+		{"method in other file", Position{Line: 1, Character: 3}, Location{
+			URI:   fileA.URI,
+			Range: Range{Start: Position{Line: 5, Character: 4}, End: Position{Line: 5, Character: 17}},
+		}},
+		{"local class", Position{Line: 5, Character: 2}, Location{
+			URI:   fileB.URI,
+			Range: Range{Start: Position{Line: 3, Character: 6}, End: Position{Line: 3, Character: 11}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locations := analyzer.GetDefinition(fileB, tt.pos)
+			if len(locations) != 1 || locations[0] != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, locations)
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_MethodReferences(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Greeter
+  def self.greet(name)
+    "greet #{name}"
+  end
+
+  def greet(name)
+    count = 1
+    Greeter.greet(name) * count
+  end
+end
+
+greet("ann") # greet
+`,
+	}
+
+	type occurrence struct {
+		line, character, kind int
+	}
+	var highlights []occurrence
+	// A call site finds the definitions as well
+	for _, highlight := range analyzer.GetDocumentHighlights(doc, Position{Line: 7, Character: 14}) {
+		highlights = append(highlights, occurrence{highlight.Range.Start.Line, highlight.Range.Start.Character, highlight.Kind})
+	}
+	expected := []occurrence{
+		{1, 11, DocumentHighlightKindText},
+		{5, 6, DocumentHighlightKindText},
+		{7, 12, DocumentHighlightKindRead},
+		{11, 0, DocumentHighlightKindRead},
+	}
+	if !reflect.DeepEqual(highlights, expected) {
+		t.Errorf("Expected highlights %v, got %v", expected, highlights)
+	}
+
+	if references := analyzer.GetReferences(doc, Position{Line: 5, Character: 7}, true); len(references) != 4 {
+		t.Errorf("Expected definitions and calls, got %+v", references)
+	}
+	references := analyzer.GetReferences(doc, Position{Line: 5, Character: 7}, false)
+	if len(references) != 2 || references[0].Range.Start != (Position{Line: 7, Character: 12}) || references[0].URI != "test.cr" {
+		t.Errorf("Expected only the calls without declarations, got %+v", references)
+	}
+
+	var kinds []int
+	for _, highlight := range analyzer.GetDocumentHighlights(doc, Position{Line: 6, Character: 4}) {
+		kinds = append(kinds, highlight.Kind)
+	}
+	if !reflect.DeepEqual(kinds, []int{DocumentHighlightKindWrite, DocumentHighlightKindRead}) {
+		t.Errorf("Expected a write and a read of count, got %v", kinds)
+	}
+
+	if highlights := analyzer.GetDocumentHighlights(doc, Position{Line: 9, Character: 1}); len(highlights) != 0 {
+		t.Errorf("Expected no highlights on a keyword, got %+v", highlights)
+	}
+}
+
+func TestCrystalAnalyzer_Rename(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "def total(items)\n  # total of the items\n  sum = items.sum\n  puts \"total: #{sum}\"\n  sum\nend\n\ntotal([1, 2])",
+	}
+
+	prepared := analyzer.PrepareRename(doc, Position{Line: 2, Character: 3})
+	if prepared == nil || *prepared != (Range{Start: Position{Line: 2, Character: 2}, End: Position{Line: 2, Character: 5}}) {
+		t.Errorf("Unexpected prepareRename range %+v", prepared)
+	}
+	if analyzer.PrepareRename(doc, Position{Line: 1, Character: 6}) != nil {
+		t.Error("Expected no rename inside a comment")
+	}
+
+	edit, err := analyzer.Rename(doc, Position{Line: 0, Character: 5}, "grand_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edits := edit.Changes[doc.URI]
+	if len(edits) != 2 {
+		t.Fatalf("Expected the definition and the call to be renamed, got %+v", edits)
+	}
+	if edits[0].Range.Start != (Position{Line: 0, Character: 4}) || edits[1].Range.Start != (Position{Line: 7, Character: 0}) {
+		t.Errorf("Unexpected rename edits %+v", edits)
+	}
+
+	if _, err := analyzer.Rename(doc, Position{Line: 2, Character: 3}, "end"); err == nil {
+		t.Error("Expected renaming to a keyword to fail")
+	}
+	if _, err := analyzer.Rename(doc, Position{Line: 2, Character: 3}, "not valid"); err == nil {
+		t.Error("Expected renaming to an invalid name to fail")
+	}
+}
+
+func TestCrystalAnalyzer_RenameScope(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `def a
+  name = 1
+  [name].each { |name| puts name }
+  name
+end
+
+def b(user)
+  name = user.name
+end
+
+class Post
+  @@count = 0
+  @title = ""
+end`,
+	}
+
+	edit, err := analyzer.Rename(doc, Position{Line: 1, Character: 3}, "label")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var renamed []Position
+	for _, edit := range edit.Changes[doc.URI] {
+		renamed = append(renamed, edit.Range.Start)
+	}
+	// Neither the block parameter shadowing it, the local of b nor the
+	// user.name call are the same name
+	expected := []Position{{Line: 1, Character: 2}, {Line: 2, Character: 3}, {Line: 3, Character: 2}}
+	if !reflect.DeepEqual(renamed, expected) {
+		t.Errorf("Expected edits at %v, got %v", expected, renamed)
+	}
+
+	edit, err = analyzer.Rename(doc, Position{Line: 2, Character: 18}, "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edits := edit.Changes[doc.URI]; len(edits) != 2 || edits[0].Range.Start != (Position{Line: 2, Character: 17}) {
+		t.Errorf("Expected only the block parameter and its use, got %+v", edits)
+	}
+
+	tests := []struct {
+		name    string
+		pos     Position
+		newName string
+	}{
+		{"local to constant", Position{Line: 1, Character: 3}, "Title"},
+		{"local to instance variable", Position{Line: 1, Character: 3}, "@name"},
+		{"instance variable to local", Position{Line: 12, Character: 3}, "title"},
+		{"instance variable to class variable", Position{Line: 12, Character: 3}, "@@title"},
+		{"class variable to instance variable", Position{Line: 11, Character: 3}, "@count"},
+		{"constant to local", Position{Line: 10, Character: 7}, "post"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := analyzer.Rename(doc, tt.pos, tt.newName); err == nil {
+				t.Errorf("Expected renaming to %q to fail", tt.newName)
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_RemoveUnexpectedEnd(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "def foo\n  1\nend\n  end\nputs foo",
+	}
+
+	var diagnostics []Diagnostic
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if diagnostic.Message == unexpectedEndMessage {
+			diagnostics = append(diagnostics, diagnostic)
+		}
+	}
+	if len(diagnostics) != 1 {
+		t.Fatalf("Expected one unexpected end diagnostic, got %+v", diagnostics)
+	}
+
+	// Other diagnostics never produce this fix
+	unrelated := Diagnostic{Range: Range{Start: Position{Line: 2}}, Message: "Unclosed 'def' (missing 'end')"}
+	actions := analyzer.GetCodeActions(doc, append(diagnostics, unrelated))
+	if len(actions) != 1 {
+		t.Fatalf("Expected one code action, got %+v", actions)
+	}
+
+	edits := actions[0].Edit.Changes[doc.URI]
+	if len(edits) != 1 {
+		t.Fatalf("Expected one edit, got %+v", edits)
+	}
+	expected := Range{Start: Position{Line: 3, Character: 0}, End: Position{Line: 4, Character: 0}}
+	if edits[0].Range != expected || edits[0].NewText != "" {
+		t.Errorf("Expected the stray end line to be deleted, got %+v", edits[0])
+	}
+}
+
+func TestCrystalAnalyzer_GetSemanticTokens(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "def greet(name)\n  puts \"hi\" # say\nend\n\ngreet(:bob, 42)",
+	}
+
+	expected := []int{
+		0, 0, 3, semanticKeyword, 0,
+		0, 4, 5, semanticMethod, 0,
+		0, 6, 4, semanticVariable, 0,
+		1, 2, 4, semanticKeyword, 0,
+		0, 5, 4, semanticString, 0,
+		0, 5, 5, semanticComment, 0,
+		1, 0, 3, semanticKeyword, 0,
+		2, 0, 5, semanticMethod, 0,
+		0, 6, 4, semanticEnumMember, 0,
+		0, 6, 2, semanticNumber, 0,
+	}
+
+	tokens := analyzer.GetSemanticTokens(doc)
+	if fmt.Sprint(tokens.Data) != fmt.Sprint(expected) {
+		t.Errorf("Expected semantic tokens %v, got %v", expected, tokens.Data)
+	}
+}
+
+func TestCrystalAnalyzer_SemanticBareCalls(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "def greet\nend\n\ngreet\nname = 1\nname",
+	}
+
+	expected := []int{
+		0, 0, 3, semanticKeyword, 0,
+		0, 4, 5, semanticMethod, 0,
+		1, 0, 3, semanticKeyword, 0,
+		2, 0, 5, semanticMethod, 0,
+		1, 0, 4, semanticVariable, 0,
+		0, 7, 1, semanticNumber, 0,
+		1, 0, 4, semanticVariable, 0,
+	}
+
+	// `=` is an operator, which has no semantic type
+	tokens := analyzer.GetSemanticTokens(doc)
+	if fmt.Sprint(tokens.Data) != fmt.Sprint(expected) {
+		t.Errorf("Expected semantic tokens %v, got %v", expected, tokens.Data)
+	}
+}
+
+func TestCrystalAnalyzer_GetSemanticTokensMultiline(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "x = \"a\nbc\"",
+	}
+
+	// The string is split into one span per line
+	expected := []int{
+		0, 0, 1, semanticVariable, 0,
+		0, 4, 2, semanticString, 0,
+		1, 0, 3, semanticString, 0,
+	}
+
+	tokens := analyzer.GetSemanticTokens(doc)
+	if fmt.Sprint(tokens.Data) != fmt.Sprint(expected) {
+		t.Errorf("Expected semantic tokens %v, got %v", expected, tokens.Data)
+	}
+}
+
+func TestCrystalAnalyzer_GetInlayHints(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `count = 0
+name : String = "x"
+user = User.new
+unknown = something_else
+# note = 1
+ok = count == 1
+total = count`,
+	}
+
+	hints := analyzer.GetInlayHints(doc, Range{End: Position{Line: 6}})
+
+	expected := map[int]string{0: ": Int32", 2: ": User", 6: ": Int32"}
+	if len(hints) != len(expected) {
+		t.Fatalf("Expected %d hints, got %+v", len(expected), hints)
+	}
+	for _, hint := range hints {
+		if expected[hint.Position.Line] != hint.Label {
+			t.Errorf("Unexpected hint %+v", hint)
+		}
+		if hint.Kind != InlayHintKindType {
+			t.Errorf("Expected a type hint, got kind %d", hint.Kind)
+		}
+	}
+	if hints[0].Position.Character != 5 {
+		t.Errorf("Expected the hint right after the name, got %+v", hints[0].Position)
+	}
+
+	// Only lines inside the range are hinted
+	if hints := analyzer.GetInlayHints(doc, Range{Start: Position{Line: 1}, End: Position{Line: 5}}); len(hints) != 1 {
+		t.Errorf("Expected one hint in range, got %+v", hints)
+	}
+}
+
+func TestCrystalAnalyzer_GetSelectionRanges(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Greeter
+  def greet(name)
+    if name
+      puts name.upcase
+    end
+  end
+end`,
+	}
+
+	ranges := analyzer.GetSelectionRanges(doc, []Position{{Line: 3, Character: 16}})
+	if len(ranges) != 1 {
+		t.Fatalf("Expected one selection range, got %d", len(ranges))
+	}
+
+	expected := []Range{
+		{Start: Position{Line: 3, Character: 16}, End: Position{Line: 3, Character: 22}}, // upcase
+		{Start: Position{Line: 3, Character: 6}, End: Position{Line: 3, Character: 22}},  // line
+		{Start: Position{Line: 2, Character: 4}, End: Position{Line: 4, Character: 7}},   // if
+		{Start: Position{Line: 1, Character: 2}, End: Position{Line: 5, Character: 5}},   // def
+		{Start: Position{Line: 0, Character: 0}, End: Position{Line: 6, Character: 3}},   // class
+	}
+
+	current := &ranges[0]
+	for i, want := range expected {
+		if current == nil {
+			t.Fatalf("Selection chain ended after %d ranges", i)
+		}
+		if current.Range != want {
+			t.Errorf("Range %d: expected %+v, got %+v", i, want, current.Range)
+		}
+		current = current.Parent
+	}
+	if current != nil {
+		t.Errorf("Expected the chain to end at the class, got %+v", current.Range)
+	}
+}
+
+func TestCrystalAnalyzer_GetTypeDefinition(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Address
+end
+
+class User
+  def address : Address
+    Address.new
+  end
+end
+
+user = User.new
+user.address
+count = 1
+count`,
+	}
+
+	tests := []struct {
+		name     string
+		pos      Position
+		expected int // line of the type declaration, -1 for none
+	}{
+		{"variable", Position{Line: 10, Character: 1}, 3},
+		{"method call", Position{Line: 10, Character: 8}, 0},
+		{"builtin type", Position{Line: 12, Character: 2}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locations := analyzer.GetTypeDefinition(doc, tt.pos)
+			if tt.expected < 0 {
+				if len(locations) != 0 {
+					t.Errorf("Expected no locations, got %+v", locations)
+				}
+				return
+			}
+			if len(locations) != 1 || locations[0].Range.Start.Line != tt.expected {
+				t.Errorf("Expected the declaration on line %d, got %+v", tt.expected, locations)
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_DiagnosticOptions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI:  "test.cr",
+		Text: "def foo\n  bar(\n",
+	}
+
+	countBySource := func() (structure, brackets int) {
+		for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+			switch {
+			case strings.HasPrefix(diagnostic.Message, "Unclosed"):
+				structure++
+			case strings.HasPrefix(diagnostic.Message, "Unmatched"):
+				brackets++
+			}
+		}
+		return structure, brackets
+	}
+
+	if structure, brackets := countBySource(); structure != 1 || brackets != 1 {
+		t.Fatalf("Expected both checks by default, got %d structure and %d bracket diagnostics", structure, brackets)
+	}
+
+	disabled := false
+	analyzer.SetDiagnosticOptions(analyzer.DiagnosticOptions().Apply(DiagnosticSettings{StructureBalance: &disabled}))
+	if structure, brackets := countBySource(); structure != 0 || brackets != 1 {
+		t.Errorf("Expected only bracket diagnostics, got %d structure and %d bracket diagnostics", structure, brackets)
+	}
+
+	// Settings that don't mention a check leave it alone
+	options := analyzer.DiagnosticOptions().Apply(DiagnosticSettings{})
+	if options.StructureBalance || !options.BracketBalance || !options.UndefinedVariable {
+		t.Errorf("Unexpected options after an empty update: %+v", options)
+	}
+}
+
+func TestCrystalAnalyzer_AssignmentInCondition(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `if x = 5
+  puts x
+elsif y == 2
+  puts y
+end
+return unless ready = check
+while line = gets
+end
+if a >= 1 && b != 2 then c = 3 end
+obj.if = 1
+label = "if x = 5"
+`,
+	}
+
+	var found []Range
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if diagnostic.Message == "Assignment in condition; did you mean '=='?" {
+			if diagnostic.Severity != DiagnosticSeverityWarning {
+				t.Errorf("Expected a warning, got severity %d", diagnostic.Severity)
+			}
+			found = append(found, diagnostic.Range)
+		}
+	}
+
+	expected := []Range{
+		{Start: Position{Line: 0, Character: 5}, End: Position{Line: 0, Character: 6}},
+		{Start: Position{Line: 5, Character: 20}, End: Position{Line: 5, Character: 21}},
+		{Start: Position{Line: 6, Character: 11}, End: Position{Line: 6, Character: 12}},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected ranges %+v, got %+v", expected, found)
+	}
+
+	disabled := false
+	analyzer.SetDiagnosticOptions(analyzer.DiagnosticOptions().Apply(DiagnosticSettings{AssignmentInCondition: &disabled}))
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if strings.HasPrefix(diagnostic.Message, "Assignment in condition") {
+			t.Errorf("Expected no warning once disabled, got %+v", diagnostic)
+		}
+	}
+}
+
+func TestCrystalAnalyzer_UndefinedMethods(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Animal
+  property name : String
+
+  def initialize(@name : String)
+  end
+
+  def speak : String
+    "..."
+  end
+end
+
+class Dog < Animal
+  def fetch
+  end
+end
+
+class Flexible
+  include Comparable(Flexible)
+end
+
+def run(pet : Dog)
+  dog = Dog.new("Rex")
+  dog.fetch
+  dog.speek
+  dog.name = "Max"
+  dog.nmae = "Max"
+  dog.to_s
+  dog.not_nil!
+  pet.fly
+  Dog.new("Rex").speak.size
+  Dog.new("Rex").bark
+  other = Flexible.new
+  other.anything
+  value = "text"
+  value.whatever
+end
+
+def animal
+  animal = Animal.new("cat")
+  animal.purr
+end
+
+class Cache
+  def get(key : String) : Cache
+    self
+  end
+end
+
+client = HTTP::Client.new("x")
+puts client.get("/").body
+Cache.new.get("k").bdy
+`,
+	}
+
+	var messages []string
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if strings.HasPrefix(diagnostic.Message, "undefined method") {
+			if diagnostic.Severity != DiagnosticSeverityWarning {
+				t.Errorf("Expected a warning, got severity %d", diagnostic.Severity)
+			}
+			messages = append(messages, fmt.Sprintf("%d:%d %s", diagnostic.Range.Start.Line, diagnostic.Range.Start.Character, diagnostic.Message))
+		}
+	}
+
+	// Animal has a subclass, so its instances may be any Dog as well.
+	// HTTP::Client#get isn't Cache#get just because the names match.
+	expected := []string{
+		"23:6 undefined method 'speek' for Dog",
+		"25:6 undefined method 'nmae=' for Dog",
+		"28:6 undefined method 'fly' for Dog",
+		"30:17 undefined method 'bark' for Dog",
+		"50:19 undefined method 'bdy' for Cache",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+}
+
+func TestCrystalAnalyzer_ArityMismatch(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `def greet(name, greeting = "Hello")
+end
+
+def log(*messages, level = 1)
+end
+
+def each_item(&block)
+end
+
+class Point
+  def initialize(@x : Int32, @y : Int32 = 0)
+  end
+
+  def move(dx, dy)
+    scale(2, 3)
+  end
+
+  def scale(factor)
+  end
+end
+
+greet("Ann")
+greet("Ann", "Hi", "!")
+greet
+greet(name: "Ann", greeting: "Hey")
+greet(nmae: "Ann")
+log("a", "b", "c", level: 2)
+each_item(&.to_s)
+each_item { |item| item }
+args = ["Ann"]
+greet(*args)
+point = Point.new(1)
+point.move(1)
+Point.new(1, 2, 3)
+Point.new(x: 1)
+`,
+	}
+
+	var messages []string
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if strings.HasPrefix(diagnostic.Message, "wrong number") || strings.HasPrefix(diagnostic.Message, "no overload") {
+			if diagnostic.Severity != DiagnosticSeverityWarning {
+				t.Errorf("Expected a warning, got severity %d", diagnostic.Severity)
+			}
+			messages = append(messages, fmt.Sprintf("%d:%d %s", diagnostic.Range.Start.Line, diagnostic.Range.Start.Character, diagnostic.Message))
+		}
+	}
+
+	// A call without parentheses may be a local variable and isn't checked
+	expected := []string{
+		"14:4 wrong number of arguments for 'scale' (given 2, expected 1)",
+		"22:0 wrong number of arguments for 'greet' (given 3, expected 1..2)",
+		"25:0 no overload of 'greet' accepts these arguments",
+		"32:6 wrong number of arguments for 'move' (given 1, expected 2)",
+		"33:6 wrong number of arguments for 'new' (given 3, expected 1..2)",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+}
+
+func TestCrystalAnalyzer_DuplicateMethods(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Greeter
+  def initialize(name)
+  end
+
+  def initialize(name)
+  end
+
+  def greet(name)
+  end
+
+  def greet(name : String, loud)
+  end
+
+  def greet(other)
+  end
+
+  def size(x : Int32)
+  end
+
+  def size(x : String)
+  end
+end`,
+	}
+
+	var duplicates []Diagnostic
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if strings.Contains(diagnostic.Message, "already defined") {
+			duplicates = append(duplicates, diagnostic)
+		}
+	}
+
+	if len(duplicates) != 1 {
+		t.Fatalf("Expected one duplicate definition, got %+v", duplicates)
+	}
+	duplicate := duplicates[0]
+	if duplicate.Message != "Method 'greet' is already defined" || duplicate.Severity != DiagnosticSeverityWarning {
+		t.Errorf("Unexpected diagnostic %+v", duplicate)
+	}
+	if duplicate.Range.Start.Line != 13 {
+		t.Errorf("Expected the redefinition on line 13, got %d", duplicate.Range.Start.Line)
+	}
+	if len(duplicate.RelatedInformation) != 1 || duplicate.RelatedInformation[0].Location.Range.Start.Line != 7 {
+		t.Errorf("Expected the first definition on line 7 as related information, got %+v", duplicate.RelatedInformation)
+	}
+}
+
+func TestCrystalAnalyzer_DuplicateClasses(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Animal
+end
+
+class Dog < Animal
+  def bark
+  end
+end
+
+class Dog
+  def wag
+  end
+end
+
+class Dog < String
+end
+
+module Helpers
+end
+
+module Helpers
+end`,
+	}
+
+	var duplicates []Diagnostic
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if strings.Contains(diagnostic.Message, "reopens") || strings.Contains(diagnostic.Message, "mismatch") {
+			duplicates = append(duplicates, diagnostic)
+		}
+	}
+
+	if len(duplicates) != 2 {
+		t.Fatalf("Expected two diagnostics, got %+v", duplicates)
+	}
+	if duplicates[0].Severity != DiagnosticSeverityWarning || duplicates[0].Range.Start.Line != 8 {
+		t.Errorf("Expected a warning for the reopening on line 8, got %+v", duplicates[0])
+	}
+	if duplicates[1].Severity != DiagnosticSeverityError || duplicates[1].Range.Start.Line != 13 ||
+		duplicates[1].Message != "Superclass mismatch for class 'Dog' (String vs Animal)" {
+		t.Errorf("Expected a superclass mismatch on line 13, got %+v", duplicates[1])
+	}
+
+	// Reopening keeps the methods of every declaration
+	dog := analyzer.documentClasses["Dog"]
+	if dog == nil || len(dog.Methods["bark"]) != 1 || len(dog.Methods["wag"]) != 1 {
+		t.Errorf("Expected Dog to have bark and wag, got %+v", dog)
+	}
+	if dog.Location.Line != 3 || dog.EndLine != 6 || len(dog.Declarations) != 3 {
+		t.Errorf("Expected the first declaration to define Dog, got %+v", dog)
+	}
+}
+
+func TestCrystalAnalyzer_ScopedVariableCompletions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `top_level = 1
+
+def a(alpha_param)
+  alpha_local = 2
+end
+
+def b
+  items.each do |alpha_item|
+    al
+  end
+  al
+end
+`,
+	}
+
+	labels := func(pos Position) map[string]bool {
+		found := make(map[string]bool)
+		for _, item := range analyzer.GetCompletions(doc, pos).Items {
+			if item.Kind == CompletionItemKindVariable {
+				found[item.Label] = true
+			}
+		}
+		return found
+	}
+
+	// Inside the block its parameter is visible, but not a's locals
+	inBlock := labels(Position{Line: 8, Character: 6})
+	if !inBlock["alpha_item"] {
+		t.Errorf("Expected the block parameter to be offered, got %v", inBlock)
+	}
+	if inBlock["alpha_local"] || inBlock["alpha_param"] {
+		t.Errorf("Expected locals of another method to be out of scope, got %v", inBlock)
+	}
+
+	// After the block ends its parameter is gone
+	if afterBlock := labels(Position{Line: 10, Character: 4}); len(afterBlock) != 0 {
+		t.Errorf("Expected no variables after the block, got %v", afterBlock)
+	}
+
+	// Methods don't see top-level locals, but the top level does
+	if variables := analyzer.variablesInScope(analyzer.documentContext(doc).Tokens, Position{Line: 4}); strings.Join(variables, ",") != "alpha_local,alpha_param" {
+		t.Errorf("Unexpected variables in a: %v", variables)
+	}
+	if variables := analyzer.variablesInScope(analyzer.documentContext(doc).Tokens, Position{Line: 12}); strings.Join(variables, ",") != "top_level" {
+		t.Errorf("Unexpected top-level variables: %v", variables)
+	}
+}
+
+func TestCrystalAnalyzer_BlockParameterTypes(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `names = ["ann", "bob"]
+names.each do |name|
+  name.
+end
+
+def total(counts : Array(Int32))
+  counts.map { |count| count. }
+end
+
+ages = {} of String => Int32
+ages.each do |person, age|
+  person.
+  age.
+end
+names.each_with_index do |name, index|
+  index.
+end`,
+	}
+
+	tests := []struct {
+		name     string
+		pos      Position
+		expected string
+	}{
+		{"array literal", Position{Line: 2, Character: 7}, "upcase"},
+		{"typed parameter", Position{Line: 6, Character: 29}, "abs"},
+		{"hash key", Position{Line: 11, Character: 9}, "upcase"},
+		{"hash value", Position{Line: 12, Character: 6}, "abs"},
+		{"index", Position{Line: 15, Character: 8}, "abs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completions := analyzer.GetCompletions(doc, tt.pos)
+			found := false
+			for _, item := range completions.Items {
+				if item.Label == tt.expected {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Expected %s in completions, got %d items", tt.expected, len(completions.Items))
+			}
+		})
+	}
+
+	if typeName := analyzer.inferTypeOfExpression("age", doc, Position{Line: 12, Character: 2}); typeName != "Int32" {
+		t.Errorf("Expected age to be Int32, got %q", typeName)
+	}
+}
+
+func TestCrystalAnalyzer_MethodChainTypes(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class User
+  def name : String
+    "ann"
+  end
+
+  def friends : Array(User)
+    [] of User
+  end
+end
+
+user = User.new
+words = ["a", "b"]
+`,
+	}
+	analyzer.parseDocumentStructure(doc)
+	pos := Position{Line: 12, Character: 0}
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`"hi".upcase.size`, "Int32"},
+		{`"a b".split(" ").first`, "String"},
+		{"words.first?.upcase", "String"},
+		{"words.dup", "Array(String)"},
+		{"user.name.size", "Int32"},
+		{"user.friends.first.name", "String"},
+		{"user.friends.last?", "User?"},
+		{"user.unknown.size", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := analyzer.inferTypeOfExpression(tt.expr, doc, pos); got != tt.expected {
+				t.Errorf("inferTypeOfExpression(%q) = %q, want %q", tt.expr, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_TypedDeclarations(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `count : Int64 = 5
+label : String
+buffer = uninitialized UInt8[256]
+total : Float64 = count * 2 # scaled
+def build(
+  name : String,
+  size : Int32
+)
+  name
+end
+
+`,
+	}
+
+	tests := []struct {
+		name     string
+		line     int
+		expected string
+	}{
+		{"count", 0, "Int64"},
+		{"label", 1, "String"},
+		{"buffer", 2, "UInt8[256]"},
+		{"total", 3, "Float64"},
+	}
+
+	pos := Position{Line: 11, Character: 0}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := analyzer.inferTypeOfExpression(tt.name, doc, pos); got != tt.expected {
+				t.Errorf("inferTypeOfExpression(%q) = %q, want %q", tt.name, got, tt.expected)
+			}
+
+			hover := analyzer.GetHover(doc, Position{Line: tt.line, Character: 1})
+			expected := fmt.Sprintf("**%s** : %s - local variable", tt.name, tt.expected)
+			if hover == nil || len(hover.Contents) != 1 || hover.Contents[0] != expected {
+				t.Errorf("Expected hover %q, got %+v", expected, hover)
+			}
+		})
+	}
+
+	// Declared variables are offered with their type
+	details := make(map[string]string)
+	for _, item := range analyzer.GetCompletions(doc, pos).Items {
+		if item.Kind == CompletionItemKindVariable {
+			details[item.Label] = item.Detail
+		}
+	}
+	for _, tt := range tests {
+		if details[tt.name] != tt.expected {
+			t.Errorf("Expected completion detail %q for %s, got %q", tt.expected, tt.name, details[tt.name])
+		}
+	}
+
+	// Parameters on their own signature lines keep their type
+	if got := analyzer.inferTypeOfExpression("name", doc, Position{Line: 9, Character: 2}); got != "String" {
+		t.Errorf("Expected String for a multi-line parameter, got %q", got)
+	}
+}
+
+func TestCrystalAnalyzer_UnionTypeCompletions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class User
+  def name : String
+    "ann"
+  end
+end
+
+value : Int32 | String = 5
+maybe : String? = nil
+found : User | Nil = nil
+value.
+maybe.
+found.
+`,
+	}
+
+	labels := func(line int) map[string]int {
+		counts := make(map[string]int)
+		for _, item := range analyzer.GetCompletions(doc, Position{Line: line, Character: 6}).Items {
+			counts[item.Label]++
+		}
+		return counts
+	}
+
+	union := labels(9)
+	for _, expected := range []string{"to_s", "inspect", "nil?"} {
+		if union[expected] != 1 {
+			t.Errorf("Expected %s once for Int32 | String, got %d", expected, union[expected])
+		}
+	}
+	for _, unexpected := range []string{"upcase", "abs", "not_nil!"} {
+		if union[unexpected] > 0 {
+			t.Errorf("Expected no %s for Int32 | String", unexpected)
+		}
+	}
+
+	nilable := labels(10)
+	for _, expected := range []string{"upcase", "nil?", "not_nil!"} {
+		if nilable[expected] != 1 {
+			t.Errorf("Expected %s once for String?, got %d", expected, nilable[expected])
+		}
+	}
+
+	local := labels(11)
+	if local["name"] != 1 || local["not_nil!"] != 1 || local["upcase"] > 0 {
+		t.Errorf("Unexpected completions for User | Nil: %v", local)
+	}
+
+	hover := analyzer.GetHover(doc, Position{Line: 6, Character: 1})
+	if hover == nil || hover.Contents[0] != "**value** : Int32 | String - local variable" {
+		t.Errorf("Expected the full union in hover, got %+v", hover)
+	}
+}
+
+func TestCrystalAnalyzer_Records(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `# A point on the plane
+record Point, x : Int32, y : Int32 = 0 do
+  def length : Float64
+    Math.sqrt(x * x + y * y)
+  end
+end
+
+point = Point.new(1)
+point.
+point.x.
+`,
+	}
+
+	labels := func(line, character int) map[string]bool {
+		found := make(map[string]bool)
+		for _, item := range analyzer.GetCompletions(doc, Position{Line: line, Character: character}).Items {
+			found[item.Label] = true
+		}
+		return found
+	}
+
+	members := labels(8, 6)
+	for _, expected := range []string{"x", "y", "length", "copy_with"} {
+		if !members[expected] {
+			t.Errorf("Expected %s in record completions, got %v", expected, members)
+		}
+	}
+	if members["x="] {
+		t.Error("Expected record fields to be read-only")
+	}
+	if !labels(9, 8)["abs"] {
+		t.Error("Expected the field type to be inferred as Int32")
+	}
+
+	point := analyzer.findClass("Point")
+	if point == nil || !point.IsStruct || point.Documentation != "A point on the plane" || point.EndLine != 5 {
+		t.Fatalf("Unexpected record struct: %+v", point)
+	}
+	if y := point.Properties["y"]; y == nil || y.Type != "Int32" || y.DefaultValue != "0" || y.Location != (Position{Line: 1, Character: 25}) {
+		t.Errorf("Unexpected field y: %+v", y)
+	}
+
+	tree := analyzer.GetDocumentSymbolTree(doc)
+	if len(tree) != 1 || tree[0].Name != "Point" || tree[0].Kind != SymbolKindStruct {
+		t.Fatalf("Expected the record in document symbols, got %+v", tree)
+	}
+	var children []string
+	for _, child := range tree[0].Children {
+		children = append(children, child.Name)
+	}
+	if !reflect.DeepEqual(children, []string{"x", "y", "length"}) {
+		t.Errorf("Expected fields and methods as children, got %v", children)
+	}
+
+	// The generated constructor takes the fields in order
+	for _, diagnostic := range analyzer.AnalyzeDocument(doc) {
+		if strings.Contains(diagnostic.Message, "'new'") {
+			t.Errorf("Unexpected diagnostic for Point.new(1): %s", diagnostic.Message)
+		}
+	}
+}
+
+func TestCrystalAnalyzer_TopLevelMethods(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `def helper(name : String) : String
+  name.upcase
+end
+
+class Greeter
+  def greet
+    hel
+  end
+end
+
+helper("ann")`,
+	}
+
+	completions := analyzer.GetCompletions(doc, Position{Line: 6, Character: 7})
+	var item *CompletionItem
+	for i := range completions.Items {
+		if completions.Items[i].Label == "helper" {
+			item = &completions.Items[i]
+		}
+	}
+	if item == nil {
+		t.Fatalf("Expected helper in completions")
+	}
+	if item.Kind != CompletionItemKindFunction || item.Detail != "helper(name : String) : String" {
+		t.Errorf("Unexpected completion item %+v", *item)
+	}
+
+	locations := analyzer.GetDefinition(doc, Position{Line: 10, Character: 2})
+	if len(locations) != 1 || locations[0].Range.Start.Line != 0 {
+		t.Errorf("Expected definition on line 0, got %+v", locations)
+	}
+
+	found := false
+	for _, symbol := range analyzer.GetDocumentSymbolTree(doc) {
+		if symbol.Name == "helper" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected helper in document symbols")
+	}
+}
+
+func TestCrystalAnalyzer_Constants(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `MAX_SIZE = 100
+
+module Config
+  # Seconds before a request is abandoned
+  TIMEOUT = 3.5
+
+  def self.limit
+    TI
+  end
+end
+
+enum Color
+  Red = 1
+end
+
+if MAX_SIZE == 100
+  puts Config::TIMEOUT
+end`,
+	}
+
+	t.Run("completion", func(t *testing.T) {
+		completions := analyzer.GetCompletions(doc, Position{Line: 7, Character: 6})
+		var item *CompletionItem
+		for i := range completions.Items {
+			if completions.Items[i].Label == "TIMEOUT" {
+				item = &completions.Items[i]
+			}
+		}
+		if item == nil {
+			t.Fatalf("Expected TIMEOUT in completions")
+		}
+		if item.Kind != CompletionItemKindConstant || item.Detail != "Float64" {
+			t.Errorf("Unexpected completion item %+v", *item)
+		}
+	})
+
+	t.Run("symbols", func(t *testing.T) {
+		var names []string
+		for _, symbol := range analyzer.GetDocumentSymbols(doc) {
+			if symbol.Kind == SymbolKindConstant {
+				names = append(names, symbol.Name)
+			}
+		}
+		if strings.Join(names, ",") != "MAX_SIZE,TIMEOUT" {
+			t.Errorf("Expected constants MAX_SIZE and TIMEOUT, got %v", names)
+		}
+
+		for _, symbol := range analyzer.GetDocumentSymbolTree(doc) {
+			if symbol.Name != "Config" {
+				continue
+			}
+			if len(symbol.Children) == 0 || symbol.Children[0].Kind != SymbolKindConstant {
+				t.Errorf("Expected TIMEOUT nested under Config, got %+v", symbol.Children)
+			}
+		}
+	})
+
+	t.Run("definition", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			pos      Position
+			expected Position
+		}{
+			{"top-level", Position{Line: 15, Character: 5}, Position{Line: 0, Character: 0}},
+			{"qualified", Position{Line: 16, Character: 17}, Position{Line: 4, Character: 2}},
+		}
+		for _, tt := range tests {
+			locations := analyzer.GetDefinition(doc, tt.pos)
+			if len(locations) != 1 || locations[0].Range.Start != tt.expected {
+				t.Errorf("%s: expected definition at %+v, got %+v", tt.name, tt.expected, locations)
+			}
+		}
+	})
+
+	t.Run("hover", func(t *testing.T) {
+		hover := analyzer.GetHover(doc, Position{Line: 16, Character: 17})
+		if hover == nil || !strings.Contains(hover.Contents[0], "**Config::TIMEOUT** - Float64 constant") ||
+			!strings.Contains(hover.Contents[0], "Seconds before a request is abandoned") {
+			t.Errorf("Unexpected hover %+v", hover)
+		}
+	})
+}
+
+func TestCrystalAnalyzer_TypeAliases(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `alias Count = Int32
+alias Ping = Pong
+alias Pong = Ping
+
+def double(x : Count)
+  x.
+end
+
+def loop(y : Ping)
+  y.
+end
+
+Cou`,
+	}
+
+	hasLabel := func(items []CompletionItem, label string) bool {
+		for _, item := range items {
+			if item.Label == label {
+				return true
+			}
+		}
+		return false
+	}
+
+	if items := analyzer.GetCompletions(doc, Position{Line: 5, Character: 4}).Items; !hasLabel(items, "abs") {
+		t.Errorf("Expected Int32 methods through the alias, got %d items", len(items))
+	}
+
+	// A cycle must not hang; it simply resolves nothing
+	analyzer.GetCompletions(doc, Position{Line: 9, Character: 4})
+
+	items := analyzer.GetCompletions(doc, Position{Line: 12, Character: 3}).Items
+	found := false
+	for _, item := range items {
+		if item.Label == "Count" && item.Kind == CompletionItemKindClass && item.Detail == "alias of Int32" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected alias Count in completions, got %+v", items)
+	}
+}
+
+func TestCrystalAnalyzer_Annotations(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `annotation Audited
+end
+
+class User
+  @[JSON::Field(key: "id")]
+  property id : Int64
+
+  @[Audited]
+  def save
+  end
+end`,
+	}
+
+	analyzer.parseDocumentStructure(doc)
+	user := analyzer.findClass("User")
+	if user == nil {
+		t.Fatalf("Expected class User")
+	}
+	if property := user.Properties["id"]; property == nil || property.Type != "Int64" {
+		t.Errorf("Expected annotated property id : Int64, got %+v", property)
+	}
+	if _, exists := user.Methods["save"]; !exists {
+		t.Errorf("Expected annotated method save on User")
+	}
+
+	if diagnostics := analyzer.AnalyzeDocument(doc); len(diagnostics) != 0 {
+		t.Errorf("Expected no diagnostics, got %+v", diagnostics)
+	}
+
+	found := false
+	for _, symbol := range analyzer.GetDocumentSymbols(doc) {
+		if symbol.Name == "Audited" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected annotation Audited in document symbols")
+	}
+	if audited := analyzer.findClass("Audited"); audited == nil || audited.KindName() != "annotation" {
+		t.Errorf("Expected Audited to be parsed as an annotation, got %+v", audited)
+	}
+}
+
+func TestCrystalAnalyzer_Macros(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `# Defines a getter returning value
+macro define_getter(name, value)
+  def {{name.id}}
+    {{value}}
+  end
+end
+
+class Model
+  macro field(name, type)
+    def generated
+    end
+  end
+
+  def save
+    fi
+  end
+end`,
+	}
+
+	completions := analyzer.GetCompletions(doc, Position{Line: 14, Character: 6})
+	var field *CompletionItem
+	for i := range completions.Items {
+		if completions.Items[i].Label == "field" {
+			field = &completions.Items[i]
+		}
+	}
+	if field == nil {
+		t.Fatalf("Expected macro field in completions")
+	}
+	if field.Kind != CompletionItemKindFunction || field.Detail != "macro field(name, type)" {
+		t.Errorf("Unexpected completion item %+v", *field)
+	}
+
+	macro := analyzer.documentMacros["define_getter"]
+	if macro == nil || macro.Documentation != "Defines a getter returning value" || macro.EndLine != 5 {
+		t.Errorf("Unexpected top-level macro %+v", macro)
+	}
+
+	// Definitions inside a macro body are templates, not methods
+	if _, exists := analyzer.findClass("Model").Methods["generated"]; exists {
+		t.Errorf("Expected no method recorded from the macro body")
+	}
+
+	var names []string
+	for _, symbol := range analyzer.GetDocumentSymbols(doc) {
+		if symbol.Kind == SymbolKindFunction {
+			names = append(names, symbol.Name)
+		}
+	}
+	if strings.Join(names, ",") != "define_getter,field" {
+		t.Errorf("Expected macros in document symbols, got %v", names)
+	}
+}
+
+func TestCrystalAnalyzer_EndCompletion(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	tests := []struct {
+		name     string
+		text     string
+		pos      Position
+		expected string // detail of the end item, "" if none
+	}{
+		{"unclosed def", "class Foo\n  def bar\n    puts 1\n    \nend", Position{Line: 3, Character: 4}, "Close 'def'"},
+		{"partial word", "if ready\n  go\n  e", Position{Line: 2, Character: 3}, "Close 'if'"},
+		{"balanced", "def bar\n  \nend", Position{Line: 1, Character: 2}, ""},
+		{"mid statement", "def bar\n  x = ", Position{Line: 1, Character: 6}, ""},
+		{"top level", "puts 1\nend\n", Position{Line: 2, Character: 0}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &TextDocumentItem{URI: "test.cr", Text: tt.text}
+			items := analyzer.GetCompletions(doc, tt.pos).Items
+
+			detail := ""
+			for _, item := range items {
+				if item.Label == "end" && item.Preselect {
+					detail = item.Detail
+				}
+			}
+			if detail != tt.expected {
+				t.Errorf("Expected end item %q, got %q", tt.expected, detail)
+			}
+			if tt.expected != "" && items[0].Label != "end" {
+				t.Errorf("Expected end to be the first item, got %s", items[0].Label)
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_DeclarationCompletionContexts(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	base := `module Greeting
+end
+
+class Animal
+end
+
+enum Color
+  Red
+end
+`
+
+	tests := []struct {
+		name     string
+		line     string
+		include  []string
+		exclude  []string
+		expected int // -1 to skip the count check
+	}{
+		{"superclass", "class Dog < ", []string{"Animal", "Object"}, []string{"Greeting", "Color", "def"}, -1},
+		{"superclass prefix", "class Dog < An", []string{"Animal"}, []string{"Array", "def"}, -1},
+		{"include", "  include ", []string{"Greeting"}, []string{"Animal", "String", "def"}, -1},
+		{"extend prefix", "extend Gr", []string{"Greeting"}, nil, 1},
+		{"def name", "def ", nil, nil, 0},
+		{"class method name", "def self.", nil, nil, 0},
+		{"class name", "class Do", nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &TextDocumentItem{URI: "test.cr", Text: base + tt.line}
+			pos := Position{Line: strings.Count(base, "\n"), Character: len(tt.line)}
+			items := analyzer.GetCompletions(doc, pos).Items
+
+			labels := make(map[string]bool)
+			for _, item := range items {
+				labels[item.Label] = true
+			}
+			for _, label := range tt.include {
+				if !labels[label] {
+					t.Errorf("Expected %s in completions", label)
+				}
+			}
+			for _, label := range tt.exclude {
+				if labels[label] {
+					t.Errorf("Did not expect %s in completions", label)
+				}
+			}
+			if tt.expected >= 0 && len(items) != tt.expected {
+				t.Errorf("Expected %d items, got %d", tt.expected, len(items))
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_FuzzyCompletion(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `def downcase_all
+end
+
+def dc_total
+end
+
+dc
+"hi".dwn`,
+	}
+
+	index := func(items []CompletionItem, label string) int {
+		for i, item := range items {
+			if item.Label == label {
+				return i
+			}
+		}
+		return -1
+	}
+
+	items := analyzer.GetCompletions(doc, Position{Line: 6, Character: 2}).Items
+	prefixed, fuzzy := index(items, "dc_total"), index(items, "downcase_all")
+	if prefixed < 0 || fuzzy < 0 {
+		t.Fatalf("Expected dc_total and downcase_all, got %+v", items)
+	}
+	if prefixed > fuzzy || items[prefixed].SortText >= items[fuzzy].SortText {
+		t.Errorf("Expected the prefix match dc_total to rank above downcase_all")
+	}
+	if index(items, "class") >= 0 {
+		t.Errorf("Did not expect class to match dc")
+	}
+
+	items = analyzer.GetCompletions(doc, Position{Line: 7, Character: 8}).Items
+	if index(items, "downcase") < 0 {
+		t.Errorf("Expected dwn to match downcase")
+	}
+	if index(items, "upcase") >= 0 {
+		t.Errorf("Did not expect dwn to match upcase")
+	}
+}
+
+func TestCrystalAnalyzer_ScopeDistanceCompletion(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Counter
+  def wrap_up
+  end
+
+  def run(items)
+    wage = 1
+    items.each do |wanted|
+      wider = 2
+      w
+    end
+  end
+end`,
+	}
+
+	items := analyzer.GetCompletions(doc, Position{Line: 8, Character: 7}).Items
+	sortText := make(map[string]string)
+	for _, item := range items {
+		sortText[item.Label] = item.SortText
+	}
+
+	// Nearest first: block locals, enclosing locals, members, keywords
+	order := []string{"wanted", "wider", "wage", "wrap_up", "while"}
+	for i := 1; i < len(order); i++ {
+		before, after := sortText[order[i-1]], sortText[order[i]]
+		if before == "" || after == "" {
+			t.Fatalf("Expected %s and %s to be offered, got %+v", order[i-1], order[i], items)
+		}
+		if before >= after {
+			t.Errorf("Expected %s to sort before %s, got %q and %q", order[i-1], order[i], before, after)
+		}
+	}
+}
+
+func TestFuzzyScore(t *testing.T) {
+	tests := []struct {
+		word, label string
+		ok          bool
+	}{
+		{"", "anything", true},
+		{"down", "downcase", true},
+		{"DOWN", "downcase", true},
+		{"dc", "downcase", true},
+		{"dwn", "downcase", true},
+		{"cd", "downcase", false},
+		{"downcasex", "downcase", false},
+	}
+	for _, tt := range tests {
+		if _, ok := fuzzyScore(tt.word, tt.label); ok != tt.ok {
+			t.Errorf("fuzzyScore(%q, %q) matched = %v, want %v", tt.word, tt.label, ok, tt.ok)
+		}
+	}
+
+	prefix, _ := fuzzyScore("down", "downcase")
+	folded, _ := fuzzyScore("DOWN", "downcase")
+	tight, _ := fuzzyScore("case", "downcase")
+	loose, _ := fuzzyScore("dcs", "downcase")
+	if !(prefix > folded && folded > tight && tight > loose) {
+		t.Errorf("Unexpected score order: prefix %d, folded %d, tight %d, loose %d", prefix, folded, tight, loose)
+	}
+}
+
+func TestCrystalAnalyzer_GetOnTypeFormatting(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	tests := []struct {
+		name     string
+		text     string
+		pos      Position
+		expected string // inserted text, "" for no edit
+	}{
+		{"def", "class Foo\n  def bar\n    \nend", Position{Line: 2, Character: 4}, "\n  end"},
+		{"block", "items.each do |item|\n  ", Position{Line: 1, Character: 2}, "\nend"},
+		{"modifier if", "def bar\n  return if done\n  \nend", Position{Line: 2, Character: 2}, ""},
+		{"one-liner", "def bar; end\n", Position{Line: 1, Character: 0}, ""},
+		{"already closed", "def bar\n  \nend", Position{Line: 1, Character: 2}, ""},
+		{"not after the opener", "def bar\n  x = 1\n  ", Position{Line: 2, Character: 2}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &TextDocumentItem{URI: "test.cr", Text: tt.text}
+			edits := analyzer.GetOnTypeFormatting(doc, tt.pos, "\n")
+
+			if tt.expected == "" {
+				if len(edits) != 0 {
+					t.Errorf("Expected no edits, got %+v", edits)
+				}
+				return
+			}
+			if len(edits) != 1 || edits[0].NewText != tt.expected {
+				t.Fatalf("Expected to insert %q, got %+v", tt.expected, edits)
+			}
+			lineEnd := Position{Line: tt.pos.Line, Character: tt.pos.Character}
+			if edits[0].Range.Start != lineEnd || edits[0].Range.End != lineEnd {
+				t.Errorf("Expected the insertion at the end of the cursor line, got %+v", edits[0].Range)
+			}
+		})
+	}
+}
+
+func TestCrystalAnalyzer_FormatDocument(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "nested blocks",
+			input:    "class Foo\ndef bar   \n        if x\nputs 1\n   else\n puts 2\nend\n  end\n      end\n\n\n",
+			expected: "class Foo\n  def bar\n    if x\n      puts 1\n    else\n      puts 2\n    end\n  end\nend\n",
+		},
+		{
+			name:     "case and modifiers",
+			input:    "case x\n    when 1\n  return if y\nwhen 2\n        z\nend",
+			expected: "case x\nwhen 1\n  return if y\nwhen 2\n  z\nend\n",
+		},
+		{
+			name:     "brackets and blocks",
+			input:    "list = [\n1,\n    2,\n]\nlist.each do |i|\nputs i\n end\nlist.map { |i|\ni * 2\n}",
+			expected: "list = [\n  1,\n  2,\n]\nlist.each do |i|\n  puts i\nend\nlist.map { |i|\n  i * 2\n}\n",
+		},
+		{
+			name:     "multi-line strings are kept",
+			input:    "def text\n\"first\n    second  \n\"\nend",
+			expected: "def text\n  \"first\n    second  \n\"\nend\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &TextDocumentItem{URI: "test.cr", Text: tt.input}
+			if got := analyzer.FormatDocument(doc); got != tt.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.expected, got)
+			}
+		})
+	}
+
+	formatted := "def foo\nend\n"
+	if edits := documentEdits(formatted, formatted); len(edits) != 0 {
+		t.Errorf("Expected no edits for formatted text, got %+v", edits)
+	}
+}
+
+func TestCrystalAnalyzer_SpecDocuments(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "file:///project/spec/calculator_spec.cr",
+		Text: `require "./spec_helper"
+
+describe Calculator do
+  context "when adding" do
+    it "handles do and end in descriptions" do
+      result = 1 + 2
+      result.should eq(3)
+    end
+
+    pending "overflow"
+  end
+
+  it "subtracts" { (3 - 1).should eq(2) }
+end
+be
+result.sh
+`,
+	}
+
+	labels := func(doc *TextDocumentItem, pos Position) map[string]bool {
+		found := make(map[string]bool)
+		for _, item := range analyzer.GetCompletions(doc, pos).Items {
+			found[item.Label] = true
+		}
+		return found
+	}
+
+	general := labels(doc, Position{Line: 14, Character: 2})
+	if !general["be_true"] || !general["before_each"] || !general["be_nil"] {
+		t.Errorf("Expected spec DSL completions, got %v", general)
+	}
+	if after := labels(doc, Position{Line: 15, Character: 9}); !after["should"] || !after["should_not"] {
+		t.Errorf("Expected expectation methods after a dot, got %v", after)
+	}
+
+	plain := &TextDocumentItem{URI: "file:///project/src/calculator.cr", Text: "be\n"}
+	if labels(plain, Position{Line: 0, Character: 2})["be_true"] {
+		t.Error("Expected no spec DSL outside of spec files")
+	}
+	required := &TextDocumentItem{URI: "file:///project/check.cr", Text: "require \"spec\"\nbe\n"}
+	if !labels(required, Position{Line: 1, Character: 2})["be_true"] {
+		t.Error("Expected spec DSL in a file requiring spec")
+	}
+
+	tree := analyzer.GetDocumentSymbolTree(doc)
+	if len(tree) != 1 || tree[0].Name != "Calculator" || tree[0].Kind != SymbolKindNamespace || tree[0].Range.End.Line != 13 {
+		t.Fatalf("Expected a Calculator group spanning its block, got %+v", tree)
+	}
+	children := tree[0].Children
+	if len(children) != 2 || children[0].Name != "when adding" || children[1].Name != "subtracts" || children[1].Kind != SymbolKindMethod {
+		t.Fatalf("Unexpected children of Calculator: %+v", children)
+	}
+	examples := children[0].Children
+	if len(examples) != 2 || examples[0].Name != "handles do and end in descriptions" || examples[0].Detail != "it" ||
+		examples[1].Name != "overflow" || examples[1].Detail != "pending" {
+		t.Errorf("Unexpected examples: %+v", examples)
+	}
+
+	flat := analyzer.GetDocumentSymbols(doc)
+	var overflow *SymbolInformation
+	for i := range flat {
+		if flat[i].Name == "overflow" {
+			overflow = &flat[i]
+		}
+	}
+	if overflow == nil || overflow.ContainerName != "when adding" {
+		t.Errorf("Expected the pending example in flat symbols, got %+v", flat)
+	}
+}
+
+// benchmarkDocument builds a document of roughly the given number of lines
+func benchmarkDocument(lines int) *TextDocumentItem {
+	var builder strings.Builder
+	for i := 0; strings.Count(builder.String(), "\n") < lines; i++ {
+		fmt.Fprintf(&builder, `# A documented class
+class Widget%d < Base
+  property name : String = "widget"
+  getter count : Int32
+
+  def initialize(@name : String, @count : Int32)
+  end
+
+  def render(io : IO, indent = 0) : Nil
+    io << name if count > 0
+    [1, 2].each do |x|
+      puts "#{x} items"
+    end
+  end
+end
+
+`, i)
+	}
+	return &TextDocumentItem{URI: "bench.cr", Text: builder.String()}
+}
+
+func BenchmarkAnalyzeDocument(b *testing.B) {
+	analyzer := NewCrystalAnalyzer()
+	doc := benchmarkDocument(2000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		analyzer.AnalyzeDocument(doc)
+		analyzer.GetDocumentSymbols(doc)
+	}
+}
+
+func BenchmarkGetCompletions(b *testing.B) {
+	analyzer := NewCrystalAnalyzer()
+	doc := benchmarkDocument(2000)
+	doc.Text += "widget = Widget1.new(\"a\", 1)\nwidget."
+	pos := Position{Line: strings.Count(doc.Text, "\n"), Character: 7}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		analyzer.GetCompletions(doc, pos)
+	}
+}
+
+func TestCrystalAnalyzer_FoldingRanges(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `# region Models
+class Point
+  # REGION accessors
+  getter x = 0
+  #endregion
+  puts "# region in a string"
+end
+# endregion
+# endregion without a start
+`,
+	}
+
+	expected := []FoldingRange{
+		{StartLine: 0, EndLine: 7, Kind: FoldingRangeKindRegion},
+		{StartLine: 1, EndLine: 5},
+		{StartLine: 2, EndLine: 4, Kind: FoldingRangeKindRegion},
+	}
+	if ranges := analyzer.GetFoldingRanges(doc); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected folding ranges %+v, got %+v", expected, ranges)
+	}
+}
+
+func TestCrystalAnalyzer_SectionFolding(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `case value
+when 1
+  if value
+    one
+  else
+    other
+  end
+when 2
+  two
+else
+  many
+end
+begin
+  risky
+  more
+rescue ex
+  handle ex
+ensure
+  cleanup
+end
+`,
+	}
+
+	expected := []FoldingRange{
+		{StartLine: 0, EndLine: 10},
+		{StartLine: 1, EndLine: 6},
+		{StartLine: 2, EndLine: 5},
+		{StartLine: 7, EndLine: 8},
+		{StartLine: 9, EndLine: 10},
+		{StartLine: 12, EndLine: 18},
+		{StartLine: 15, EndLine: 16},
+		{StartLine: 17, EndLine: 18},
+	}
+	if ranges := analyzer.GetFoldingRanges(doc); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected folding ranges %+v, got %+v", expected, ranges)
+	}
+}
+
+func TestCrystalAnalyzer_EnumSymbols(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `enum Color
+  Red
+  Green = 2 # the default
+  Blue
+
+  def warm?
+    red?
+  end
+end`,
+	}
+
+	symbols := analyzer.GetDocumentSymbolTree(doc)
+	if len(symbols) != 1 || symbols[0].Name != "Color" || symbols[0].Kind != SymbolKindEnum {
+		t.Fatalf("Expected the Color enum, got %+v", symbols)
+	}
+
+	type child struct {
+		name string
+		kind int
+	}
+	var children []child
+	for _, symbol := range symbols[0].Children {
+		children = append(children, child{symbol.Name, symbol.Kind})
+	}
+	expected := []child{
+		{"Red", SymbolKindEnumMember},
+		{"Green", SymbolKindEnumMember},
+		{"Blue", SymbolKindEnumMember},
+		{"warm?", SymbolKindMethod},
+	}
+	if !reflect.DeepEqual(children, expected) {
+		t.Errorf("Expected children %v, got %v", expected, children)
+	}
+	if detail := symbols[0].Children[1].Detail; detail != "2" {
+		t.Errorf("Expected Green's value as its detail, got %q", detail)
+	}
+
+	var flat []child
+	for _, symbol := range analyzer.GetDocumentSymbols(doc) {
+		flat = append(flat, child{symbol.Name, symbol.Kind})
+	}
+	expected = append([]child{{"Color", SymbolKindEnum}}, expected...)
+	if !reflect.DeepEqual(flat, expected) {
+		t.Errorf("Expected flat symbols %v, got %v", expected, flat)
+	}
+}
+
+func TestCrystalAnalyzer_RescueCompletions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class ParseError < Exception
+end
+
+begin
+  parse
+rescue e : Arg
+  log e
+rescue error : IO::Error | Pars
+ensure
+  done
+end
+`,
+	}
+
+	labels := func(pos Position) []string {
+		var labels []string
+		for _, item := range analyzer.GetCompletions(doc, pos).Items {
+			labels = append(labels, item.Label)
+		}
+		return labels
+	}
+
+	if got := labels(Position{Line: 5, Character: 14}); !reflect.DeepEqual(got, []string{"ArgumentError"}) {
+		t.Errorf("Expected only ArgumentError after `rescue e : Arg`, got %v", got)
+	}
+	if got := labels(Position{Line: 7, Character: 31}); !reflect.DeepEqual(got, []string{"ParseError", "JSON::ParseException"}) {
+		t.Errorf("Expected exceptions after a union member, got %v", got)
+	}
+
+	hasVariable := func(pos Position, name string) bool {
+		for _, item := range analyzer.GetCompletions(doc, pos).Items {
+			if item.Label == name && item.Kind == CompletionItemKindVariable {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasVariable(Position{Line: 6, Character: 6}, "e") {
+		t.Error("Expected the rescued exception in scope in its rescue body")
+	}
+	if hasVariable(Position{Line: 9, Character: 3}, "e") {
+		t.Error("Expected the rescued exception out of scope in the ensure section")
+	}
+}
+
+func TestCrystalAnalyzer_NamespaceCompletions(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `module Foo
+  VERSION = "1.0"
+
+  class Bar
+    def self.build
+    end
+
+    def run
+    end
+  end
+
+  def self.setup
+  end
+end
+
+Foo::
+Foo::Ba
+x = flag ? 1 :
+`,
+	}
+
+	labels := func(pos Position) []string {
+		var labels []string
+		for _, item := range analyzer.GetCompletions(doc, pos).Items {
+			labels = append(labels, item.Label)
+		}
+		return labels
+	}
+
+	if got := labels(Position{Line: 15, Character: 5}); !reflect.DeepEqual(got, []string{"Bar", "VERSION", "setup"}) {
+		t.Errorf("Expected the members of Foo, got %v", got)
+	}
+	if got := labels(Position{Line: 16, Character: 7}); !reflect.DeepEqual(got, []string{"Bar"}) {
+		t.Errorf("Expected Foo::Ba to narrow to Bar, got %v", got)
+	}
+
+	doc.Text = strings.Replace(doc.Text, "Foo::Ba\n", "Foo::Bar::\n", 1)
+	if got := labels(Position{Line: 16, Character: 10}); !reflect.DeepEqual(got, []string{"build"}) {
+		t.Errorf("Expected the class methods of Foo::Bar, got %v", got)
+	}
+
+	if got := labels(Position{Line: 17, Character: 14}); len(got) != 0 {
+		t.Errorf("Expected no completions after a ternary's colon, got %v", got)
+	}
+}
+
+func TestCrystalAnalyzer_QualifiedNames(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Bar
+  def other
+  end
+end
+
+module Foo; class Bar; def baz; end; end; end
+
+module Foo
+  def self.make
+    Bar.new.
+  end
+end
+
+Foo::Bar.new.baz
+Foo::Bar.new.
+`,
+	}
+
+	locations := analyzer.GetDefinition(doc, Position{Line: 13, Character: 6})
+	if len(locations) != 1 || locations[0].Range.Start != (Position{Line: 5, Character: 18}) {
+		t.Errorf("Expected Foo::Bar to resolve to the nested class, got %+v", locations)
+	}
+	locations = analyzer.GetDefinition(doc, Position{Line: 13, Character: 14})
+	if len(locations) != 1 || locations[0].Range.Start.Line != 5 {
+		t.Errorf("Expected baz to resolve to Foo::Bar#baz, got %+v", locations)
+	}
+
+	hasBaz := func(pos Position) bool {
+		for _, item := range analyzer.GetCompletions(doc, pos).Items {
+			if item.Label == "baz" {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasBaz(Position{Line: 14, Character: 13}) {
+		t.Error("Expected Foo::Bar.new to complete baz")
+	}
+	// Inside Foo, Bar names Foo::Bar rather than the top-level class
+	if !hasBaz(Position{Line: 9, Character: 12}) {
+		t.Error("Expected Bar.new inside Foo to complete baz")
+	}
+	if typeName := analyzer.inferTypeOfExpression("Foo::Bar.new", doc, Position{Line: 13}); typeName != "Foo::Bar" {
+		t.Errorf("Expected Foo::Bar, got %q", typeName)
+	}
+}
+
+func TestCrystalAnalyzer_TryBlock(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `name : String? = ENV["NAME"]?
+name.try do |value|
+  value.
+end
+name.try { |value| value }
+`,
+	}
+
+	if typeName := analyzer.inferTypeOfExpression("value", doc, Position{Line: 2, Character: 2}); typeName != "String" {
+		t.Errorf("Expected the try block to yield String, got %q", typeName)
+	}
+	if typeName := analyzer.inferTypeOfExpression("value", doc, Position{Line: 4, Character: 20}); typeName != "String" {
+		t.Errorf("Expected the try brace block to yield String, got %q", typeName)
+	}
+
+	labels := make(map[string]bool)
+	for _, item := range analyzer.GetCompletions(doc, Position{Line: 2, Character: 8}).Items {
+		labels[item.Label] = true
+	}
+	if !labels["upcase"] || !labels["presence"] || !labels["try"] {
+		t.Errorf("Expected String methods inside the try block, got %v", labels)
+	}
+	if labels["not_nil!"] {
+		t.Error("Expected no not_nil! on the non-nil block parameter")
+	}
+
+	if typeName := analyzer.inferTypeOfExpression(`"".presence`, doc, Position{Line: 4}); typeName != "String?" {
+		t.Errorf("Expected presence to return String?, got %q", typeName)
+	}
+}
+
+func TestCrystalAnalyzer_MethodHoverOwner(t *testing.T) {
+	analyzer := NewCrystalAnalyzer()
+
+	doc := &TextDocumentItem{
+		URI: "test.cr",
+		Text: `class Animal
+  def speak
+  end
+end
+
+class Dog < Animal
+  def fetch
+    speak
+  end
+end
+
+dog = Dog.new
+dog.speak
+dog.fetch
+`,
+	}
+
+	tests := []struct {
+		name     string
+		pos      Position
+		expected string
+	}{
+		{"inherited call", Position{Line: 12, Character: 6}, "**speak** - public method defined in class Animal, inherited by Dog"},
+		{"own method", Position{Line: 13, Character: 6}, "**fetch** - public method defined in class Dog"},
+		{"call without receiver", Position{Line: 7, Character: 5}, "**speak** - public method defined in class Animal, inherited by Dog"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hover := analyzer.GetHover(doc, tt.pos)
+			if hover == nil || len(hover.Contents) != 1 || hover.Contents[0] != tt.expected {
+				t.Errorf("Expected %q, got %+v", tt.expected, hover)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package lsp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// BuiltinMethod describes a method of a standard library type. Signatures use
+// the type's generic parameter names (T, K, V) as in the Crystal API docs.
+type BuiltinMethod struct {
+	Name      string
+	Signature string
+	Doc       string
+}
+
+// objectMethods are available on every value
+var objectMethods = []BuiltinMethod{
+	{"to_s", "to_s : String", "Returns a string representation of this object."},
+	{"inspect", "inspect : String", "Returns a developer-friendly string representation."},
+	{"class", "class : Class", "Returns the runtime class of this object."},
+	{"hash", "hash : UInt64", "Returns a hash value for this object."},
+	{"dup", "dup : self", "Returns a shallow copy of this object."},
+	{"clone", "clone : self", "Returns a deep copy of this object."},
+	{"nil?", "nil? : Bool", "Returns true if this object is nil."},
+	{"is_a?", "is_a?(type : Class) : Bool", "Returns true if this object is an instance of the given type."},
+	{"responds_to?", "responds_to?(name : Symbol) : Bool", "Returns true if this object has a method with the given name."},
+	{"tap", "tap(&block : self -> _) : self", "Yields self to the block, then returns self."},
+	{"try", "try(&block : self -> U) : U?", "Yields self to the block unless it is nil, and returns the block's value."},
+	{"==", "==(other) : Bool", "Returns true if this object is equal to other."},
+	{"!=", "!=(other) : Bool", "Returns true if this object is not equal to other."},
+}
+
+// exceptionTypes are the standard library exceptions offered after
+// `rescue ex : `
+var exceptionTypes = []string{
+	"Exception", "ArgumentError", "DivisionByZeroError", "IndexError",
+	"KeyError", "NilAssertionError", "NotImplementedError", "OverflowError",
+	"TypeCastError", "IO::Error", "IO::EOFError", "IO::TimeoutError",
+	"File::Error", "File::NotFoundError", "JSON::ParseException",
+}
+
+// isExceptionName reports whether a type is named like an exception
+func isExceptionName(name string) bool {
+	return strings.HasSuffix(name, "Error") || strings.HasSuffix(name, "Exception")
+}
+
+// builtinMethods holds the completion tables for standard library types,
+// keyed by the type name without generic arguments
+var builtinMethods = map[string][]BuiltinMethod{
+	"String": {
+		{"size", "size : Int32", "Returns the number of characters in this string."},
+		{"bytesize", "bytesize : Int32", "Returns the number of bytes in this string."},
+		{"empty?", "empty? : Bool", "Returns true if this string has no characters."},
+		{"presence", "presence : self?", "Returns self, or nil if this string is empty."},
+		{"blank?", "blank? : Bool", "Returns true if this string is empty or only whitespace."},
+		{"downcase", "downcase : String", "Returns a new string with all characters downcased."},
+		{"upcase", "upcase : String", "Returns a new string with all characters upcased."},
+		{"capitalize", "capitalize : String", "Returns a new string with the first character upcased."},
+		{"strip", "strip : String", "Returns a new string with leading and trailing whitespace removed."},
+		{"lstrip", "lstrip : String", "Returns a new string with leading whitespace removed."},
+		{"rstrip", "rstrip : String", "Returns a new string with trailing whitespace removed."},
+		{"split", "split(separator : String) : Array(String)", "Splits this string by the given separator."},
+		{"gsub", "gsub(pattern, replacement) : String", "Replaces every match of pattern with replacement."},
+		{"sub", "sub(pattern, replacement) : String", "Replaces the first match of pattern with replacement."},
+		{"match", "match(regex : Regex) : Regex::MatchData?", "Matches this string against a regex."},
+		{"includes?", "includes?(search : String) : Bool", "Returns true if this string contains search."},
+		{"starts_with?", "starts_with?(prefix : String) : Bool", "Returns true if this string starts with prefix."},
+		{"ends_with?", "ends_with?(suffix : String) : Bool", "Returns true if this string ends with suffix."},
+		{"to_i", "to_i : Int32", "Parses this string as an integer."},
+		{"to_f", "to_f : Float64", "Parses this string as a float."},
+		{"to_s", "to_s : String", "Returns self."},
+		{"chars", "chars : Array(Char)", "Returns the characters of this string."},
+		{"bytes", "bytes : Array(UInt8)", "Returns the bytes of this string."},
+		{"lines", "lines : Array(String)", "Splits this string into lines."},
+		{"reverse", "reverse : String", "Returns this string reversed."},
+		{"each_char", "each_char(&block : Char -> _) : Nil", "Yields each character of this string."},
+	},
+	"Array": {
+		{"size", "size : Int32", "Returns the number of elements."},
+		{"empty?", "empty? : Bool", "Returns true if the array has no elements."},
+		{"first", "first : T", "Returns the first element; raises if empty."},
+		{"first?", "first? : T?", "Returns the first element, or nil if empty."},
+		{"last", "last : T", "Returns the last element; raises if empty."},
+		{"last?", "last? : T?", "Returns the last element, or nil if empty."},
+		{"push", "push(value : T) : self", "Appends value to the end of the array."},
+		{"<<", "<<(value : T) : self", "Appends value to the end of the array."},
+		{"pop", "pop : T", "Removes and returns the last element."},
+		{"shift", "shift : T", "Removes and returns the first element."},
+		{"unshift", "unshift(value : T) : self", "Prepends value to the array."},
+		{"insert", "insert(index : Int, value : T) : self", "Inserts value at the given index."},
+		{"delete", "delete(value : T) : T?", "Removes all occurrences of value."},
+		{"delete_at", "delete_at(index : Int) : T", "Removes the element at index."},
+		{"clear", "clear : self", "Removes all elements."},
+		{"concat", "concat(other : Array(T)) : self", "Appends the elements of other."},
+		{"join", "join(separator : String = \"\") : String", "Joins the elements into a string."},
+		{"map", "map(&block : T -> U) : Array(U)", "Returns a new array with the results of the block."},
+		{"select", "select(&block : T -> _) : Array(T)", "Returns the elements for which the block is truthy."},
+		{"reject", "reject(&block : T -> _) : Array(T)", "Returns the elements for which the block is falsey."},
+		{"find", "find(&block : T -> _) : T?", "Returns the first element for which the block is truthy."},
+		{"each", "each(&block : T -> _) : Nil", "Yields each element."},
+		{"each_with_index", "each_with_index(&block : T, Int32 -> _) : Nil", "Yields each element with its index."},
+		{"includes?", "includes?(value : T) : Bool", "Returns true if the array contains value."},
+		{"sort", "sort : Array(T)", "Returns a sorted copy of the array."},
+		{"reverse", "reverse : Array(T)", "Returns a reversed copy of the array."},
+		{"shuffle", "shuffle : Array(T)", "Returns a shuffled copy of the array."},
+		{"uniq", "uniq : Array(T)", "Returns a copy without duplicate elements."},
+		{"flatten", "flatten : Array", "Returns a flattened copy of a nested array."},
+		{"compact", "compact : Array", "Returns a copy without nil elements."},
+		{"sum", "sum : T", "Returns the sum of the elements."},
+	},
+	"Hash": {
+		{"size", "size : Int32", "Returns the number of key-value pairs."},
+		{"empty?", "empty? : Bool", "Returns true if the hash has no entries."},
+		{"keys", "keys : Array(K)", "Returns the keys."},
+		{"values", "values : Array(V)", "Returns the values."},
+		{"has_key?", "has_key?(key : K) : Bool", "Returns true if the hash contains key."},
+		{"has_value?", "has_value?(value : V) : Bool", "Returns true if the hash contains value."},
+		{"fetch", "fetch(key : K, default : V) : V", "Returns the value for key, or default if missing."},
+		{"[]?", "[]?(key : K) : V?", "Returns the value for key, or nil if missing."},
+		{"merge", "merge(other : Hash(K, V)) : Hash(K, V)", "Returns a new hash with the entries of other added."},
+		{"delete", "delete(key : K) : V?", "Removes key and returns its value."},
+		{"clear", "clear : self", "Removes all entries."},
+		{"each", "each(&block : K, V -> _) : Nil", "Yields each key and value."},
+		{"each_key", "each_key(&block : K -> _) : Nil", "Yields each key."},
+		{"each_value", "each_value(&block : V -> _) : Nil", "Yields each value."},
+		{"select", "select(&block : K, V -> _) : Hash(K, V)", "Returns the entries for which the block is truthy."},
+		{"reject", "reject(&block : K, V -> _) : Hash(K, V)", "Returns the entries for which the block is falsey."},
+		{"transform_keys", "transform_keys(&block : K -> K2) : Hash(K2, V)", "Returns a new hash with transformed keys."},
+		{"transform_values", "transform_values(&block : V -> V2) : Hash(K, V2)", "Returns a new hash with transformed values."},
+		{"invert", "invert : Hash(V, K)", "Returns a new hash with keys and values swapped."},
+		{"to_a", "to_a : Array(Tuple(K, V))", "Returns the entries as an array of tuples."},
+	},
+	"Int": {
+		{"abs", "abs : self", "Returns the absolute value."},
+		{"ceil", "ceil : self", "Returns self."},
+		{"floor", "floor : self", "Returns self."},
+		{"round", "round : self", "Returns self."},
+		{"to_i", "to_i : Int32", "Converts to Int32."},
+		{"to_i64", "to_i64 : Int64", "Converts to Int64."},
+		{"to_f", "to_f : Float64", "Converts to Float64."},
+		{"to_s", "to_s : String", "Returns the decimal representation."},
+		{"times", "times(&block : self -> _) : Nil", "Yields each number from 0 up to self, exclusive."},
+		{"upto", "upto(to : Int, &block : self -> _) : Nil", "Yields each number from self up to to."},
+		{"downto", "downto(to : Int, &block : self -> _) : Nil", "Yields each number from self down to to."},
+		{"step", "step(*, to, by, &block) : Nil", "Yields numbers from self to to in steps of by."},
+		{"even?", "even? : Bool", "Returns true if self is even."},
+		{"odd?", "odd? : Bool", "Returns true if self is odd."},
+		{"zero?", "zero? : Bool", "Returns true if self is zero."},
+		{"succ", "succ : self", "Returns self + 1."},
+		{"pred", "pred : self", "Returns self - 1."},
+		{"+", "+(other : Int) : self", "Adds other."},
+		{"-", "-(other : Int) : self", "Subtracts other."},
+		{"*", "*(other : Int) : self", "Multiplies by other."},
+		{"/", "/(other : Int) : Float64", "Divides by other."},
+		{"//", "//(other : Int) : self", "Floor-divides by other."},
+		{"%", "%(other : Int) : self", "Returns the remainder of division by other."},
+		{"**", "**(exponent : Int) : self", "Raises self to exponent."},
+	},
+	"Float": {
+		{"abs", "abs : self", "Returns the absolute value."},
+		{"ceil", "ceil : self", "Rounds up to the nearest integer value."},
+		{"floor", "floor : self", "Rounds down to the nearest integer value."},
+		{"round", "round(digits : Int = 0) : self", "Rounds to the given number of digits."},
+		{"to_i", "to_i : Int32", "Truncates to Int32."},
+		{"to_f", "to_f : Float64", "Converts to Float64."},
+		{"to_s", "to_s : String", "Returns the decimal representation."},
+		{"nan?", "nan? : Bool", "Returns true if self is not a number."},
+		{"infinite?", "infinite? : Int32?", "Returns 1 or -1 if self is infinite, nil otherwise."},
+		{"zero?", "zero? : Bool", "Returns true if self is zero."},
+		{"+", "+(other : Number) : self", "Adds other."},
+		{"-", "-(other : Number) : self", "Subtracts other."},
+		{"*", "*(other : Number) : self", "Multiplies by other."},
+		{"/", "/(other : Number) : self", "Divides by other."},
+		{"**", "**(exponent : Number) : self", "Raises self to exponent."},
+	},
+	"Bool": {
+		{"to_s", "to_s : String", "Returns \"true\" or \"false\"."},
+		{"&", "&(other : Bool) : Bool", "Logical and, without short-circuiting."},
+		{"|", "|(other : Bool) : Bool", "Logical or, without short-circuiting."},
+		{"^", "^(other : Bool) : Bool", "Logical exclusive or."},
+	},
+	"Symbol": {
+		{"to_s", "to_s : String", "Returns the symbol's name."},
+		{"size", "size : Int32", "Returns the number of characters in the symbol's name."},
+		{"inspect", "inspect : String", "Returns the symbol literal, e.g. `:foo`."},
+	},
+	"Char": {
+		{"ord", "ord : Int32", "Returns the codepoint of this char."},
+		{"to_s", "to_s : String", "Returns a string containing this char."},
+		{"to_i", "to_i : Int32", "Returns the digit value of this char."},
+		{"upcase", "upcase : Char", "Returns the upcased char."},
+		{"downcase", "downcase : Char", "Returns the downcased char."},
+		{"letter?", "letter? : Bool", "Returns true if this char is a letter."},
+		{"number?", "number? : Bool", "Returns true if this char is a number."},
+		{"whitespace?", "whitespace? : Bool", "Returns true if this char is whitespace."},
+		{"ascii?", "ascii? : Bool", "Returns true if this char is ASCII."},
+	},
+	"Range": {
+		{"begin", "begin : B", "Returns the start of the range."},
+		{"end", "end : E", "Returns the end of the range."},
+		{"each", "each(&block : B -> _) : Nil", "Yields each value in the range."},
+		{"to_a", "to_a : Array(B)", "Returns the values of the range as an array."},
+		{"includes?", "includes?(value) : Bool", "Returns true if value is within the range."},
+		{"size", "size : Int32", "Returns the number of values in the range."},
+		{"sum", "sum : B", "Returns the sum of the values in the range."},
+		{"step", "step(by) : Iterator", "Iterates the range in steps of by."},
+		{"map", "map(&block : B -> U) : Array(U)", "Returns an array with the results of the block."},
+		{"excludes_end?", "excludes_end? : Bool", "Returns true for `...` ranges."},
+	},
+	"Set": {
+		{"size", "size : Int32", "Returns the number of elements."},
+		{"empty?", "empty? : Bool", "Returns true if the set has no elements."},
+		{"add", "add(object : T) : self", "Adds object to the set."},
+		{"<<", "<<(object : T) : self", "Adds object to the set."},
+		{"delete", "delete(object : T) : self", "Removes object from the set."},
+		{"includes?", "includes?(object : T) : Bool", "Returns true if the set contains object."},
+		{"each", "each(&block : T -> _) : Nil", "Yields each element."},
+		{"to_a", "to_a : Array(T)", "Returns the elements as an array."},
+		{"|", "|(other : Set(U)) : Set(T | U)", "Returns the union of both sets."},
+		{"&", "&(other : Set) : Set(T)", "Returns the intersection of both sets."},
+		{"subset_of?", "subset_of?(other : Set) : Bool", "Returns true if every element is in other."},
+	},
+}
+
+// builtinTableName maps a concrete standard library type to the table that
+// describes it, e.g. Int64 uses the shared Int table
+func builtinTableName(typeName string) string {
+	typeName = baseTypeName(typeName)
+	switch {
+	case strings.HasPrefix(typeName, "Int") || strings.HasPrefix(typeName, "UInt"):
+		return "Int"
+	case strings.HasPrefix(typeName, "Float"):
+		return "Float"
+	}
+	return typeName
+}
+
+// builtinReturnType returns the return type of a standard library method on
+// typeName, with `self` and the generic parameters T, K and V substituted. It
+// returns an empty string when the method is unknown or its return type
+// depends on a generic argument typeName doesn't supply.
+func builtinReturnType(typeName, name string) string {
+	methods := append(builtinMethods[builtinTableName(typeName)], objectMethods...)
+	for _, method := range methods {
+		if method.Name != name {
+			continue
+		}
+
+		returnType := signatureReturnType(method.Signature[len(method.Name):])
+		if returnType == "" {
+			return ""
+		}
+		switch returnType {
+		case "self":
+			return strings.TrimSuffix(typeName, "?")
+		case "self?":
+			return strings.TrimSuffix(typeName, "?") + "?"
+		}
+
+		returnType = substituteGenerics(returnType, typeName)
+		if unresolvedGenericRegexp.MatchString(returnType) {
+			return ""
+		}
+		return returnType
+	}
+	return ""
+}
+
+var (
+	genericParamRegexps = map[string]*regexp.Regexp{
+		"T": regexp.MustCompile(`\bT\b`),
+		"K": regexp.MustCompile(`\bK\b`),
+		"V": regexp.MustCompile(`\bV\b`),
+		"B": regexp.MustCompile(`\bB\b`),
+		"E": regexp.MustCompile(`\bE\b`),
+	}
+	unresolvedGenericRegexp = regexp.MustCompile(`\b[TKVUBE_]\b`)
+)
+
+// substituteGenerics replaces the generic parameters T, K and V for a Hash,
+// or B and E for a Range, in text with the arguments typeName supplies, e.g. T with String for
+// `Array(String)`. Parameters without an argument are left as they are.
+func substituteGenerics(text, typeName string) string {
+	args := genericArguments(typeName)
+	params := []string{"T"}
+	switch baseTypeName(typeName) {
+	case "Hash":
+		params = []string{"K", "V"}
+	case "Range":
+		params = []string{"B", "E"}
+	}
+	for i, param := range params {
+		if i < len(args) {
+			text = genericParamRegexps[param].ReplaceAllLiteralString(text, args[i])
+		}
+	}
+	return text
+}
+
+// signatureReturnType returns the type after the parameter list of a
+// signature, e.g. `Array(String)` for `(separator : String) : Array(String)`
+func signatureReturnType(rest string) string {
+	if strings.HasPrefix(rest, "(") {
+		depth := 0
+		for i, ch := range rest {
+			if ch == '(' {
+				depth++
+			} else if ch == ')' {
+				depth--
+				if depth == 0 {
+					rest = rest[i+1:]
+					break
+				}
+			}
+		}
+	}
+	if !strings.HasPrefix(rest, " : ") {
+		return ""
+	}
+	return strings.TrimSpace(rest[len(" : "):])
+}
+
+// getBuiltInMethodsForType returns completion items for a standard library
+// type's methods followed by the methods every object has. The generic
+// parameters in the signatures are replaced with the type's arguments, so
+// `Array(Int32)#first` reads `first : Int32`. It returns nil if the type has
+// no method table.
+func getBuiltInMethodsForType(typeName string) []CompletionItem {
+	methods, exists := builtinMethods[builtinTableName(typeName)]
+	if !exists {
+		return nil
+	}
+
+	items := builtinCompletionItems(methods)
+	for i := range items {
+		items[i].Detail = substituteGenerics(items[i].Detail, typeName)
+	}
+	return append(items, getBuiltInObjectMethods()...)
+}
+
+// getBuiltInObjectMethods returns completion items for the methods every
+// object has
+func getBuiltInObjectMethods() []CompletionItem {
+	return builtinCompletionItems(objectMethods)
+}
+
+func builtinCompletionItems(methods []BuiltinMethod) []CompletionItem {
+	items := make([]CompletionItem, 0, len(methods))
+	for _, method := range methods {
+		items = append(items, CompletionItem{
+			Label:         method.Name,
+			Kind:          CompletionItemKindMethod,
+			Detail:        method.Signature,
+			Documentation: method.Doc,
+		})
+	}
+	return items
+}
@@ -0,0 +1,65 @@
+package lsp
+
+import "strings"
+
+// GetCodeActions returns quick fixes for the given diagnostics
+func (a *CrystalAnalyzer) GetCodeActions(doc *TextDocumentItem, diagnostics []Diagnostic) []CodeAction {
+	actions := []CodeAction{}
+	lines := strings.Split(doc.Text, "\n")
+
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Message == unexpectedEndMessage {
+			if action := removeEndAction(doc.URI, lines, diagnostic); action != nil {
+				actions = append(actions, *action)
+			}
+		}
+	}
+
+	return actions
+}
+
+// removeEndAction deletes the stray `end` a diagnostic points at. When the
+// `end` is alone on its line the whole line goes, including its newline.
+func removeEndAction(uri string, lines []string, diagnostic Diagnostic) *CodeAction {
+	start := diagnostic.Range.Start
+	if start.Line >= len(lines) {
+		return nil
+	}
+
+	// Only delete what is actually an `end`
+	line := lines[start.Line]
+	offset := byteOffset(line, start.Character)
+	if !strings.HasPrefix(line[offset:], "end") {
+		return nil
+	}
+
+	deletion := Range{
+		Start: start,
+		End:   Position{Line: start.Line, Character: start.Character + len("end")},
+	}
+	if strings.TrimSpace(line) == "end" {
+		switch {
+		case start.Line+1 < len(lines):
+			deletion = Range{Start: Position{Line: start.Line}, End: Position{Line: start.Line + 1}}
+		case start.Line > 0:
+			// The last line has no newline of its own; take the previous one
+			previous := lines[start.Line-1]
+			deletion = Range{
+				Start: Position{Line: start.Line - 1, Character: encodedLen(previous)},
+				End:   Position{Line: start.Line, Character: encodedLen(line)},
+			}
+		default:
+			deletion = Range{End: Position{Character: encodedLen(line)}}
+		}
+	}
+
+	return &CodeAction{
+		Title:       "Remove unexpected 'end'",
+		Kind:        CodeActionKindQuickFix,
+		Diagnostics: []Diagnostic{diagnostic},
+		IsPreferred: true,
+		Edit: &WorkspaceEdit{
+			Changes: map[string][]TextEdit{uri: {{Range: deletion, NewText: ""}}},
+		},
+	}
+}
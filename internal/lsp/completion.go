@@ -0,0 +1,474 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// completionContextKind classifies what the cursor is completing
+type completionContextKind int
+
+const (
+	// completionContextNone means no completions should be offered, e.g.
+	// inside a comment or string literal
+	completionContextNone completionContextKind = iota
+	// completionContextGeneral completes keywords, types and local names
+	completionContextGeneral
+	// completionContextMethod completes methods after `receiver.`
+	completionContextMethod
+	// completionContextSuperclass completes the type after `class Foo < `
+	completionContextSuperclass
+	// completionContextModule completes the module after `include` or
+	// `extend`
+	completionContextModule
+	// completionContextException completes the exception type after
+	// `rescue ex : `
+	completionContextException
+	// completionContextNamespace completes the members of a type after
+	// `Type::`
+	completionContextNamespace
+)
+
+// completionContext describes the text around the cursor
+type completionContext struct {
+	Kind completionContextKind
+	// Prefix is the code before the cursor on the current line. Inside a
+	// string interpolation it starts after the opening `#{`.
+	Prefix string
+	// Word is the partial identifier being typed
+	Word string
+	// CloseBlock is the keyword of the innermost open block that an `end`
+	// typed at the cursor would close, or "" when none is missing one
+	CloseBlock string
+	// Namespace is the type before `::` in a namespace context, e.g.
+	// `Foo::Bar` for `Foo::Bar::Ba`
+	Namespace string
+}
+
+var (
+	methodAccessRegexp = regexp.MustCompile(`[^.]\.[\p{L}\p{N}_]*[\?!]?$`)
+	superclassRegexp   = regexp.MustCompile(`^\s*(?:(?:private|abstract)\s+)*(?:class|struct)\s+[\p{L}\p{N}_:]+(?:\([^)]*\))?\s*<\s*[\p{L}\p{N}_:]*$`)
+	includeRegexp      = regexp.MustCompile(`^\s*(?:include|extend)\s+[\p{L}\p{N}_:]*$`)
+	namespaceRegexp    = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_:@$])((?:\p{Lu}[\p{L}\p{N}_]*::)+)[\p{L}\p{N}_]*$`)
+	rescueTypeRegexp   = regexp.MustCompile(`^\s*rescue\s+[\p{L}\p{N}_]+\s*:\s*(?:[\p{L}\p{N}_:]+\s*\|\s*)*[\p{L}\p{N}_:]*$`)
+	// Names being declared have nothing to complete
+	declarationRegexp = regexp.MustCompile(`^\s*(?:(?:private|protected|abstract)\s+)*(?:(?:def\s+(?:self\.)?)|(?:(?:class|struct|module|enum|macro|annotation|alias)\s+))[\p{L}\p{N}_:]*[\?!=]?$`)
+)
+
+// analyzeCompletionContext determines what kind of completion applies at pos
+func (a *CrystalAnalyzer) analyzeCompletionContext(doc *TextDocumentItem, pos Position) completionContext {
+	lines := strings.Split(doc.Text, "\n")
+	if pos.Line >= len(lines) {
+		return completionContext{Kind: completionContextNone}
+	}
+
+	currentLine := lines[pos.Line]
+	prefix := currentLine[:byteOffset(currentLine, pos.Character)]
+
+	// Comments and strings get no completions, except for code inside a
+	// string interpolation
+	if token := findTokenAt(a.documentContext(doc).Tokens, pos); token != nil {
+		switch token.Type {
+		case TokenComment, TokenChar:
+			return completionContext{Kind: completionContextNone}
+		case TokenString, TokenRegex:
+			interpolation := openInterpolation(prefix)
+			if interpolation < 0 {
+				return completionContext{Kind: completionContextNone}
+			}
+			prefix = prefix[interpolation+2:]
+		}
+	}
+
+	context := completionContext{
+		Kind:   completionContextGeneral,
+		Prefix: prefix,
+		Word:   trailingWord(prefix),
+	}
+	namespace := namespaceRegexp.FindStringSubmatch(prefix)
+	switch {
+	case declarationRegexp.MatchString(prefix):
+		return completionContext{Kind: completionContextNone}
+	case rescueTypeRegexp.MatchString(prefix):
+		context.Kind = completionContextException
+	case namespace != nil:
+		context.Kind = completionContextNamespace
+		context.Namespace = strings.TrimSuffix(namespace[1], "::")
+	case strings.HasSuffix(prefix, ":") && !strings.HasSuffix(prefix, "::"):
+		// A lone `:` starts a symbol, a named argument's value or a
+		// ternary's else branch; only `::` asks for completions
+		return completionContext{Kind: completionContextNone}
+	case superclassRegexp.MatchString(prefix):
+		context.Kind = completionContextSuperclass
+	case includeRegexp.MatchString(prefix):
+		context.Kind = completionContextModule
+	case methodAccessRegexp.MatchString(prefix):
+		context.Kind = completionContextMethod
+	}
+
+	// `end` is only valid as the first word of a statement
+	if context.Kind == completionContextGeneral && strings.TrimSpace(prefix) == context.Word {
+		if block, ok := unclosedBlockAt(a.documentContext(doc).Tokens, pos); ok {
+			context.CloseBlock = block.Keyword
+		}
+	}
+	return context
+}
+
+// namespaceCompletions returns the nested types, constants, enum members and
+// class methods of the type named namespace, looked up locally and then in
+// the workspace index
+func (a *CrystalAnalyzer) namespaceCompletions(doc *TextDocumentItem, namespace string) []CompletionItem {
+	var items []CompletionItem
+
+	classInfo := a.findClass(namespace)
+	var nested []*ClassInfo
+	if classInfo != nil {
+		for qualifiedName, candidate := range a.documentClasses {
+			if parentNamespace(qualifiedName, a.documentClasses) == classInfo.QualifiedName {
+				nested = append(nested, candidate)
+			}
+		}
+	} else if a.index != nil {
+		indexed, ok := a.index.FindClass(namespace, doc.URI)
+		if !ok {
+			return items
+		}
+		classInfo = indexed.Class
+		for _, candidate := range a.index.Classes() {
+			if strings.TrimSuffix(candidate.Class.QualifiedName, "::"+candidate.Class.Name) == classInfo.QualifiedName &&
+				candidate.Class.QualifiedName != candidate.Class.Name {
+				nested = append(nested, candidate.Class)
+			}
+		}
+	} else {
+		return items
+	}
+
+	sort.Slice(nested, func(i, j int) bool { return nested[i].Name < nested[j].Name })
+	for _, nestedClass := range nested {
+		items = append(items, classCompletionItem(nestedClass, nestedClass.KindName()+" in "+classInfo.QualifiedName))
+	}
+
+	for _, name := range sortedConstantNames(classInfo.Constants) {
+		constant := classInfo.Constants[name]
+		items = append(items, CompletionItem{
+			Label:         constant.Name,
+			Kind:          CompletionItemKindConstant,
+			Detail:        a.constantDetail(constant, doc),
+			Documentation: constant.Documentation,
+		})
+	}
+	for _, member := range classInfo.Members {
+		items = append(items, CompletionItem{
+			Label:         member.Name,
+			Kind:          CompletionItemKindEnumMember,
+			Detail:        classInfo.QualifiedName,
+			Documentation: member.Documentation,
+		})
+	}
+
+	if a.documentClasses[classInfo.QualifiedName] == classInfo {
+		items = append(items, a.getMethodsForType(classInfo.QualifiedName, false, true)...)
+		return items
+	}
+	for _, name := range sortedMethodNames(classInfo) {
+		for _, method := range classInfo.Methods[name] {
+			if method.IsClassMethod && method.Visibility == "public" {
+				items = append(items, CompletionItem{
+					Label:         method.Name,
+					Kind:          CompletionItemKindMethod,
+					Detail:        generateMethodSignature(method),
+					Documentation: method.Documentation,
+				})
+				break
+			}
+		}
+	}
+	return items
+}
+
+// sortedConstantNames returns the names of constants in alphabetical order
+func sortedConstantNames(constants map[string]*ConstantInfo) []string {
+	names := make([]string, 0, len(constants))
+	for name := range constants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unclosedBlockAt returns the opener of the innermost block open at pos,
+// provided the document has more block openers than `end`s. A block that is
+// closed further down needs no `end` at the cursor.
+func unclosedBlockAt(tokens []Token, pos Position) (blockEvent, bool) {
+	var stack []blockEvent
+	balance := 0
+
+	for _, event := range scanBlockEvents(tokens) {
+		before := positionBefore(Position{Line: event.Line, Character: event.Character}, pos)
+		if event.Keyword == "end" {
+			balance--
+			if before && len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		balance++
+		if before {
+			stack = append(stack, event)
+		}
+	}
+
+	if balance <= 0 || len(stack) == 0 {
+		return blockEvent{}, false
+	}
+	return stack[len(stack)-1], true
+}
+
+// ResolveCompletionItem fills in the documentation and detail of an item
+// returned without them, by completing again at the position its data
+// records. Items that can no longer be found are returned unchanged.
+func (a *CrystalAnalyzer) ResolveCompletionItem(doc *TextDocumentItem, item CompletionItem) CompletionItem {
+	if item.Data == nil {
+		return item
+	}
+
+	for _, candidate := range a.GetCompletions(doc, item.Data.Position).Items {
+		if candidate.Label == item.Label && candidate.Kind == item.Kind {
+			item.Detail = candidate.Detail
+			item.Documentation = candidate.Documentation
+			break
+		}
+	}
+	return item
+}
+
+// findTokenAt returns the token that contains pos. A position just past a
+// comment, or past an unterminated string at the end of the document, is
+// considered inside it since typing there extends the token.
+func findTokenAt(tokens []Token, pos Position) *Token {
+	for i := range tokens {
+		token := &tokens[i]
+		if token.Type != TokenComment && token.Type != TokenString && token.Type != TokenChar && token.Type != TokenRegex {
+			continue
+		}
+
+		start := token.Position
+		if pos.Line < start.Line || (pos.Line == start.Line && pos.Character <= start.Character) {
+			return nil
+		}
+
+		// Compute where the token ends; strings may span lines
+		end := Position{Line: start.Line, Character: start.Character + token.Length}
+		if newline := strings.LastIndex(token.Value, "\n"); newline >= 0 {
+			end = Position{
+				Line:      start.Line + strings.Count(token.Value, "\n"),
+				Character: encodedLen(token.Value[newline+1:]),
+			}
+		}
+
+		if pos.Line < end.Line || (pos.Line == end.Line && pos.Character < end.Character) {
+			return token
+		}
+		if pos.Line == end.Line && pos.Character == end.Character && !isClosedToken(token) {
+			return token
+		}
+	}
+	return nil
+}
+
+// isClosedToken reports whether a token has a terminator, so that the
+// position right after it is outside of it
+func isClosedToken(token *Token) bool {
+	if token.Type == TokenChar {
+		return len(token.Value) >= 3 && strings.HasSuffix(token.Value, "'")
+	}
+	if token.Type == TokenRegex {
+		// Regexes are only lexed once their closing slash is found
+		return true
+	}
+	if token.Type != TokenString || len(token.Value) < 2 {
+		return false
+	}
+	quote := token.Value[0]
+	if quote != '"' && quote != '%' {
+		// A heredoc's opening or its body through the terminator
+		return true
+	}
+	return token.Value[len(token.Value)-1] == quote && token.Value[len(token.Value)-2] != '\\'
+}
+
+// openInterpolation returns the index of the `#{` that is still open at the
+// end of text, or -1
+func openInterpolation(text string) int {
+	depth := 0
+	for i := len(text) - 1; i >= 0; i-- {
+		switch text[i] {
+		case '}':
+			depth++
+		case '{':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if i > 0 && text[i-1] == '#' {
+				return i - 1
+			}
+		}
+	}
+	return -1
+}
+
+// fuzzyMatch reports whether every character of word appears in label in
+// order, ignoring case
+func fuzzyMatch(word, label string) bool {
+	_, ok := fuzzyScore(word, label)
+	return ok
+}
+
+// fuzzyScore rates how well label matches the typed word. Prefix matches
+// rank above everything else, case-sensitive ones first. Other subsequence
+// matches score higher the more of their characters are consecutive or start
+// a word (`dc` in `downcase` rather than `index_of_char`).
+func fuzzyScore(word, label string) (int, bool) {
+	switch {
+	case strings.HasPrefix(label, word):
+		return 3000, true
+	case strings.HasPrefix(strings.ToLower(label), strings.ToLower(word)):
+		return 2000, true
+	}
+
+	target := []rune(strings.ToLower(label))
+	score := 1000
+	next := 0
+	previous := -2
+	for _, r := range strings.ToLower(word) {
+		for next < len(target) && target[next] != r {
+			next++
+		}
+		if next == len(target) {
+			return 0, false
+		}
+		switch {
+		case next == previous+1:
+			score += 10
+		case next == 0 || target[next-1] == '_':
+			score += 5
+		default:
+			score -= next - previous
+		}
+		previous = next
+		next++
+	}
+	if score < 1 {
+		score = 1
+	}
+	return score, true
+}
+
+// Scope distances of general completions, nearest first
+const (
+	scopeBlock     = iota // locals of the innermost block
+	scopeEnclosing        // locals of the enclosing method or file
+	scopeMember           // methods, macros and constants of the enclosing type
+	scopeGlobal           // keywords, snippets and types
+)
+
+// rankCompletionItems drops the items that don't match word and orders the
+// rest by fuzzyScore. Within the same kind of match, case-sensitive prefix,
+// prefix or subsequence, items nearer in scope come first, looked up by
+// label in scopes; unlisted labels count as nearest. The original order is
+// kept among equals, and the order is fixed through SortText, since clients
+// sort by it.
+func rankCompletionItems(items []CompletionItem, word string, scopes map[string]int) []CompletionItem {
+	type ranked struct {
+		item  CompletionItem
+		score int
+		match int
+		scope int
+	}
+
+	candidates := make([]ranked, 0, len(items))
+	for _, item := range items {
+		score, ok := fuzzyScore(word, item.Label)
+		if !ok {
+			continue
+		}
+		match := 0
+		switch {
+		case strings.HasPrefix(item.Label, word):
+			match = 2
+		case strings.HasPrefix(strings.ToLower(item.Label), strings.ToLower(word)):
+			match = 1
+		}
+		candidates = append(candidates, ranked{item, score, match, scopes[item.Label]})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].match != candidates[j].match {
+			return candidates[i].match > candidates[j].match
+		}
+		if candidates[i].scope != candidates[j].scope {
+			return candidates[i].scope < candidates[j].scope
+		}
+		return candidates[i].score > candidates[j].score
+	})
+
+	result := make([]CompletionItem, len(candidates))
+	for i, candidate := range candidates {
+		result[i] = candidate.item
+		result[i].SortText = fmt.Sprintf("%05d", i)
+		result[i].FilterText = result[i].Label
+	}
+	return result
+}
+
+// trailingWord returns the identifier characters at the end of text
+func trailingWord(text string) string {
+	start := len(text)
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(text[:start])
+		if !isWordChar(r) {
+			break
+		}
+		start -= size
+	}
+	return text[start:]
+}
+
+// blockSnippet is a snippet completion for a common block construct
+type blockSnippet struct {
+	Label  string
+	Detail string
+	Body   string
+}
+
+var blockSnippets = []blockSnippet{
+	{"def", "def ... end", "def ${1:name}\n  $0\nend"},
+	{"class", "class ... end", "class ${1:Name}\n  $0\nend"},
+	{"module", "module ... end", "module ${1:Name}\n  $0\nend"},
+	{"if", "if ... end", "if ${1:condition}\n  $0\nend"},
+	{"case", "case ... when ... end", "case ${1:value}\nwhen ${2:pattern}\n  $0\nend"},
+	{"each", "each do |x| ... end", "each do |${1:x}|\n  $0\nend"},
+}
+
+// snippetCompletions returns the block snippets whose label starts with word
+func snippetCompletions(word string) []CompletionItem {
+	var items []CompletionItem
+	for _, snippet := range blockSnippets {
+		if !fuzzyMatch(word, snippet.Label) {
+			continue
+		}
+		items = append(items, CompletionItem{
+			Label:            snippet.Label,
+			Kind:             CompletionItemKindSnippet,
+			Detail:           snippet.Detail,
+			InsertText:       snippet.Body,
+			InsertTextFormat: InsertTextFormatSnippet,
+		})
+	}
+	return items
+}
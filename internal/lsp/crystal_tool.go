@@ -1,11 +1,16 @@
 package lsp
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -35,7 +40,7 @@ type ContextInfo struct {
 }
 
 // GetContext uses `crystal tool context` to get type information at a position
-func (ct *CrystalTool) GetContext(filename string, line, column int) (*ContextInfo, error) {
+func (ct *CrystalTool) GetContext(ctx context.Context, filename string, line, column int) (*ContextInfo, error) {
 	if ct.crystalPath == "" {
 		return nil, fmt.Errorf("crystal executable not found")
 	}
@@ -47,11 +52,14 @@ func (ct *CrystalTool) GetContext(filename string, line, column int) (*ContextIn
 	}
 
 	// Run crystal tool context
-	cmd := exec.Command(ct.crystalPath, "tool", "context",
+	cmd := exec.CommandContext(ctx, ct.crystalPath, "tool", "context",
 		fmt.Sprintf("--cursor=%d:%d", line+1, column+1), absPath)
 	cmd.Dir = ct.workspaceRoot
 
 	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("crystal tool context failed: %v", err)
 	}
@@ -67,7 +75,7 @@ func (ct *CrystalTool) GetContext(filename string, line, column int) (*ContextIn
 }
 
 // GetImplementations uses `crystal tool implementations` to find implementations
-func (ct *CrystalTool) GetImplementations(filename string, line, column int) ([]Location, error) {
+func (ct *CrystalTool) GetImplementations(ctx context.Context, filename string, line, column int) ([]Location, error) {
 	if ct.crystalPath == "" {
 		return nil, fmt.Errorf("crystal executable not found")
 	}
@@ -77,11 +85,14 @@ func (ct *CrystalTool) GetImplementations(filename string, line, column int) ([]
 		return nil, err
 	}
 
-	cmd := exec.Command(ct.crystalPath, "tool", "implementations",
+	cmd := exec.CommandContext(ctx, ct.crystalPath, "tool", "implementations",
 		fmt.Sprintf("--cursor=%d:%d", line+1, column+1), absPath)
 	cmd.Dir = ct.workspaceRoot
 
 	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("crystal tool implementations failed: %v", err)
 	}
@@ -90,15 +101,40 @@ func (ct *CrystalTool) GetImplementations(filename string, line, column int) ([]
 }
 
 // FormatCode uses `crystal tool format` to format Crystal code
-func (ct *CrystalTool) FormatCode(filename string) (string, error) {
+func (ct *CrystalTool) FormatCode(ctx context.Context, filename string) (string, error) {
+	if ct.crystalPath == "" {
+		return "", fmt.Errorf("crystal executable not found")
+	}
+
+	cmd := exec.CommandContext(ctx, ct.crystalPath, "tool", "format", filename)
+	cmd.Dir = ct.workspaceRoot
+
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return "", fmt.Errorf("crystal tool format failed: %v", err)
+	}
+
+	return string(output), nil
+}
+
+// FormatSource formats Crystal source with `crystal tool format -` and
+// returns the result. It fails when the source doesn't parse on its own.
+func (ct *CrystalTool) FormatSource(ctx context.Context, source string) (string, error) {
 	if ct.crystalPath == "" {
 		return "", fmt.Errorf("crystal executable not found")
 	}
 
-	cmd := exec.Command(ct.crystalPath, "tool", "format", filename)
+	cmd := exec.CommandContext(ctx, ct.crystalPath, "tool", "format", "-")
 	cmd.Dir = ct.workspaceRoot
+	cmd.Stdin = strings.NewReader(source)
 
 	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
 	if err != nil {
 		return "", fmt.Errorf("crystal tool format failed: %v", err)
 	}
@@ -106,8 +142,141 @@ func (ct *CrystalTool) FormatCode(filename string) (string, error) {
 	return string(output), nil
 }
 
+// CheckFile uses `crystal build --no-codegen` to type-check a file and
+// returns the compiler errors that point into it
+func (ct *CrystalTool) CheckFile(ctx context.Context, filename string) ([]Diagnostic, error) {
+	if ct.crystalPath == "" {
+		return nil, fmt.Errorf("crystal executable not found")
+	}
+
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, ct.crystalPath, "build", "--no-codegen", "--error-trace", absPath)
+	cmd.Dir = ct.workspaceRoot
+
+	// The compiler exits non-zero when it reports errors; only a failure to
+	// run it at all is an error here
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("crystal build failed: %v", err)
+	}
+
+	// Ranges are widened to the token the compiler points at, using the
+	// text it compiled
+	source, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCompilerOutput(string(output), absPath, string(source)), nil
+}
+
+var (
+	// compilerLocationRegexp matches `file:line:col: message` and the
+	// `In file:line:col` frames of an error trace
+	compilerLocationRegexp = regexp.MustCompile(`^(?:In )?(.+?):(\d+):(\d+)(?::\s*(.*))?$`)
+	// compilerLegacyRegexp matches the older `Error in file:line: message`
+	compilerLegacyRegexp = regexp.MustCompile(`^Error in (.+?):(\d+):\s*(.+)$`)
+	compilerErrorRegexp  = regexp.MustCompile(`^Error:\s*(.+)$`)
+)
+
+// parseCompilerOutput converts compiler output into diagnostics for the
+// file at path, whose contents are text. Output may hold several errors. In
+// an `--error-trace` stack the frames run from the outermost call to the
+// failing expression, so the last frame inside the file is where its error
+// is reported, with the message from the following `Error:` line.
+func parseCompilerOutput(output, path, text string) []Diagnostic {
+	var diagnostics []Diagnostic
+	var frame *Position
+	tokens := NewCrystalLexer(text).Tokenize()
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		if match := compilerLegacyRegexp.FindStringSubmatch(line); match != nil {
+			if samePath(match[1], path) {
+				lineNum, _ := strconv.Atoi(match[2])
+				diagnostics = append(diagnostics, compilerDiagnostic(Position{Line: lineNum - 1}, match[3], tokens))
+			}
+			frame = nil
+			continue
+		}
+
+		if match := compilerErrorRegexp.FindStringSubmatch(line); match != nil {
+			if frame != nil {
+				diagnostics = append(diagnostics, compilerDiagnostic(*frame, match[1], tokens))
+			}
+			frame = nil
+			continue
+		}
+
+		match := compilerLocationRegexp.FindStringSubmatch(line)
+		if match == nil || !samePath(match[1], path) {
+			continue
+		}
+		lineNum, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		position := Position{Line: lineNum - 1, Character: column - 1}
+
+		if match[4] != "" {
+			diagnostics = append(diagnostics, compilerDiagnostic(position, match[4], tokens))
+			continue
+		}
+		frame = &position
+	}
+
+	return diagnostics
+}
+
+// compilerDiagnostic builds an error diagnostic at a compiler location. The
+// range covers the token at that position, or a single character when there
+// is none.
+func compilerDiagnostic(position Position, message string, tokens []Token) Diagnostic {
+	diagnostic := Diagnostic{
+		Range: Range{
+			Start: position,
+			End:   Position{Line: position.Line, Character: position.Character + 1},
+		},
+		Severity: DiagnosticSeverityError,
+		Message:  message,
+		Source:   "crystal",
+	}
+
+	for _, token := range tokens {
+		if token.Position.Line != position.Line || strings.Contains(token.Value, "\n") {
+			continue
+		}
+		if position.Character >= token.Position.Character && position.Character < token.Position.Character+token.Length {
+			diagnostic.Range = Range{
+				Start: token.Position,
+				End:   Position{Line: token.Position.Line, Character: token.Position.Character + token.Length},
+			}
+			break
+		}
+	}
+
+	return diagnostic
+}
+
+// samePath reports whether a path printed by the compiler refers to path
+func samePath(reported, path string) bool {
+	if !filepath.IsAbs(reported) {
+		if abs, err := filepath.Abs(reported); err == nil {
+			reported = abs
+		}
+	}
+	return filepath.Clean(reported) == filepath.Clean(path)
+}
+
 // GetTypeHierarchy uses `crystal tool hierarchy` to get type hierarchy
-func (ct *CrystalTool) GetTypeHierarchy(filename string, line, column int) ([]string, error) {
+func (ct *CrystalTool) GetTypeHierarchy(ctx context.Context, filename string, line, column int) ([]string, error) {
 	if ct.crystalPath == "" {
 		return nil, fmt.Errorf("crystal executable not found")
 	}
@@ -117,11 +286,14 @@ func (ct *CrystalTool) GetTypeHierarchy(filename string, line, column int) ([]st
 		return nil, err
 	}
 
-	cmd := exec.Command(ct.crystalPath, "tool", "hierarchy",
+	cmd := exec.CommandContext(ctx, ct.crystalPath, "tool", "hierarchy",
 		fmt.Sprintf("--cursor=%d:%d", line+1, column+1), absPath)
 	cmd.Dir = ct.workspaceRoot
 
 	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("crystal tool hierarchy failed: %v", err)
 	}
@@ -129,6 +301,71 @@ func (ct *CrystalTool) GetTypeHierarchy(filename string, line, column int) ([]st
 	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
 }
 
+// hierarchyNode is one type in the tree printed by `crystal tool hierarchy`
+type hierarchyNode struct {
+	Name  string
+	Kind  int
+	Depth int
+}
+
+// hierarchyLineRegexp matches a type line such as `  +- class Foo (8 bytes)`;
+// the indentation before the marker gives the depth in the tree
+var hierarchyLineRegexp = regexp.MustCompile(`^(.*?)(?:\+- |- )(class|struct|module)\s+(\S+)`)
+
+// parseHierarchy parses the indented tree printed by `crystal tool hierarchy`
+func parseHierarchy(lines []string) []hierarchyNode {
+	var nodes []hierarchyNode
+	for _, line := range lines {
+		match := hierarchyLineRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		kind := SymbolKindClass
+		switch match[2] {
+		case "struct":
+			kind = SymbolKindStruct
+		case "module":
+			kind = SymbolKindModule
+		}
+		nodes = append(nodes, hierarchyNode{Name: match[3], Kind: kind, Depth: len(match[1])})
+	}
+	return nodes
+}
+
+// hierarchyRelatives returns the parent and direct children of the type named
+// name in a parsed hierarchy
+func hierarchyRelatives(nodes []hierarchyNode, name string) (*hierarchyNode, []hierarchyNode) {
+	for i, node := range nodes {
+		if node.Name != name && !strings.HasSuffix(node.Name, "::"+name) {
+			continue
+		}
+
+		var parent *hierarchyNode
+		for j := i - 1; j >= 0; j-- {
+			if nodes[j].Depth < node.Depth {
+				parent = &nodes[j]
+				break
+			}
+		}
+
+		var children []hierarchyNode
+		childDepth := -1
+		for _, next := range nodes[i+1:] {
+			if next.Depth <= node.Depth {
+				break
+			}
+			if childDepth < 0 {
+				childDepth = next.Depth
+			}
+			if next.Depth == childDepth {
+				children = append(children, next)
+			}
+		}
+		return parent, children
+	}
+	return nil, nil
+}
+
 // parseTextContext parses text-based context output
 func (ct *CrystalTool) parseTextContext(output string) (*ContextInfo, error) {
 	lines := strings.Split(strings.TrimSpace(output), "\n")
@@ -160,32 +397,103 @@ func (ct *CrystalTool) parseTextContext(output string) (*ContextInfo, error) {
 	return info, nil
 }
 
+// toolLocationRegexp matches `file:line:column`; the path is matched greedily
+// so a Windows drive letter's colon stays part of it
+var toolLocationRegexp = regexp.MustCompile(`^(.+):(\d+):(\d+)$`)
+
 // parseLocations parses location output from Crystal tools
 func (ct *CrystalTool) parseLocations(output string) ([]Location, error) {
-	var locations []Location
+	locations := []Location{}
 	lines := strings.Split(strings.TrimSpace(output), "\n")
 
 	for _, line := range lines {
-		// Parse format: filename:line:column
-		parts := strings.Split(line, ":")
-		if len(parts) >= 3 {
-			// Convert to URI format
-			uri := "file://" + filepath.ToSlash(parts[0])
-
-			location := Location{
-				URI: uri,
-				Range: Range{
-					Start: Position{Line: 0, Character: 0}, // Would need to parse line/column
-					End:   Position{Line: 0, Character: 0},
-				},
-			}
-			locations = append(locations, location)
+		match := toolLocationRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
 		}
+
+		lineNum, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		position := Position{Line: lineNum - 1, Character: column - 1}
+
+		locations = append(locations, Location{
+			URI:   pathToURI(match[1]),
+			Range: Range{Start: position, End: position},
+		})
 	}
 
 	return locations, nil
 }
 
+// tempFilePattern names the copies of unsaved documents documentFile writes
+const tempFilePattern = ".crystal-ls-*.cr"
+
+// isTempCopy reports whether path is one of documentFile's temporary copies,
+// which file watchers and workspace scans see like any other source file
+func isTempCopy(path string) bool {
+	matched, _ := filepath.Match(tempFilePattern, filepath.Base(path))
+	return matched
+}
+
+// documentFile returns a path on disk holding the document's current text.
+// Saved documents use their own file; unsaved changes are written to a
+// temporary file beside it so relative requires still resolve. The returned
+// cleanup function removes any temporary file.
+func documentFile(doc *TextDocumentItem) (string, func(), error) {
+	path := uriToPath(doc.URI)
+	if onDisk, err := os.ReadFile(path); err == nil && string(onDisk) == doc.Text {
+		return path, func() {}, nil
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), tempFilePattern)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(doc.Text); err != nil {
+		os.Remove(file.Name())
+		return "", nil, err
+	}
+	return file.Name(), func() { os.Remove(file.Name()) }, nil
+}
+
+// documentLocations points locations in the file at path, which may be a
+// temporary copy from documentFile, back at the document's URI
+func documentLocations(locations []Location, path, uri string) []Location {
+	for i := range locations {
+		if samePath(uriToPath(locations[i].URI), path) {
+			locations[i].URI = uri
+		}
+	}
+	return locations
+}
+
+// uriToPath converts a file:// URI to a local file path
+func uriToPath(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return uri
+	}
+
+	path := parsed.Path
+	// file:///C:/dir becomes /C:/dir; drop the slash before the drive letter
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+// pathToURI converts a local file path to a file:// URI
+func pathToURI(path string) string {
+	path = filepath.ToSlash(path)
+	// Windows paths gain a leading slash: C:/dir becomes /C:/dir
+	if len(path) >= 2 && path[1] == ':' {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
 // findCrystalExecutable finds the Crystal executable in PATH
 func findCrystalExecutable() string {
 	// Try common Crystal executable names
@@ -213,6 +521,12 @@ func findCrystalExecutable() string {
 	return ""
 }
 
+// SetCrystalPath uses the given compiler executable instead of the one
+// found on PATH
+func (ct *CrystalTool) SetCrystalPath(path string) {
+	ct.crystalPath = path
+}
+
 // IsCrystalAvailable checks if Crystal compiler is available
 func (ct *CrystalTool) IsCrystalAvailable() bool {
 	return ct.crystalPath != ""
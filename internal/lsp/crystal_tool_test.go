@@ -0,0 +1,257 @@
+package lsp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCompilerOutput(t *testing.T) {
+	path, _ := filepath.Abs("app.cr")
+	other, _ := filepath.Abs("lib.cr")
+
+	output := `Showing last frame. Use --error-trace for full trace.
+
+In ` + other + `:2:3
+
+ 2 | helper(1)
+     ^
+In ` + path + `:5:9
+
+ 5 | value.upcase
+           ^-----
+Error: undefined method 'upcase' for Int32
+
+` + path + `:9:1: unexpected token: end
+` + other + `:1:1: ignored`
+
+	text := "require \"./lib\"\n\nvalue = 1\n\nvalue = value.upcase\n"
+
+	diagnostics := parseCompilerOutput(output, path, text)
+	if len(diagnostics) != 2 {
+		t.Fatalf("Expected 2 diagnostics, got %d: %+v", len(diagnostics), diagnostics)
+	}
+
+	first := diagnostics[0]
+	if first.Message != "undefined method 'upcase' for Int32" {
+		t.Errorf("Unexpected message %q", first.Message)
+	}
+	// The range covers the `value` token the compiler points at
+	expected := Range{Start: Position{Line: 4, Character: 8}, End: Position{Line: 4, Character: 13}}
+	if first.Range != expected {
+		t.Errorf("Expected the error at %+v, got %+v", expected, first.Range)
+	}
+
+	second := diagnostics[1]
+	if second.Message != "unexpected token: end" || second.Range.Start.Line != 8 {
+		t.Errorf("Unexpected diagnostic %+v", second)
+	}
+}
+
+func TestParseCompilerOutput_MultipleErrors(t *testing.T) {
+	path, _ := filepath.Abs("app.cr")
+	text := "foo(1)\nbar = baz\n"
+
+	output := "In " + path + ":1:1\n\nError: undefined method 'foo'\n\n" +
+		"In " + path + ":2:7\n\nError: undefined local variable or method 'baz'\n" +
+		"Error in " + path + ":2: old style error\n"
+
+	diagnostics := parseCompilerOutput(output, path, text)
+	if len(diagnostics) != 3 {
+		t.Fatalf("Expected 3 diagnostics, got %d: %+v", len(diagnostics), diagnostics)
+	}
+
+	expected := []Range{
+		{Start: Position{Line: 0, Character: 0}, End: Position{Line: 0, Character: 3}},
+		{Start: Position{Line: 1, Character: 6}, End: Position{Line: 1, Character: 9}},
+		{Start: Position{Line: 1, Character: 0}, End: Position{Line: 1, Character: 3}},
+	}
+	for i, want := range expected {
+		if diagnostics[i].Range != want {
+			t.Errorf("Expected diagnostic %d at %+v, got %+v", i, want, diagnostics[i].Range)
+		}
+		if diagnostics[i].Severity != DiagnosticSeverityError {
+			t.Errorf("Expected diagnostic %d to be an error", i)
+		}
+	}
+}
+
+func TestURIToPath(t *testing.T) {
+	if path := uriToPath("file:///home/user/my%20app/main.cr"); path != filepath.FromSlash("/home/user/my app/main.cr") {
+		t.Errorf("Unexpected path %q", path)
+	}
+	if path := uriToPath("file:///C:/src/main.cr"); path != filepath.FromSlash("C:/src/main.cr") {
+		t.Errorf("Unexpected Windows path %q", path)
+	}
+}
+
+func TestDocumentFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.cr")
+	if err := os.WriteFile(path, []byte("puts 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := &TextDocumentItem{URI: "file://" + filepath.ToSlash(path), Text: "puts 1\n"}
+	saved, cleanup, err := documentFile(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if saved != path {
+		t.Errorf("Expected the saved file to be used, got %q", saved)
+	}
+
+	doc.Text = "puts 2\n"
+	unsaved, cleanup, err := documentFile(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsaved == path || filepath.Dir(unsaved) != dir || !isTempCopy(unsaved) {
+		t.Errorf("Expected a temporary file beside the document, got %q", unsaved)
+	}
+	if content, _ := os.ReadFile(unsaved); string(content) != doc.Text {
+		t.Errorf("Expected the temporary file to hold the unsaved text, got %q", content)
+	}
+	cleanup()
+	if _, err := os.Stat(unsaved); !os.IsNotExist(err) {
+		t.Error("Expected the temporary file to be removed")
+	}
+
+	locations := []Location{
+		{URI: pathToURI(unsaved)},
+		{URI: pathToURI(filepath.Join(dir, "other.cr"))},
+	}
+	locations = documentLocations(locations, unsaved, doc.URI)
+	if locations[0].URI != doc.URI || locations[1].URI == doc.URI {
+		t.Errorf("Expected only the temporary file to map back to the document, got %+v", locations)
+	}
+}
+
+func TestCrystalTool_ParseLocations(t *testing.T) {
+	tool := &CrystalTool{}
+
+	output := "2 implementations found\n/home/user/app/src/a.cr:3:5\nC:\\src\\b.cr:10:1\n"
+	locations, err := tool.parseLocations(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 2 {
+		t.Fatalf("Expected 2 locations, got %d: %+v", len(locations), locations)
+	}
+
+	if locations[0].URI != "file:///home/user/app/src/a.cr" {
+		t.Errorf("Unexpected URI %q", locations[0].URI)
+	}
+	if locations[0].Range.Start != (Position{Line: 2, Character: 4}) {
+		t.Errorf("Expected 2:4, got %+v", locations[0].Range.Start)
+	}
+	if locations[1].Range.Start != (Position{Line: 9, Character: 0}) {
+		t.Errorf("Expected the drive letter colon to be kept in the path, got %+v", locations[1])
+	}
+}
+
+func TestParseHierarchy(t *testing.T) {
+	output := []string{
+		"- class Object (4 bytes)",
+		"  |",
+		"  +- class Reference (4 bytes)",
+		"  |  |",
+		"  |  +- class Animal (8 bytes)",
+		"  |     |",
+		"  |     +- class Dog (8 bytes)",
+		"  |     |  |",
+		"  |     |  +- class Puppy (8 bytes)",
+		"  |     |",
+		"  |     +- class Cat (8 bytes)",
+		"  |",
+		"  +- struct Value",
+	}
+
+	nodes := parseHierarchy(output)
+	if len(nodes) != 7 {
+		t.Fatalf("Expected 7 types, got %d: %+v", len(nodes), nodes)
+	}
+	if nodes[6].Kind != SymbolKindStruct {
+		t.Errorf("Expected Value to be a struct, got kind %d", nodes[6].Kind)
+	}
+
+	parent, children := hierarchyRelatives(nodes, "Animal")
+	if parent == nil || parent.Name != "Reference" {
+		t.Errorf("Expected Reference as the parent of Animal, got %+v", parent)
+	}
+	if len(children) != 2 || children[0].Name != "Dog" || children[1].Name != "Cat" {
+		t.Errorf("Expected Dog and Cat as children of Animal, got %+v", children)
+	}
+
+	if parent, children := hierarchyRelatives(nodes, "Missing"); parent != nil || children != nil {
+		t.Error("Expected no relatives for an unknown type")
+	}
+}
+
+func TestRangeFormattingEdits(t *testing.T) {
+	// A stand-in for `crystal tool format` that collapses repeated spaces
+	// and rejects an unterminated block
+	format := func(source string) (string, error) {
+		if strings.Contains(source, "def") && !strings.Contains(source, "end") {
+			return "", errors.New("unexpected EOF")
+		}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSuffix(source, "\n"), "\n") {
+			indent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+			lines = append(lines, indent+strings.Join(strings.Fields(line), " "))
+		}
+		return strings.Join(lines, "\n") + "\n", nil
+	}
+
+	text := "class Foo\n  def bar\n    x  =  1\n    y =   2\n  end\nend"
+
+	tests := []struct {
+		name     string
+		rng      Range
+		expected []TextEdit
+	}{
+		{
+			name: "partial lines expand to whole lines",
+			rng:  Range{Start: Position{Line: 2, Character: 6}, End: Position{Line: 3, Character: 3}},
+			expected: []TextEdit{{
+				Range:   Range{Start: Position{Line: 2, Character: 0}, End: Position{Line: 3, Character: 11}},
+				NewText: "    x = 1\n    y = 2",
+			}},
+		},
+		{
+			name: "selection ending at a line start",
+			rng:  Range{Start: Position{Line: 2, Character: 0}, End: Position{Line: 3, Character: 0}},
+			expected: []TextEdit{{
+				Range:   Range{Start: Position{Line: 2, Character: 0}, End: Position{Line: 2, Character: 11}},
+				NewText: "    x = 1",
+			}},
+		},
+		{
+			name:     "partial expression",
+			rng:      Range{Start: Position{Line: 1, Character: 0}, End: Position{Line: 2, Character: 0}},
+			expected: []TextEdit{},
+		},
+		{
+			name:     "already formatted",
+			rng:      Range{Start: Position{Line: 4, Character: 0}, End: Position{Line: 5, Character: 3}},
+			expected: []TextEdit{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edits := rangeFormattingEdits(text, tt.rng, format)
+			if len(edits) != len(tt.expected) {
+				t.Fatalf("Expected %d edits, got %+v", len(tt.expected), edits)
+			}
+			for i := range edits {
+				if edits[i] != tt.expected[i] {
+					t.Errorf("Expected %+v, got %+v", tt.expected[i], edits[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,840 @@
+package lsp
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// unexpectedEndMessage is reported for an `end` that closes no block
+const unexpectedEndMessage = "Unexpected 'end'"
+
+// DiagnosticOptions selects which of the analyzer's checks run
+type DiagnosticOptions struct {
+	SyntaxErrors      bool
+	UndefinedVariable bool
+	StructureBalance  bool
+	BracketBalance    bool
+
+	// AssignmentInCondition warns about `if x = 5` where `==` was likely
+	// meant. It can be turned off for code that relies on the
+	// `while line = gets` idiom.
+	AssignmentInCondition bool
+}
+
+// defaultDiagnosticOptions enables every check
+func defaultDiagnosticOptions() DiagnosticOptions {
+	return DiagnosticOptions{
+		SyntaxErrors:          true,
+		UndefinedVariable:     true,
+		StructureBalance:      true,
+		BracketBalance:        true,
+		AssignmentInCondition: true,
+	}
+}
+
+// Apply returns the options with every check named in settings overridden
+func (o DiagnosticOptions) Apply(settings DiagnosticSettings) DiagnosticOptions {
+	override := func(value *bool, current bool) bool {
+		if value == nil {
+			return current
+		}
+		return *value
+	}
+
+	return DiagnosticOptions{
+		SyntaxErrors:          override(settings.SyntaxErrors, o.SyntaxErrors),
+		UndefinedVariable:     override(settings.UndefinedVariable, o.UndefinedVariable),
+		StructureBalance:      override(settings.StructureBalance, o.StructureBalance),
+		BracketBalance:        override(settings.BracketBalance, o.BracketBalance),
+		AssignmentInCondition: override(settings.AssignmentInCondition, o.AssignmentInCondition),
+	}
+}
+
+// checkStructureBalance reports block openers without a matching `end` and
+// `end` keywords that close nothing. Openers are classified by the lexer, so
+// keywords inside strings or comments and trailing modifiers such as
+// `return 1 if done` are not counted.
+func (a *CrystalAnalyzer) checkStructureBalance(tokens []Token) []Diagnostic {
+	var diagnostics []Diagnostic
+	var stack []blockEvent
+
+	for _, event := range scanBlockEvents(tokens) {
+		if event.Keyword != "end" {
+			stack = append(stack, event)
+			continue
+		}
+
+		if len(stack) == 0 {
+			diagnostics = append(diagnostics, Diagnostic{
+				Range:    keywordRange(event),
+				Severity: DiagnosticSeverityError,
+				Message:  unexpectedEndMessage,
+				Source:   "crystal-lsp",
+			})
+			continue
+		}
+		stack = stack[:len(stack)-1]
+	}
+
+	for _, open := range stack {
+		diagnostics = append(diagnostics, Diagnostic{
+			Range:    keywordRange(open),
+			Severity: DiagnosticSeverityError,
+			Message:  fmt.Sprintf("Unclosed '%s' (missing 'end')", open.Keyword),
+			Source:   "crystal-lsp",
+		})
+	}
+
+	return diagnostics
+}
+
+// keywordRange returns the range covering the keyword of a block event
+func keywordRange(event blockEvent) Range {
+	return Range{
+		Start: Position{Line: event.Line, Character: event.Character},
+		End:   Position{Line: event.Line, Character: event.Character + len(event.Keyword)},
+	}
+}
+
+// bracketPairs maps each closing bracket to its opener
+var bracketPairs = map[string]string{")": "(", "]": "[", "}": "{"}
+
+// checkBracketBalance reports unmatched `(`, `[` and `{` and stray closers.
+// Brackets inside strings and comments are not tokens and are ignored. A
+// `{` may open either a block or a hash literal; when the keyword pass has
+// already found a problem, brace errors are left out since they are most
+// likely a consequence of it.
+func (a *CrystalAnalyzer) checkBracketBalance(tokens []Token, structureBroken bool) []Diagnostic {
+	var diagnostics []Diagnostic
+	var stack []Token
+
+	report := func(token Token, message string) {
+		if structureBroken && (token.Value == "{" || token.Value == "}") {
+			return
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Range: Range{
+				Start: token.Position,
+				End:   Position{Line: token.Position.Line, Character: token.Position.Character + token.Length},
+			},
+			Severity: DiagnosticSeverityError,
+			Message:  message,
+			Source:   "crystal-lsp",
+		})
+	}
+
+	for _, token := range tokens {
+		if token.Type != TokenOperator {
+			continue
+		}
+
+		switch token.Value {
+		case "(", "[", "{":
+			stack = append(stack, token)
+		case ")", "]", "}":
+			// Find the nearest opener this closes; anything above it was
+			// never closed
+			match := -1
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].Value == bracketPairs[token.Value] {
+					match = i
+					break
+				}
+			}
+			if match < 0 {
+				report(token, fmt.Sprintf("Unexpected '%s'", token.Value))
+				continue
+			}
+			for _, open := range stack[match+1:] {
+				report(open, fmt.Sprintf("Unmatched '%s'", open.Value))
+			}
+			stack = stack[:match]
+		}
+	}
+
+	for _, open := range stack {
+		report(open, fmt.Sprintf("Unmatched '%s'", open.Value))
+	}
+
+	return diagnostics
+}
+
+// conditionKeywords introduce a condition that runs to the end of the line,
+// `then` or `;`, whether they open a block or trail a statement as a modifier
+var conditionKeywords = map[string]bool{
+	"if": true, "elsif": true, "unless": true, "while": true, "until": true,
+}
+
+// checkAssignmentInCondition warns about a plain `=` in the condition of an
+// if, unless, while or until, which assigns instead of comparing. The range
+// covers the `=` operator only.
+func (a *CrystalAnalyzer) checkAssignmentInCondition(tokens []Token) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for i, token := range tokens {
+		if token.Type != TokenKeyword || !conditionKeywords[token.Value] {
+			continue
+		}
+		// `obj.if` is a method call and `{% if %}` is macro control flow
+		if i > 0 && tokens[i-1].Position.Line == token.Position.Line &&
+			(tokens[i-1].Value == "." || tokens[i-1].Value == "%") {
+			continue
+		}
+
+		for _, next := range tokens[i+1:] {
+			if next.Position.Line != token.Position.Line || next.Value == ";" ||
+				(next.Type == TokenKeyword && next.Value == "then") {
+				break
+			}
+			if next.Type != TokenOperator || next.Value != "=" {
+				continue
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				Range: Range{
+					Start: next.Position,
+					End:   Position{Line: next.Position.Line, Character: next.Position.Character + next.Length},
+				},
+				Severity: DiagnosticSeverityWarning,
+				Message:  "Assignment in condition; did you mean '=='?",
+				Source:   "crystal-lsp",
+			})
+		}
+	}
+
+	return diagnostics
+}
+
+// checkMissingRequires warns about relative requires whose file doesn't
+// exist beside the document. Other requires name the standard library or a
+// shard, which only the compiler resolves reliably. Documents that are not
+// files on disk are skipped.
+func checkMissingRequires(doc *TextDocumentItem) []Diagnostic {
+	if !strings.HasPrefix(doc.URI, "file://") {
+		return nil
+	}
+
+	var diagnostics []Diagnostic
+	dir := filepath.Dir(uriToPath(doc.URI))
+	for lineNum, line := range strings.Split(doc.Text, "\n") {
+		match := requireRegexp.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		path := line[match[2]:match[3]]
+		if !strings.HasPrefix(path, "./") && !strings.HasPrefix(path, "../") || strings.Contains(path, "*") {
+			continue
+		}
+		if resolveRequire(path, dir, "") != "" {
+			continue
+		}
+
+		// The range covers the string literal with its quotes
+		diagnostics = append(diagnostics, Diagnostic{
+			Range: Range{
+				Start: Position{Line: lineNum, Character: encodedLen(line[:match[2]-1])},
+				End:   Position{Line: lineNum, Character: encodedLen(line[:match[3]+1])},
+			},
+			Severity: DiagnosticSeverityWarning,
+			Message:  fmt.Sprintf("cannot find required file '%s'", path),
+			Source:   "crystal-lsp",
+		})
+	}
+
+	return diagnostics
+}
+
+// referenceMethods are methods every object responds to that the builtin
+// object table leaves out because they are rarely completed
+var referenceMethods = map[string]bool{
+	"as": true, "as?": true, "not_nil!": true, "itself": true,
+	"same?": true, "object_id": true, "in?": true, "===": true, "=~": true,
+	"!~": true, "unsafe_as": true, "pretty_print": true, "pretty_inspect": true,
+	"to_json": true, "to_pretty_json": true, "to_yaml": true, "finalize": true,
+}
+
+// classBodyKeywords are the statements a type body may hold without
+// generating methods the parser doesn't see
+var classBodyKeywords = map[string]bool{
+	"def": true, "abstract": true, "alias": true,
+	"class": true, "struct": true, "module": true, "enum": true, "annotation": true, "end": true,
+}
+
+// checkUndefinedMethods warns about `obj.name` calls where obj is an instance
+// of a type defined in this document and name is neither defined by it, an
+// ancestor nor Object. Only types the parser understands completely are
+// checked: see fullyKnownClass.
+func (a *CrystalAnalyzer) checkUndefinedMethods(doc *TextDocumentItem, tokens []Token) []Diagnostic {
+	var diagnostics []Diagnostic
+	lines := strings.Split(doc.Text, "\n")
+
+	for i := 1; i+1 < len(tokens); i++ {
+		dot, name := tokens[i], tokens[i+1]
+		if dot.Type != TokenOperator || dot.Value != "." || name.Type != TokenIdentifier ||
+			name.Position.Line != dot.Position.Line || tokens[i-1].Position.Line != dot.Position.Line {
+			continue
+		}
+
+		line := lines[dot.Position.Line]
+		receiver := extractReceiver(line[:byteOffset(line, dot.Position.Character)])
+		// Calls on a type name reach class methods, which aren't checked
+		if receiver == "" || typeNameRegexp.MatchString(receiver) || !a.receiverInScope(receiver, lines, dot.Position) {
+			continue
+		}
+		// A type guessed from the method name alone may be the wrong one
+		if a.typedByNameOnly(receiver, doc, dot.Position) {
+			continue
+		}
+		typeName := a.inferTypeOfExpression(receiver, doc, dot.Position)
+		classInfo := a.findClass(typeName)
+		if classInfo == nil || a.documentClasses[classInfo.QualifiedName] != classInfo || !a.fullyKnownClass(classInfo, doc.URI, lines) {
+			continue
+		}
+
+		method := name.Value
+		if i+2 < len(tokens) && tokens[i+2].Type == TokenOperator && tokens[i+2].Value == "=" {
+			method += "="
+		}
+		if a.respondsTo(classInfo, method) {
+			continue
+		}
+
+		diagnostics = append(diagnostics, Diagnostic{
+			Range: Range{
+				Start: name.Position,
+				End:   Position{Line: name.Position.Line, Character: name.Position.Character + name.Length},
+			},
+			Severity: DiagnosticSeverityWarning,
+			Message:  fmt.Sprintf("undefined method '%s' for %s", method, classInfo.QualifiedName),
+			Source:   "crystal-lsp",
+		})
+	}
+
+	return diagnostics
+}
+
+// receiverInScope reports whether the local variable a receiver starts with,
+// if any, is assigned in the method around pos (or at the top level) or is a
+// typed parameter of it. Inference otherwise picks up assignments to a
+// variable of the same name in an earlier method.
+func (a *CrystalAnalyzer) receiverInScope(receiver string, lines []string, pos Position) bool {
+	root := receiver
+	if idx := strings.IndexAny(root, ".("); idx >= 0 {
+		root = root[:idx]
+	}
+	if !identifierRegexp.MatchString(root) {
+		return true
+	}
+
+	method := a.findEnclosingMethod(pos.Line)
+	if assigned := variableAssignmentLine(lines, root, pos.Line); assigned >= 0 {
+		return a.findEnclosingMethod(assigned) == method
+	}
+	return a.parameterType(root, pos) != ""
+}
+
+// fullyKnownClass reports whether every method of a type's instances is
+// visible to the parser: it and its ancestors are classes or structs that no
+// other workspace file reopens, have no subclasses here that could make the type
+// virtual, and their bodies hold nothing but methods, accessors, constants and
+// nested types. Includes, macros and other macro calls may define methods
+// the parser can't see.
+func (a *CrystalAnalyzer) fullyKnownClass(classInfo *ClassInfo, uri string, lines []string) bool {
+	for _, other := range a.documentClasses {
+		if other != classInfo && other.SuperClass != "" && a.findClass(other.SuperClass) == classInfo {
+			return false
+		}
+	}
+
+	for current := classInfo; current != nil; {
+		if current.IsModule || current.IsEnum || current.IsAnnotation || len(current.Macros) > 0 {
+			return false
+		}
+		if a.index != nil {
+			if _, ok := a.index.FindClass(current.Name, uri); ok {
+				return false
+			}
+		}
+		if !a.plainClassBody(current, lines) {
+			return false
+		}
+
+		switch current.SuperClass {
+		case "", "Reference", "Object", "Struct", "Value":
+			current = nil
+		default:
+			parent := a.documentClasses[current.SuperClass]
+			if parent == nil {
+				parent = a.findClass(current.SuperClass)
+			}
+			if parent == nil || a.documentClasses[parent.QualifiedName] != parent || parent == classInfo {
+				return false
+			}
+			current = parent
+		}
+	}
+
+	return true
+}
+
+// plainClassBody reports whether every declaration of a type holds only
+// method definitions, accessor macros, constants, instance variable
+// declarations and nested types, so that the parsed methods are complete
+func (a *CrystalAnalyzer) plainClassBody(classInfo *ClassInfo, lines []string) bool {
+	skipped := make(map[int]bool)
+	for _, overloads := range classInfo.Methods {
+		for _, method := range overloads {
+			if method.IsProperty {
+				continue
+			}
+			for line := method.Location.Line + 1; line <= method.EndLine; line++ {
+				skipped[line] = true
+			}
+		}
+	}
+	// Nested types are checked on their own when they are receivers
+	for _, other := range a.documentClasses {
+		if !strings.HasPrefix(other.QualifiedName, classInfo.QualifiedName+"::") {
+			continue
+		}
+		for _, nested := range other.Declarations {
+			for line := nested.Location.Line; line <= nested.EndLine; line++ {
+				skipped[line] = true
+			}
+		}
+	}
+
+	for _, declaration := range classInfo.Declarations {
+		for lineNum := declaration.Location.Line + 1; lineNum < declaration.EndLine && lineNum < len(lines); lineNum++ {
+			if skipped[lineNum] {
+				continue
+			}
+			trimmed := strings.TrimSpace(lines[lineNum])
+			for _, visibility := range []string{"private ", "protected "} {
+				trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, visibility))
+			}
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "@") {
+				continue
+			}
+			first, _, _ := strings.Cut(trimmed, " ")
+			if classBodyKeywords[first] || propertyRegexp.MatchString(trimmed) || constantDefRegexp.MatchString(trimmed) {
+				continue
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// respondsTo reports whether instances of a type have a method called name
+func (a *CrystalAnalyzer) respondsTo(classInfo *ClassInfo, name string) bool {
+	for _, method := range a.resolveMethods(classInfo)[name].Overloads {
+		if !method.IsClassMethod {
+			return true
+		}
+	}
+	for _, method := range objectMethods {
+		if method.Name == name {
+			return true
+		}
+	}
+	return referenceMethods[name]
+}
+
+// callArguments describes the arguments written between the parentheses of
+// a call
+type callArguments struct {
+	Positional int
+	Named      []string
+	Splat      bool // `*args` or `**opts`, whose size isn't known
+}
+
+// checkArityMismatch warns about parenthesized calls to methods of this
+// document that no overload can accept with the given number of positional
+// and named arguments. Block arguments (`&block`, `&.name`) and blocks after
+// the call are not counted. Calls that may reach methods the parser can't
+// see are skipped, as for checkUndefinedMethods.
+func (a *CrystalAnalyzer) checkArityMismatch(doc *TextDocumentItem, tokens []Token) []Diagnostic {
+	var diagnostics []Diagnostic
+	lines := strings.Split(doc.Text, "\n")
+
+	for i := 0; i+1 < len(tokens); i++ {
+		name, paren := tokens[i], tokens[i+1]
+		if name.Type != TokenIdentifier || paren.Value != "(" || paren.Position.Line != name.Position.Line ||
+			paren.Position.Character != name.Position.Character+name.Length {
+			continue
+		}
+
+		overloads := a.callCandidates(doc, lines, tokens, i)
+		if len(overloads) == 0 {
+			continue
+		}
+		args, ok := parseCallArguments(tokens, i+1)
+		if !ok || args.Splat {
+			continue
+		}
+
+		accepted := false
+		for _, method := range overloads {
+			if acceptsCall(method, args) {
+				accepted = true
+				break
+			}
+		}
+		if accepted {
+			continue
+		}
+
+		message := fmt.Sprintf("no overload of '%s' accepts these arguments", name.Value)
+		if len(args.Named) == 0 {
+			message = fmt.Sprintf("wrong number of arguments for '%s' (given %d, expected %s)",
+				name.Value, args.Positional, expectedArity(overloads))
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Range: Range{
+				Start: name.Position,
+				End:   Position{Line: name.Position.Line, Character: name.Position.Character + name.Length},
+			},
+			Severity: DiagnosticSeverityWarning,
+			Message:  message,
+			Source:   "crystal-lsp",
+		})
+	}
+
+	return diagnostics
+}
+
+// callCandidates returns the overloads the call named by tokens[i] may reach,
+// or nil when the call can't be resolved to methods the parser fully sees
+func (a *CrystalAnalyzer) callCandidates(doc *TextDocumentItem, lines []string, tokens []Token, i int) []*MethodInfo {
+	name := tokens[i]
+	var prev *Token
+	if i > 0 {
+		prev = &tokens[i-1]
+	}
+
+	// Definitions and qualified names aren't calls on a receiver we know
+	if prev != nil && (prev.Value == "def" || prev.Value == "macro" || prev.Value == "::") {
+		return nil
+	}
+
+	// `obj.name(...)` and `Type.name(...)`
+	if prev != nil && prev.Value == "." {
+		line := lines[prev.Position.Line]
+		receiver := extractReceiver(line[:byteOffset(line, prev.Position.Character)])
+		if receiver == "" || prev.Position.Line != name.Position.Line {
+			return nil
+		}
+
+		classLevel := typeNameRegexp.MatchString(receiver)
+		var classInfo *ClassInfo
+		if classLevel {
+			classInfo = a.findClass(receiver)
+		} else if a.receiverInScope(receiver, lines, prev.Position) {
+			classInfo = a.findClass(a.inferTypeOfExpression(receiver, doc, prev.Position))
+		}
+		if classInfo == nil || a.documentClasses[classInfo.QualifiedName] != classInfo ||
+			!a.fullyKnownClass(classInfo, doc.URI, lines) {
+			return nil
+		}
+
+		// `Type.new(...)` runs initialize; without one the default takes
+		// no arguments, which isn't worth reporting here
+		method := name.Value
+		if classLevel && method == "new" {
+			method, classLevel = "initialize", false
+		}
+		return methodsAtLevel(a.resolveMethods(classInfo)[method].Overloads, classLevel)
+	}
+
+	if a.documentMacros[name.Value] != nil {
+		return nil
+	}
+
+	// Receiverless calls reach the enclosing type first, then the top level
+	enclosing := a.findEnclosingMethod(name.Position.Line)
+	if classInfo := a.findEnclosingClass(name.Position.Line); classInfo != nil {
+		if !a.fullyKnownClass(classInfo, doc.URI, lines) {
+			return nil
+		}
+		classLevel := enclosing == nil || enclosing.IsClassMethod
+		if overloads := methodsAtLevel(a.resolveMethods(classInfo)[name.Value].Overloads, classLevel); len(overloads) > 0 {
+			return overloads
+		}
+	}
+
+	if a.index != nil && len(a.index.FindMethods(name.Value, doc.URI)) > 0 {
+		return nil
+	}
+	var overloads []*MethodInfo
+	for _, method := range a.documentMethods[""] {
+		if method.Name == name.Value {
+			overloads = append(overloads, method)
+		}
+	}
+	return overloads
+}
+
+// methodsAtLevel keeps the class methods or the instance methods of a set
+// of overloads
+func methodsAtLevel(overloads []*MethodInfo, classLevel bool) []*MethodInfo {
+	var methods []*MethodInfo
+	for _, method := range overloads {
+		if method.IsClassMethod == classLevel {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// parseCallArguments reads the arguments of the call whose opening
+// parenthesis is tokens[open]. It reports false when the closing parenthesis
+// is missing.
+func parseCallArguments(tokens []Token, open int) (callArguments, bool) {
+	var args callArguments
+	depth := 0
+	start := true
+
+	for i := open + 1; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.Type == TokenOperator {
+			switch token.Value {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				if depth == 0 {
+					return args, token.Value == ")"
+				}
+				depth--
+			case ",":
+				if depth == 0 {
+					start = true
+					continue
+				}
+			}
+		}
+		if !start || depth > 0 && token.Value != "(" && token.Value != "[" && token.Value != "{" {
+			continue
+		}
+
+		// The first token of an argument decides its kind
+		start = false
+		switch {
+		case token.Value == "*" || token.Value == "**":
+			args.Splat = true
+		case token.Value == "&":
+			// A block argument isn't counted
+		case token.Type == TokenIdentifier && i+1 < len(tokens) && tokens[i+1].Value == ":" &&
+			tokens[i+1].Position.Line == token.Position.Line &&
+			tokens[i+1].Position.Character == token.Position.Character+token.Length:
+			args.Named = append(args.Named, token.Value)
+		default:
+			args.Positional++
+		}
+	}
+
+	return args, false
+}
+
+// acceptsCall reports whether method can be called with args. Named
+// arguments may fill positional parameters as well as the named-only ones
+// after a splat.
+func acceptsCall(method *MethodInfo, args callArguments) bool {
+	var positional, namedOnly []ParameterInfo
+	splat, afterSplat, doubleSplat := false, false, false
+	for _, param := range method.Parameters {
+		switch {
+		case param.IsBlock:
+		case param.IsDoubleSplat:
+			doubleSplat = true
+		case param.IsSplat:
+			// A bare `*` ends the positional parameters without taking any
+			splat = param.Name != ""
+			afterSplat = true
+		case afterSplat:
+			namedOnly = append(namedOnly, param)
+		default:
+			positional = append(positional, param)
+		}
+	}
+
+	if args.Positional > len(positional) && !splat {
+		return false
+	}
+
+	given := make(map[int]bool)
+	for i := 0; i < args.Positional && i < len(positional); i++ {
+		given[i] = true
+	}
+	all := append(append([]ParameterInfo{}, positional...), namedOnly...)
+	for _, named := range args.Named {
+		found := false
+		for i, param := range all {
+			external := param.ExternalName
+			if external == "" {
+				external = strings.TrimLeft(param.Name, "@")
+			}
+			if external == named {
+				if given[i] {
+					return false
+				}
+				given[i], found = true, true
+				break
+			}
+		}
+		if !found && !doubleSplat {
+			return false
+		}
+	}
+
+	for i, param := range all {
+		if param.DefaultValue == "" && !given[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// expectedArity describes the positional argument counts the overloads
+// accept, e.g. "1..2, 4+"
+func expectedArity(overloads []*MethodInfo) string {
+	var ranges []string
+	seen := make(map[string]bool)
+	for _, method := range overloads {
+		required, total, splat := 0, 0, false
+		for _, param := range method.Parameters {
+			if param.IsDoubleSplat || param.IsBlock {
+				continue
+			}
+			if param.IsSplat {
+				splat = param.Name != ""
+				break
+			}
+			total++
+			if param.DefaultValue == "" {
+				required++
+			}
+		}
+
+		arity := fmt.Sprint(required)
+		switch {
+		case splat:
+			arity += "+"
+		case total > required:
+			arity += fmt.Sprintf("..%d", total)
+		}
+		if !seen[arity] {
+			seen[arity] = true
+			ranges = append(ranges, arity)
+		}
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// checkDuplicateMethods warns about a method defined twice in the same type
+// with the same parameters, which silently replaces the first definition.
+// Overloads that differ in arity or parameter types are legitimate, as are
+// the several constructors a type may declare with `initialize`.
+func (a *CrystalAnalyzer) checkDuplicateMethods(uri string) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	owners := make([]string, 0, len(a.documentClasses)+1)
+	for name := range a.documentClasses {
+		owners = append(owners, name)
+	}
+	sort.Strings(owners)
+	// Top-level methods are tracked under the empty owner
+	owners = append([]string{""}, owners...)
+
+	for _, owner := range owners {
+		methods := a.documentMethods[owner]
+		if classInfo := a.documentClasses[owner]; classInfo != nil {
+			methods = nil
+			for _, name := range sortedMethodNames(classInfo) {
+				methods = append(methods, classInfo.Methods[name]...)
+			}
+		}
+
+		first := make(map[string]*MethodInfo)
+		for _, method := range methods {
+			if method.IsProperty || method.Name == "initialize" {
+				continue
+			}
+			key := methodSignatureKey(method)
+			original, seen := first[key]
+			if !seen {
+				first[key] = method
+				continue
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				Range:    definitionLocation(uri, method.Location, method.Name).Range,
+				Severity: DiagnosticSeverityWarning,
+				Message:  fmt.Sprintf("Method '%s' is already defined", method.Name),
+				Source:   "crystal-lsp",
+				RelatedInformation: []DiagnosticRelatedInformation{{
+					Location: definitionLocation(uri, original.Location, original.Name),
+					Message:  "First definition",
+				}},
+			})
+		}
+	}
+
+	return diagnostics
+}
+
+// methodSignatureKey identifies a method by name, receiver, arity and
+// parameter types; two definitions with the same key can't both be called
+func methodSignatureKey(method *MethodInfo) string {
+	types := make([]string, 0, len(method.Parameters))
+	for _, param := range method.Parameters {
+		types = append(types, param.Type)
+	}
+	return fmt.Sprintf("%s/%t/%d/%s", method.Name, method.IsClassMethod, len(method.Parameters), strings.Join(types, ","))
+}
+
+// checkDuplicateClasses reports a class or struct declared a second time in
+// the document. Crystal reopens the type, which is usually unintended within
+// one file; naming a different superclass is a compile error. Modules are
+// commonly reopened and are left alone.
+func (a *CrystalAnalyzer) checkDuplicateClasses(uri string) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	names := make([]string, 0, len(a.documentClasses))
+	for name := range a.documentClasses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		classInfo := a.documentClasses[name]
+		if len(classInfo.Declarations) < 2 || classInfo.IsModule {
+			continue
+		}
+
+		first := classInfo.Declarations[0]
+		related := []DiagnosticRelatedInformation{{
+			Location: definitionLocation(uri, first.Location, classInfo.Name),
+			Message:  "First declaration",
+		}}
+
+		for _, declaration := range classInfo.Declarations[1:] {
+			diagnostic := Diagnostic{
+				Range:              definitionLocation(uri, declaration.Location, classInfo.Name).Range,
+				Severity:           DiagnosticSeverityWarning,
+				Message:            fmt.Sprintf("'%s' is already defined; this reopens it", name),
+				Source:             "crystal-lsp",
+				RelatedInformation: related,
+			}
+			if declaration.SuperClass != "" && declaration.SuperClass != classInfo.SuperClass {
+				diagnostic.Severity = DiagnosticSeverityError
+				diagnostic.Message = fmt.Sprintf("Superclass mismatch for %s '%s' (%s vs %s)",
+					declaration.Keyword, name, declaration.SuperClass, classInfo.SuperClass)
+			}
+			diagnostics = append(diagnostics, diagnostic)
+		}
+	}
+
+	return diagnostics
+}
@@ -0,0 +1,49 @@
+package lsp
+
+// DocumentContext holds everything parsed from one version of a document
+type DocumentContext struct {
+	URI     string
+	Version int
+	Text    string
+	Tokens  []Token
+	Classes map[string]*ClassInfo
+	Methods map[string][]*MethodInfo
+	// Constants assigned outside of any type; nested ones live on their
+	// ClassInfo
+	Constants map[string]*ConstantInfo
+	// Aliased types by alias name, e.g. Id => Int32 for `alias Id = Int32`
+	Aliases map[string]string
+	// Macros defined outside of any type
+	Macros map[string]*MacroInfo
+}
+
+// documentContext returns the parsed context for doc, reusing the cached one
+// while the document version is unchanged. The text is compared as well so
+// callers that never bump the version still see their edits.
+func (a *CrystalAnalyzer) documentContext(doc *TextDocumentItem) *DocumentContext {
+	if context, ok := a.contexts[doc.URI]; ok && context.Version == doc.Version && context.Text == doc.Text {
+		return context
+	}
+
+	tokens := NewCrystalLexer(doc.Text).Tokenize()
+	a.parseDocument(doc, tokens)
+
+	context := &DocumentContext{
+		URI:       doc.URI,
+		Version:   doc.Version,
+		Text:      doc.Text,
+		Tokens:    tokens,
+		Classes:   a.documentClasses,
+		Methods:   a.documentMethods,
+		Constants: a.documentConstants,
+		Aliases:   a.documentAliases,
+		Macros:    a.documentMacros,
+	}
+	a.contexts[doc.URI] = context
+	return context
+}
+
+// ForgetDocument drops the cached context for a closed document
+func (a *CrystalAnalyzer) ForgetDocument(uri string) {
+	delete(a.contexts, uri)
+}
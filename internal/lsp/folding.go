@@ -0,0 +1,110 @@
+package lsp
+
+import (
+	"regexp"
+	"sort"
+)
+
+// regionMarkerRegexp matches `# region Name` and `# endregion` comments
+var regionMarkerRegexp = regexp.MustCompile(`(?i)^#\s*(end)?region\b`)
+
+// sectionKeywords lists, per block opener, the keywords that split the block
+// into separately foldable sections
+var sectionKeywords = map[string]map[string]bool{
+	"case":  {"when": true, "in": true, "else": true},
+	"begin": {"rescue": true, "else": true, "ensure": true},
+	"def":   {"rescue": true, "else": true, "ensure": true},
+	"do":    {"rescue": true, "else": true, "ensure": true},
+}
+
+// GetFoldingRanges returns a range for every block spanning several lines,
+// folding up to the line before its `end`, for each section of a `case` or
+// `begin` block, and for every `# region` comment through its matching
+// `# endregion`
+func (a *CrystalAnalyzer) GetFoldingRanges(doc *TextDocumentItem) []FoldingRange {
+	tokens := a.documentContext(doc).Tokens
+
+	// Blocks opened on the same line fold together as the outermost one
+	blockEnds := make(map[int]int)
+	addFold := func(start, end int) {
+		if end > start && end > blockEnds[start] {
+			blockEnds[start] = end
+		}
+	}
+
+	spans := matchBlocks(tokens)
+	for _, span := range spans {
+		addFold(span.Open.Line, span.Close.Line-1)
+	}
+
+	// Each `when` arm and `rescue`/`ensure` section folds up to the line
+	// before the next section of the same block
+	sections := make(map[int][]int)
+	for i, token := range tokens {
+		if token.Type != TokenKeyword || !firstInStatement(tokens, i) {
+			continue
+		}
+		if span := innermostSpan(spans, token.Position); span >= 0 && sectionKeywords[spans[span].Open.Keyword][token.Value] {
+			sections[span] = append(sections[span], token.Position.Line)
+		}
+	}
+	for span, lines := range sections {
+		for i, line := range lines {
+			end := spans[span].Close.Line
+			if i+1 < len(lines) {
+				end = lines[i+1]
+			}
+			addFold(line, end-1)
+		}
+	}
+
+	ranges := []FoldingRange{}
+	for start, end := range blockEnds {
+		ranges = append(ranges, FoldingRange{StartLine: start, EndLine: end})
+	}
+
+	// Regions nest, so each endregion closes the innermost open region
+	var regions []int
+	for _, token := range tokens {
+		if token.Type != TokenComment {
+			continue
+		}
+		match := regionMarkerRegexp.FindStringSubmatch(token.Value)
+		switch {
+		case match == nil:
+		case match[1] == "":
+			regions = append(regions, token.Position.Line)
+		case len(regions) > 0:
+			start := regions[len(regions)-1]
+			regions = regions[:len(regions)-1]
+			ranges = append(ranges, FoldingRange{StartLine: start, EndLine: token.Position.Line, Kind: FoldingRangeKindRegion})
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].StartLine != ranges[j].StartLine {
+			return ranges[i].StartLine < ranges[j].StartLine
+		}
+		return ranges[i].EndLine > ranges[j].EndLine
+	})
+	return ranges
+}
+
+// innermostSpan returns the index of the innermost span enclosing pos, or -1
+func innermostSpan(spans []blockSpan, pos Position) int {
+	innermost := -1
+	for i, span := range spans {
+		if !eventBefore(span.Open, pos) || eventBefore(span.Close, pos) {
+			continue
+		}
+		if innermost < 0 || eventBefore(spans[innermost].Open, Position{Line: span.Open.Line, Character: span.Open.Character}) {
+			innermost = i
+		}
+	}
+	return innermost
+}
+
+// eventBefore reports whether event comes before pos in the document
+func eventBefore(event blockEvent, pos Position) bool {
+	return event.Line < pos.Line || (event.Line == pos.Line && event.Character < pos.Character)
+}
@@ -0,0 +1,180 @@
+package lsp
+
+import "strings"
+
+// dedentKeywords start a line one level out from the code around them
+var dedentKeywords = map[string]bool{
+	"end": true, "else": true, "elsif": true, "when": true, "in": true,
+	"rescue": true, "ensure": true,
+}
+
+// FormatDocument is the formatter used when Crystal isn't installed. It
+// reindents every line by two spaces per open block or bracket, trims
+// trailing whitespace and ends the text with a single newline. Lines inside
+// multi-line string literals are kept as they are.
+func (a *CrystalAnalyzer) FormatDocument(doc *TextDocumentItem) string {
+	tokens := a.documentContext(doc).Tokens
+	lines := strings.Split(doc.Text, "\n")
+
+	// How much each line changes the nesting, and how each line starts
+	delta := make([]int, len(lines))
+	first := make([]*Token, len(lines))
+	verbatim := make([]bool, len(lines))
+	for _, event := range scanBlockEvents(tokens) {
+		if event.Keyword == "end" {
+			delta[event.Line]--
+		} else {
+			delta[event.Line]++
+		}
+	}
+	for i := range tokens {
+		token := &tokens[i]
+		line := token.Position.Line
+		if first[line] == nil {
+			first[line] = token
+		}
+		if token.Type == TokenOperator {
+			switch token.Value {
+			case "(", "[", "{":
+				delta[line]++
+			case ")", "]", "}":
+				delta[line]--
+			}
+		}
+		for j := 1; j <= strings.Count(token.Value, "\n") && line+j < len(lines); j++ {
+			verbatim[line+j] = true
+		}
+	}
+
+	formatted := make([]string, len(lines))
+	depth := 0
+	for i, line := range lines {
+		if verbatim[i] {
+			formatted[i] = strings.TrimSuffix(line, "\r")
+		} else if trimmed := strings.TrimSpace(line); trimmed != "" {
+			level := depth
+			if token := first[i]; token != nil && (token.Type == TokenKeyword && dedentKeywords[token.Value] ||
+				token.Type == TokenOperator && strings.Contains(")]}", token.Value)) {
+				level--
+			}
+			formatted[i] = strings.Repeat("  ", max(level, 0)) + trimmed
+		}
+		depth = max(depth+delta[i], 0)
+	}
+
+	return strings.TrimRight(strings.Join(formatted, "\n"), "\n") + "\n"
+}
+
+// documentEdits returns an edit replacing all of text with formatted, or no
+// edits when they are the same
+func documentEdits(text, formatted string) []TextEdit {
+	if formatted == text {
+		return []TextEdit{}
+	}
+
+	lines := strings.Split(text, "\n")
+	last := len(lines) - 1
+	return []TextEdit{{
+		Range: Range{
+			Start: Position{Line: 0, Character: 0},
+			End:   Position{Line: last, Character: encodedLen(lines[last])},
+		},
+		NewText: formatted,
+	}}
+}
+
+// rangeFormattingEdits formats the lines that rng touches with format and
+// returns an edit replacing them. The lines are dedented before formatting
+// and reindented after, so a selection inside a method formats like the
+// method body. Text that can't be formatted on its own yields no edits.
+func rangeFormattingEdits(text string, rng Range, format func(string) (string, error)) []TextEdit {
+	lines := strings.Split(text, "\n")
+	start, end := rng.Start.Line, rng.End.Line
+	// A selection ending at the start of a line doesn't include that line
+	if end > start && rng.End.Character == 0 {
+		end--
+	}
+	if start >= len(lines) {
+		return []TextEdit{}
+	}
+	if end >= len(lines) {
+		end = len(lines) - 1
+	}
+
+	selected := lines[start : end+1]
+	indent := commonIndent(selected)
+	dedented := make([]string, len(selected))
+	for i, line := range selected {
+		dedented[i] = strings.TrimPrefix(line, indent)
+	}
+
+	formatted, err := format(strings.Join(dedented, "\n") + "\n")
+	if err != nil {
+		return []TextEdit{}
+	}
+
+	formattedLines := strings.Split(strings.TrimSuffix(formatted, "\n"), "\n")
+	for i, line := range formattedLines {
+		if line != "" {
+			formattedLines[i] = indent + line
+		}
+	}
+	newText := strings.Join(formattedLines, "\n")
+	if newText == strings.Join(selected, "\n") {
+		return []TextEdit{}
+	}
+
+	return []TextEdit{{
+		Range: Range{
+			Start: Position{Line: start, Character: 0},
+			End:   Position{Line: end, Character: encodedLen(lines[end])},
+		},
+		NewText: newText,
+	}}
+}
+
+// GetOnTypeFormatting closes a block when a newline is typed after the line
+// that opens it: if that block is missing its `end`, one is inserted below
+// the cursor at the opener's indentation. Modifiers like `return if x` and
+// one-line blocks open nothing and get no edit.
+func (a *CrystalAnalyzer) GetOnTypeFormatting(doc *TextDocumentItem, pos Position, ch string) []TextEdit {
+	lines := strings.Split(doc.Text, "\n")
+	if ch != "\n" || pos.Line == 0 || pos.Line >= len(lines) {
+		return []TextEdit{}
+	}
+
+	block, ok := unclosedBlockAt(a.documentContext(doc).Tokens, pos)
+	if !ok || block.Line != pos.Line-1 {
+		return []TextEdit{}
+	}
+
+	opener := lines[block.Line]
+	indent := opener[:len(opener)-len(strings.TrimLeft(opener, " \t"))]
+	current := strings.TrimSuffix(lines[pos.Line], "\r")
+	end := Position{Line: pos.Line, Character: encodedLen(current)}
+
+	return []TextEdit{{
+		Range:   Range{Start: end, End: end},
+		NewText: "\n" + indent + "end",
+	}}
+}
+
+// commonIndent returns the leading whitespace shared by every non-blank line
+func commonIndent(lines []string) string {
+	indent := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			indent, first = lead, false
+			continue
+		}
+		for !strings.HasPrefix(lead, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	return indent
+}
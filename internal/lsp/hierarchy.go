@@ -0,0 +1,107 @@
+package lsp
+
+import (
+	"sort"
+	"strings"
+)
+
+// PrepareTypeHierarchy returns the local type named at pos
+func (a *CrystalAnalyzer) PrepareTypeHierarchy(doc *TextDocumentItem, pos Position) []TypeHierarchyItem {
+	lines := strings.Split(doc.Text, "\n")
+	if pos.Line >= len(lines) {
+		return nil
+	}
+
+	currentLine := lines[pos.Line]
+	word := getWordAtPosition(currentLine, byteOffset(currentLine, pos.Character))
+
+	a.parseDocumentStructure(doc)
+
+	classInfo := a.findClass(word)
+	if classInfo == nil {
+		return nil
+	}
+	return []TypeHierarchyItem{typeHierarchyItem(doc.URI, classInfo, lines)}
+}
+
+// GetSupertypes returns the superclass of a type from its local definition
+func (a *CrystalAnalyzer) GetSupertypes(doc *TextDocumentItem, item TypeHierarchyItem) []TypeHierarchyItem {
+	a.parseDocumentStructure(doc)
+
+	classInfo := a.findClass(hierarchyItemName(item))
+	if classInfo == nil || classInfo.SuperClass == "" {
+		return []TypeHierarchyItem{}
+	}
+
+	chain := a.ancestors(classInfo)
+	if len(chain) == 0 {
+		return []TypeHierarchyItem{}
+	}
+	return []TypeHierarchyItem{typeHierarchyItem(doc.URI, chain[0], strings.Split(doc.Text, "\n"))}
+}
+
+// GetSubtypes returns the local types that directly inherit from a type
+func (a *CrystalAnalyzer) GetSubtypes(doc *TextDocumentItem, item TypeHierarchyItem) []TypeHierarchyItem {
+	a.parseDocumentStructure(doc)
+
+	parent := a.findClass(hierarchyItemName(item))
+	if parent == nil {
+		return []TypeHierarchyItem{}
+	}
+
+	lines := strings.Split(doc.Text, "\n")
+	items := []TypeHierarchyItem{}
+	for _, classInfo := range a.documentClasses {
+		if classInfo.SuperClass != "" && a.findClass(classInfo.SuperClass) == parent {
+			items = append(items, typeHierarchyItem(doc.URI, classInfo, lines))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Data < items[j].Data
+	})
+	return items
+}
+
+// hierarchyItemFor returns an item for a type reported by the compiler,
+// located at its local definition when there is one. Types defined elsewhere,
+// such as the standard library, point back at origin.
+func (a *CrystalAnalyzer) hierarchyItemFor(doc *TextDocumentItem, name string, kind int, origin TypeHierarchyItem) TypeHierarchyItem {
+	a.parseDocumentStructure(doc)
+
+	if classInfo := a.findClass(name); classInfo != nil {
+		return typeHierarchyItem(doc.URI, classInfo, strings.Split(doc.Text, "\n"))
+	}
+	return TypeHierarchyItem{
+		Name:           name,
+		Kind:           kind,
+		URI:            origin.URI,
+		Range:          origin.Range,
+		SelectionRange: origin.SelectionRange,
+		Data:           name,
+	}
+}
+
+// typeHierarchyItem describes a local type
+func typeHierarchyItem(uri string, classInfo *ClassInfo, lines []string) TypeHierarchyItem {
+	return TypeHierarchyItem{
+		Name:   classInfo.Name,
+		Kind:   classInfo.SymbolKind(),
+		Detail: classInfo.QualifiedName,
+		URI:    uri,
+		Range:  blockRange(classInfo.Location.Line, classInfo.EndLine, lines),
+		SelectionRange: Range{
+			Start: classInfo.Location,
+			End:   Position{Line: classInfo.Location.Line, Character: classInfo.Location.Character + encodedLen(classInfo.Name)},
+		},
+		Data: classInfo.QualifiedName,
+	}
+}
+
+// hierarchyItemName returns the qualified name stored in an item, falling
+// back to its display name
+func hierarchyItemName(item TypeHierarchyItem) string {
+	if item.Data != "" {
+		return item.Data
+	}
+	return item.Name
+}
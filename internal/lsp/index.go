@@ -0,0 +1,249 @@
+package lsp
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxIndexedFiles bounds how many files a workspace scan indexes
+const maxIndexedFiles = 5000
+
+// WorkspaceIndex holds the parsed structure of every Crystal file in the
+// workspace. It is filled in the background, so all access is locked.
+type WorkspaceIndex struct {
+	mu sync.RWMutex
+
+	// Parsing goes through a private analyzer so it never disturbs the
+	// per-request state of the server's analyzer
+	parser *CrystalAnalyzer
+	files  map[string]*DocumentContext
+
+	// The indexed types by qualified and by simple name, so lookups don't
+	// go through every file
+	qualified map[string][]IndexedClass
+	named     map[string][]IndexedClass
+}
+
+// IndexedClass is a type found in the workspace index
+type IndexedClass struct {
+	URI   string
+	Class *ClassInfo
+}
+
+// NewWorkspaceIndex creates an empty workspace index
+func NewWorkspaceIndex() *WorkspaceIndex {
+	return &WorkspaceIndex{
+		parser:    NewCrystalAnalyzer(),
+		files:     make(map[string]*DocumentContext),
+		qualified: make(map[string][]IndexedClass),
+		named:     make(map[string][]IndexedClass),
+	}
+}
+
+// Update parses text and stores it as the indexed contents of uri
+func (w *WorkspaceIndex) Update(uri, text string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	context := w.parser.documentContext(&TextDocumentItem{URI: uri, Text: text})
+	// The index keeps its own copy; the parser cache is not needed
+	w.parser.ForgetDocument(uri)
+	w.unindexClasses(uri)
+	w.files[uri] = context
+	for _, classInfo := range context.Classes {
+		indexed := IndexedClass{URI: uri, Class: classInfo}
+		w.qualified[classInfo.QualifiedName] = append(w.qualified[classInfo.QualifiedName], indexed)
+		w.named[classInfo.Name] = append(w.named[classInfo.Name], indexed)
+	}
+}
+
+// unindexClasses drops the types of uri from the name lookups; the caller
+// holds the write lock
+func (w *WorkspaceIndex) unindexClasses(uri string) {
+	context, ok := w.files[uri]
+	if !ok {
+		return
+	}
+	without := func(classes []IndexedClass) []IndexedClass {
+		kept := classes[:0]
+		for _, indexed := range classes {
+			if indexed.URI != uri {
+				kept = append(kept, indexed)
+			}
+		}
+		return kept
+	}
+	for _, classInfo := range context.Classes {
+		if kept := without(w.qualified[classInfo.QualifiedName]); len(kept) > 0 {
+			w.qualified[classInfo.QualifiedName] = kept
+		} else {
+			delete(w.qualified, classInfo.QualifiedName)
+		}
+		if kept := without(w.named[classInfo.Name]); len(kept) > 0 {
+			w.named[classInfo.Name] = kept
+		} else {
+			delete(w.named, classInfo.Name)
+		}
+	}
+}
+
+// Remove drops uri from the index
+func (w *WorkspaceIndex) Remove(uri string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.unindexClasses(uri)
+	delete(w.files, uri)
+}
+
+// Len returns the number of indexed files
+func (w *WorkspaceIndex) Len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return len(w.files)
+}
+
+// Classes returns every indexed type, ordered by URI and qualified name
+func (w *WorkspaceIndex) Classes() []IndexedClass {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var classes []IndexedClass
+	for uri, context := range w.files {
+		for _, classInfo := range context.Classes {
+			classes = append(classes, IndexedClass{URI: uri, Class: classInfo})
+		}
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		return indexedBefore(classes[i], classes[j])
+	})
+	return classes
+}
+
+// IndexedMethod is a method found in the workspace index
+type IndexedMethod struct {
+	URI    string
+	Owner  string
+	Method *MethodInfo
+}
+
+// FindClass returns the indexed type with the given qualified or simple name
+// outside of excludeURI, preferring exact qualified names and then the
+// shallowest nesting. Ties go to the first URI in order.
+func (w *WorkspaceIndex) FindClass(name, excludeURI string) (IndexedClass, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var found IndexedClass
+	for _, indexed := range w.qualified[name] {
+		if indexed.URI != excludeURI && (found.Class == nil || indexed.URI < found.URI) {
+			found = indexed
+		}
+	}
+	if found.Class != nil {
+		return found, true
+	}
+
+	for _, indexed := range w.named[name] {
+		if indexed.URI == excludeURI {
+			continue
+		}
+		if found.Class == nil || len(indexed.Class.QualifiedName) < len(found.Class.QualifiedName) ||
+			len(indexed.Class.QualifiedName) == len(found.Class.QualifiedName) && indexedBefore(indexed, found) {
+			found = indexed
+		}
+	}
+	return found, found.Class != nil
+}
+
+// indexedBefore reports whether a comes before b in the order of Classes
+func indexedBefore(a, b IndexedClass) bool {
+	if a.URI != b.URI {
+		return a.URI < b.URI
+	}
+	return a.Class.QualifiedName < b.Class.QualifiedName
+}
+
+// FindMethods returns every indexed method named name outside of excludeURI,
+// ordered by URI and owner
+func (w *WorkspaceIndex) FindMethods(name, excludeURI string) []IndexedMethod {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var methods []IndexedMethod
+	for uri, context := range w.files {
+		if uri == excludeURI {
+			continue
+		}
+		for owner, overloads := range context.Methods {
+			for _, method := range overloads {
+				if method.Name == name {
+					methods = append(methods, IndexedMethod{URI: uri, Owner: owner, Method: method})
+				}
+			}
+		}
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].URI != methods[j].URI {
+			return methods[i].URI < methods[j].URI
+		}
+		if methods[i].Owner != methods[j].Owner {
+			return methods[i].Owner < methods[j].Owner
+		}
+		return methods[i].Method.Location.Line < methods[j].Method.Location.Line
+	})
+	return methods
+}
+
+// collectCrystalFiles returns the .cr files under root, skipping hidden
+// directories, temporary copies of unsaved documents and, unless includeLib
+// is set, the shards `lib` directory. At most limit files are returned.
+func collectCrystalFiles(root string, includeLib bool, limit int) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped rather than aborting the scan
+			if entry != nil && entry.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() {
+			if path == root {
+				return nil
+			}
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") || (!includeLib && name == "lib" && filepath.Dir(path) == root) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Ext(path) == ".cr" && !isTempCopy(path) {
+			files = append(files, path)
+			if len(files) >= limit {
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// indexFile reads a file from disk into the index
+func (w *WorkspaceIndex) indexFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	w.Update(pathToURI(path), string(content))
+	return nil
+}
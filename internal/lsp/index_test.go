@@ -0,0 +1,257 @@
+package lsp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectCrystalFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"src/app.cr", "src/models/user.cr", "spec/app_spec.cr", "lib/shard/src/shard.cr", ".git/hooks/x.cr", "src/.crystal-ls-123.cr", "README.md"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("class X\nend\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := collectCrystalFiles(root, false, maxIndexedFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expected 3 files outside lib and hidden directories, got %v", files)
+	}
+
+	files, _ = collectCrystalFiles(root, true, maxIndexedFiles)
+	if len(files) != 4 {
+		t.Errorf("Expected lib to be included when asked, got %v", files)
+	}
+
+	files, _ = collectCrystalFiles(root, false, 2)
+	if len(files) != 2 {
+		t.Errorf("Expected the file limit to apply, got %v", files)
+	}
+}
+
+func TestWorkspaceIndex(t *testing.T) {
+	index := NewWorkspaceIndex()
+	index.Update("file:///a.cr", "class Alpha\nend")
+	index.Update("file:///b.cr", "module Beta\n  class Gamma\n  end\nend")
+
+	classes := index.Classes()
+	if len(classes) != 3 {
+		t.Fatalf("Expected 3 indexed types, got %d", len(classes))
+	}
+	if classes[0].URI != "file:///a.cr" || classes[0].Class.Name != "Alpha" {
+		t.Errorf("Unexpected first type %+v", classes[0])
+	}
+
+	index.Update("file:///a.cr", "class Delta\nend")
+	index.Remove("file:///b.cr")
+
+	classes = index.Classes()
+	if len(classes) != 1 || classes[0].Class.Name != "Delta" {
+		t.Errorf("Expected only Delta after updates, got %+v", classes)
+	}
+	if index.Len() != 1 {
+		t.Errorf("Expected 1 indexed file, got %d", index.Len())
+	}
+}
+
+func TestWorkspaceIndex_FindClass(t *testing.T) {
+	index := NewWorkspaceIndex()
+	index.Update("file:///b.cr", "module Outer\n  class Item\n  end\nend\nclass Item\nend")
+	index.Update("file:///a.cr", "class Item\nend\nclass Other\nend")
+
+	tests := []struct {
+		name       string
+		excludeURI string
+		uri        string
+		qualified  string
+	}{
+		{"Item", "", "file:///a.cr", "Item"},
+		{"Item", "file:///a.cr", "file:///b.cr", "Item"},
+		{"Outer::Item", "", "file:///b.cr", "Outer::Item"},
+		{"Other", "", "file:///a.cr", "Other"},
+	}
+	for _, tt := range tests {
+		found, ok := index.FindClass(tt.name, tt.excludeURI)
+		if !ok || found.URI != tt.uri || found.Class.QualifiedName != tt.qualified {
+			t.Errorf("FindClass(%q, %q) = %+v, expected %s in %s", tt.name, tt.excludeURI, found, tt.qualified, tt.uri)
+		}
+	}
+
+	// Updates and removals replace what the lookups see
+	index.Update("file:///a.cr", "class Renamed\nend")
+	if _, ok := index.FindClass("Other", ""); ok {
+		t.Error("Expected Other to be gone after its file changed")
+	}
+	index.Remove("file:///b.cr")
+	if _, ok := index.FindClass("Outer::Item", ""); ok {
+		t.Error("Expected Outer::Item to be gone after its file was removed")
+	}
+	if found, ok := index.FindClass("Renamed", ""); !ok || found.URI != "file:///a.cr" {
+		t.Errorf("Expected Renamed in a.cr, got %+v", found)
+	}
+}
+
+func TestCrystalAnalyzer_GetDocumentLinks(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"src/app.cr", "src/models/user.cr", "src/config/config.cr", "lib/kemal/src/kemal.cr"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(""), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc := &TextDocumentItem{
+		URI: pathToURI(filepath.Join(root, "src", "app.cr")),
+		Text: `require "json"
+require "kemal"
+require "./models/user"
+require "./config"
+require "./models/*"
+require "./missing"
+require "models/user.cr"`,
+	}
+
+	links := NewCrystalAnalyzer().GetDocumentLinks(doc, root)
+
+	expected := map[int]string{
+		1: "lib/kemal/src/kemal.cr",
+		2: "src/models/user.cr",
+		3: "src/config/config.cr",
+		6: "src/models/user.cr",
+	}
+	if len(links) != len(expected) {
+		t.Fatalf("Expected %d links, got %+v", len(expected), links)
+	}
+	for _, link := range links {
+		want, ok := expected[link.Range.Start.Line]
+		if !ok {
+			t.Errorf("Unexpected link on line %d", link.Range.Start.Line)
+			continue
+		}
+		if link.Target != pathToURI(filepath.Join(root, filepath.FromSlash(want))) {
+			t.Errorf("Line %d: expected target %s, got %s", link.Range.Start.Line, want, link.Target)
+		}
+		if link.Range.Start.Character != 9 {
+			t.Errorf("Line %d: expected the link to start inside the quotes, got %d", link.Range.Start.Line, link.Range.Start.Character)
+		}
+	}
+}
+
+func TestCrystalAnalyzer_GetRequireHover(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "src", "models", "user.cr")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(""), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := &TextDocumentItem{
+		URI:  pathToURI(filepath.Join(root, "src", "app.cr")),
+		Text: "require \"./models/user\"\nrequire \"./missing\"\nrequire \"json\"",
+	}
+	analyzer := NewCrystalAnalyzer()
+
+	tests := []struct {
+		pos      Position
+		expected string
+	}{
+		{Position{Line: 0, Character: 12}, "**require** `./models/user`\n\n" + pathToURI(path)},
+		{Position{Line: 1, Character: 8}, "**require** `./missing`\n\nFile not found"},
+		{Position{Line: 2, Character: 10}, "**require** `json`\n\nNot found in the project or its shards; it may be part of the standard library"},
+	}
+	for _, tt := range tests {
+		hover := analyzer.GetRequireHover(doc, tt.pos, root)
+		if hover == nil || len(hover.Contents) != 1 || hover.Contents[0] != tt.expected {
+			t.Errorf("At %+v: expected %q, got %+v", tt.pos, tt.expected, hover)
+		}
+	}
+
+	if hover := analyzer.GetRequireHover(doc, Position{Line: 0, Character: 3}, root); hover != nil {
+		t.Errorf("Expected no require hover on the keyword, got %+v", hover)
+	}
+}
+
+func TestRequiresAny(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"src/app.cr":               "require \"./config\"\n",
+		"src/config.cr":            "require \"./models/*\"\n",
+		"src/models/user.cr":       "",
+		"src/models/admin/cap.cr":  "",
+		"src/tasks/migrate.cr":     "",
+		"lib/kemal/src/kemal.cr":   "require \"./kemal/*\"\n",
+		"lib/kemal/src/kemal/r.cr": "",
+	}
+	for name, text := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(root, "src")
+
+	tests := []struct {
+		text     string
+		changed  string
+		expected bool
+	}{
+		{"require \"./config\"", "src/config.cr", true},
+		{"require \"./config\"", "src/models/user.cr", true},
+		{"require \"./config\"", "src/models/admin/cap.cr", false},
+		{"require \"./app\"", "src/models/user.cr", true},
+		{"require \"./tasks/**\"", "src/tasks/seed.cr", true},
+		{"require \"./tasks/*\"", "src/tasks/db/seed.cr", false},
+		{"require \"kemal\"", "lib/kemal/src/kemal/r.cr", true},
+		{"require \"json\"", "src/config.cr", false},
+		// A deleted file is still required by name
+		{"require \"./gone\"", "src/gone.cr", true},
+	}
+	for _, tt := range tests {
+		changed := map[string]bool{filepath.Join(root, filepath.FromSlash(tt.changed)): true}
+		if got := requiresAny(tt.text, dir, root, changed); got != tt.expected {
+			t.Errorf("%s with %s changed: expected %v, got %v", tt.text, tt.changed, tt.expected, got)
+		}
+	}
+}
+
+func TestCheckMissingRequires(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "user.cr"), []byte(""), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := &TextDocumentItem{
+		URI:  pathToURI(filepath.Join(root, "app.cr")),
+		Text: "require \"json\"\nrequire \"./user\"\nrequire \"./usr\"\nrequire \"./models/*\"",
+	}
+
+	diagnostics := checkMissingRequires(doc)
+	if len(diagnostics) != 1 {
+		t.Fatalf("Expected only the misspelled require to be flagged, got %+v", diagnostics)
+	}
+	expected := Range{Start: Position{Line: 2, Character: 8}, End: Position{Line: 2, Character: 15}}
+	if diagnostics[0].Range != expected || diagnostics[0].Severity != DiagnosticSeverityWarning {
+		t.Errorf("Expected a warning at %+v, got %+v", expected, diagnostics[0])
+	}
+
+	// Documents without a file on disk have nothing to resolve against
+	if diagnostics := checkMissingRequires(&TextDocumentItem{URI: "untitled:1", Text: doc.Text}); len(diagnostics) != 0 {
+		t.Errorf("Expected no diagnostics for an unsaved document, got %+v", diagnostics)
+	}
+}
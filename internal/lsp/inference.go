@@ -0,0 +1,480 @@
+package lsp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// maxInferenceDepth bounds how many variable assignments are followed when
+// inferring a type, guarding against cycles like `x = x.foo`
+const maxInferenceDepth = 8
+
+var (
+	integerLiteralRegexp = regexp.MustCompile(`^-?\d[\d_]*$`)
+	floatLiteralRegexp   = regexp.MustCompile(`^-?\d[\d_]*\.\d[\d_]*$`)
+	rangeLiteralRegexp   = regexp.MustCompile(`^\(?-?[\p{L}\p{N}_@]+\.\.\.?-?[\p{L}\p{N}_@]*\)?$`)
+	constructorRegexp    = regexp.MustCompile(`^(\p{Lu}[\p{L}\p{N}_:]*(?:\(.*\))?)\.new\b`)
+	emptyArrayRegexp     = regexp.MustCompile(`^\[\s*\]\s*of\s+(.+)$`)
+	emptyHashRegexp      = regexp.MustCompile(`^\{\s*\}\s*of\s+(.+?)\s*=>\s*(.+)$`)
+	identifierRegexp     = regexp.MustCompile(`^[\p{Ll}_][\p{L}\p{N}_]*[\?!]?$`)
+	typeNameRegexp       = regexp.MustCompile(`^\p{Lu}[\p{L}\p{N}_:]*$`)
+	assignmentRegexp     = regexp.MustCompile(`^\s*([\p{L}\p{N}_]+[\?!]?)\s*=`)
+	variableDeclRegexp   = regexp.MustCompile(`^\s*([\p{Ll}_][\p{L}\p{N}_]*)\s+:\s+(\S.*)$`)
+)
+
+// inferTypeOfExpression infers the type of a receiver expression at pos.
+// It returns an empty string when the type can't be determined.
+func (a *CrystalAnalyzer) inferTypeOfExpression(expr string, doc *TextDocumentItem, pos Position) string {
+	return a.resolveAlias(a.inferType(expr, doc, pos, 0))
+}
+
+// resolveAlias follows `alias` declarations to the aliased type, keeping a
+// trailing `?`. A cycle of aliases leaves typeName unresolved.
+func (a *CrystalAnalyzer) resolveAlias(typeName string) string {
+	nilable := strings.HasSuffix(typeName, "?")
+	resolved := strings.TrimSuffix(typeName, "?")
+
+	seen := make(map[string]bool)
+	for {
+		target, exists := a.documentAliases[resolved]
+		if !exists {
+			break
+		}
+		if seen[resolved] {
+			return typeName
+		}
+		seen[resolved] = true
+		resolved = target
+	}
+
+	if nilable && !strings.HasSuffix(resolved, "?") {
+		resolved += "?"
+	}
+	return resolved
+}
+
+func (a *CrystalAnalyzer) inferType(expr string, doc *TextDocumentItem, pos Position, depth int) string {
+	expr = strings.TrimSpace(expr)
+	if expr == "" || depth > maxInferenceDepth {
+		return ""
+	}
+
+	// Method calls return their declared return type. Chains like
+	// `"hi".upcase.size` resolve each call on the type of its receiver.
+	if dot := lastTopLevelDot(expr); dot >= 0 && !rangeLiteralRegexp.MatchString(expr) {
+		name := stripArguments(expr[dot+1:])
+		// Constructor calls: Foo.new(...)
+		if match := constructorRegexp.FindStringSubmatch(expr); match != nil && name == "new" {
+			// `Bar.new` inside `module Foo` may construct Foo::Bar
+			if classInfo := a.resolveClass(match[1], pos.Line); classInfo != nil {
+				return classInfo.QualifiedName
+			}
+			return match[1]
+		}
+		// Only a receiver of unknown type falls back to any method of the name
+		if receiverType := a.inferType(expr[:dot], doc, pos, depth); receiverType != "" {
+			return a.methodReturnTypeOn(receiverType, name)
+		}
+		return a.methodReturnType(name)
+	}
+
+	// Literals
+	switch {
+	case strings.HasPrefix(expr, `"`):
+		return "String"
+	case strings.HasPrefix(expr, "'"):
+		return "Char"
+	case rangeLiteralRegexp.MatchString(expr):
+		return "Range"
+	case strings.HasPrefix(expr, ":"):
+		return "Symbol"
+	case strings.HasPrefix(expr, "["):
+		return a.arrayLiteralType(expr, doc, pos, depth)
+	case strings.HasPrefix(expr, "{"):
+		if match := emptyHashRegexp.FindStringSubmatch(expr); match != nil {
+			return "Hash(" + match[1] + ", " + match[2] + ")"
+		}
+		return "Hash"
+	case expr == "true" || expr == "false":
+		return "Bool"
+	case expr == "nil":
+		return "Nil"
+	case strings.HasPrefix(expr, "uninitialized "):
+		return strings.TrimSpace(strings.TrimPrefix(expr, "uninitialized "))
+	case integerLiteralRegexp.MatchString(expr):
+		return "Int32"
+	case floatLiteralRegexp.MatchString(expr):
+		return "Float64"
+	case expr == "self":
+		if classInfo := a.findEnclosingClass(pos.Line); classInfo != nil {
+			return classInfo.QualifiedName
+		}
+		return ""
+	}
+
+	name := stripArguments(expr)
+	if identifierRegexp.MatchString(name) {
+		if name == expr {
+			if typeName := a.blockParameterType(name, doc, pos, depth); typeName != "" {
+				return typeName
+			}
+			// A declared type is authoritative over the assigned value
+			if declared, value, found := findVariableAssignment(doc, name, pos.Line); found {
+				if declared != "" {
+					return declared
+				}
+				return a.inferType(value, doc, pos, depth+1)
+			}
+			if typeName := a.parameterType(name, pos); typeName != "" {
+				return typeName
+			}
+		}
+		return a.methodReturnType(name)
+	}
+
+	if typeNameRegexp.MatchString(expr) {
+		// A constant has the type of its value; anything else names a type
+		name, qualifier := expr, ""
+		if idx := strings.LastIndex(expr, "::"); idx >= 0 {
+			name, qualifier = expr[idx+2:], expr[:idx]
+		}
+		if constant := a.findConstant(name, qualifier, pos.Line); constant != nil {
+			return a.inferType(constant.Value, doc, constant.Location, depth+1)
+		}
+		return expr
+	}
+
+	return ""
+}
+
+// arrayLiteralType infers `[] of T` and `[a, b]` literals as Array(T),
+// taking T from the first element
+func (a *CrystalAnalyzer) arrayLiteralType(expr string, doc *TextDocumentItem, pos Position, depth int) string {
+	if match := emptyArrayRegexp.FindStringSubmatch(expr); match != nil {
+		return "Array(" + strings.TrimSpace(match[1]) + ")"
+	}
+	if !strings.HasSuffix(expr, "]") {
+		return "Array"
+	}
+
+	elements := splitTopLevel(expr[1:len(expr)-1], ',')
+	if len(elements) == 0 {
+		return "Array"
+	}
+	if element := a.inferType(elements[0], doc, pos, depth+1); element != "" {
+		return "Array(" + element + ")"
+	}
+	return "Array"
+}
+
+// parameterType returns the declared type of a parameter of the method
+// around pos
+func (a *CrystalAnalyzer) parameterType(name string, pos Position) string {
+	method := a.findEnclosingMethod(pos.Line)
+	if method == nil {
+		return ""
+	}
+	for _, param := range method.Parameters {
+		if param.Name == name {
+			return param.Type
+		}
+	}
+	return ""
+}
+
+// blockParameterType infers the type of a block parameter from the
+// collection the block iterates, e.g. `item` in
+// `names.each do |item|` is String when names is an Array(String)
+func (a *CrystalAnalyzer) blockParameterType(name string, doc *TextDocumentItem, pos Position, depth int) string {
+	tokens := a.documentContext(doc).Tokens
+	lines := strings.Split(doc.Text, "\n")
+
+	// The innermost block around pos that declares name
+	var block *codeBlock
+	index := -1
+	for _, candidate := range findBlocks(tokens) {
+		if !positionBefore(candidate.Start, pos) || !positionBefore(pos, candidate.End) {
+			continue
+		}
+		for i, param := range candidate.Parameters {
+			if param == name && (block == nil || positionBefore(block.Start, candidate.Start)) {
+				block, index = &candidate, i
+			}
+		}
+	}
+	if block == nil || block.Start.Line >= len(lines) {
+		return ""
+	}
+
+	// The call the block is passed to, e.g. `names.each`
+	line := lines[block.Start.Line]
+	call := extractReceiver(strings.TrimRight(line[:byteOffset(line, block.Start.Character)], " \t"))
+	dot := lastTopLevelDot(call)
+	if dot < 0 {
+		return ""
+	}
+	receiverType := a.resolveAlias(a.inferType(call[:dot], doc, block.Start, depth+1))
+	method := stripArguments(call[dot+1:])
+
+	// `value.try do |x|` only yields when value isn't nil
+	if method == "try" && index == 0 {
+		return nonNilType(receiverType)
+	}
+	return iteratedType(receiverType, method, index)
+}
+
+// nonNilType returns typeName without Nil, e.g. String for `String?` and
+// `Int32 | String` for `Int32 | String | Nil`
+func nonNilType(typeName string) string {
+	members, nilable := unionMembers(typeName)
+	if !nilable {
+		return typeName
+	}
+	return strings.Join(members, " | ")
+}
+
+// iteratedType returns the type of the block parameter at index for the
+// iteration methods of standard collections
+func iteratedType(collection, method string, index int) string {
+	args := genericArguments(collection)
+
+	switch method {
+	case "each", "map", "select", "reject", "each_with_index", "find", "any?", "all?":
+	default:
+		return ""
+	}
+
+	switch baseTypeName(collection) {
+	case "Array", "Set", "Slice", "Deque", "Range":
+		if method == "each_with_index" && index == 1 {
+			return "Int32"
+		}
+		if index == 0 && len(args) > 0 {
+			return args[0]
+		}
+	case "Hash":
+		if len(args) == 2 && index < 2 {
+			return args[index]
+		}
+	}
+	return ""
+}
+
+// genericArguments returns the type arguments of a generic type, e.g.
+// String and Int32 for `Hash(String, Int32)`
+func genericArguments(typeName string) []string {
+	typeName = strings.TrimSuffix(strings.TrimSpace(typeName), "?")
+	open := strings.Index(typeName, "(")
+	if open < 0 || !strings.HasSuffix(typeName, ")") {
+		return nil
+	}
+
+	var args []string
+	for _, arg := range splitTopLevel(typeName[open+1:len(typeName)-1], ',') {
+		args = append(args, strings.TrimSpace(arg))
+	}
+	return args
+}
+
+// methodReturnType returns the declared return type of a local method
+func (a *CrystalAnalyzer) methodReturnType(name string) string {
+	_, overloads := a.findMethod(name)
+	for _, methodInfo := range overloads {
+		if methodInfo.ReturnType != "" {
+			return methodInfo.ReturnType
+		}
+	}
+	return ""
+}
+
+// methodReturnTypeOn returns the return type of a method called on a value
+// of typeName, looking at the type's own and inherited methods before the
+// standard library tables
+func (a *CrystalAnalyzer) methodReturnTypeOn(typeName, name string) string {
+	typeName = a.resolveAlias(typeName)
+	if classInfo := a.findClass(baseTypeName(typeName)); classInfo != nil {
+		if set, exists := a.resolveMethods(classInfo)[name]; exists {
+			for _, methodInfo := range set.Overloads {
+				switch methodInfo.ReturnType {
+				case "":
+				case "self":
+					return classInfo.QualifiedName
+				default:
+					return methodInfo.ReturnType
+				}
+			}
+		}
+	}
+	return builtinReturnType(typeName, name)
+}
+
+// typedByNameOnly reports whether the type of a call chain like `a.b.c` rests
+// on a call whose receiver type is unknown, so that it was guessed from any
+// method of the same name
+func (a *CrystalAnalyzer) typedByNameOnly(expr string, doc *TextDocumentItem, pos Position) bool {
+	dot := lastTopLevelDot(expr)
+	if dot < 0 || rangeLiteralRegexp.MatchString(expr) {
+		return false
+	}
+	if constructorRegexp.MatchString(expr) && stripArguments(expr[dot+1:]) == "new" {
+		return false
+	}
+	if a.inferType(expr[:dot], doc, pos, 0) == "" {
+		return true
+	}
+	return a.typedByNameOnly(expr[:dot], doc, pos)
+}
+
+// findVariableAssignment finds the closest assignment or declaration of name
+// at or above the given line. It returns the type written in a declaration
+// like `x : Int32 = 5`, if any, and the assigned expression.
+func findVariableAssignment(doc *TextDocumentItem, name string, beforeLine int) (declared, value string, found bool) {
+	lines := strings.Split(doc.Text, "\n")
+	lineNum := variableAssignmentLine(lines, name, beforeLine)
+	if lineNum < 0 {
+		return "", "", false
+	}
+
+	line := lines[lineNum]
+	if declared, value, ok := parseVariableDeclaration(line); ok {
+		return declared, value, true
+	}
+	return "", strings.TrimSpace(line[findAssignment(line)+1:]), true
+}
+
+// parseVariableDeclaration splits a typed declaration such as `x : String`
+// or `x : Int32 = 5` into its type and optional value
+func parseVariableDeclaration(line string) (declared, value string, ok bool) {
+	match := variableDeclRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return "", "", false
+	}
+
+	declared = match[2]
+	if idx := findAssignment(declared); idx >= 0 {
+		declared, value = declared[:idx], strings.TrimSpace(declared[idx+1:])
+	}
+	if idx := strings.Index(declared, "#"); idx >= 0 {
+		declared = declared[:idx]
+	}
+	// A parameter on its own line of a multi-line signature ends with a
+	// separator or the closing parenthesis
+	declared = strings.TrimSuffix(strings.TrimSpace(declared), ",")
+	if strings.Count(declared, ")") > strings.Count(declared, "(") {
+		declared = strings.TrimSuffix(declared, ")")
+	}
+	return strings.TrimSpace(declared), value, true
+}
+
+// variableAssignmentLine returns the last line at or before beforeLine that
+// assigns to or declares the local variable name, or -1
+func variableAssignmentLine(lines []string, name string, beforeLine int) int {
+	if beforeLine >= len(lines) {
+		beforeLine = len(lines) - 1
+	}
+
+	for i := beforeLine; i >= 0; i-- {
+		line := lines[i]
+		if match := variableDeclRegexp.FindStringSubmatch(line); match != nil && match[1] == name {
+			return i
+		}
+		match := assignmentRegexp.FindStringSubmatchIndex(line)
+		if match == nil || line[match[2]:match[3]] != name {
+			continue
+		}
+		// Skip comparisons like `x == y`
+		if idx := findAssignment(line); idx != match[1]-1 {
+			continue
+		}
+		return i
+	}
+
+	return -1
+}
+
+// baseTypeName strips generic arguments and nilability from a type,
+// e.g. `Array(String)?` becomes `Array`
+func baseTypeName(typeName string) string {
+	typeName = strings.TrimSuffix(strings.TrimSpace(typeName), "?")
+	if idx := strings.Index(typeName, "("); idx >= 0 {
+		typeName = typeName[:idx]
+	}
+	return typeName
+}
+
+// extractReceiver returns the receiver expression at the end of text, e.g.
+// `user.name` for `puts user.name`
+func extractReceiver(text string) string {
+	depth := 0
+	i := len(text) - 1
+
+	for ; i >= 0; i-- {
+		ch := text[i]
+		switch {
+		case ch == ')' || ch == ']' || ch == '}':
+			depth++
+		case ch == '(' || ch == '[' || ch == '{':
+			if depth == 0 {
+				return strings.TrimSpace(text[i+1:])
+			}
+			depth--
+		case ch == '"' && depth == 0:
+			// Include the whole string literal
+			start := strings.LastIndex(text[:i], `"`)
+			if start < 0 {
+				return strings.TrimSpace(text[i+1:])
+			}
+			i = start
+		case depth > 0:
+		case isWordChar(rune(ch)) || ch == '.' || ch == ':' || ch == '@':
+		default:
+			return strings.TrimSpace(text[i+1:])
+		}
+	}
+
+	return strings.TrimSpace(text[i+1:])
+}
+
+// lastTopLevelDot returns the index of the last `.` outside of brackets and
+// string literals, or -1
+func lastTopLevelDot(expr string) int {
+	dot := -1
+	depth := 0
+	inString := false
+
+	for i := 0; i < len(expr); i++ {
+		ch := expr[i]
+		switch {
+		case inString:
+			if ch == '\\' {
+				i++
+			} else if ch == '"' {
+				inString = false
+			}
+		case ch == '"':
+			inString = true
+		case ch == '(' || ch == '[' || ch == '{':
+			depth++
+		case ch == ')' || ch == ']' || ch == '}':
+			depth--
+		case ch == '.' && depth == 0:
+			// Ignore the decimal point in float literals
+			if i > 0 && isDigit(expr[i-1]) && i+1 < len(expr) && isDigit(expr[i+1]) {
+				continue
+			}
+			dot = i
+		}
+	}
+
+	return dot
+}
+
+// stripArguments removes a trailing argument list from a call, e.g.
+// `fetch(1, 2)` becomes `fetch`
+func stripArguments(call string) string {
+	call = strings.TrimSpace(call)
+	if idx := strings.IndexAny(call, "( "); idx >= 0 {
+		call = call[:idx]
+	}
+	return call
+}
@@ -0,0 +1,54 @@
+package lsp
+
+import "strings"
+
+// GetInlayHints returns type hints for variables assigned in rng whose type
+// is not written out. Assignments whose type can't be inferred get no hint.
+func (a *CrystalAnalyzer) GetInlayHints(doc *TextDocumentItem, rng Range) []InlayHint {
+	a.parseDocumentStructure(doc)
+	context := a.documentContext(doc)
+
+	// An assignment statement starts with the variable's identifier token;
+	// this keeps matches inside strings and comments out
+	firstTokens := make(map[int]*Token)
+	for i := range context.Tokens {
+		token := &context.Tokens[i]
+		if _, seen := firstTokens[token.Position.Line]; !seen {
+			firstTokens[token.Position.Line] = token
+		}
+	}
+
+	hints := []InlayHint{}
+	lines := strings.Split(doc.Text, "\n")
+	for i := rng.Start.Line; i <= rng.End.Line && i < len(lines); i++ {
+		line := lines[i]
+		match := assignmentRegexp.FindStringSubmatchIndex(line)
+		if match == nil || findAssignment(line) != match[1]-1 {
+			continue
+		}
+
+		name := line[match[2]:match[3]]
+		token := firstTokens[i]
+		if token == nil || token.Type != TokenIdentifier || token.Value != name || !identifierRegexp.MatchString(name) {
+			continue
+		}
+
+		value := strings.TrimSpace(line[match[1]:])
+		// `x = uninitialized Int32` already names the type
+		if strings.HasPrefix(value, "uninitialized ") {
+			continue
+		}
+		typeName := a.inferTypeOfExpression(value, doc, Position{Line: i, Character: match[1]})
+		if typeName == "" || typeName == "Object" {
+			continue
+		}
+
+		hints = append(hints, InlayHint{
+			Position: Position{Line: i, Character: token.Position.Character + token.Length},
+			Label:    ": " + typeName,
+			Kind:     InlayHintKindType,
+		})
+	}
+
+	return hints
+}
@@ -1,7 +1,10 @@
 package lsp
 
 import (
+	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // TokenType represents different types of Crystal tokens
@@ -16,6 +19,10 @@ const (
 	TokenOperator
 	TokenSymbol
 	TokenConstant
+	TokenChar
+	TokenInstanceVar
+	TokenClassVar
+	TokenRegex
 )
 
 // Token represents a Crystal language token
@@ -33,6 +40,13 @@ type CrystalLexer struct {
 	line     int
 	column   int
 	tokens   []Token
+	heredocs []heredoc // opened on the current line, bodies not read yet
+}
+
+// heredoc is a heredoc whose body starts on the line after its `<<-ID`
+type heredoc struct {
+	terminator string
+	indented   bool // `<<-` and `<<~` allow whitespace before the terminator
 }
 
 // NewCrystalLexer creates a new Crystal lexer
@@ -47,6 +61,7 @@ func NewCrystalLexer(text string) *CrystalLexer {
 // Tokenize analyzes the text and returns a list of tokens
 func (l *CrystalLexer) Tokenize() []Token {
 	l.tokens = []Token{}
+	l.heredocs = nil
 	l.position = 0
 	l.line = 0
 	l.column = 0
@@ -63,16 +78,26 @@ func (l *CrystalLexer) Tokenize() []Token {
 		switch {
 		case ch == '#':
 			l.readComment()
-		case ch == '"' || ch == '\'':
+		case ch == '"':
 			l.readString()
+		case ch == '\'':
+			l.readChar()
 		case isDigit(ch):
 			l.readNumber()
-		case isLetter(ch) || ch == '_':
+		case isIdentifierStart(l.runeAt(l.position)):
 			l.readIdentifierOrKeyword()
+		case ch == '@' && l.startsVariable():
+			l.readVariable()
+		case ch == '%' && l.startsPercentLiteral():
+			l.readPercentLiteral()
+		case ch == ':' && l.startsSymbol():
+			l.readSymbol()
+		case ch == '<' && l.startsHeredoc():
+			l.readHeredocStart()
+		case ch == '/' && l.startsRegex():
+			l.readRegex()
 		case isOperator(ch):
 			l.readOperator()
-		case ch == ':':
-			l.readSymbol()
 		default:
 			l.advance()
 		}
@@ -102,6 +127,9 @@ func (l *CrystalLexer) skipWhitespace() {
 			l.line++
 			l.column = 0
 			l.position++
+			if len(l.heredocs) > 0 {
+				l.readHeredocBodies()
+			}
 		} else {
 			break
 		}
@@ -110,19 +138,19 @@ func (l *CrystalLexer) skipWhitespace() {
 
 func (l *CrystalLexer) readComment() {
 	start := l.position
-	startCol := l.column
+	startLine, startCol := l.line, l.column
 
 	for l.position < len(l.text) && l.text[l.position] != '\n' {
 		l.advance()
 	}
 
 	value := l.text[start:l.position]
-	l.addToken(TokenComment, value, startCol, len(value))
+	l.addToken(TokenComment, value, startLine, startCol)
 }
 
 func (l *CrystalLexer) readString() {
 	start := l.position
-	startCol := l.column
+	startLine, startCol := l.line, l.column
 	quote := l.text[l.position]
 	l.advance()
 
@@ -139,26 +167,379 @@ func (l *CrystalLexer) readString() {
 	}
 
 	value := l.text[start:l.position]
-	l.addToken(TokenString, value, startCol, len(value))
+	l.addToken(TokenString, value, startLine, startCol)
 }
 
-func (l *CrystalLexer) readNumber() {
+// readChar reads a character literal such as 'a', '\n', '\u0041' or
+// '\u{1F600}'. Only a single, possibly escaped, code point is consumed so
+// that separate literals on one line are not merged.
+func (l *CrystalLexer) readChar() {
+	start := l.position
+	startLine, startCol := l.line, l.column
+	l.advance() // Opening quote
+
+	if l.position < len(l.text) && l.text[l.position] == '\\' {
+		l.advance()
+		if l.position < len(l.text) && l.text[l.position] == 'u' {
+			l.advance()
+			if l.position < len(l.text) && l.text[l.position] == '{' {
+				for l.position < len(l.text) && l.text[l.position] != '}' && l.text[l.position] != '\n' {
+					l.advance()
+				}
+				if l.position < len(l.text) && l.text[l.position] == '}' {
+					l.advance()
+				}
+			} else {
+				for i := 0; i < 4 && l.position < len(l.text) && isHexDigit(l.text[l.position]); i++ {
+					l.advance()
+				}
+			}
+		} else if l.position < len(l.text) {
+			l.advance()
+		}
+	} else if l.position < len(l.text) && l.text[l.position] != '\n' {
+		// Consume one UTF-8 encoded code point
+		l.advance()
+		for l.position < len(l.text) && l.text[l.position]&0xC0 == 0x80 {
+			l.advance()
+		}
+	}
+
+	if l.position < len(l.text) && l.text[l.position] == '\'' {
+		l.advance()
+	}
+
+	value := l.text[start:l.position]
+	l.addToken(TokenChar, value, startLine, startCol)
+}
+
+// startsVariable reports whether the `@` at the current position begins an
+// instance or class variable rather than an annotation like `@[Link]`
+func (l *CrystalLexer) startsVariable() bool {
+	next := l.position + 1
+	if next < len(l.text) && l.text[next] == '@' {
+		next++
+	}
+	return isIdentifierStart(l.runeAt(next))
+}
+
+// readVariable reads an instance variable (`@name`) or class variable
+// (`@@count`) including its sigil
+func (l *CrystalLexer) readVariable() {
+	start := l.position
+	startLine, startCol := l.line, l.column
+	tokenType := TokenInstanceVar
+
+	l.advance()
+	if l.text[l.position] == '@' {
+		tokenType = TokenClassVar
+		l.advance()
+	}
+	l.skipIdentifier()
+
+	value := l.text[start:l.position]
+	l.addToken(tokenType, value, startLine, startCol)
+}
+
+// percentDelimiters maps the opening delimiters of percent literals to their
+// closing counterparts
+var percentDelimiters = map[byte]byte{'(': ')', '[': ']', '{': '}', '<': '>'}
+
+// startsPercentLiteral reports whether the `%` at the current position opens
+// a literal such as `%w[a b]` or `%(text)` rather than being the modulo
+// operator. After a value (`a % b`, `a%(b)`) it is modulo.
+func (l *CrystalLexer) startsPercentLiteral() bool {
+	next := l.position + 1
+	if next < len(l.text) && strings.IndexByte("wiqQr", l.text[next]) >= 0 {
+		next++
+	}
+	if next >= len(l.text) {
+		return false
+	}
+	if _, ok := percentDelimiters[l.text[next]]; !ok {
+		return false
+	}
+	return l.expectsValue()
+}
+
+// expectsValue reports whether a literal may start at the current position,
+// judged by the token before it: at the start of the input, after an
+// operator other than a closing bracket, after a keyword, or after a name
+// and a space as a call argument. Anywhere else an operator character is
+// a binary operator applied to the preceding value.
+func (l *CrystalLexer) expectsValue() bool {
+	if len(l.tokens) == 0 {
+		return true
+	}
+	prev := l.tokens[len(l.tokens)-1]
+	switch prev.Type {
+	case TokenOperator:
+		return prev.Value != ")" && prev.Value != "]" && prev.Value != "}"
+	case TokenKeyword:
+		return true
+	case TokenIdentifier:
+		// `puts %w[a b]` is a call with a literal argument
+		return l.position > 0 && (l.text[l.position-1] == ' ' || l.text[l.position-1] == '\t')
+	}
+	return false
+}
+
+// heredocStartRegexp matches the opening of a heredoc: `<<-ID`, `<<~ID`,
+// a quoted `<<-'ID'`, or a bare `<<ID` whose identifier is upper case
+var heredocStartRegexp = regexp.MustCompile(`^<<(?:([-~])(?:([A-Za-z_]\w*)|'([A-Za-z_]\w*)')|([A-Z][A-Z0-9_]*)\b)`)
+
+// startsHeredoc reports whether the `<` at the current position opens a
+// heredoc rather than being a shift or comparison
+func (l *CrystalLexer) startsHeredoc() bool {
+	return heredocStartRegexp.MatchString(l.text[l.position:]) && l.expectsValue()
+}
+
+// readHeredocStart reads the `<<-ID` opening a heredoc as a string token and
+// remembers its terminator; the body is read once the line ends
+func (l *CrystalLexer) readHeredocStart() {
+	start := l.position
+	startLine, startCol := l.line, l.column
+
+	match := heredocStartRegexp.FindStringSubmatch(l.text[l.position:])
+	for range match[0] {
+		l.advance()
+	}
+	l.heredocs = append(l.heredocs, heredoc{
+		terminator: match[2] + match[3] + match[4],
+		indented:   match[1] != "",
+	})
+
+	value := l.text[start:l.position]
+	l.addToken(TokenString, value, startLine, startCol)
+}
+
+// readHeredocBodies reads the bodies of the heredocs opened on the previous
+// line, in order, each as a single string token running through its
+// terminator line. A body without a terminator runs to the end of the text.
+func (l *CrystalLexer) readHeredocBodies() {
+	for i, doc := range l.heredocs {
+		if i > 0 {
+			if l.position >= len(l.text) {
+				break
+			}
+			l.advance() // Newline after the previous terminator
+		}
+
+		start := l.position
+		startLine, startCol := l.line, l.column
+		for l.position < len(l.text) {
+			end := strings.IndexByte(l.text[l.position:], '\n')
+			if end < 0 {
+				end = len(l.text) - l.position
+			}
+			line := strings.TrimSuffix(l.text[l.position:l.position+end], "\r")
+			if doc.indented {
+				line = strings.TrimLeft(line, " \t")
+			}
+			for j := 0; j < end; j++ {
+				l.advance()
+			}
+			if line == doc.terminator {
+				break
+			}
+			if l.position < len(l.text) {
+				l.advance()
+			}
+		}
+
+		value := l.text[start:l.position]
+		l.addToken(TokenString, value, startLine, startCol)
+	}
+	l.heredocs = nil
+}
+
+// readPercentLiteral reads a percent literal. Nested delimiters are balanced
+// so `%(a (b) c)` is a single token. `%i[...]` produces a symbol token and
+// every other form a string token.
+func (l *CrystalLexer) readPercentLiteral() {
 	start := l.position
-	startCol := l.column
+	startLine, startCol := l.line, l.column
+	tokenType := TokenString
+
+	l.advance() // %
+	if l.text[l.position] == 'i' {
+		tokenType = TokenSymbol
+	}
+	if _, ok := percentDelimiters[l.text[l.position]]; !ok {
+		l.advance()
+	}
+
+	open := l.text[l.position]
+	closing := percentDelimiters[open]
+	l.advance()
 
-	for l.position < len(l.text) && (isDigit(l.text[l.position]) || l.text[l.position] == '.') {
+	depth := 1
+	for l.position < len(l.text) && depth > 0 {
+		switch ch := l.text[l.position]; {
+		case ch == '\\' && l.position+1 < len(l.text):
+			l.advance()
+		case ch == open:
+			depth++
+		case ch == closing:
+			depth--
+		}
 		l.advance()
 	}
 
 	value := l.text[start:l.position]
-	l.addToken(TokenNumber, value, startCol, len(value))
+	l.addToken(tokenType, value, startLine, startCol)
+}
+
+// startsRegex reports whether the `/` at the current position opens a regex
+// literal rather than dividing. Division follows a value, so a regex is only
+// assumed where a literal may start: at the start of a line, after an
+// operator or keyword, or after a name and a space as a call argument
+// (`puts /x/`). In that last case the body must not start with a space, so
+// `a / b` still divides. The literal must also close on the same line.
+func (l *CrystalLexer) startsRegex() bool {
+	if next := l.peek(1); next == '/' || next == '=' || next == ' ' && l.afterName() {
+		return false
+	}
+	lineStart := len(l.tokens) == 0 || l.tokens[len(l.tokens)-1].Position.Line != l.line
+	return (lineStart || l.expectsValue()) && regexEnd(l.text, l.position) > 0
+}
+
+// afterName reports whether the last token is an identifier or constant
+func (l *CrystalLexer) afterName() bool {
+	if len(l.tokens) == 0 {
+		return false
+	}
+	prev := l.tokens[len(l.tokens)-1]
+	return prev.Type == TokenIdentifier || prev.Type == TokenConstant
+}
+
+// regexEnd returns the offset after the `/` closing the regex literal that
+// opens at start, or -1 if it doesn't close on its line. Escaped slashes and
+// slashes inside a character class don't close it.
+func regexEnd(text string, start int) int {
+	inClass := false
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\n':
+			return -1
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// readRegex reads a regex literal such as `/a(b)?/i`, including its flags
+func (l *CrystalLexer) readRegex() {
+	start := l.position
+	startLine, startCol := l.line, l.column
+
+	for end := regexEnd(l.text, l.position); l.position < end; {
+		l.advance()
+	}
+	for l.position < len(l.text) && strings.IndexByte("imx", l.text[l.position]) >= 0 {
+		l.advance()
+	}
+
+	value := l.text[start:l.position]
+	l.addToken(TokenRegex, value, startLine, startCol)
+}
+
+// readNumber reads an integer or float literal, including `_` separators,
+// `0x`/`0b`/`0o` radix prefixes, exponents and type suffixes like `_i64`
+func (l *CrystalLexer) readNumber() {
+	start := l.position
+	startLine, startCol := l.line, l.column
+
+	digit := isDigit
+	radix := false
+	if l.peek(0) == '0' {
+		switch l.peek(1) {
+		case 'x':
+			digit, radix = isHexDigit, true
+		case 'b':
+			digit, radix = func(ch byte) bool { return ch == '0' || ch == '1' }, true
+		case 'o':
+			digit, radix = func(ch byte) bool { return ch >= '0' && ch <= '7' }, true
+		}
+	}
+	if radix {
+		l.advance()
+		l.advance()
+	}
+	l.skipDigits(digit)
+
+	if !radix {
+		// A dot only continues the number when a digit follows, so `1..5`
+		// and `1.to_s` keep their operators
+		if l.peek(0) == '.' && isDigit(l.peek(1)) {
+			l.advance()
+			l.skipDigits(isDigit)
+		}
+		if l.peek(0) == 'e' || l.peek(0) == 'E' {
+			sign := 0
+			if l.peek(1) == '+' || l.peek(1) == '-' {
+				sign = 1
+			}
+			if isDigit(l.peek(1 + sign)) {
+				for i := 0; i <= sign; i++ {
+					l.advance()
+				}
+				l.skipDigits(isDigit)
+			}
+		}
+	}
+
+	// Type suffix: `1i64`, `1_u8`, `3.14_f32`
+	suffix := 0
+	if l.peek(0) == '_' {
+		suffix = 1
+	}
+	if kind := l.peek(suffix); (kind == 'i' || kind == 'u' || kind == 'f') && isDigit(l.peek(suffix+1)) {
+		for i := 0; i <= suffix; i++ {
+			l.advance()
+		}
+		l.skipDigits(isDigit)
+	}
+
+	value := l.text[start:l.position]
+	l.addToken(TokenNumber, value, startLine, startCol)
+}
+
+// skipDigits advances over digits accepted by digit and `_` separators that
+// are followed by another digit
+func (l *CrystalLexer) skipDigits(digit func(byte) bool) {
+	for l.position < len(l.text) {
+		ch := l.text[l.position]
+		if !digit(ch) && !(ch == '_' && digit(l.peek(1))) {
+			return
+		}
+		l.advance()
+	}
+}
+
+// peek returns the byte offset bytes ahead of the current position, or 0
+func (l *CrystalLexer) peek(offset int) byte {
+	if l.position+offset < len(l.text) {
+		return l.text[l.position+offset]
+	}
+	return 0
 }
 
 func (l *CrystalLexer) readIdentifierOrKeyword() {
 	start := l.position
-	startCol := l.column
+	startLine, startCol := l.line, l.column
 
-	for l.position < len(l.text) && (isAlphaNumeric(l.text[l.position]) || l.text[l.position] == '_' || l.text[l.position] == '?' || l.text[l.position] == '!') {
+	l.skipIdentifier()
+	for l.position < len(l.text) && (l.text[l.position] == '?' || l.text[l.position] == '!') {
 		l.advance()
 	}
 
@@ -167,7 +548,7 @@ func (l *CrystalLexer) readIdentifierOrKeyword() {
 
 	// Check if it's a keyword
 	keywords := []string{
-		"abstract", "alias", "and", "as", "begin", "break", "case", "class",
+		"abstract", "alias", "and", "annotation", "as", "begin", "break", "case", "class",
 		"def", "do", "else", "elsif", "end", "ensure", "enum", "extend",
 		"false", "for", "fun", "if", "in", "include", "instance_sizeof",
 		"is_a?", "lib", "macro", "module", "next", "nil", "not", "of",
@@ -185,52 +566,160 @@ func (l *CrystalLexer) readIdentifierOrKeyword() {
 	}
 
 	// Check if it's a constant (starts with uppercase)
-	if len(value) > 0 && isUppercase(value[0]) {
+	if first, _ := utf8.DecodeRuneInString(value); unicode.IsUpper(first) {
 		tokenType = TokenConstant
 	}
 
-	l.addToken(tokenType, value, startCol, len(value))
+	l.addToken(tokenType, value, startLine, startCol)
+}
+
+// multiCharOperators lists operators longer than one byte, longest first so
+// the first match is the greedy one
+var multiCharOperators = []string{
+	"<=>", "===", "...", "**=", "<<=", ">>=", "&&=", "||=", "//=",
+	"==", "!=", "=~", "!~", "<=", ">=", "<<", ">>", "&&", "||", "**", "//",
+	"=>", "->", "..", "::",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=",
 }
 
 func (l *CrystalLexer) readOperator() {
 	start := l.position
-	startCol := l.column
-	l.advance()
+	startLine, startCol := l.line, l.column
+
+	length := 1
+	for _, operator := range multiCharOperators {
+		if strings.HasPrefix(l.text[l.position:], operator) {
+			length = len(operator)
+			break
+		}
+	}
+	for i := 0; i < length; i++ {
+		l.advance()
+	}
 
 	value := l.text[start:l.position]
-	l.addToken(TokenOperator, value, startCol, len(value))
+	l.addToken(TokenOperator, value, startLine, startCol)
 }
 
+// operatorSymbols are the operator method names that may follow `:` in a
+// symbol literal, longest first
+var operatorSymbols = []string{
+	"[]=", "[]?", "<=>", "===", "[]", "==", "!=", "=~", "!~", "<<", ">>",
+	"<=", ">=", "**", "+", "-", "*", "/", "%", "<", ">", "!", "~", "&", "|", "^",
+}
+
+// startsSymbol reports whether the `:` at the current position begins a
+// symbol literal. A colon directly after a name is a hash key or named
+// argument (`{key: 1}`), and one followed by a space is a ternary branch or
+// type annotation (`a ? 1 : 2`, `x : Int32`).
+func (l *CrystalLexer) startsSymbol() bool {
+	if prev, _ := utf8.DecodeLastRuneInString(l.text[:l.position]); isIdentifierChar(prev) || prev == '?' || prev == '!' || prev == ':' {
+		return false
+	}
+
+	if next := l.runeAt(l.position + 1); isIdentifierStart(next) || next == '"' {
+		return true
+	}
+	for _, operator := range operatorSymbols {
+		if strings.HasPrefix(l.text[l.position+1:], operator) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSymbol reads a symbol literal: `:name`, `:name?`, `:+` or `:"quoted"`
 func (l *CrystalLexer) readSymbol() {
 	start := l.position
-	startCol := l.column
+	startLine, startCol := l.line, l.column
 	l.advance()
 
-	// Read the symbol name
-	for l.position < len(l.text) && (isAlphaNumeric(l.text[l.position]) || l.text[l.position] == '_') {
+	switch next := l.peek(0); {
+	case next == '"':
 		l.advance()
+		for l.position < len(l.text) && l.text[l.position] != '"' && l.text[l.position] != '\n' {
+			if l.text[l.position] == '\\' {
+				l.advance()
+			}
+			l.advance()
+		}
+		if l.peek(0) == '"' {
+			l.advance()
+		}
+	case isIdentifierStart(l.runeAt(l.position)):
+		l.skipIdentifier()
+		if c := l.peek(0); c == '?' || c == '!' || (c == '=' && l.peek(1) != '=' && l.peek(1) != '>') {
+			l.advance()
+		}
+	default:
+		for _, operator := range operatorSymbols {
+			if strings.HasPrefix(l.text[l.position:], operator) {
+				for range operator {
+					l.advance()
+				}
+				break
+			}
+		}
 	}
 
 	value := l.text[start:l.position]
-	l.addToken(TokenSymbol, value, startCol, len(value))
+	l.addToken(TokenSymbol, value, startLine, startCol)
 }
 
 func (l *CrystalLexer) advance() {
 	if l.position < len(l.text) {
+		if l.text[l.position] == '\n' {
+			// Multi-line strings span lines; keep line tracking in sync
+			l.line++
+			l.column = 0
+		} else if positionEncoding == PositionEncodingUTF8 {
+			// UTF-8 columns count bytes
+			l.column++
+		} else if ch := l.text[l.position]; ch < 0x80 || ch >= 0xC0 {
+			// UTF-16 columns count one unit per code point and two for
+			// code points outside the BMP
+			l.column++
+			if ch >= 0xF0 {
+				l.column++
+			}
+		}
 		l.position++
-		l.column++
 	}
 }
 
-func (l *CrystalLexer) addToken(tokenType TokenType, value string, startCol, length int) {
+// runeAt returns the code point starting at byte offset i, or utf8.RuneError
+func (l *CrystalLexer) runeAt(i int) rune {
+	if i >= len(l.text) {
+		return utf8.RuneError
+	}
+	r, _ := utf8.DecodeRuneInString(l.text[i:])
+	return r
+}
+
+// skipIdentifier advances over letters, digits and underscores, including
+// non-ASCII letters
+func (l *CrystalLexer) skipIdentifier() {
+	for l.position < len(l.text) {
+		r, size := utf8.DecodeRuneInString(l.text[l.position:])
+		if !isIdentifierChar(r) {
+			return
+		}
+		for i := 0; i < size; i++ {
+			l.advance()
+		}
+	}
+}
+
+// addToken appends a token; its length is measured in the position encoding
+func (l *CrystalLexer) addToken(tokenType TokenType, value string, startLine, startCol int) {
 	token := Token{
 		Type:  tokenType,
 		Value: value,
 		Position: Position{
-			Line:      l.line,
+			Line:      startLine,
 			Character: startCol,
 		},
-		Length: length,
+		Length: encodedLen(value),
 	}
 	l.tokens = append(l.tokens, token)
 }
@@ -240,16 +729,66 @@ func isDigit(ch byte) bool {
 	return ch >= '0' && ch <= '9'
 }
 
-func isLetter(ch byte) bool {
-	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+func isIdentifierStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
 }
 
-func isAlphaNumeric(ch byte) bool {
-	return isLetter(ch) || isDigit(ch)
+func isIdentifierChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
 }
 
-func isUppercase(ch byte) bool {
-	return ch >= 'A' && ch <= 'Z'
+// Position encodings a client and server can agree on in initialize
+const (
+	PositionEncodingUTF8  = "utf-8"
+	PositionEncodingUTF16 = "utf-16"
+)
+
+// positionEncoding is how the characters of a Position are counted. A
+// process serves a single client, so it is set once for all documents.
+var positionEncoding = PositionEncodingUTF16
+
+// SetPositionEncoding chooses how position characters are counted
+func SetPositionEncoding(encoding string) {
+	positionEncoding = encoding
+}
+
+// encodedLen returns the length of text in the units of the negotiated
+// position encoding: bytes for UTF-8, code units for UTF-16
+func encodedLen(text string) int {
+	if positionEncoding == PositionEncodingUTF8 {
+		return len(text)
+	}
+	length := 0
+	for _, r := range text {
+		length++
+		if r > 0xFFFF {
+			length++
+		}
+	}
+	return length
+}
+
+// byteOffset converts a character offset within line to a byte offset,
+// clamped to the length of the line
+func byteOffset(line string, character int) int {
+	if positionEncoding == PositionEncodingUTF8 {
+		return min(max(character, 0), len(line))
+	}
+	units := 0
+	for i, r := range line {
+		if units >= character {
+			return i
+		}
+		units++
+		if r > 0xFFFF {
+			units++
+		}
+	}
+	return len(line)
 }
 
 func isOperator(ch byte) bool {
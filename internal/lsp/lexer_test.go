@@ -58,6 +58,30 @@ end`)
 	}
 }
 
+func TestCrystalLexer_Variables(t *testing.T) {
+	tokens := NewCrystalLexer("@@count += @value\n@[Link(\"c\")]").Tokenize()
+
+	expected := []struct {
+		tokenType TokenType
+		value     string
+	}{
+		{TokenClassVar, "@@count"},
+		{TokenOperator, "+="},
+		{TokenInstanceVar, "@value"},
+		{TokenOperator, "@"},
+		{TokenOperator, "["},
+	}
+
+	if len(tokens) < len(expected) {
+		t.Fatalf("Expected at least %d tokens, got %d", len(expected), len(tokens))
+	}
+	for i, want := range expected {
+		if tokens[i].Type != want.tokenType || tokens[i].Value != want.value {
+			t.Errorf("Expected token %d to be %q (type %d), got %q (type %d)", i, want.value, want.tokenType, tokens[i].Value, tokens[i].Type)
+		}
+	}
+}
+
 func TestCrystalLexer_GetTokenAtPosition(t *testing.T) {
 	lexer := NewCrystalLexer("def hello\n  puts world")
 	lexer.Tokenize()
@@ -81,6 +105,9 @@ func TestTokenTypes(t *testing.T) {
 		{"MyClass", TokenConstant, "MyClass"},
 		{"my_var", TokenIdentifier, "my_var"},
 		{`"hello"`, TokenString, `"hello"`},
+		{`'a'`, TokenChar, `'a'`},
+		{"@a", TokenInstanceVar, "@a"},
+		{"@@b", TokenClassVar, "@@b"},
 		{"123", TokenNumber, "123"},
 		{"# comment", TokenComment, "# comment"},
 		{":sym", TokenSymbol, ":sym"},
@@ -91,19 +118,6 @@ func TestTokenTypes(t *testing.T) {
 		lexer := NewCrystalLexer(test.input)
 		tokens := lexer.Tokenize()
 
-		if test.input == ":sym" {
-			// Symbol tokenization creates 2 tokens: ':' and 'sym'
-			if len(tokens) != 2 {
-				t.Errorf("Expected 2 tokens for input '%s', got %d", test.input, len(tokens))
-				continue
-			}
-			// Check the first token is the symbol
-			if tokens[0].Type != TokenOperator || tokens[0].Value != ":" {
-				t.Errorf("Expected ':' operator token for '%s', got type %d value '%s'", test.input, tokens[0].Type, tokens[0].Value)
-			}
-			continue
-		}
-
 		if len(tokens) != 1 {
 			t.Errorf("Expected 1 token for input '%s', got %d", test.input, len(tokens))
 			continue
@@ -118,3 +132,318 @@ func TestTokenTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestCrystalLexer_MultiCharOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"a <=> b", []string{"a", "<=>", "b"}},
+		{"a === b", []string{"a", "===", "b"}},
+		{"1..5", []string{"1", "..", "5"}},
+		{"1...5", []string{"1", "...", "5"}},
+		{"x += 1.5", []string{"x", "+=", "1.5"}},
+		{"a && b || c", []string{"a", "&&", "b", "||", "c"}},
+		{"{a => 1}", []string{"{", "a", "=>", "1", "}"}},
+		{"Foo::Bar", []string{"Foo", "::", "Bar"}},
+		{"x != y", []string{"x", "!=", "y"}},
+	}
+
+	for _, test := range tests {
+		tokens := NewCrystalLexer(test.input).Tokenize()
+
+		if len(tokens) != len(test.expected) {
+			t.Errorf("Expected %d tokens for input '%s', got %d", len(test.expected), test.input, len(tokens))
+			continue
+		}
+		for i, value := range test.expected {
+			if tokens[i].Value != value {
+				t.Errorf("Expected token %d of '%s' to be '%s', got '%s'", i, test.input, value, tokens[i].Value)
+			}
+		}
+	}
+}
+
+func TestCrystalLexer_CharLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`'a'`, []string{`'a'`}},
+		{`'\n'`, []string{`'\n'`}},
+		{`'\''`, []string{`'\''`}},
+		{`'\u0041'`, []string{`'\u0041'`}},
+		{`'\u{1F600}'`, []string{`'\u{1F600}'`}},
+		{`'é'`, []string{`'é'`}},
+		{`x = 'a'; y = 'b'`, []string{"x", "=", `'a'`, ";", "y", "=", `'b'`}},
+	}
+
+	for _, test := range tests {
+		tokens := NewCrystalLexer(test.input).Tokenize()
+
+		if len(tokens) != len(test.expected) {
+			t.Errorf("Expected %d tokens for input '%s', got %d", len(test.expected), test.input, len(tokens))
+			continue
+		}
+		for i, value := range test.expected {
+			if tokens[i].Value != value {
+				t.Errorf("Expected token %d of '%s' to be '%s', got '%s'", i, test.input, value, tokens[i].Value)
+			}
+			if value[0] == '\'' && tokens[i].Type != TokenChar {
+				t.Errorf("Expected '%s' to be a char token, got type %d", value, tokens[i].Type)
+			}
+		}
+	}
+}
+
+func TestCrystalLexer_PercentLiterals(t *testing.T) {
+	tests := []struct {
+		input     string
+		tokenType TokenType
+		value     string
+	}{
+		{"words = %w[foo bar]", TokenString, "%w[foo bar]"},
+		{"greeting = %(hello world)", TokenString, "%(hello world)"},
+		{"names = %i[x y]", TokenSymbol, "%i[x y]"},
+		{"text = %q{a {nested} b}", TokenString, "%q{a {nested} b}"},
+		{"puts %<angle>", TokenString, "%<angle>"},
+	}
+
+	for _, test := range tests {
+		tokens := NewCrystalLexer(test.input).Tokenize()
+		last := tokens[len(tokens)-1]
+		if last.Type != test.tokenType || last.Value != test.value {
+			t.Errorf("Expected '%s' to end with %q (type %d), got %q (type %d)", test.input, test.value, test.tokenType, last.Value, last.Type)
+		}
+	}
+
+	// Modulo is still an operator
+	tokens := NewCrystalLexer("x = a%(b)\ny = c % d\nz = (e)%(f)").Tokenize()
+	for _, token := range tokens {
+		if token.Type == TokenString {
+			t.Errorf("Expected no string tokens in modulo expressions, got %q", token.Value)
+		}
+	}
+}
+
+func TestCrystalLexer_NumberLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"1_000", []string{"1_000"}},
+		{"1_000_000", []string{"1_000_000"}},
+		{"0xFF", []string{"0xFF"}},
+		{"0b1010", []string{"0b1010"}},
+		{"0o17", []string{"0o17"}},
+		{"2.5e-3", []string{"2.5e-3"}},
+		{"1e10", []string{"1e10"}},
+		{"1_i64", []string{"1_i64"}},
+		{"3.14_f32", []string{"3.14_f32"}},
+		{"255u8", []string{"255u8"}},
+		{"0..10", []string{"0", "..", "10"}},
+		{"1...3", []string{"1", "...", "3"}},
+		{"1.to_s", []string{"1", ".", "to_s"}},
+	}
+
+	for _, test := range tests {
+		tokens := NewCrystalLexer(test.input).Tokenize()
+
+		if len(tokens) != len(test.expected) {
+			t.Errorf("Expected %d tokens for input '%s', got %d", len(test.expected), test.input, len(tokens))
+			continue
+		}
+		for i, value := range test.expected {
+			if tokens[i].Value != value {
+				t.Errorf("Expected token %d of '%s' to be '%s', got '%s'", i, test.input, value, tokens[i].Value)
+			}
+		}
+		if tokens[0].Type != TokenNumber {
+			t.Errorf("Expected '%s' to start with a number token, got type %d", test.input, tokens[0].Type)
+		}
+	}
+}
+
+func TestCrystalLexer_Symbols(t *testing.T) {
+	tests := []struct {
+		input   string
+		symbols []string
+	}{
+		{":ok", []string{":ok"}},
+		{"x = a ? 1 : 2", nil},
+		{"x = a ? b : c", nil},
+		{"{key: 1, other: :value}", []string{":value"}},
+		{"def foo(x : Int32)", nil},
+		{"Foo::Bar", nil},
+		{"ops = [:+, :<=>, :[]=, :empty?]", []string{":+", ":<=>", ":[]=", ":empty?"}},
+		{`name = :"foo bar"`, []string{`:"foo bar"`}},
+	}
+
+	for _, test := range tests {
+		var symbols []string
+		for _, token := range NewCrystalLexer(test.input).Tokenize() {
+			if token.Type == TokenSymbol {
+				symbols = append(symbols, token.Value)
+			}
+		}
+
+		if len(symbols) != len(test.symbols) {
+			t.Errorf("Expected symbols %v for '%s', got %v", test.symbols, test.input, symbols)
+			continue
+		}
+		for i, symbol := range test.symbols {
+			if symbols[i] != symbol {
+				t.Errorf("Expected symbol '%s' in '%s', got '%s'", symbol, test.input, symbols[i])
+			}
+		}
+	}
+}
+
+func TestCrystalLexer_UnicodeIdentifiers(t *testing.T) {
+	tokens := NewCrystalLexer("café = 1\nnaïve_größe = café + 😀x").Tokenize()
+
+	expected := []struct {
+		value     string
+		tokenType TokenType
+		line      int
+		character int
+		length    int
+	}{
+		{"café", TokenIdentifier, 0, 0, 4},
+		{"=", TokenOperator, 0, 5, 1},
+		{"1", TokenNumber, 0, 7, 1},
+		{"naïve_größe", TokenIdentifier, 1, 0, 11},
+		{"=", TokenOperator, 1, 12, 1},
+		{"café", TokenIdentifier, 1, 14, 4},
+		{"+", TokenOperator, 1, 19, 1},
+		// The emoji is two UTF-16 code units wide
+		{"x", TokenIdentifier, 1, 23, 1},
+	}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d: %+v", len(expected), len(tokens), tokens)
+	}
+	for i, want := range expected {
+		token := tokens[i]
+		if token.Value != want.value || token.Type != want.tokenType {
+			t.Errorf("Expected token %d to be %q (type %d), got %q (type %d)", i, want.value, want.tokenType, token.Value, token.Type)
+		}
+		if token.Position.Line != want.line || token.Position.Character != want.character || token.Length != want.length {
+			t.Errorf("Expected %q at %d:%d with length %d, got %d:%d with length %d", want.value,
+				want.line, want.character, want.length, token.Position.Line, token.Position.Character, token.Length)
+		}
+	}
+}
+
+func TestCrystalLexer_UTF8Positions(t *testing.T) {
+	SetPositionEncoding(PositionEncodingUTF8)
+	t.Cleanup(func() { SetPositionEncoding(PositionEncodingUTF16) })
+
+	tokens := NewCrystalLexer("café = \"😀\" + x").Tokenize()
+
+	// Columns and lengths count bytes
+	expected := []struct {
+		value     string
+		character int
+		length    int
+	}{
+		{"café", 0, 5},
+		{"=", 6, 1},
+		{`"😀"`, 8, 6},
+		{"+", 15, 1},
+		{"x", 17, 1},
+	}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d: %+v", len(expected), len(tokens), tokens)
+	}
+	for i, want := range expected {
+		token := tokens[i]
+		if token.Value != want.value || token.Position.Character != want.character || token.Length != want.length {
+			t.Errorf("Expected %q at %d with length %d, got %q at %d with length %d", want.value,
+				want.character, want.length, token.Value, token.Position.Character, token.Length)
+		}
+	}
+
+	if offset := byteOffset("café = 1", 6); offset != 6 {
+		t.Errorf("Expected UTF-8 characters to be byte offsets, got %d", offset)
+	}
+}
+
+func TestCrystalLexer_Heredocs(t *testing.T) {
+	text := "message = <<-TEXT\n  say \"hi\n  words if end\n  TEXT\nputs message"
+	tokens := NewCrystalLexer(text).Tokenize()
+
+	expected := []struct {
+		tokenType TokenType
+		value     string
+		line      int
+	}{
+		{TokenIdentifier, "message", 0},
+		{TokenOperator, "=", 0},
+		{TokenString, "<<-TEXT", 0},
+		{TokenString, "  say \"hi\n  words if end\n  TEXT", 1},
+		{TokenKeyword, "puts", 4},
+		{TokenIdentifier, "message", 4},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d: %+v", len(expected), len(tokens), tokens)
+	}
+	for i, want := range expected {
+		if tokens[i].Type != want.tokenType || tokens[i].Value != want.value || tokens[i].Position.Line != want.line {
+			t.Errorf("Token %d: expected %q (type %d) on line %d, got %+v", i, want.value, want.tokenType, want.line, tokens[i])
+		}
+	}
+
+	// Two heredocs on one line are read in order after it
+	tokens = NewCrystalLexer("join(<<-A, <<~B)\na\nA\n  b\n  B\nx").Tokenize()
+	var bodies []string
+	for _, token := range tokens {
+		if token.Type == TokenString {
+			bodies = append(bodies, token.Value)
+		}
+	}
+	if len(bodies) != 4 || bodies[2] != "a\nA" || bodies[3] != "  b\n  B" {
+		t.Errorf("Expected both heredoc bodies, got %q", bodies)
+	}
+	if last := tokens[len(tokens)-1]; last.Value != "x" || last.Position.Line != 5 {
+		t.Errorf("Expected lexing to resume after the bodies, got %+v", last)
+	}
+
+	// Shifts are still operators
+	tokens = NewCrystalLexer("list << item\nn = 1 << 2\nitems <<-1").Tokenize()
+	for _, token := range tokens {
+		if token.Type == TokenString {
+			t.Errorf("Expected no string tokens in shift expressions, got %q", token.Value)
+		}
+	}
+}
+
+func TestCrystalLexer_RegexLiterals(t *testing.T) {
+	tests := []struct {
+		input string
+		value string
+	}{
+		{"x = /a.b/", "/a.b/"},
+		{"pattern = /foo(bar)?/i", "/foo(bar)?/i"},
+		{"matched = line =~ /a\\/b[/]/", "/a\\/b[/]/"},
+		{"puts /x+/", "/x+/"},
+		{"  /^#/", "/^#/"},
+	}
+
+	for _, test := range tests {
+		tokens := NewCrystalLexer(test.input).Tokenize()
+		last := tokens[len(tokens)-1]
+		if last.Type != TokenRegex || last.Value != test.value {
+			t.Errorf("Expected '%s' to end with regex %q, got %q (type %d)", test.input, test.value, last.Value, last.Type)
+		}
+	}
+
+	// Division after a value is still an operator
+	tokens := NewCrystalLexer("a / b\nc = (d) / 2 / e\nf /= 2\nratio = total/count/2").Tokenize()
+	for _, token := range tokens {
+		if token.Type == TokenRegex {
+			t.Errorf("Expected no regex tokens in divisions, got %q", token.Value)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package lsp
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var requireRegexp = regexp.MustCompile(`^\s*require\s+"([^"]+)"`)
+
+// GetDocumentLinks returns a link for every `require` whose target file can
+// be found. Relative requires resolve against the document's directory; the
+// others against the `src` and shard `lib` directories of root. Standard
+// library requires and wildcards resolve to nothing and get no link.
+func (a *CrystalAnalyzer) GetDocumentLinks(doc *TextDocumentItem, root string) []DocumentLink {
+	links := []DocumentLink{}
+	dir := filepath.Dir(uriToPath(doc.URI))
+
+	for lineNum, line := range strings.Split(doc.Text, "\n") {
+		match := requireRegexp.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+
+		target := resolveRequire(line[match[2]:match[3]], dir, root)
+		if target == "" {
+			continue
+		}
+		links = append(links, DocumentLink{
+			Range: Range{
+				Start: Position{Line: lineNum, Character: encodedLen(line[:match[2]])},
+				End:   Position{Line: lineNum, Character: encodedLen(line[:match[3]])},
+			},
+			Target: pathToURI(target),
+		})
+	}
+
+	return links
+}
+
+// GetRequireHover describes the file a `require` string under the cursor
+// resolves to, the same way GetDocumentLinks resolves it, or notes that it
+// can't be found. It returns nil when the cursor is not on a require string.
+func (a *CrystalAnalyzer) GetRequireHover(doc *TextDocumentItem, pos Position, root string) *Hover {
+	lines := strings.Split(doc.Text, "\n")
+	if pos.Line >= len(lines) {
+		return nil
+	}
+
+	line := lines[pos.Line]
+	match := requireRegexp.FindStringSubmatchIndex(line)
+	if match == nil {
+		return nil
+	}
+	// The quotes count as part of the string
+	start := Position{Line: pos.Line, Character: encodedLen(line[:match[2]-1])}
+	end := Position{Line: pos.Line, Character: encodedLen(line[:match[3]+1])}
+	if pos.Character < start.Character || pos.Character >= end.Character {
+		return nil
+	}
+
+	path := line[match[2]:match[3]]
+	content := fmt.Sprintf("**require** `%s`", path)
+	switch target := resolveRequire(path, filepath.Dir(uriToPath(doc.URI)), root); {
+	case target != "":
+		content += "\n\n" + pathToURI(target)
+	case strings.Contains(path, "*"):
+		content += "\n\nRequires every file the pattern matches"
+	case strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../"):
+		content += "\n\nFile not found"
+	default:
+		content += "\n\nNot found in the project or its shards; it may be part of the standard library"
+	}
+
+	return &Hover{
+		Contents: []string{content},
+		Range:    &Range{Start: start, End: end},
+	}
+}
+
+// resolveRequire returns the file a require path refers to, or "" if it
+// can't be found
+func resolveRequire(path, dir, root string) string {
+	for _, candidate := range requireCandidates(path, dir, root) {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// requireCandidates returns the files a require path may refer to, in the
+// order they are tried, whether or not they exist. `require "foo"` may name
+// foo.cr or foo/foo.cr. Wildcards have no candidates.
+func requireCandidates(path, dir, root string) []string {
+	if strings.Contains(path, "*") {
+		return nil
+	}
+
+	var bases []string
+	switch {
+	case strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../"):
+		bases = append(bases, filepath.Join(dir, filepath.FromSlash(path)))
+	case root != "":
+		name := filepath.FromSlash(path)
+		shard := strings.SplitN(path, "/", 2)[0]
+		bases = append(bases,
+			filepath.Join(root, "src", name),
+			filepath.Join(root, "lib", shard, "src", name),
+		)
+	}
+
+	var candidates []string
+	for _, base := range bases {
+		base = strings.TrimSuffix(base, ".cr")
+		candidates = append(candidates, base+".cr", filepath.Join(base, filepath.Base(base)+".cr"))
+	}
+	return candidates
+}
+
+// requiresFile reports whether a require path in a file in dir refers to
+// file. Paths are compared, not resolved, so a file that was just deleted
+// still counts. `./dir/*` matches the files in dir and `./dir/**` those
+// beneath it.
+func requiresFile(path, dir, root, file string) bool {
+	if strings.Contains(path, "*") {
+		if filepath.Ext(file) != ".cr" {
+			return false
+		}
+		if pattern, ok := strings.CutSuffix(path, "/**"); ok {
+			return strings.HasPrefix(file, filepath.Join(dir, filepath.FromSlash(pattern))+string(filepath.Separator))
+		}
+		if pattern, ok := strings.CutSuffix(path, "/*"); ok {
+			return filepath.Dir(file) == filepath.Join(dir, filepath.FromSlash(pattern))
+		}
+		return false
+	}
+
+	for _, candidate := range requireCandidates(path, dir, root) {
+		if candidate == file {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardFiles returns the files a `./dir/*` or `./dir/**` require in a
+// file in dir matches
+func wildcardFiles(path, dir string) []string {
+	pattern, recursive := strings.CutSuffix(path, "/**")
+	if !recursive {
+		var ok bool
+		if pattern, ok = strings.CutSuffix(path, "/*"); !ok {
+			return nil
+		}
+	}
+	base := filepath.Join(dir, filepath.FromSlash(pattern))
+
+	if !recursive {
+		files, _ := filepath.Glob(filepath.Join(base, "*.cr"))
+		return files
+	}
+	var files []string
+	filepath.WalkDir(base, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && filepath.Ext(path) == ".cr" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+// requiresAny reports whether text, the contents of a file in dir, requires
+// one of files, directly or through the files it requires in turn. Only
+// files that resolve within the project and its shards are followed.
+func requiresAny(text, dir, root string, files map[string]bool) bool {
+	visited := map[string]bool{}
+
+	var visit func(text, dir string) bool
+	visit = func(text, dir string) bool {
+		var required []string
+		for _, line := range strings.Split(text, "\n") {
+			match := requireRegexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			for file := range files {
+				if requiresFile(match[1], dir, root, file) {
+					return true
+				}
+			}
+			if target := resolveRequire(match[1], dir, root); target != "" {
+				required = append(required, target)
+			} else {
+				required = append(required, wildcardFiles(match[1], dir)...)
+			}
+		}
+
+		for _, file := range required {
+			if visited[file] {
+				continue
+			}
+			visited[file] = true
+			source, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			if visit(string(source), filepath.Dir(file)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return visit(text, dir)
+}
@@ -0,0 +1,116 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// Trace levels a client sets with $/setTrace
+const (
+	TraceOff      = "off"
+	TraceMessages = "messages"
+	TraceVerbose  = "verbose"
+)
+
+// logf logs a message of the given MessageType. Once the client has
+// initialized with logToClient set, messages are sent as window/logMessage
+// and filtered by the trace level: errors and warnings always, info from
+// `messages` up and log lines only at `verbose`. Before that, and for
+// clients that did not ask for it, everything goes to the log output,
+// filtered only by a log level set with SetLogLevel.
+func (s *Server) logf(messageType int, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+
+	if s.conn == nil || !s.initialized || !s.initializationOptions.LogToClient {
+		if _, logLevel := s.levels(); logLevel == "" || levelAllows(logLevel, messageType) {
+			s.logger.Println(message)
+		}
+		return
+	}
+	if !s.traceAllows(messageType) {
+		return
+	}
+
+	s.conn.Notify(context.Background(), "window/logMessage", map[string]any{
+		"type":    messageType,
+		"message": message,
+	})
+}
+
+// traceAllows reports whether messages of the given type pass the current
+// trace level
+func (s *Server) traceAllows(messageType int) bool {
+	traceLevel, _ := s.levels()
+	return levelAllows(traceLevel, messageType)
+}
+
+// levels returns the trace level and the log level
+func (s *Server) levels() (traceLevel, logLevel string) {
+	s.levelMu.Lock()
+	defer s.levelMu.Unlock()
+	return s.traceLevel, s.logLevel
+}
+
+// setTraceLevel changes the trace level
+func (s *Server) setTraceLevel(level string) {
+	s.levelMu.Lock()
+	s.traceLevel = level
+	s.levelMu.Unlock()
+}
+
+// levelAllows reports whether messages of the given type are logged at a
+// trace level
+func levelAllows(level string, messageType int) bool {
+	switch messageType {
+	case MessageTypeError, MessageTypeWarning:
+		return true
+	case MessageTypeInfo:
+		return level == TraceMessages || level == TraceVerbose
+	}
+	return level == TraceVerbose
+}
+
+// SetLogOutput sends the server's own log lines to w instead of stderr
+func (s *Server) SetLogOutput(w io.Writer) {
+	s.logger.SetOutput(w)
+}
+
+// SetLogLevel filters the server's own log lines by a trace level and makes
+// it the initial trace level, until the client sets its own
+func (s *Server) SetLogLevel(level string) error {
+	switch level {
+	case TraceOff, TraceMessages, TraceVerbose:
+		s.levelMu.Lock()
+		s.logLevel = level
+		s.traceLevel = level
+		s.levelMu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unknown log level %q, expected off, messages or verbose", level)
+}
+
+// logTrace sends a $/logTrace notification for a handled message. At
+// `messages` only the method and timing are sent; at `verbose` the
+// parameters are included as well.
+func (s *Server) logTrace(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request, elapsed time.Duration) {
+	traceLevel, _ := s.levels()
+	if traceLevel != TraceMessages && traceLevel != TraceVerbose {
+		return
+	}
+	kind := "notification"
+	if !req.Notif {
+		kind = "request"
+	}
+	params := map[string]any{
+		"message": fmt.Sprintf("Handled %s '%s' in %s", kind, req.Method, elapsed.Round(time.Microsecond)),
+	}
+	if traceLevel == TraceVerbose && req.Params != nil {
+		params["verbose"] = "Params: " + string(*req.Params)
+	}
+
+	conn.Notify(ctx, "$/logTrace", params)
+}
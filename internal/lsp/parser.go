@@ -0,0 +1,1220 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// blockEvent is a keyword that opens a block, or an `end` that closes one
+type blockEvent struct {
+	Keyword   string
+	Line      int
+	Character int
+}
+
+// blockOpeners are keywords that open a block terminated by `end` when
+// they start a statement. Continuations such as `else`, `elsif`, `when`,
+// `rescue` and `ensure` belong to the block that is already open.
+var blockOpeners = map[string]bool{
+	"class": true, "module": true, "struct": true, "enum": true, "def": true,
+	"if": true, "unless": true, "while": true, "until": true, "case": true,
+	"begin": true, "lib": true, "macro": true, "annotation": true, "union": true,
+}
+
+var (
+	namespaceDefRegexp        = regexp.MustCompile(`^(class|struct|module|enum|annotation)\s+([\p{L}\p{N}_:]+)(?:\s*<\s*([\p{L}\p{N}_:]+))?`)
+	propertyRegexp            = regexp.MustCompile(`^\s*(class_)?(property|getter|setter)([\?!])?\s+(\S.*)$`)
+	recordDefRegexp           = regexp.MustCompile(`^\s*(?:private\s+)?record\s+(\p{Lu}[\p{L}\p{N}_]*)(.*)$`)
+	propertyDeclarationRegexp = regexp.MustCompile(`^([\p{L}\p{N}_]+)(?:\s*:\s*([^=]+?))?(?:\s*=\s*(.+))?$`)
+	methodDefRegexp           = regexp.MustCompile(`^def\s+(self\.)?([\p{L}\p{N}_]+[\?!=]?)\s*(\()?`)
+	macroDefRegexp            = regexp.MustCompile(`^macro\s+([\p{L}\p{N}_]+[\?!=]?)\s*(\()?`)
+	constantDefRegexp         = regexp.MustCompile(`^\s*(\p{Lu}[\p{L}\p{N}_]*)\s*=`)
+	enumMemberRegexp          = regexp.MustCompile(`^\s*(\p{Lu}[\p{L}\p{N}_]*)\s*(?:=\s*([^#]*?))?\s*(?:#.*)?$`)
+	aliasDefRegexp            = regexp.MustCompile(`^\s*(?:private\s+)?alias\s+(\p{Lu}[\p{L}\p{N}_]*)\s*=\s*(.+?)\s*$`)
+)
+
+// scanBlockEvents walks the tokens left to right and returns every block
+// opener and `end` in document order. Keywords used as trailing modifiers
+// (`return x if y`) or as method names (`obj.class`) are not reported.
+func scanBlockEvents(tokens []Token) []blockEvent {
+	var events []blockEvent
+
+	for i, token := range tokens {
+		if token.Type != TokenKeyword {
+			continue
+		}
+
+		var prev *Token
+		if i > 0 && tokens[i-1].Position.Line == token.Position.Line {
+			prev = &tokens[i-1]
+		}
+
+		// `obj.end` or `obj.class` are method calls, not keywords
+		if prev != nil && prev.Value == "." {
+			continue
+		}
+
+		// `{% if %} ... {% end %}` is macro control flow, balanced separately
+		// from the code around it
+		if prev != nil && prev.Value == "%" {
+			continue
+		}
+
+		switch {
+		case token.Value == "end":
+			events = append(events, blockEvent{Keyword: "end", Line: token.Position.Line, Character: token.Position.Character})
+		case token.Value == "do":
+			events = append(events, blockEvent{Keyword: "do", Line: token.Position.Line, Character: token.Position.Character})
+		case blockOpeners[token.Value] && startsStatement(prev, token.Value):
+			events = append(events, blockEvent{Keyword: token.Value, Line: token.Position.Line, Character: token.Position.Character})
+		}
+	}
+
+	return events
+}
+
+// startsStatement reports whether a keyword preceded by prev begins a new
+// statement rather than acting as a modifier
+func startsStatement(prev *Token, keyword string) bool {
+	if prev == nil {
+		return true
+	}
+
+	switch prev.Value {
+	case ";", "=", "(", "then", "else", "begin":
+		return true
+	case "private", "protected":
+		return keyword == "def" || keyword == "class" || keyword == "struct" ||
+			keyword == "module" || keyword == "enum" || keyword == "macro"
+	case "abstract":
+		// `abstract def` declares a method without a body
+		return keyword == "class" || keyword == "struct"
+	}
+
+	return false
+}
+
+// parseDocumentStructure makes the classes and methods of doc the current
+// document state, parsing it only if the cached context is stale
+func (a *CrystalAnalyzer) parseDocumentStructure(doc *TextDocumentItem) {
+	context := a.documentContext(doc)
+	a.documentClasses = context.Classes
+	a.documentMethods = context.Methods
+	a.documentConstants = context.Constants
+	a.documentAliases = context.Aliases
+	a.documentMacros = context.Macros
+}
+
+// parseDocument parses classes, modules and methods in the document.
+// Namespaces are tracked with a stack so nested definitions are attributed to
+// the innermost enclosing scope and recorded under their qualified name.
+func (a *CrystalAnalyzer) parseDocument(doc *TextDocumentItem, tokens []Token) {
+	// Clear previous data
+	a.documentClasses = make(map[string]*ClassInfo)
+	a.documentMethods = make(map[string][]*MethodInfo)
+	a.documentConstants = make(map[string]*ConstantInfo)
+	a.documentAliases = make(map[string]string)
+	a.documentMacros = make(map[string]*MacroInfo)
+
+	lines := strings.Split(doc.Text, "\n")
+	events := scanBlockEvents(tokens)
+
+	// Each stack entry is an open block; definitions carry what they define
+	var stack []openBlock
+	// A bare `private`/`protected` line changes the default for following defs
+	defaultVisibility := make(map[*ClassInfo]string)
+
+	// A `record` with a block: the struct its `do` opens and that line
+	var record *ClassInfo
+	recordLine := -1
+
+	next, nextToken := 0, 0
+	for lineNum, line := range lines {
+		if trimmed := strings.TrimSpace(line); trimmed == "private" || trimmed == "protected" {
+			defaultVisibility[currentNamespace(stack)] = trimmed
+		}
+
+		// Records are declared at the top level or directly in a type body
+		if (len(stack) == 0 || stack[len(stack)-1].Class != nil) && !insideMacro(stack) {
+			if classInfo, lastLine, hasBlock := a.parseRecordDefinition(currentNamespace(stack), lines, lineNum); classInfo != nil && hasBlock {
+				record, recordLine = classInfo, lastLine
+			}
+		}
+
+		// Properties are declared directly in a type body
+		if len(stack) > 0 && stack[len(stack)-1].Class != nil {
+			parsePropertyDefinition(stack[len(stack)-1].Class, lines, lineNum)
+		}
+
+		// Instance variables belong to the type whose body or methods
+		// assign them
+		for ; nextToken < len(tokens) && tokens[nextToken].Position.Line <= lineNum; nextToken++ {
+			if owner := currentNamespace(stack); owner != nil && declaresInstanceVar(tokens, nextToken) {
+				name := strings.TrimPrefix(tokens[nextToken].Value, "@")
+				if _, exists := owner.InstanceVars[name]; !exists {
+					// Like properties, the location points at the name
+					position := tokens[nextToken].Position
+					owner.InstanceVars[name] = Position{Line: position.Line, Character: position.Character + 1}
+				}
+			}
+		}
+
+		// Constants are assigned at the top level or directly in a type body
+		if len(stack) == 0 || stack[len(stack)-1].Class != nil {
+			a.parseConstantDefinition(currentNamespace(stack), lines, lineNum)
+			a.parseAliasDefinition(currentNamespace(stack), line)
+		}
+
+		for ; next < len(events) && events[next].Line == lineNum; next++ {
+			event := events[next]
+
+			if event.Keyword == "end" {
+				if len(stack) > 0 {
+					stack[len(stack)-1].close(lineNum)
+					stack = stack[:len(stack)-1]
+				}
+				continue
+			}
+
+			var block openBlock
+			start := byteOffset(line, event.Character)
+			rest := line[start:]
+
+			// A macro body is a template; definitions in it are only
+			// balanced, not recorded
+			if insideMacro(stack) {
+				stack = append(stack, block)
+				continue
+			}
+
+			switch event.Keyword {
+			case "do":
+				// Methods in a record's block belong to the record
+				if record != nil && lineNum == recordLine {
+					block.Class = record
+					block.Declaration = len(record.Declarations) - 1
+					record = nil
+				}
+			case "class", "struct", "module", "enum", "annotation":
+				block.Class = a.parseNamespaceDefinition(rest, event, currentNamespace(stack))
+				if block.Class != nil {
+					block.Declaration = len(block.Class.Declarations) - 1
+					// A reopening keeps the documentation of the first declaration
+					if documentation := collectDocComment(lines, lineNum); documentation != "" || block.Declaration == 0 {
+						block.Class.Documentation = documentation
+					}
+				}
+			case "def":
+				owner := currentNamespace(stack)
+				visibility := defaultVisibility[owner]
+				// `private def` / `protected def` override the default
+				if fields := strings.Fields(line[:start]); len(fields) > 0 {
+					if modifier := fields[len(fields)-1]; modifier == "private" || modifier == "protected" {
+						visibility = modifier
+					}
+				}
+				header := joinSignatureLines(lines, lineNum, rest)
+				if methodInfo := parseMethodDefinition(header, event, visibility); methodInfo != nil {
+					methodInfo.Documentation = collectDocComment(lines, lineNum)
+					block.Method = methodInfo
+					ownerName := ""
+					if owner != nil {
+						owner.Methods[methodInfo.Name] = append(owner.Methods[methodInfo.Name], methodInfo)
+						ownerName = owner.QualifiedName
+					}
+					// Also track globally
+					a.documentMethods[ownerName] = append(a.documentMethods[ownerName], methodInfo)
+				}
+			case "macro":
+				if macroInfo := parseMacroDefinition(rest, event); macroInfo != nil {
+					macroInfo.Documentation = collectDocComment(lines, lineNum)
+					block.Macro = macroInfo
+					if owner := currentNamespace(stack); owner != nil {
+						owner.Macros[macroInfo.Name] = macroInfo
+					} else {
+						a.documentMacros[macroInfo.Name] = macroInfo
+					}
+				}
+			}
+
+			stack = append(stack, block)
+		}
+	}
+
+	// Blocks left open run to the end of the document
+	for _, block := range stack {
+		block.close(len(lines) - 1)
+	}
+}
+
+// openBlock is an entry on the parser's block stack
+type openBlock struct {
+	Class       *ClassInfo
+	Declaration int // index into Class.Declarations
+	Method      *MethodInfo
+	Macro       *MacroInfo
+}
+
+// close records the line on which the block's definition ends
+func (b openBlock) close(line int) {
+	if b.Class != nil {
+		b.Class.Declarations[b.Declaration].EndLine = line
+		if b.Declaration == 0 {
+			b.Class.EndLine = line
+		}
+	}
+	if b.Method != nil {
+		b.Method.EndLine = line
+	}
+	if b.Macro != nil {
+		b.Macro.EndLine = line
+	}
+}
+
+// declaresInstanceVar reports whether the token at index i is an instance
+// variable being assigned (`@name = 1`), declared with a type
+// (`@name : String`) or set by a parameter (`def initialize(@name)`)
+func declaresInstanceVar(tokens []Token, i int) bool {
+	if tokens[i].Type != TokenInstanceVar {
+		return false
+	}
+	if i+1 < len(tokens) {
+		switch tokens[i+1].Value {
+		case "=", "||=", ":":
+			return true
+		}
+	}
+	if i == 0 || tokens[i-1].Value != "(" && tokens[i-1].Value != "," {
+		return false
+	}
+	for j := i - 1; j >= 0 && tokens[j].Position.Line == tokens[i].Position.Line; j-- {
+		if tokens[j].Value == "def" {
+			return true
+		}
+	}
+	return false
+}
+
+// findInstanceVariable returns where an instance variable of the type
+// around line is declared: the property of that name in the type or its
+// ancestors, or else the variable's first assignment
+func (a *CrystalAnalyzer) findInstanceVariable(name string, line int) (Position, bool) {
+	classInfo := a.findEnclosingClass(line)
+	if classInfo == nil {
+		return Position{}, false
+	}
+
+	owners := append([]*ClassInfo{classInfo}, a.ancestors(classInfo)...)
+	for _, owner := range owners {
+		if property := owner.Properties[name]; property != nil && !property.IsClassLevel {
+			return property.Location, true
+		}
+	}
+	for _, owner := range owners {
+		if location, exists := owner.InstanceVars[name]; exists {
+			return location, true
+		}
+	}
+	return Position{}, false
+}
+
+// insideMacro reports whether any open block is a macro definition
+func insideMacro(stack []openBlock) bool {
+	for _, block := range stack {
+		if block.Macro != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNamespaceDefinition parses a class, struct, module, enum or annotation header
+// and records it under its qualified name. A type declared again reopens
+// the first declaration, which collects the methods of both.
+func (a *CrystalAnalyzer) parseNamespaceDefinition(rest string, event blockEvent, outer *ClassInfo) *ClassInfo {
+	match := namespaceDefRegexp.FindStringSubmatch(rest)
+	if match == nil {
+		return nil
+	}
+
+	qualifiedName := match[2]
+	if outer != nil {
+		qualifiedName = outer.QualifiedName + "::" + qualifiedName
+	}
+
+	declaration := ClassDeclaration{
+		Keyword:    match[1],
+		SuperClass: match[3],
+		Location: Position{
+			Line:      event.Line,
+			Character: event.Character + strings.Index(rest, match[2]),
+		},
+	}
+	if existing := a.documentClasses[qualifiedName]; existing != nil {
+		existing.Declarations = append(existing.Declarations, declaration)
+		if existing.SuperClass == "" {
+			existing.SuperClass = declaration.SuperClass
+		}
+		return existing
+	}
+
+	classInfo := &ClassInfo{
+		Name:          qualifiedName[strings.LastIndex(qualifiedName, ":")+1:],
+		QualifiedName: qualifiedName,
+		SuperClass:    match[3],
+		IsStruct:      match[1] == "struct",
+		IsModule:      match[1] == "module",
+		IsEnum:        match[1] == "enum",
+		IsAnnotation:  match[1] == "annotation",
+		Methods:       make(map[string][]*MethodInfo),
+		Properties:    make(map[string]*PropertyInfo),
+		Constants:     make(map[string]*ConstantInfo),
+		Macros:        make(map[string]*MacroInfo),
+		InstanceVars:  make(map[string]Position),
+		Location:      declaration.Location,
+		Declarations:  []ClassDeclaration{declaration},
+	}
+	a.documentClasses[qualifiedName] = classInfo
+	return classInfo
+}
+
+// parsePropertyDefinition parses property-style macros such as
+// `property name : Type = default`, `getter name, age : Int32` or
+// `class_setter level`, recording each declared property along with the
+// accessor methods the macro generates
+func parsePropertyDefinition(owner *ClassInfo, lines []string, lineNum int) {
+	line := lines[lineNum]
+	indices := propertyRegexp.FindStringSubmatchIndex(line)
+	if indices == nil {
+		return
+	}
+
+	isClassLevel := indices[2] >= 0
+	macro := line[indices[4]:indices[5]]
+	suffix := ""
+	if indices[6] >= 0 {
+		suffix = line[indices[6]:indices[7]]
+	}
+	documentation := collectDocComment(lines, lineNum)
+
+	// Several properties may be declared at once, separated by commas
+	offset := indices[8]
+	for _, declaration := range splitTopLevel(line[offset:], ',') {
+		start := offset + len(declaration) - len(strings.TrimLeft(declaration, " \t"))
+		offset += len(declaration) + 1
+
+		match := propertyDeclarationRegexp.FindStringSubmatch(strings.TrimSpace(declaration))
+		if match == nil {
+			continue
+		}
+
+		property := &PropertyInfo{
+			Name:          match[1],
+			Type:          strings.TrimSpace(match[2]),
+			DefaultValue:  strings.TrimSpace(match[3]),
+			Documentation: documentation,
+			HasGetter:     macro != "setter",
+			HasSetter:     macro != "getter",
+			IsReadOnly:    macro == "getter",
+			IsClassLevel:  isClassLevel,
+			Location:      Position{Line: lineNum, Character: encodedLen(line[:start])},
+		}
+		owner.Properties[property.Name] = property
+
+		for _, accessor := range propertyAccessors(property, suffix) {
+			owner.Methods[accessor.Name] = append(owner.Methods[accessor.Name], accessor)
+		}
+	}
+}
+
+// parseRecordDefinition parses `record Point, x : Int32, y : Int32 = 0`,
+// which declares a struct with a getter per field and a constructor taking
+// them in order. Fields may continue on the following lines. It returns the
+// struct, the line its declaration ends on and whether a `do` block with more
+// methods follows.
+func (a *CrystalAnalyzer) parseRecordDefinition(owner *ClassInfo, lines []string, lineNum int) (*ClassInfo, int, bool) {
+	line := lines[lineNum]
+	match := recordDefRegexp.FindStringSubmatchIndex(line)
+	if match == nil {
+		return nil, lineNum, false
+	}
+
+	name := line[match[2]:match[3]]
+	qualifiedName := name
+	if owner != nil {
+		qualifiedName = owner.QualifiedName + "::" + name
+	}
+	location := Position{Line: lineNum, Character: encodedLen(line[:match[2]])}
+	declaration := ClassDeclaration{Keyword: "struct", Location: location}
+
+	classInfo := a.documentClasses[qualifiedName]
+	if classInfo != nil {
+		classInfo.Declarations = append(classInfo.Declarations, declaration)
+	} else {
+		classInfo = &ClassInfo{
+			Name:          name,
+			QualifiedName: qualifiedName,
+			IsStruct:      true,
+			Methods:       make(map[string][]*MethodInfo),
+			Properties:    make(map[string]*PropertyInfo),
+			Constants:     make(map[string]*ConstantInfo),
+			Macros:        make(map[string]*MacroInfo),
+			InstanceVars:  make(map[string]Position),
+			Documentation: collectDocComment(lines, lineNum),
+			Location:      location,
+			EndLine:       lineNum,
+			Declarations:  []ClassDeclaration{declaration},
+		}
+		a.documentClasses[qualifiedName] = classInfo
+	}
+
+	// Fields follow the name, one line after another while a line ends with
+	// a comma. Their offsets are tracked to locate each field.
+	lastLine := lineNum
+	text, offset := line, match[4]
+	hasBlock := false
+	constructor := &MethodInfo{Name: "initialize", Visibility: "public", IsProperty: true, Location: location, EndLine: lineNum}
+	copier := &MethodInfo{Name: "copy_with", Visibility: "public", ReturnType: "self", IsProperty: true, Location: location, EndLine: lineNum}
+	for {
+		fields := strings.TrimRight(text[offset:], " \t\r")
+		if trimmed := strings.TrimSpace(fields); trimmed == "do" || strings.HasSuffix(trimmed, " do") {
+			hasBlock = true
+			fields = fields[:strings.LastIndex(fields, "do")]
+		}
+
+		for _, field := range splitTopLevel(fields, ',') {
+			start := offset + len(field) - len(strings.TrimLeft(field, " \t"))
+			offset += len(field) + 1
+
+			declared := propertyDeclarationRegexp.FindStringSubmatch(strings.TrimSpace(field))
+			if declared == nil {
+				continue
+			}
+			property := &PropertyInfo{
+				Name:         declared[1],
+				Type:         strings.TrimSpace(declared[2]),
+				DefaultValue: strings.TrimSpace(declared[3]),
+				HasGetter:    true,
+				IsReadOnly:   true,
+				Location:     Position{Line: lastLine, Character: encodedLen(text[:start])},
+			}
+			classInfo.Properties[property.Name] = property
+			for _, accessor := range propertyAccessors(property, "") {
+				classInfo.Methods[accessor.Name] = append(classInfo.Methods[accessor.Name], accessor)
+			}
+
+			constructor.Parameters = append(constructor.Parameters, ParameterInfo{
+				Name: property.Name, Type: property.Type, DefaultValue: property.DefaultValue,
+			})
+			copier.Parameters = append(copier.Parameters, ParameterInfo{
+				Name: property.Name, Type: property.Type, DefaultValue: property.Name,
+			})
+		}
+
+		if hasBlock || !strings.HasSuffix(strings.TrimSpace(fields), ",") || lastLine+1 >= len(lines) {
+			break
+		}
+		lastLine++
+		text, offset = lines[lastLine], 0
+	}
+
+	constructor.EndLine, copier.EndLine = lastLine, lastLine
+	classInfo.Methods["initialize"] = append(classInfo.Methods["initialize"], constructor)
+	classInfo.Methods["copy_with"] = append(classInfo.Methods["copy_with"], copier)
+	if len(classInfo.Declarations) == 1 {
+		classInfo.EndLine = lastLine
+	}
+	classInfo.Declarations[len(classInfo.Declarations)-1].EndLine = lastLine
+
+	return classInfo, lastLine, hasBlock
+}
+
+// parseConstantDefinition records a constant assignment such as
+// `MAX_SIZE = 100` on owner, or at the top level when owner is nil. In an
+// enum body the line declares a member instead.
+func (a *CrystalAnalyzer) parseConstantDefinition(owner *ClassInfo, lines []string, lineNum int) {
+	line := lines[lineNum]
+	if owner != nil && owner.IsEnum {
+		parseEnumMember(owner, lines, lineNum)
+		return
+	}
+	match := constantDefRegexp.FindStringSubmatchIndex(line)
+	if match == nil || findAssignment(line) != match[1]-1 {
+		return
+	}
+
+	constant := &ConstantInfo{
+		Name:          line[match[2]:match[3]],
+		Value:         strings.TrimSpace(line[match[1]:]),
+		Documentation: collectDocComment(lines, lineNum),
+		Location:      Position{Line: lineNum, Character: encodedLen(line[:match[2]])},
+	}
+	constant.QualifiedName = constant.Name
+	if owner == nil {
+		// The first assignment is the declaration
+		if _, exists := a.documentConstants[constant.Name]; !exists {
+			a.documentConstants[constant.Name] = constant
+		}
+		return
+	}
+	constant.QualifiedName = owner.QualifiedName + "::" + constant.Name
+	if _, exists := owner.Constants[constant.Name]; !exists {
+		owner.Constants[constant.Name] = constant
+	}
+}
+
+// parseEnumMember records a member such as `Red` or `Green = 2` declared in
+// the body of an enum
+func parseEnumMember(owner *ClassInfo, lines []string, lineNum int) {
+	line := lines[lineNum]
+	match := enumMemberRegexp.FindStringSubmatchIndex(line)
+	if match == nil {
+		return
+	}
+
+	name := line[match[2]:match[3]]
+	for _, member := range owner.Members {
+		if member.Name == name {
+			return
+		}
+	}
+	member := &ConstantInfo{
+		Name:          name,
+		QualifiedName: owner.QualifiedName + "::" + name,
+		Documentation: collectDocComment(lines, lineNum),
+		Location:      Position{Line: lineNum, Character: encodedLen(line[:match[2]])},
+	}
+	if match[4] >= 0 {
+		member.Value = line[match[4]:match[5]]
+	}
+	owner.Members = append(owner.Members, member)
+}
+
+// parseAliasDefinition records `alias Name = Type`. An alias nested in a type
+// is also recorded under its qualified name.
+func (a *CrystalAnalyzer) parseAliasDefinition(owner *ClassInfo, line string) {
+	match := aliasDefRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+
+	a.documentAliases[match[1]] = match[2]
+	if owner != nil {
+		a.documentAliases[owner.QualifiedName+"::"+match[1]] = match[2]
+	}
+}
+
+// propertyAccessors returns the methods a property macro generates. The `?`
+// form (`getter? active`) names the getter with a trailing question mark.
+func propertyAccessors(property *PropertyInfo, suffix string) []*MethodInfo {
+	var accessors []*MethodInfo
+
+	if property.HasGetter {
+		accessors = append(accessors, &MethodInfo{
+			Name:          property.Name + strings.TrimSuffix(suffix, "!"),
+			Visibility:    "public",
+			ReturnType:    property.Type,
+			Documentation: property.Documentation,
+			IsProperty:    true,
+			IsClassMethod: property.IsClassLevel,
+			Location:      property.Location,
+			EndLine:       property.Location.Line,
+		})
+	}
+	if property.HasSetter {
+		accessors = append(accessors, &MethodInfo{
+			Name:          property.Name + "=",
+			Visibility:    "public",
+			Parameters:    []ParameterInfo{{Name: "value", Type: property.Type}},
+			Documentation: property.Documentation,
+			IsProperty:    true,
+			IsClassMethod: property.IsClassLevel,
+			Location:      property.Location,
+			EndLine:       property.Location.Line,
+		})
+	}
+
+	return accessors
+}
+
+// parseMethodDefinition parses a `def` header. Visibility defaults to public.
+func parseMethodDefinition(rest string, event blockEvent, visibility string) *MethodInfo {
+	match := methodDefRegexp.FindStringSubmatch(rest)
+	if match == nil {
+		return nil
+	}
+
+	if visibility == "" {
+		visibility = "public"
+	}
+
+	methodInfo := &MethodInfo{
+		Name:          match[2],
+		Visibility:    visibility,
+		IsClassMethod: match[1] != "",
+		Location: Position{
+			Line:      event.Line,
+			Character: event.Character + strings.Index(rest[3:], match[2]) + 3,
+		},
+	}
+
+	// Parameters follow the name in parentheses
+	tail := rest[len(match[0]):]
+	if match[3] != "" {
+		open := len(match[0]) - 1
+		closing := findClosingParen(rest, open)
+		if closing < 0 {
+			return methodInfo
+		}
+		methodInfo.Parameters = parseParameters(rest[open+1 : closing])
+		tail = rest[closing+1:]
+	}
+
+	methodInfo.ReturnType = parseReturnType(tail)
+
+	return methodInfo
+}
+
+// parseMacroDefinition parses a `macro name(args)` header
+func parseMacroDefinition(rest string, event blockEvent) *MacroInfo {
+	match := macroDefRegexp.FindStringSubmatch(rest)
+	if match == nil {
+		return nil
+	}
+
+	macroInfo := &MacroInfo{
+		Name: match[1],
+		Location: Position{
+			Line:      event.Line,
+			Character: event.Character + strings.Index(rest[5:], match[1]) + 5,
+		},
+	}
+
+	if match[2] != "" {
+		open := len(match[0]) - 1
+		if closing := findClosingParen(rest, open); closing >= 0 {
+			macroInfo.Parameters = parseParameters(rest[open+1 : closing])
+		}
+	}
+
+	return macroInfo
+}
+
+// collectDocComment returns the contiguous `#` comment lines directly above
+// a definition, with the comment markers stripped. A blank line between the
+// comment and the definition detaches the comment; annotations may sit in
+// between.
+func collectDocComment(lines []string, lineNum int) string {
+	var comments []string
+
+	for i := lineNum - 1; i >= 0; i-- {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, "@[") && len(comments) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+
+		comment := strings.TrimPrefix(trimmed, "#")
+		comment = strings.TrimPrefix(comment, " ")
+		comments = append([]string{comment}, comments...)
+	}
+
+	return strings.Join(comments, "\n")
+}
+
+// maxSignatureLines bounds how far a wrapped `def` header is followed
+const maxSignatureLines = 32
+
+// joinSignatureLines joins a `def` header that wraps across several lines
+// into one, following continuation lines until the parameter parentheses are
+// balanced and picking up a return type written on the following line
+func joinSignatureLines(lines []string, lineNum int, rest string) string {
+	header := rest
+	open := strings.Index(header, "(")
+	if open < 0 {
+		return header
+	}
+
+	next := lineNum + 1
+	for findClosingParen(header, open) < 0 && next < len(lines) && next-lineNum < maxSignatureLines {
+		header += " " + strings.TrimSpace(lines[next])
+		next++
+	}
+
+	// `)` alone on a line may be followed by `: ReturnType` on the next one
+	if strings.HasSuffix(strings.TrimSpace(header), ")") && next < len(lines) {
+		if continuation := strings.TrimSpace(lines[next]); strings.HasPrefix(continuation, ":") && !strings.HasPrefix(continuation, "::") {
+			header += " " + continuation
+		}
+	}
+
+	return header
+}
+
+// parseReturnType extracts the return type annotation that follows a
+// method's parameter list, e.g. `Array(String)` or `String?`
+func parseReturnType(tail string) string {
+	tail = strings.TrimSpace(tail)
+	if !strings.HasPrefix(tail, ":") {
+		return ""
+	}
+	tail = tail[1:]
+
+	// Stop at a statement separator, comment or free-variable clause
+	for _, terminator := range []string{";", "#", " forall "} {
+		if idx := strings.Index(tail, terminator); idx >= 0 {
+			tail = tail[:idx]
+		}
+	}
+
+	return strings.TrimSpace(tail)
+}
+
+// parseParameters parses a comma-separated parameter list such as
+// `to target : Int32, *args, **opts, &block : ->`
+func parseParameters(params string) []ParameterInfo {
+	var parameters []ParameterInfo
+
+	for _, raw := range splitTopLevel(params, ',') {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		var param ParameterInfo
+		switch {
+		case strings.HasPrefix(raw, "**"):
+			param.IsDoubleSplat = true
+			raw = raw[2:]
+		case strings.HasPrefix(raw, "*"):
+			param.IsSplat = true
+			raw = raw[1:]
+		case strings.HasPrefix(raw, "&"):
+			param.IsBlock = true
+			raw = raw[1:]
+		}
+
+		if idx := findAssignment(raw); idx >= 0 {
+			param.DefaultValue = strings.TrimSpace(raw[idx+1:])
+			raw = raw[:idx]
+		}
+
+		if idx := strings.Index(raw, " :"); idx >= 0 {
+			param.Type = strings.TrimSpace(raw[idx+2:])
+			raw = raw[:idx]
+		}
+
+		names := strings.Fields(raw)
+		switch len(names) {
+		case 1:
+			param.Name = names[0]
+		case 2:
+			param.ExternalName = names[0]
+			param.Name = names[1]
+		}
+
+		parameters = append(parameters, param)
+	}
+
+	return parameters
+}
+
+// formatParameter renders a parameter the way it is written in a signature
+func formatParameter(param ParameterInfo) string {
+	var b strings.Builder
+	switch {
+	case param.IsSplat:
+		b.WriteString("*")
+	case param.IsDoubleSplat:
+		b.WriteString("**")
+	case param.IsBlock:
+		b.WriteString("&")
+	}
+	if param.ExternalName != "" {
+		b.WriteString(param.ExternalName + " ")
+	}
+	b.WriteString(param.Name)
+	if param.Type != "" {
+		b.WriteString(" : " + param.Type)
+	}
+	if param.DefaultValue != "" {
+		b.WriteString(" = " + param.DefaultValue)
+	}
+	return b.String()
+}
+
+// generateMethodSignature renders a method as `name(param : Type, ...) : ReturnType`
+func generateMethodSignature(method *MethodInfo) string {
+	signature := method.Name
+	if len(method.Parameters) > 0 {
+		params := make([]string, len(method.Parameters))
+		for i, param := range method.Parameters {
+			params[i] = formatParameter(param)
+		}
+		signature = fmt.Sprintf("%s(%s)", method.Name, strings.Join(params, ", "))
+	}
+
+	if method.ReturnType != "" {
+		signature += " : " + method.ReturnType
+	}
+	return signature
+}
+
+// generateMacroSignature formats a macro as `macro name(args)`
+func generateMacroSignature(macro *MacroInfo) string {
+	params := make([]string, len(macro.Parameters))
+	for i, param := range macro.Parameters {
+		params[i] = formatParameter(param)
+	}
+	if len(params) == 0 {
+		return "macro " + macro.Name
+	}
+	return fmt.Sprintf("macro %s(%s)", macro.Name, strings.Join(params, ", "))
+}
+
+// splitTopLevel splits s on sep, ignoring separators nested inside
+// brackets or string literals
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '(' || ch == '[' || ch == '{':
+			depth++
+		case ch == ')' || ch == ']' || ch == '}':
+			depth--
+		case ch == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// findClosingParen returns the index of the parenthesis matching the one at
+// open, or -1 if it isn't closed
+func findClosingParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// findAssignment returns the index of a lone `=` (not part of `==`, `=>`,
+// `!=`, `<=` or `>=`), or -1
+func findAssignment(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			continue
+		}
+		if i+1 < len(s) && (s[i+1] == '=' || s[i+1] == '>' || s[i+1] == '~') {
+			i++
+			continue
+		}
+		if i > 0 && strings.IndexByte("=!<>", s[i-1]) >= 0 {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// currentNamespace returns the innermost class, struct, module or enum on the stack
+func currentNamespace(stack []openBlock) *ClassInfo {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].Class != nil {
+			return stack[i].Class
+		}
+	}
+	return nil
+}
+
+// findClass looks up a parsed class by qualified name, falling back to the
+// shallowest class with a matching simple name
+func (a *CrystalAnalyzer) findClass(name string) *ClassInfo {
+	if classInfo, exists := a.documentClasses[name]; exists {
+		return classInfo
+	}
+
+	var found *ClassInfo
+	for _, classInfo := range a.documentClasses {
+		if classInfo.Name != name {
+			continue
+		}
+		if found == nil || len(classInfo.QualifiedName) < len(found.QualifiedName) ||
+			(len(classInfo.QualifiedName) == len(found.QualifiedName) && classInfo.QualifiedName < found.QualifiedName) {
+			found = classInfo
+		}
+	}
+	return found
+}
+
+// resolveClass looks up the type a possibly qualified name such as
+// `Foo::Bar` refers to on the given line. Like Crystal, it tries the name
+// inside each enclosing namespace from the innermost outward before the top
+// level; a leading `::` starts at the top level. An unqualified name found
+// nowhere in scope falls back to findClass.
+func (a *CrystalAnalyzer) resolveClass(name string, line int) *ClassInfo {
+	var scopes []string
+	if !strings.HasPrefix(name, "::") {
+		if enclosing := a.findEnclosingClass(line); enclosing != nil {
+			for scope := enclosing.QualifiedName; scope != ""; scope = parentNamespace(scope, a.documentClasses) {
+				scopes = append(scopes, scope+"::")
+			}
+		}
+	}
+	name = strings.TrimPrefix(name, "::")
+	scopes = append(scopes, "")
+
+	for _, scope := range scopes {
+		if classInfo, exists := a.documentClasses[scope+name]; exists {
+			return classInfo
+		}
+	}
+	if strings.Contains(name, "::") {
+		return nil
+	}
+	return a.findClass(name)
+}
+
+// constantsInScope returns the constants visible on the given line without
+// qualification: those of the enclosing types from the innermost outward,
+// then those inherited by the innermost type, then the top-level ones. A
+// name shadowed by a closer scope is listed once.
+func (a *CrystalAnalyzer) constantsInScope(line int) []*ConstantInfo {
+	var scopes []map[string]*ConstantInfo
+	if classInfo := a.findEnclosingClass(line); classInfo != nil {
+		for name := classInfo.QualifiedName; name != ""; name = parentNamespace(name, a.documentClasses) {
+			scopes = append(scopes, a.documentClasses[name].Constants)
+		}
+		for _, ancestor := range a.ancestors(classInfo) {
+			scopes = append(scopes, ancestor.Constants)
+		}
+	}
+	scopes = append(scopes, a.documentConstants)
+
+	seen := make(map[string]bool)
+	var constants []*ConstantInfo
+	for _, scope := range scopes {
+		names := make([]string, 0, len(scope))
+		for name := range scope {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				constants = append(constants, scope[name])
+			}
+		}
+	}
+	return constants
+}
+
+// macrosInScope returns the macros callable without a receiver on the given
+// line: those of the enclosing types from the innermost outward, then the
+// top-level ones
+func (a *CrystalAnalyzer) macrosInScope(line int) []*MacroInfo {
+	var scopes []map[string]*MacroInfo
+	if classInfo := a.findEnclosingClass(line); classInfo != nil {
+		for name := classInfo.QualifiedName; name != ""; name = parentNamespace(name, a.documentClasses) {
+			scopes = append(scopes, a.documentClasses[name].Macros)
+		}
+	}
+	scopes = append(scopes, a.documentMacros)
+
+	seen := make(map[string]bool)
+	var macros []*MacroInfo
+	for _, scope := range scopes {
+		names := make([]string, 0, len(scope))
+		for name := range scope {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				macros = append(macros, scope[name])
+			}
+		}
+	}
+	return macros
+}
+
+// findConstant resolves a constant referenced on the given line. A qualified
+// reference like `Config::MAX_SIZE` passes `Config` as the qualifier.
+func (a *CrystalAnalyzer) findConstant(name, qualifier string, line int) *ConstantInfo {
+	if qualifier = strings.TrimPrefix(qualifier, "::"); qualifier != "" {
+		if classInfo := a.findClass(qualifier); classInfo != nil {
+			return classInfo.Constants[name]
+		}
+		return nil
+	}
+
+	for _, constant := range a.constantsInScope(line) {
+		if constant.Name == name {
+			return constant
+		}
+	}
+	return nil
+}
+
+// findMethod looks up all overloads of a method by name, preferring methods
+// defined on a type over top-level ones
+func (a *CrystalAnalyzer) findMethod(name string) (*ClassInfo, []*MethodInfo) {
+	qualifiedNames := make([]string, 0, len(a.documentClasses))
+	for qualifiedName := range a.documentClasses {
+		qualifiedNames = append(qualifiedNames, qualifiedName)
+	}
+	sort.Strings(qualifiedNames)
+
+	for _, qualifiedName := range qualifiedNames {
+		classInfo := a.documentClasses[qualifiedName]
+		if overloads, exists := classInfo.Methods[name]; exists {
+			return classInfo, overloads
+		}
+	}
+
+	var overloads []*MethodInfo
+	for _, methodInfo := range a.documentMethods[""] {
+		if methodInfo.Name == name {
+			overloads = append(overloads, methodInfo)
+		}
+	}
+
+	return nil, overloads
+}
+
+// methodSet holds the overloads of a method and the type that defines them
+type methodSet struct {
+	Owner     *ClassInfo
+	Overloads []*MethodInfo
+}
+
+// ancestors returns the parsed superclasses of classInfo, nearest first. The
+// walk stops at a superclass that isn't defined locally (such as a builtin)
+// or when the chain loops back on itself.
+func (a *CrystalAnalyzer) ancestors(classInfo *ClassInfo) []*ClassInfo {
+	var chain []*ClassInfo
+	visited := map[*ClassInfo]bool{classInfo: true}
+
+	for current := classInfo; current.SuperClass != ""; {
+		parent := a.findClass(current.SuperClass)
+		if parent == nil || visited[parent] {
+			break
+		}
+		visited[parent] = true
+		chain = append(chain, parent)
+		current = parent
+	}
+
+	return chain
+}
+
+// resolveMethods returns the methods available on a type, including those
+// inherited through its superclass chain. A method defined closer to the type
+// overrides every ancestor overload of the same name.
+func (a *CrystalAnalyzer) resolveMethods(classInfo *ClassInfo) map[string]methodSet {
+	resolved := make(map[string]methodSet)
+
+	for _, owner := range append([]*ClassInfo{classInfo}, a.ancestors(classInfo)...) {
+		for name, overloads := range owner.Methods {
+			if _, exists := resolved[name]; !exists {
+				resolved[name] = methodSet{Owner: owner, Overloads: overloads}
+			}
+		}
+	}
+
+	return resolved
+}
+
+// acceptsArgument reports whether a method can take an argument at the given
+// zero-based position
+func acceptsArgument(method *MethodInfo, index int) bool {
+	positional := 0
+	for _, param := range method.Parameters {
+		switch {
+		case param.IsSplat:
+			return true
+		case param.IsDoubleSplat, param.IsBlock:
+		default:
+			positional++
+		}
+	}
+	return index < positional
+}
+
+// findEnclosingClass returns the innermost class, struct or module whose body
+// contains the given line
+func (a *CrystalAnalyzer) findEnclosingClass(line int) *ClassInfo {
+	var found *ClassInfo
+	foundLine := -1
+	// Any declaration of a type, including a reopening, encloses its body
+	for _, classInfo := range a.documentClasses {
+		for _, declaration := range classInfo.Declarations {
+			if line < declaration.Location.Line || line > declaration.EndLine {
+				continue
+			}
+			// Of types declared on one line, the nested one is innermost
+			if declaration.Location.Line > foundLine ||
+				(declaration.Location.Line == foundLine && len(classInfo.QualifiedName) > len(found.QualifiedName)) {
+				found, foundLine = classInfo, declaration.Location.Line
+			}
+		}
+	}
+	return found
+}
+
+// allMethods returns every method defined in the document with `def`,
+// leaving out accessors generated by property macros
+func (a *CrystalAnalyzer) allMethods() []*MethodInfo {
+	var methods []*MethodInfo
+	for _, overloads := range a.documentMethods {
+		for _, method := range overloads {
+			if !method.IsProperty {
+				methods = append(methods, method)
+			}
+		}
+	}
+	return methods
+}
+
+// findEnclosingMethod returns the innermost method whose body contains line
+func (a *CrystalAnalyzer) findEnclosingMethod(line int) *MethodInfo {
+	var found *MethodInfo
+	for _, method := range a.allMethods() {
+		if line < method.Location.Line || line > method.EndLine {
+			continue
+		}
+		if found == nil || method.Location.Line > found.Location.Line {
+			found = method
+		}
+	}
+	return found
+}
@@ -0,0 +1,260 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var renameTargetRegexp = regexp.MustCompile(`^(@@?)?[\p{L}_][\p{L}\p{N}_]*[\?!]?$`)
+
+// referenceTokenAt returns the identifier, constant or variable token at pos.
+// A cursor just past the end of a name still refers to it.
+func referenceTokenAt(tokens []Token, pos Position) *Token {
+	if i := referenceIndexAt(tokens, pos); i >= 0 {
+		return &tokens[i]
+	}
+	return nil
+}
+
+// referenceIndexAt returns the index of the token referenceTokenAt finds,
+// or -1
+func referenceIndexAt(tokens []Token, pos Position) int {
+	for i := range tokens {
+		token := &tokens[i]
+		if token.Position.Line != pos.Line || !isReferenceToken(token) {
+			continue
+		}
+		if pos.Character >= token.Position.Character && pos.Character <= token.Position.Character+token.Length {
+			return i
+		}
+	}
+	return -1
+}
+
+// isReferenceToken reports whether a token names something that can be
+// referenced or renamed
+func isReferenceToken(token *Token) bool {
+	switch token.Type {
+	case TokenIdentifier, TokenConstant, TokenInstanceVar, TokenClassVar:
+		return true
+	}
+	return false
+}
+
+// referenceIndices returns the indices of the tokens naming the same thing
+// as the token at target. Only real identifier tokens match, so occurrences
+// inside strings and comments are never included. A local variable only
+// matches within its method, or its block for a block parameter, and never
+// matches a call on a receiver; a method never matches a local.
+func (a *CrystalAnalyzer) referenceIndices(tokens []Token, target int) []int {
+	token := tokens[target]
+	local := a.isLocalReference(tokens, target)
+
+	// Blocks taking the name as a parameter shadow the outer variable
+	var blocks []codeBlock
+	var method *MethodInfo
+	var block *codeBlock
+	if local {
+		for _, candidate := range append(findBlocks(tokens), rescueBlocks(tokens)...) {
+			for _, param := range candidate.Parameters {
+				if param == token.Value {
+					blocks = append(blocks, candidate)
+					break
+				}
+			}
+		}
+		method = a.findEnclosingMethod(token.Position.Line)
+		block = innermostBlock(blocks, token.Position)
+	}
+
+	var indices []int
+	for i := range tokens {
+		if tokens[i].Type != token.Type || tokens[i].Value != token.Value {
+			continue
+		}
+		if token.Type == TokenIdentifier {
+			if local != a.isLocalReference(tokens, i) {
+				continue
+			}
+			if local && (a.findEnclosingMethod(tokens[i].Position.Line) != method ||
+				innermostBlock(blocks, tokens[i].Position) != block) {
+				continue
+			}
+		}
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// isLocalReference reports whether the identifier at index i names a local
+// variable or parameter visible where it appears, rather than a method
+func (a *CrystalAnalyzer) isLocalReference(tokens []Token, i int) bool {
+	token := &tokens[i]
+	if token.Type != TokenIdentifier || isDeclaration(tokens, i) || (i > 0 && tokens[i-1].Value == ".") {
+		return false
+	}
+	end := Position{Line: token.Position.Line, Character: token.Position.Character + token.Length}
+	for _, name := range a.variablesInScope(tokens, end) {
+		if name == token.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// innermostBlock returns the innermost of blocks around pos, or nil
+func innermostBlock(blocks []codeBlock, pos Position) *codeBlock {
+	var found *codeBlock
+	for i := range blocks {
+		if !positionBefore(blocks[i].Start, pos) || !positionBefore(pos, blocks[i].End) {
+			continue
+		}
+		if found == nil || positionBefore(found.Start, blocks[i].Start) {
+			found = &blocks[i]
+		}
+	}
+	return found
+}
+
+// nameKind returns the token type a valid name lexes as
+func nameKind(name string) TokenType {
+	switch {
+	case strings.HasPrefix(name, "@@"):
+		return TokenClassVar
+	case strings.HasPrefix(name, "@"):
+		return TokenInstanceVar
+	}
+	if first, _ := utf8.DecodeRuneInString(name); unicode.IsUpper(first) {
+		return TokenConstant
+	}
+	return TokenIdentifier
+}
+
+func tokenRange(token Token) Range {
+	return Range{
+		Start: token.Position,
+		End:   Position{Line: token.Position.Line, Character: token.Position.Character + token.Length},
+	}
+}
+
+// declarationKeywords introduce the name they are followed by
+var declarationKeywords = map[string]bool{
+	"def": true, "macro": true, "class": true, "struct": true, "module": true,
+	"enum": true, "annotation": true, "alias": true,
+}
+
+// isDeclaration reports whether the token at index i is the name in a
+// definition such as `def name`, `def self.name` or `class Name`
+func isDeclaration(tokens []Token, i int) bool {
+	if i > 0 && tokens[i-1].Type == TokenKeyword && declarationKeywords[tokens[i-1].Value] {
+		return true
+	}
+	return i > 2 && tokens[i-1].Value == "." && tokens[i-2].Value == "self" && tokens[i-3].Value == "def"
+}
+
+// isWrite reports whether the token at index i is a variable being assigned
+func isWrite(tokens []Token, i int) bool {
+	if isLocalAssignment(tokens, i) {
+		return true
+	}
+	if tokens[i].Type != TokenInstanceVar && tokens[i].Type != TokenClassVar || i+1 >= len(tokens) {
+		return false
+	}
+	switch tokens[i+1].Value {
+	case "=", "||=", "&&=", "+=", "-=", "*=", "/=", "%=", "<<=", ">>=", "**=":
+		return true
+	}
+	return false
+}
+
+// GetReferences returns every occurrence of the name at pos: for a method,
+// its definitions and each call. Definitions are left out unless
+// includeDeclaration is set.
+func (a *CrystalAnalyzer) GetReferences(doc *TextDocumentItem, pos Position, includeDeclaration bool) []Location {
+	a.parseDocumentStructure(doc)
+	tokens := a.documentContext(doc).Tokens
+	target := referenceIndexAt(tokens, pos)
+	if target < 0 {
+		return []Location{}
+	}
+
+	locations := []Location{}
+	for _, i := range a.referenceIndices(tokens, target) {
+		if !includeDeclaration && isDeclaration(tokens, i) {
+			continue
+		}
+		locations = append(locations, Location{URI: doc.URI, Range: tokenRange(tokens[i])})
+	}
+	return locations
+}
+
+// GetDocumentHighlights marks every occurrence of the name at pos.
+// Definitions are highlighted as text, assignments as writes and every other
+// use, such as a method call, as a read.
+func (a *CrystalAnalyzer) GetDocumentHighlights(doc *TextDocumentItem, pos Position) []DocumentHighlight {
+	a.parseDocumentStructure(doc)
+	tokens := a.documentContext(doc).Tokens
+	target := referenceIndexAt(tokens, pos)
+	if target < 0 {
+		return []DocumentHighlight{}
+	}
+
+	highlights := []DocumentHighlight{}
+	for _, i := range a.referenceIndices(tokens, target) {
+		kind := DocumentHighlightKindRead
+		switch {
+		case isDeclaration(tokens, i):
+			kind = DocumentHighlightKindText
+		case isWrite(tokens, i):
+			kind = DocumentHighlightKindWrite
+		}
+		highlights = append(highlights, DocumentHighlight{Range: tokenRange(tokens[i]), Kind: kind})
+	}
+	return highlights
+}
+
+// PrepareRename returns the range of the name at pos, or nil if there is
+// nothing to rename there
+func (a *CrystalAnalyzer) PrepareRename(doc *TextDocumentItem, pos Position) *Range {
+	token := referenceTokenAt(a.documentContext(doc).Tokens, pos)
+	if token == nil {
+		return nil
+	}
+	return &Range{
+		Start: token.Position,
+		End:   Position{Line: token.Position.Line, Character: token.Position.Character + token.Length},
+	}
+}
+
+// Rename returns the edits that rename every reference to the name at pos
+func (a *CrystalAnalyzer) Rename(doc *TextDocumentItem, pos Position, newName string) (*WorkspaceEdit, error) {
+	a.parseDocumentStructure(doc)
+	tokens := a.documentContext(doc).Tokens
+	target := referenceIndexAt(tokens, pos)
+	if target < 0 {
+		return nil, fmt.Errorf("no symbol to rename at this position")
+	}
+
+	for _, keyword := range a.keywords {
+		if newName == keyword {
+			return nil, fmt.Errorf("%q is a keyword", newName)
+		}
+	}
+	if !renameTargetRegexp.MatchString(newName) {
+		return nil, fmt.Errorf("%q is not a valid name", newName)
+	}
+	// The sigil and capitalization decide what a name is, so they must stay
+	if nameKind(newName) != tokens[target].Type {
+		return nil, fmt.Errorf("%q is not the same kind of name as %q", newName, tokens[target].Value)
+	}
+
+	var edits []TextEdit
+	for _, i := range a.referenceIndices(tokens, target) {
+		edits = append(edits, TextEdit{Range: tokenRange(tokens[i]), NewText: newName})
+	}
+
+	return &WorkspaceEdit{Changes: map[string][]TextEdit{doc.URI: edits}}, nil
+}
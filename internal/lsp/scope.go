@@ -0,0 +1,232 @@
+package lsp
+
+import "sort"
+
+// variablesInScope returns the local variables visible at pos. A method body
+// is its own scope holding its parameters and the variables assigned in it;
+// the top level sees only variables assigned outside of any method. Block
+// parameters are visible inside their block. Only assignments before pos
+// count.
+func (a *CrystalAnalyzer) variablesInScope(tokens []Token, pos Position) []string {
+	methods := a.allMethods()
+
+	// The innermost method around pos, if any, bounds the scope
+	scope := a.findEnclosingMethod(pos.Line)
+
+	inScope := func(line int) bool {
+		if scope != nil {
+			return scope.Location.Line <= line && line <= scope.EndLine
+		}
+		for _, method := range methods {
+			if method.Location.Line <= line && line <= method.EndLine {
+				return false
+			}
+		}
+		return true
+	}
+
+	names := make(map[string]bool)
+	if scope != nil {
+		for _, param := range scope.Parameters {
+			if !param.IsBlock && param.Name != "" {
+				names[param.Name] = true
+			}
+		}
+	}
+
+	for i := range tokens {
+		token := &tokens[i]
+		if !positionBefore(token.Position, pos) {
+			break
+		}
+		if inScope(token.Position.Line) && isLocalAssignment(tokens, i) {
+			names[token.Value] = true
+		}
+	}
+
+	blocks := append(findBlocks(tokens), rescueBlocks(tokens)...)
+	for _, block := range blocks {
+		if inScope(block.Start.Line) && positionBefore(block.Start, pos) && positionBefore(pos, block.End) {
+			for _, param := range block.Parameters {
+				names[param] = true
+			}
+		}
+	}
+
+	variables := make([]string, 0, len(names))
+	for name := range names {
+		variables = append(variables, name)
+	}
+	sort.Strings(variables)
+	return variables
+}
+
+// blockLocals returns the locals bound by the innermost block around pos:
+// its parameters and the variables assigned in it before pos. Outside of any
+// block it returns nil, the whole scope being the current one.
+func blockLocals(tokens []Token, pos Position) map[string]bool {
+	var innermost *codeBlock
+	blocks := append(findBlocks(tokens), rescueBlocks(tokens)...)
+	for i := range blocks {
+		block := &blocks[i]
+		if !positionBefore(block.Start, pos) || !positionBefore(pos, block.End) {
+			continue
+		}
+		if innermost == nil || positionBefore(innermost.Start, block.Start) {
+			innermost = block
+		}
+	}
+	if innermost == nil {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, param := range innermost.Parameters {
+		names[param] = true
+	}
+	for i := range tokens {
+		token := &tokens[i]
+		if !positionBefore(token.Position, pos) {
+			break
+		}
+		if positionBefore(innermost.Start, token.Position) && isLocalAssignment(tokens, i) {
+			names[token.Value] = true
+		}
+	}
+	return names
+}
+
+// codeBlock is a `do ... end` or `{ ... }` block that takes parameters
+type codeBlock struct {
+	Start      Position // the `do` or `{`
+	End        Position // the `end` or `}`
+	Parameters []string
+}
+
+// findBlocks returns the blocks in the document that declare parameters
+func findBlocks(tokens []Token) []codeBlock {
+	doEnds := make(map[Position]Position)
+	for _, span := range matchBlocks(tokens) {
+		if span.Open.Keyword == "do" {
+			doEnds[Position{Line: span.Open.Line, Character: span.Open.Character}] =
+				Position{Line: span.Close.Line, Character: span.Close.Character}
+		}
+	}
+
+	var blocks []codeBlock
+	for i := range tokens {
+		token := &tokens[i]
+		var end Position
+		var ok bool
+		switch {
+		case token.Value == "do" && token.Type == TokenKeyword:
+			end, ok = doEnds[token.Position]
+		case token.Value == "{":
+			end, ok = closingBrace(tokens, i)
+		}
+		if !ok {
+			continue
+		}
+		if params := blockParameters(tokens, i+1); len(params) > 0 {
+			blocks = append(blocks, codeBlock{Start: token.Position, End: end, Parameters: params})
+		}
+	}
+	return blocks
+}
+
+// rescueBlocks returns the `rescue` clauses that name the exception, as in
+// `rescue ex : IO::Error`, each running to the next section of its block
+func rescueBlocks(tokens []Token) []codeBlock {
+	spans := matchBlocks(tokens)
+
+	var blocks []codeBlock
+	for i, token := range tokens {
+		if token.Type != TokenKeyword || token.Value != "rescue" || !firstInStatement(tokens, i) {
+			continue
+		}
+		if i+1 >= len(tokens) || tokens[i+1].Type != TokenIdentifier || tokens[i+1].Position.Line != token.Position.Line {
+			continue
+		}
+		span := innermostSpan(spans, token.Position)
+		if span < 0 {
+			continue
+		}
+
+		end := Position{Line: spans[span].Close.Line, Character: spans[span].Close.Character}
+		for j := i + 1; j < len(tokens) && positionBefore(tokens[j].Position, end); j++ {
+			next := &tokens[j]
+			if next.Type == TokenKeyword && sectionKeywords["begin"][next.Value] && firstInStatement(tokens, j) &&
+				innermostSpan(spans, next.Position) == span {
+				end = next.Position
+				break
+			}
+		}
+		blocks = append(blocks, codeBlock{Start: token.Position, End: end, Parameters: []string{tokens[i+1].Value}})
+	}
+	return blocks
+}
+
+// firstInStatement reports whether the token at index i begins a statement,
+// being the first on its line or following a `;`
+func firstInStatement(tokens []Token, i int) bool {
+	return i == 0 || tokens[i-1].Position.Line != tokens[i].Position.Line || tokens[i-1].Value == ";"
+}
+
+// isLocalAssignment reports whether the token at index i is a local
+// variable being assigned, as in `x = 1` or `x ||= 1`, but not `obj.x = 1`,
+// or declared with a type at the start of a statement, as in `x : Int32`
+func isLocalAssignment(tokens []Token, i int) bool {
+	if tokens[i].Type != TokenIdentifier || i+1 >= len(tokens) {
+		return false
+	}
+
+	next := tokens[i+1]
+	if next.Value == ":" {
+		// `foo(x: 1)` names an argument; a declaration spaces the colon
+		spaced := next.Position.Line == tokens[i].Position.Line &&
+			next.Position.Character > tokens[i].Position.Character+tokens[i].Length
+		return spaced && (i == 0 || tokens[i-1].Position.Line != tokens[i].Position.Line || tokens[i-1].Value == ";")
+	}
+	if next.Value != "=" && next.Value != "||=" {
+		return false
+	}
+	return i == 0 || tokens[i-1].Value != "."
+}
+
+// blockParameters returns the names between the pipes of a block header
+// starting at index i, e.g. `|key, value|`
+func blockParameters(tokens []Token, i int) []string {
+	if i >= len(tokens) || tokens[i].Value != "|" {
+		return nil
+	}
+
+	var params []string
+	for i++; i < len(tokens) && tokens[i].Value != "|"; i++ {
+		if tokens[i].Type == TokenIdentifier {
+			params = append(params, tokens[i].Value)
+		}
+	}
+	return params
+}
+
+// closingBrace returns the position of the `}` matching the `{` at index i
+func closingBrace(tokens []Token, i int) (Position, bool) {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].Value {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return tokens[i].Position, true
+			}
+		}
+	}
+	return Position{}, false
+}
+
+// positionBefore reports whether a comes before b in the document
+func positionBefore(a, b Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
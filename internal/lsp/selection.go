@@ -0,0 +1,112 @@
+package lsp
+
+import "strings"
+
+// blockSpan is a block from its opening keyword to the `end` that closes it
+type blockSpan struct {
+	Open  blockEvent
+	Close blockEvent
+}
+
+// matchBlocks pairs block openers with their `end` using the same stack as
+// checkStructureBalance. Unclosed blocks and stray `end`s are left out.
+func matchBlocks(tokens []Token) []blockSpan {
+	var spans []blockSpan
+	var stack []blockEvent
+
+	for _, event := range scanBlockEvents(tokens) {
+		if event.Keyword != "end" {
+			stack = append(stack, event)
+			continue
+		}
+		if len(stack) == 0 {
+			continue
+		}
+		spans = append(spans, blockSpan{Open: stack[len(stack)-1], Close: event})
+		stack = stack[:len(stack)-1]
+	}
+
+	return spans
+}
+
+// GetSelectionRanges returns, for each position, the chain of ranges an
+// editor grows the selection through: the word, its line, then every
+// enclosing block out to the outermost class or module
+func (a *CrystalAnalyzer) GetSelectionRanges(doc *TextDocumentItem, positions []Position) []SelectionRange {
+	context := a.documentContext(doc)
+	lines := strings.Split(doc.Text, "\n")
+	spans := matchBlocks(context.Tokens)
+
+	results := make([]SelectionRange, 0, len(positions))
+	for _, pos := range positions {
+		var ranges []Range
+
+		if token := selectionTokenAt(context.Tokens, pos); token != nil {
+			ranges = append(ranges, Range{
+				Start: token.Position,
+				End:   Position{Line: pos.Line, Character: token.Position.Character + token.Length},
+			})
+		}
+
+		if pos.Line < len(lines) {
+			ranges = append(ranges, lineContentRange(lines, pos.Line, pos.Line))
+		}
+
+		// Spans close innermost first, so enclosing blocks come out in order
+		for _, span := range spans {
+			if span.Open.Line <= pos.Line && pos.Line <= span.Close.Line {
+				ranges = append(ranges, lineContentRange(lines, span.Open.Line, span.Close.Line))
+			}
+		}
+
+		results = append(results, buildSelectionRange(ranges, pos))
+	}
+
+	return results
+}
+
+// selectionTokenAt returns the token under pos, preferring a name over the
+// punctuation touching it
+func selectionTokenAt(tokens []Token, pos Position) *Token {
+	if token := referenceTokenAt(tokens, pos); token != nil {
+		return token
+	}
+	for i := range tokens {
+		token := &tokens[i]
+		if token.Position.Line == pos.Line && pos.Character >= token.Position.Character &&
+			pos.Character <= token.Position.Character+token.Length {
+			return token
+		}
+	}
+	return nil
+}
+
+// lineContentRange covers lines first through last without the leading
+// indentation of the first or trailing whitespace of the last
+func lineContentRange(lines []string, first, last int) Range {
+	firstLine := lines[first]
+	lastLine := strings.TrimRight(lines[last], " \t\r")
+	indent := len(firstLine) - len(strings.TrimLeft(firstLine, " \t"))
+
+	return Range{
+		Start: Position{Line: first, Character: indent},
+		End:   Position{Line: last, Character: encodedLen(lastLine)},
+	}
+}
+
+// buildSelectionRange links ranges, ordered innermost first, into a parent
+// chain. Ranges identical to the one inside them are dropped.
+func buildSelectionRange(ranges []Range, pos Position) SelectionRange {
+	if len(ranges) == 0 {
+		return SelectionRange{Range: Range{Start: pos, End: pos}}
+	}
+
+	var outer *SelectionRange
+	for i := len(ranges) - 1; i >= 0; i-- {
+		if outer != nil && outer.Range == ranges[i] {
+			continue
+		}
+		outer = &SelectionRange{Range: ranges[i], Parent: outer}
+	}
+	return *outer
+}
@@ -0,0 +1,150 @@
+package lsp
+
+import "strings"
+
+// semanticTokenTypes is the legend advertised in initialize. The index of a
+// name in this list is the type number sent to the client.
+var semanticTokenTypes = []string{
+	"keyword", "class", "string", "number", "comment",
+	"enumMember", "method", "variable", "property", "regexp",
+}
+
+// Indices into semanticTokenTypes
+const (
+	semanticKeyword = iota
+	semanticClass
+	semanticString
+	semanticNumber
+	semanticComment
+	semanticEnumMember
+	semanticMethod
+	semanticVariable
+	semanticProperty
+	semanticRegexp
+)
+
+// semanticToken is a single-line span of a classified token
+type semanticToken struct {
+	Line      int
+	Character int
+	Length    int
+	Type      int
+}
+
+// GetSemanticTokens classifies every token in the document and returns them
+// in the LSP relative delta encoding
+func (a *CrystalAnalyzer) GetSemanticTokens(doc *TextDocumentItem) *SemanticTokens {
+	a.parseDocumentStructure(doc)
+	context := a.documentContext(doc)
+
+	// Bare calls like `greet` are told from variables by the defined names
+	methods := make(map[string]bool)
+	for _, method := range a.allMethods() {
+		methods[method.Name] = true
+	}
+
+	var spans []semanticToken
+	for i := range context.Tokens {
+		tokenType, ok := a.semanticTokenType(context.Tokens, i, methods)
+		if !ok {
+			continue
+		}
+		spans = append(spans, splitSemanticToken(&context.Tokens[i], tokenType)...)
+	}
+
+	return &SemanticTokens{Data: encodeSemanticTokens(spans)}
+}
+
+// semanticTokenType maps the token at index i to a legend index. Identifiers
+// are methods when they are defined or called as one, or name one of
+// methods, and variables otherwise.
+func (a *CrystalAnalyzer) semanticTokenType(tokens []Token, i int, methods map[string]bool) (int, bool) {
+	token := &tokens[i]
+	switch token.Type {
+	case TokenKeyword:
+		return semanticKeyword, true
+	case TokenConstant:
+		return semanticClass, true
+	case TokenString, TokenChar:
+		return semanticString, true
+	case TokenNumber:
+		return semanticNumber, true
+	case TokenComment:
+		return semanticComment, true
+	case TokenSymbol:
+		return semanticEnumMember, true
+	case TokenInstanceVar, TokenClassVar:
+		return semanticProperty, true
+	case TokenRegex:
+		return semanticRegexp, true
+	case TokenIdentifier:
+		if a.isMethodIdentifier(tokens, i, methods) {
+			return semanticMethod, true
+		}
+		return semanticVariable, true
+	}
+	return 0, false
+}
+
+// isMethodIdentifier reports whether the identifier at index i names a method
+func (a *CrystalAnalyzer) isMethodIdentifier(tokens []Token, i int, methods map[string]bool) bool {
+	token := &tokens[i]
+	if i > 0 {
+		prev := &tokens[i-1]
+		if prev.Type == TokenKeyword && prev.Value == "def" {
+			return true
+		}
+		if prev.Value == "." {
+			return true
+		}
+	}
+	if i+1 < len(tokens) {
+		next := &tokens[i+1]
+		if next.Value == "(" && next.Position.Line == token.Position.Line &&
+			next.Position.Character == token.Position.Character+token.Length {
+			return true
+		}
+	}
+	return methods[token.Value]
+}
+
+// splitSemanticToken breaks a token that spans lines, such as a multi-line
+// string, into one span per line
+func splitSemanticToken(token *Token, tokenType int) []semanticToken {
+	if !strings.Contains(token.Value, "\n") {
+		return []semanticToken{{token.Position.Line, token.Position.Character, token.Length, tokenType}}
+	}
+
+	var spans []semanticToken
+	for i, part := range strings.Split(token.Value, "\n") {
+		part = strings.TrimSuffix(part, "\r")
+		if part == "" {
+			continue
+		}
+		character := 0
+		if i == 0 {
+			character = token.Position.Character
+		}
+		spans = append(spans, semanticToken{token.Position.Line + i, character, encodedLen(part), tokenType})
+	}
+	return spans
+}
+
+// encodeSemanticTokens converts spans in document order to the flat
+// [deltaLine, deltaStart, length, type, modifiers] format
+func encodeSemanticTokens(spans []semanticToken) []int {
+	data := make([]int, 0, len(spans)*5)
+	prevLine, prevCharacter := 0, 0
+
+	for _, span := range spans {
+		deltaLine := span.Line - prevLine
+		deltaStart := span.Character
+		if deltaLine == 0 {
+			deltaStart = span.Character - prevCharacter
+		}
+		data = append(data, deltaLine, deltaStart, span.Length, span.Type, 0)
+		prevLine, prevCharacter = span.Line, span.Character
+	}
+
+	return data
+}
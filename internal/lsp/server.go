@@ -4,8 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sourcegraph/jsonrpc2"
 )
@@ -20,30 +26,110 @@ type Server struct {
 
 	// Crystal analyzer
 	analyzer *CrystalAnalyzer
+
+	// Crystal compiler integration
+	crystalTool *CrystalTool
+
+	// `crystal tool context` hovers by URI, valid for one document version
+	contextHovers map[string]*contextHoverCache
+
+	// Workspace root and the index of the Crystal files beneath it
+	rootPath              string
+	initializationOptions InitializationOptions
+	index                 *WorkspaceIndex
+
+	// Whether inferred type inlay hints are sent
+	inlayHints bool
+
+	// Capabilities advertised by the client in initialize
+	clientCapabilities ClientCapabilities
+
+	// Whether the user was already told the compiler is missing
+	crystalWarningShown bool
+
+	// Whether the client sent initialized
+	initialized bool
+
+	// The trace level the client set, and the level the log output is
+	// filtered by if set on the command line. Background goroutines log
+	// while the worker handles $/setTrace, so both are read under levelMu.
+	levelMu    sync.Mutex
+	traceLevel string
+	logLevel   string
+
+	// Set once shutdown is received; only exit is handled after that
+	shuttingDown bool
+
+	// Stops the background workspace scan
+	cancelIndex context.CancelFunc
+
+	// Ends the process; replaced in tests
+	exit func(code int)
+
+	// Messages wait here to be handled one at a time, in order, so the
+	// connection keeps reading and can deliver $/cancelRequest meanwhile
+	queue     chan queuedRequest
+	startOnce sync.Once
+
+	// Cancel functions of the requests queued or being handled, by ID
+	cancelMu sync.Mutex
+	cancels  map[jsonrpc2.ID]context.CancelFunc
+
+	// Compiler checks running in the background, by document URI
+	checkMu sync.Mutex
+	checks  map[string]*compilerCheck
+}
+
+// compilerCheck is a `crystal build` of a saved document, run off the worker
+type compilerCheck struct {
+	cancel context.CancelFunc
+}
+
+// queuedRequest is a message waiting to be handled with its context
+type queuedRequest struct {
+	ctx  context.Context
+	conn *jsonrpc2.Conn
+	req  *jsonrpc2.Request
 }
 
 // NewServer creates a new Crystal Language Server
 func NewServer() *Server {
+	index := NewWorkspaceIndex()
+	analyzer := NewCrystalAnalyzer()
+	analyzer.SetWorkspaceIndex(index)
+
 	return &Server{
-		logger:    log.New(os.Stderr, "[Crystal LSP] ", log.LstdFlags),
-		documents: make(map[string]*TextDocumentItem),
-		analyzer:  NewCrystalAnalyzer(),
+		logger:        log.New(os.Stderr, "[Crystal LSP] ", log.LstdFlags),
+		documents:     make(map[string]*TextDocumentItem),
+		analyzer:      analyzer,
+		crystalTool:   NewCrystalTool(""),
+		contextHovers: make(map[string]*contextHoverCache),
+		index:         index,
+		inlayHints:    true,
+		traceLevel:    TraceOff,
+		queue:         make(chan queuedRequest, 64),
+		cancels:       make(map[jsonrpc2.ID]context.CancelFunc),
+		checks:        make(map[string]*compilerCheck),
+		cancelIndex:   func() {},
+		exit:          os.Exit,
 	}
 }
 
-// Start starts the language server
+// Start starts the language server on stdin and stdout
 func (s *Server) Start(ctx context.Context) error {
+	return s.Serve(ctx, stdrwc{})
+}
+
+// Serve runs the language server over stream until the connection closes
+func (s *Server) Serve(ctx context.Context, stream io.ReadWriteCloser) error {
 	s.logger.Println("Crystal Language Server starting...")
 
-	// Create JSON-RPC connection over stdio
 	conn := jsonrpc2.NewConn(
 		ctx,
-		jsonrpc2.NewBufferedStream(stdrwc{}, jsonrpc2.VSCodeObjectCodec{}),
+		jsonrpc2.NewBufferedStream(stream, jsonrpc2.VSCodeObjectCodec{}),
 		s,
 	)
 
-	s.conn = conn
-
 	// Wait for connection to close
 	<-conn.DisconnectNotify()
 	s.logger.Println("Crystal Language Server stopped")
@@ -51,8 +137,82 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
-// Handle implements jsonrpc2.Handler
+// Handle implements jsonrpc2.Handler. Messages are queued for a single
+// worker, except $/cancelRequest which takes effect immediately. Each request
+// gets its own context that the client can cancel.
 func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	// The connection is kept here rather than in Serve: NewConn is already
+	// reading by the time it returns, and the worker logs through s.conn.
+	// Tests may have set it already.
+	s.startOnce.Do(func() {
+		if s.conn == nil {
+			s.conn = conn
+		}
+		go s.processQueue()
+	})
+
+	if req.Method == "$/cancelRequest" {
+		s.handleCancelRequest(ctx, conn, req)
+		return
+	}
+
+	if !req.Notif {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		s.cancelMu.Lock()
+		s.cancels[req.ID] = cancel
+		s.cancelMu.Unlock()
+	}
+
+	s.queue <- queuedRequest{ctx: ctx, conn: conn, req: req}
+}
+
+// processQueue handles queued messages in the order they arrived
+func (s *Server) processQueue() {
+	for queued := range s.queue {
+		ctx, conn, req := queued.ctx, queued.conn, queued.req
+
+		if !req.Notif && ctx.Err() != nil {
+			s.replyCancelled(ctx, conn, req)
+		} else {
+			s.dispatch(ctx, conn, req)
+		}
+
+		if !req.Notif {
+			s.cancelMu.Lock()
+			if cancel, ok := s.cancels[req.ID]; ok {
+				cancel()
+				delete(s.cancels, req.ID)
+			}
+			s.cancelMu.Unlock()
+		}
+	}
+}
+
+// replyCancelled answers a request the client cancelled
+func (s *Server) replyCancelled(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+		Code:    CodeRequestCancelled,
+		Message: fmt.Sprintf("Request %s was cancelled", req.Method),
+	})
+}
+
+// dispatch routes a message to its handler
+func (s *Server) dispatch(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	start := time.Now()
+	defer func() { s.logTrace(ctx, conn, req, time.Since(start)) }()
+
+	// After shutdown the server only waits for exit
+	if s.shuttingDown && req.Method != "exit" {
+		if !req.Notif {
+			conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    jsonrpc2.CodeInvalidRequest,
+				Message: fmt.Sprintf("Server is shutting down, %s rejected", req.Method),
+			})
+		}
+		return
+	}
+
 	switch req.Method {
 	case "initialize":
 		s.handleInitialize(ctx, conn, req)
@@ -62,18 +222,62 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		s.handleTextDocumentDidOpen(ctx, conn, req)
 	case "textDocument/didChange":
 		s.handleTextDocumentDidChange(ctx, conn, req)
+	case "textDocument/didSave":
+		s.handleTextDocumentDidSave(ctx, conn, req)
 	case "textDocument/didClose":
 		s.handleTextDocumentDidClose(ctx, conn, req)
 	case "textDocument/completion":
 		s.handleTextDocumentCompletion(ctx, conn, req)
+	case "completionItem/resolve":
+		s.handleCompletionItemResolve(ctx, conn, req)
 	case "textDocument/hover":
 		s.handleTextDocumentHover(ctx, conn, req)
 	case "textDocument/signatureHelp":
 		s.handleTextDocumentSignatureHelp(ctx, conn, req)
 	case "textDocument/definition":
 		s.handleTextDocumentDefinition(ctx, conn, req)
+	case "textDocument/typeDefinition":
+		s.handleTextDocumentTypeDefinition(ctx, conn, req)
+	case "textDocument/implementation":
+		s.handleTextDocumentImplementation(ctx, conn, req)
+	case "textDocument/prepareTypeHierarchy":
+		s.handleTextDocumentPrepareTypeHierarchy(ctx, conn, req)
+	case "typeHierarchy/supertypes":
+		s.handleTypeHierarchySupertypes(ctx, conn, req)
+	case "typeHierarchy/subtypes":
+		s.handleTypeHierarchySubtypes(ctx, conn, req)
+	case "textDocument/formatting":
+		s.handleTextDocumentFormatting(ctx, conn, req)
+	case "textDocument/rangeFormatting":
+		s.handleTextDocumentRangeFormatting(ctx, conn, req)
+	case "textDocument/onTypeFormatting":
+		s.handleTextDocumentOnTypeFormatting(ctx, conn, req)
+	case "textDocument/codeAction":
+		s.handleTextDocumentCodeAction(ctx, conn, req)
+	case "textDocument/references":
+		s.handleTextDocumentReferences(ctx, conn, req)
+	case "textDocument/documentHighlight":
+		s.handleTextDocumentHighlight(ctx, conn, req)
+	case "textDocument/prepareRename":
+		s.handleTextDocumentPrepareRename(ctx, conn, req)
+	case "textDocument/rename":
+		s.handleTextDocumentRename(ctx, conn, req)
 	case "textDocument/documentSymbol":
 		s.handleTextDocumentSymbol(ctx, conn, req)
+	case "textDocument/semanticTokens/full":
+		s.handleTextDocumentSemanticTokensFull(ctx, conn, req)
+	case "textDocument/inlayHint":
+		s.handleTextDocumentInlayHint(ctx, conn, req)
+	case "textDocument/foldingRange":
+		s.handleTextDocumentFoldingRange(ctx, conn, req)
+	case "textDocument/selectionRange":
+		s.handleTextDocumentSelectionRange(ctx, conn, req)
+	case "textDocument/documentLink":
+		s.handleTextDocumentDocumentLink(ctx, conn, req)
+	case "workspace/symbol":
+		s.handleWorkspaceSymbol(ctx, conn, req)
+	case "workspace/didChangeWatchedFiles":
+		s.handleWorkspaceDidChangeWatchedFiles(ctx, conn, req)
 	case "shutdown":
 		s.handleShutdown(ctx, conn, req)
 	case "exit":
@@ -82,10 +286,8 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		s.handleWorkspaceDidChangeConfiguration(ctx, conn, req)
 	case "$/setTrace":
 		s.handleSetTrace(ctx, conn, req)
-	case "$/cancelRequest":
-		s.handleCancelRequest(ctx, conn, req)
 	default:
-		s.logger.Printf("Unhandled method: %s", req.Method)
+		s.logf(MessageTypeWarning, "Unhandled method: %s", req.Method)
 		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 			Code:    jsonrpc2.CodeMethodNotFound,
 			Message: fmt.Sprintf("Method not found: %s", req.Method),
@@ -95,11 +297,12 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 
 func (s *Server) handleInitialize(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	var params struct {
-		ProcessID             *int   `json:"processId"`
-		RootPath              string `json:"rootPath"`
-		RootURI               string `json:"rootUri"`
-		InitializationOptions any    `json:"initializationOptions"`
-		Capabilities          any    `json:"capabilities"`
+		ProcessID             *int                  `json:"processId"`
+		RootPath              string                `json:"rootPath"`
+		RootURI               string                `json:"rootUri"`
+		InitializationOptions InitializationOptions `json:"initializationOptions"`
+		Capabilities          ClientCapabilities    `json:"capabilities"`
+		Trace                 string                `json:"trace"`
 	}
 
 	if err := json.Unmarshal(*req.Params, &params); err != nil {
@@ -110,24 +313,97 @@ func (s *Server) handleInitialize(ctx context.Context, conn *jsonrpc2.Conn, req
 		return
 	}
 
-	s.logger.Printf("Initializing with root: %s", params.RootURI)
+	s.logf(MessageTypeInfo, "Initializing with root: %s", params.RootURI)
+	s.clientCapabilities = params.Capabilities
+	switch params.Trace {
+	case TraceOff, TraceMessages, TraceVerbose:
+		s.setTraceLevel(params.Trace)
+	}
+	s.initializationOptions = params.InitializationOptions
+	if params.InitializationOptions.InlayHints != nil {
+		s.inlayHints = *params.InitializationOptions.InlayHints
+	}
+	s.analyzer.SetDiagnosticOptions(s.analyzer.DiagnosticOptions().Apply(params.InitializationOptions.Diagnostics))
+	if params.RootURI != "" {
+		s.rootPath = uriToPath(params.RootURI)
+	} else {
+		s.rootPath = params.RootPath
+	}
+	if s.rootPath != "" {
+		s.crystalTool = NewCrystalTool(s.rootPath)
+	}
+	if params.InitializationOptions.CrystalPath != "" {
+		s.crystalTool.SetCrystalPath(params.InitializationOptions.CrystalPath)
+	}
+	s.analyzer.SetSnippetSupport(params.Capabilities.TextDocument.Completion.CompletionItem.SnippetSupport)
+
+	// UTF-8 positions index the text directly; UTF-16 is the default every
+	// client supports
+	encoding := PositionEncodingUTF16
+	for _, offered := range params.Capabilities.General.PositionEncodings {
+		if offered == PositionEncodingUTF8 {
+			encoding = PositionEncodingUTF8
+		}
+	}
+	SetPositionEncoding(encoding)
+
+	// Rename and code action options may only be sent to clients that
+	// support them; the others get the plain boolean
+	var renameProvider any = true
+	if params.Capabilities.TextDocument.Rename.PrepareSupport {
+		renameProvider = map[string]any{"prepareProvider": true}
+	}
+	var codeActionProvider any = true
+	if params.Capabilities.TextDocument.CodeAction.CodeActionLiteralSupport != nil {
+		codeActionProvider = map[string]any{
+			"codeActionKinds": []string{CodeActionKindQuickFix},
+		}
+	}
 
 	result := map[string]any{
 		"capabilities": map[string]any{
+			"positionEncoding": encoding,
 			"textDocumentSync": map[string]any{
 				"openClose": true,
 				"change":    2, // Incremental
+				"save":      map[string]any{"includeText": false},
 			},
 			"completionProvider": map[string]any{
-				"resolveProvider":   false,
+				"resolveProvider":   true,
 				"triggerCharacters": []string{".", ":"},
 			},
 			"hoverProvider": true,
 			"signatureHelpProvider": map[string]any{
 				"triggerCharacters": []string{"(", ","},
 			},
-			"definitionProvider":     true,
+			"definitionProvider":              true,
+			"typeDefinitionProvider":          true,
+			"implementationProvider":          true,
+			"typeHierarchyProvider":           true,
+			"workspaceSymbolProvider":         true,
+			"referencesProvider":              true,
+			"documentHighlightProvider":       true,
+			"renameProvider":                  renameProvider,
+			"documentFormattingProvider":      true,
+			"documentRangeFormattingProvider": true,
+			"documentOnTypeFormattingProvider": map[string]any{
+				"firstTriggerCharacter": "\n",
+			},
+			"codeActionProvider":     codeActionProvider,
 			"documentSymbolProvider": true,
+			"semanticTokensProvider": map[string]any{
+				"legend": map[string]any{
+					"tokenTypes":     semanticTokenTypes,
+					"tokenModifiers": []string{},
+				},
+				"full": true,
+			},
+			"inlayHintProvider":      true,
+			"selectionRangeProvider": true,
+			"foldingRangeProvider":   true,
+			"documentLinkProvider": map[string]any{
+				"resolveProvider": false,
+			},
 		},
 		"serverInfo": map[string]any{
 			"name":    "Crystal Language Server",
@@ -139,7 +415,71 @@ func (s *Server) handleInitialize(ctx context.Context, conn *jsonrpc2.Conn, req
 }
 
 func (s *Server) handleInitialized(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	s.logger.Println("Server initialized")
+	s.initialized = true
+	s.logf(MessageTypeInfo, "Server initialized")
+
+	if !s.crystalTool.IsCrystalAvailable() && !s.crystalWarningShown {
+		s.crystalWarningShown = true
+		conn.Notify(ctx, "window/showMessage", map[string]any{
+			"type": MessageTypeWarning,
+			"message": "Crystal compiler not found: compiler-backed features such as type hovers and compile errors are disabled. " +
+				"Add crystal to your PATH or set the crystalPath initialization option.",
+		})
+	}
+
+	// Requests to the client must not block the handler, which the
+	// connection needs to deliver their responses
+	if s.clientCapabilities.Workspace.Configuration {
+		go s.pullConfiguration(ctx, conn)
+	}
+	if s.rootPath != "" {
+		var indexCtx context.Context
+		indexCtx, s.cancelIndex = context.WithCancel(ctx)
+		go s.indexWorkspace(indexCtx, conn)
+	}
+}
+
+// indexWorkspace scans the workspace for Crystal files and adds them to the
+// index, reporting progress to clients that support it
+func (s *Server) indexWorkspace(ctx context.Context, conn *jsonrpc2.Conn) {
+	if s.clientCapabilities.Workspace.DidChangeWatchedFiles.DynamicRegistration {
+		registration := map[string]any{
+			"registrations": []map[string]any{{
+				"id":     "crystal-ls/watched-files",
+				"method": "workspace/didChangeWatchedFiles",
+				"registerOptions": map[string]any{
+					"watchers": []map[string]any{{"globPattern": "**/*.cr"}},
+				},
+			}},
+		}
+		if err := conn.Call(ctx, "client/registerCapability", registration, nil); err != nil {
+			s.logf(MessageTypeError, "Error registering file watcher: %v", err)
+		}
+	}
+
+	files, err := collectCrystalFiles(s.rootPath, s.initializationOptions.IndexLib, maxIndexedFiles)
+	if err != nil {
+		s.logf(MessageTypeError, "Error scanning workspace: %v", err)
+	}
+
+	progress := s.beginProgress(ctx, conn, "crystal-ls/indexing", "Indexing Crystal project")
+	for i, path := range files {
+		if ctx.Err() != nil {
+			progress.end(ctx, "Indexing cancelled")
+			s.logf(MessageTypeInfo, "Indexing cancelled after %d files", i)
+			return
+		}
+		if err := s.index.indexFile(path); err != nil {
+			s.logf(MessageTypeError, "Error indexing %s: %v", path, err)
+		}
+		// Report in batches, and once more for the last file
+		if i%50 == 0 || i == len(files)-1 {
+			progress.report(ctx, fmt.Sprintf("%d/%d files", i+1, len(files)), (i+1)*100/len(files))
+		}
+	}
+	progress.end(ctx, fmt.Sprintf("Indexed %d files", len(files)))
+
+	s.logf(MessageTypeInfo, "Indexed %d Crystal files", len(files))
 }
 
 func (s *Server) handleTextDocumentDidOpen(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
@@ -148,12 +488,12 @@ func (s *Server) handleTextDocumentDidOpen(ctx context.Context, conn *jsonrpc2.C
 	}
 
 	if err := json.Unmarshal(*req.Params, &params); err != nil {
-		s.logger.Printf("Error unmarshaling didOpen params: %v", err)
+		s.logf(MessageTypeError, "Error unmarshaling didOpen params: %v", err)
 		return
 	}
 
 	s.documents[params.TextDocument.URI] = &params.TextDocument
-	s.logger.Printf("Opened document: %s", params.TextDocument.URI)
+	s.logf(MessageTypeLog, "Opened document: %s", params.TextDocument.URI)
 
 	// Analyze the document and send diagnostics
 	diagnostics := s.analyzer.AnalyzeDocument(&params.TextDocument)
@@ -167,13 +507,13 @@ func (s *Server) handleTextDocumentDidChange(ctx context.Context, conn *jsonrpc2
 	}
 
 	if err := json.Unmarshal(*req.Params, &params); err != nil {
-		s.logger.Printf("Error unmarshaling didChange params: %v", err)
+		s.logf(MessageTypeError, "Error unmarshaling didChange params: %v", err)
 		return
 	}
 
 	doc, exists := s.documents[params.TextDocument.URI]
 	if !exists {
-		s.logger.Printf("Document not found: %s", params.TextDocument.URI)
+		s.logf(MessageTypeWarning, "Document not found: %s", params.TextDocument.URI)
 		return
 	}
 
@@ -189,24 +529,117 @@ func (s *Server) handleTextDocumentDidChange(ctx context.Context, conn *jsonrpc2
 	}
 
 	doc.Version = params.TextDocument.Version
+	s.cancelCheck(doc.URI)
 
 	// Re-analyze and send diagnostics
 	diagnostics := s.analyzer.AnalyzeDocument(doc)
 	s.publishDiagnostics(ctx, conn, params.TextDocument.URI, diagnostics)
 }
 
+func (s *Server) handleTextDocumentDidSave(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		s.logf(MessageTypeError, "Error unmarshaling didSave params: %v", err)
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		s.logf(MessageTypeWarning, "Document not found: %s", params.TextDocument.URI)
+		return
+	}
+
+	s.index.Update(doc.URI, doc.Text)
+	s.checkDocument(conn, doc)
+}
+
+// checkDocument publishes the diagnostics of a document that matches the
+// file on disk, with compiler errors once `crystal build` has finished. The
+// build runs in the background. Checking the document again, changing or
+// closing it cancels the build, so what it reports is only published while
+// the document is still at the version that was built.
+func (s *Server) checkDocument(conn *jsonrpc2.Conn, doc *TextDocumentItem) {
+	diagnostics := s.analyzer.AnalyzeDocument(doc)
+	s.cancelCheck(doc.URI)
+	if !s.crystalTool.IsCrystalAvailable() {
+		s.publishDiagnostics(context.Background(), conn, doc.URI, diagnostics)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	check := &compilerCheck{cancel: cancel}
+	s.checkMu.Lock()
+	s.checks[doc.URI] = check
+	s.checkMu.Unlock()
+
+	// The worker may point the tool at another compiler meanwhile
+	uri, tool := doc.URI, *s.crystalTool
+	go func() {
+		defer cancel()
+
+		compilerDiagnostics, err := tool.CheckFile(ctx, uriToPath(uri))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logf(MessageTypeError, "Error checking %s: %v", uri, err)
+		}
+
+		// Publishing under the lock keeps a change that comes in meanwhile
+		// from being followed by these older diagnostics
+		s.checkMu.Lock()
+		defer s.checkMu.Unlock()
+		if s.checks[uri] != check {
+			return
+		}
+		delete(s.checks, uri)
+		s.publishDiagnostics(ctx, conn, uri, append(diagnostics, compilerDiagnostics...))
+	}()
+}
+
+// cancelCheck stops the compiler check of a document, if one is running
+func (s *Server) cancelCheck(uri string) {
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+	if check, ok := s.checks[uri]; ok {
+		check.cancel()
+		delete(s.checks, uri)
+	}
+}
+
+// cancelChecks stops every running compiler check
+func (s *Server) cancelChecks() {
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+	for uri, check := range s.checks {
+		check.cancel()
+		delete(s.checks, uri)
+	}
+}
+
 func (s *Server) handleTextDocumentDidClose(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	var params struct {
 		TextDocument TextDocumentIdentifier `json:"textDocument"`
 	}
 
 	if err := json.Unmarshal(*req.Params, &params); err != nil {
-		s.logger.Printf("Error unmarshaling didClose params: %v", err)
+		s.logf(MessageTypeError, "Error unmarshaling didClose params: %v", err)
 		return
 	}
 
+	// Clients keep the last published set around unless it is cleared
+	s.cancelCheck(params.TextDocument.URI)
+	if _, ok := s.documents[params.TextDocument.URI]; ok {
+		s.publishDiagnostics(ctx, conn, params.TextDocument.URI, []Diagnostic{})
+	}
+
 	delete(s.documents, params.TextDocument.URI)
-	s.logger.Printf("Closed document: %s", params.TextDocument.URI)
+	s.analyzer.ForgetDocument(params.TextDocument.URI)
+	delete(s.contextHovers, params.TextDocument.URI)
+	s.logf(MessageTypeLog, "Closed document: %s", params.TextDocument.URI)
 }
 
 func (s *Server) handleTextDocumentCompletion(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
@@ -230,9 +663,34 @@ func (s *Server) handleTextDocumentCompletion(ctx context.Context, conn *jsonrpc
 	}
 
 	completions := s.analyzer.GetCompletions(doc, params.Position)
+
+	// Documentation is sent by completionItem/resolve once an item is focused
+	data := &CompletionItemData{URI: doc.URI, Position: params.Position}
+	for i := range completions.Items {
+		completions.Items[i].Documentation = ""
+		completions.Items[i].Data = data
+	}
 	conn.Reply(ctx, req.ID, completions)
 }
 
+func (s *Server) handleCompletionItemResolve(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var item CompletionItem
+	if err := json.Unmarshal(*req.Params, &item); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if item.Data != nil {
+		if doc, exists := s.documents[item.Data.URI]; exists {
+			item = s.analyzer.ResolveCompletionItem(doc, item)
+		}
+	}
+	conn.Reply(ctx, req.ID, item)
+}
+
 func (s *Server) handleTextDocumentHover(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	var params struct {
 		TextDocument TextDocumentIdentifier `json:"textDocument"`
@@ -253,10 +711,94 @@ func (s *Server) handleTextDocumentHover(ctx context.Context, conn *jsonrpc2.Con
 		return
 	}
 
-	hover := s.analyzer.GetHover(doc, params.Position)
+	if hover := s.analyzer.GetRequireHover(doc, params.Position, s.rootPath); hover != nil {
+		conn.Reply(ctx, req.ID, hover)
+		return
+	}
+
+	// Prefer the compiler's view of the code, falling back to local analysis
+	hover := s.contextHover(ctx, doc, params.Position)
+	if ctx.Err() != nil {
+		s.replyCancelled(ctx, conn, req)
+		return
+	}
+	if hover == nil {
+		hover = s.analyzer.GetHover(doc, params.Position)
+	}
 	conn.Reply(ctx, req.ID, hover)
 }
 
+// contextHoverCache holds hovers computed for one version of a document,
+// including failed lookups as nil entries
+type contextHoverCache struct {
+	version int
+	hovers  map[Position]*Hover
+}
+
+// contextHover returns a hover built from `crystal tool context`, or nil when
+// Crystal is unavailable or has nothing to say about the position
+func (s *Server) contextHover(ctx context.Context, doc *TextDocumentItem, pos Position) *Hover {
+	if !s.crystalTool.IsCrystalAvailable() {
+		return nil
+	}
+
+	cache, ok := s.contextHovers[doc.URI]
+	if !ok || cache.version != doc.Version {
+		cache = &contextHoverCache{version: doc.Version, hovers: make(map[Position]*Hover)}
+		s.contextHovers[doc.URI] = cache
+	}
+	if hover, ok := cache.hovers[pos]; ok {
+		return hover
+	}
+
+	var hover *Hover
+	path, cleanup, err := documentFile(doc)
+	if err != nil {
+		s.logf(MessageTypeError, "Error preparing %s for crystal tool context: %v", doc.URI, err)
+	} else {
+		info, err := s.crystalTool.GetContext(ctx, path, pos.Line, pos.Character)
+		cleanup()
+		if ctx.Err() != nil {
+			// A cancelled lookup says nothing about the position
+			return nil
+		}
+		if err != nil {
+			s.logf(MessageTypeWarning, "crystal tool context: %v", err)
+		} else {
+			hover = formatContextHover(info)
+		}
+	}
+
+	cache.hovers[pos] = hover
+	return hover
+}
+
+// formatContextHover renders context information as hover content
+func formatContextHover(info *ContextInfo) *Hover {
+	if info == nil || (info.Name == "" && info.Type == "" && info.Description == "") {
+		return nil
+	}
+
+	var contents []string
+	if info.Name != "" {
+		header := "**" + info.Name + "**"
+		if info.Type != "" {
+			header += " : " + info.Type
+		}
+		contents = append(contents, header)
+	} else if info.Type != "" {
+		contents = append(contents, "**"+info.Type+"**")
+	}
+	if len(info.Ancestors) > 0 {
+		contents = append(contents, "Ancestors: "+strings.Join(info.Ancestors, " < "))
+	}
+	if info.Description != "" {
+		contents = append(contents, info.Description)
+	}
+
+	return &Hover{Contents: contents}
+}
+
 func (s *Server) handleTextDocumentSignatureHelp(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	var params struct {
 		TextDocument TextDocumentIdentifier `json:"textDocument"`
@@ -305,9 +847,10 @@ func (s *Server) handleTextDocumentDefinition(ctx context.Context, conn *jsonrpc
 	conn.Reply(ctx, req.ID, definitions)
 }
 
-func (s *Server) handleTextDocumentSymbol(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+func (s *Server) handleTextDocumentTypeDefinition(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	var params struct {
 		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
 	}
 
 	if err := json.Unmarshal(*req.Params, &params); err != nil {
@@ -320,86 +863,799 @@ func (s *Server) handleTextDocumentSymbol(ctx context.Context, conn *jsonrpc2.Co
 
 	doc, exists := s.documents[params.TextDocument.URI]
 	if !exists {
-		conn.Reply(ctx, req.ID, []SymbolInformation{})
+		conn.Reply(ctx, req.ID, []Location{})
 		return
 	}
 
-	symbols := s.analyzer.GetDocumentSymbols(doc)
-	conn.Reply(ctx, req.ID, symbols)
+	conn.Reply(ctx, req.ID, s.analyzer.GetTypeDefinition(doc, params.Position))
 }
 
-func (s *Server) handleShutdown(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	s.logger.Println("Shutdown requested")
-	conn.Reply(ctx, req.ID, nil)
-}
+func (s *Server) handleTextDocumentImplementation(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
+	}
 
-func (s *Server) handleExit(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	s.logger.Println("Exit requested")
-	os.Exit(0)
-}
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
 
-func (s *Server) handleWorkspaceDidChangeConfiguration(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	// Handle workspace configuration changes
-	s.logger.Println("Workspace configuration changed")
-}
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists || !s.crystalTool.IsCrystalAvailable() {
+		conn.Reply(ctx, req.ID, []Location{})
+		return
+	}
 
-func (s *Server) handleSetTrace(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	// Handle trace level changes (for debugging)
-	// This is a notification, so no response needed
-}
+	path, cleanup, err := documentFile(doc)
+	if err != nil {
+		s.logf(MessageTypeError, "Error preparing %s for crystal tool implementations: %v", doc.URI, err)
+		conn.Reply(ctx, req.ID, []Location{})
+		return
+	}
+	defer cleanup()
 
-func (s *Server) handleCancelRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	// Handle request cancellation
-	// This is a notification, so no response needed
+	locations, err := s.crystalTool.GetImplementations(ctx, path, params.Position.Line, params.Position.Character)
+	if ctx.Err() != nil {
+		s.replyCancelled(ctx, conn, req)
+		return
+	}
+	if err != nil {
+		s.logf(MessageTypeWarning, "crystal tool implementations: %v", err)
+		conn.Reply(ctx, req.ID, []Location{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, documentLocations(locations, path, doc.URI))
 }
 
-func (s *Server) publishDiagnostics(ctx context.Context, conn *jsonrpc2.Conn, uri string, diagnostics []Diagnostic) {
-	params := map[string]any{
-		"uri":         uri,
-		"diagnostics": diagnostics,
+func (s *Server) handleTextDocumentCodeAction(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Range        Range                  `json:"range"`
+		Context      struct {
+			Diagnostics []Diagnostic `json:"diagnostics"`
+		} `json:"context"`
 	}
 
-	conn.Notify(ctx, "textDocument/publishDiagnostics", params)
-}
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
 
-func (s *Server) applyTextChange(text string, change TextDocumentContentChangeEvent) string {
-	// This is a simplified implementation
-	// In a real implementation, you'd need to properly handle line/character positions
-	if change.Range == nil {
-		return change.Text
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []CodeAction{})
+		return
 	}
 
-	lines := splitLines(text)
+	conn.Reply(ctx, req.ID, s.analyzer.GetCodeActions(doc, params.Context.Diagnostics))
+}
 
-	// Calculate start and end offsets
-	startOffset := 0
-	for i := 0; i < change.Range.Start.Line && i < len(lines); i++ {
-		startOffset += len(lines[i]) + 1 // +1 for newline
+// handleTextDocumentFormatting formats with `crystal tool format`, falling
+// back to reindenting by block structure when Crystal isn't installed
+func (s *Server) handleTextDocumentFormatting(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
 	}
-	startOffset += change.Range.Start.Character
 
-	endOffset := 0
-	for i := 0; i < change.Range.End.Line && i < len(lines); i++ {
-		endOffset += len(lines[i]) + 1 // +1 for newline
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
 	}
-	endOffset += change.Range.End.Character
 
-	if startOffset > len(text) {
-		startOffset = len(text)
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []TextEdit{})
+		return
 	}
-	if endOffset > len(text) {
-		endOffset = len(text)
+
+	if !s.crystalTool.IsCrystalAvailable() {
+		conn.Reply(ctx, req.ID, documentEdits(doc.Text, s.analyzer.FormatDocument(doc)))
+		return
 	}
 
-	return text[:startOffset] + change.Text + text[endOffset:]
+	formatted, err := s.crystalTool.FormatSource(ctx, doc.Text)
+	if err != nil {
+		// The compiler can't format code that doesn't parse
+		s.logf(MessageTypeLog, "Error formatting %s: %v", doc.URI, err)
+		conn.Reply(ctx, req.ID, []TextEdit{})
+		return
+	}
+	conn.Reply(ctx, req.ID, documentEdits(doc.Text, formatted))
 }
 
-func splitLines(text string) []string {
-	var lines []string
-	start := 0
+func (s *Server) handleTextDocumentRangeFormatting(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Range        Range                  `json:"range"`
+	}
 
-	for i, r := range text {
-		if r == '\n' {
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists || !s.crystalTool.IsCrystalAvailable() {
+		conn.Reply(ctx, req.ID, []TextEdit{})
+		return
+	}
+
+	edits := rangeFormattingEdits(doc.Text, params.Range, func(source string) (string, error) {
+		return s.crystalTool.FormatSource(ctx, source)
+	})
+	conn.Reply(ctx, req.ID, edits)
+}
+
+func (s *Server) handleTextDocumentOnTypeFormatting(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
+		Ch           string                 `json:"ch"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []TextEdit{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetOnTypeFormatting(doc, params.Position, params.Ch))
+}
+
+func (s *Server) handleTextDocumentReferences(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
+		Context      struct {
+			IncludeDeclaration bool `json:"includeDeclaration"`
+		} `json:"context"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []Location{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetReferences(doc, params.Position, params.Context.IncludeDeclaration))
+}
+
+func (s *Server) handleTextDocumentHighlight(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []DocumentHighlight{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetDocumentHighlights(doc, params.Position))
+}
+
+func (s *Server) handleTextDocumentFoldingRange(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []FoldingRange{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetFoldingRanges(doc))
+}
+
+func (s *Server) handleTextDocumentPrepareRename(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, nil)
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.PrepareRename(doc, params.Position))
+}
+
+func (s *Server) handleTextDocumentRename(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
+		NewName      string                 `json:"newName"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, nil)
+		return
+	}
+
+	edit, err := s.analyzer.Rename(doc, params.Position, params.NewName)
+	if err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, edit)
+}
+
+func (s *Server) handleWorkspaceSymbol(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		Query string `json:"query"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// Visit documents in a stable order so results are deterministic
+	uris := make([]string, 0, len(s.documents))
+	for uri := range s.documents {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+
+	docs := make([]*TextDocumentItem, 0, len(uris))
+	for _, uri := range uris {
+		docs = append(docs, s.documents[uri])
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetWorkspaceSymbols(docs, params.Query))
+}
+
+func (s *Server) handleWorkspaceDidChangeWatchedFiles(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		Changes []FileEvent `json:"changes"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		s.logf(MessageTypeError, "Error unmarshaling didChangeWatchedFiles params: %v", err)
+		return
+	}
+
+	changed := map[string]bool{}
+	for _, change := range params.Changes {
+		// Our own copies of unsaved buffers come and go with each request,
+		// and open documents are indexed from the editor's buffer on save
+		path := uriToPath(change.URI)
+		if isTempCopy(path) {
+			continue
+		}
+		changed[path] = true
+		if _, open := s.documents[change.URI]; open {
+			continue
+		}
+		if change.Type == FileChangeTypeDeleted {
+			s.index.Remove(change.URI)
+			continue
+		}
+		if err := s.index.indexFile(uriToPath(change.URI)); err != nil {
+			s.logf(MessageTypeError, "Error indexing %s: %v", change.URI, err)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	// Compiler errors reported for open documents that require the changed
+	// files can be stale. Documents with unsaved changes are left alone:
+	// the compiler only sees what is on disk.
+	uris := make([]string, 0, len(s.documents))
+	for uri := range s.documents {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	for _, uri := range uris {
+		doc := s.documents[uri]
+		path := uriToPath(uri)
+		if saved, err := os.ReadFile(path); err != nil || string(saved) != doc.Text {
+			continue
+		}
+		if requiresAny(doc.Text, filepath.Dir(path), s.rootPath, changed) {
+			s.checkDocument(conn, doc)
+		}
+	}
+}
+
+func (s *Server) handleTextDocumentPrepareTypeHierarchy(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Position     Position               `json:"position"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, nil)
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.PrepareTypeHierarchy(doc, params.Position))
+}
+
+func (s *Server) handleTypeHierarchySupertypes(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	s.handleTypeHierarchy(ctx, conn, req, true)
+}
+
+func (s *Server) handleTypeHierarchySubtypes(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	s.handleTypeHierarchy(ctx, conn, req, false)
+}
+
+// handleTypeHierarchy answers supertypes and subtypes requests, using
+// `crystal tool hierarchy` when available and the local superclass chain
+// otherwise
+func (s *Server) handleTypeHierarchy(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request, supertypes bool) {
+	var params struct {
+		Item TypeHierarchyItem `json:"item"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.Item.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []TypeHierarchyItem{})
+		return
+	}
+
+	items, ok := s.toolTypeHierarchy(ctx, doc, params.Item, supertypes)
+	if ctx.Err() != nil {
+		s.replyCancelled(ctx, conn, req)
+		return
+	}
+	if ok {
+		conn.Reply(ctx, req.ID, items)
+		return
+	}
+
+	if supertypes {
+		conn.Reply(ctx, req.ID, s.analyzer.GetSupertypes(doc, params.Item))
+	} else {
+		conn.Reply(ctx, req.ID, s.analyzer.GetSubtypes(doc, params.Item))
+	}
+}
+
+// toolTypeHierarchy looks up the relatives of an item with `crystal tool
+// hierarchy`. The boolean is false when the tool is unavailable or does not
+// know the type.
+func (s *Server) toolTypeHierarchy(ctx context.Context, doc *TextDocumentItem, item TypeHierarchyItem, supertypes bool) ([]TypeHierarchyItem, bool) {
+	if !s.crystalTool.IsCrystalAvailable() {
+		return nil, false
+	}
+
+	path, cleanup, err := documentFile(doc)
+	if err != nil {
+		s.logf(MessageTypeError, "Error preparing %s for crystal tool hierarchy: %v", doc.URI, err)
+		return nil, false
+	}
+	defer cleanup()
+
+	start := item.SelectionRange.Start
+	output, err := s.crystalTool.GetTypeHierarchy(ctx, path, start.Line, start.Character)
+	if err != nil {
+		s.logf(MessageTypeWarning, "crystal tool hierarchy: %v", err)
+		return nil, false
+	}
+
+	nodes := parseHierarchy(output)
+	parent, children := hierarchyRelatives(nodes, hierarchyItemName(item))
+	if parent == nil && children == nil {
+		return nil, false
+	}
+
+	items := []TypeHierarchyItem{}
+	if supertypes {
+		if parent != nil {
+			items = append(items, s.analyzer.hierarchyItemFor(doc, parent.Name, parent.Kind, item))
+		}
+		return items, true
+	}
+	for _, child := range children {
+		items = append(items, s.analyzer.hierarchyItemFor(doc, child.Name, child.Kind, item))
+	}
+	return items, true
+}
+
+func (s *Server) handleTextDocumentSymbol(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []SymbolInformation{})
+		return
+	}
+
+	// Clients that support it get symbols nested under their types
+	if s.clientCapabilities.TextDocument.DocumentSymbol.HierarchicalDocumentSymbolSupport {
+		conn.Reply(ctx, req.ID, s.analyzer.GetDocumentSymbolTree(doc))
+		return
+	}
+
+	symbols := s.analyzer.GetDocumentSymbols(doc)
+	conn.Reply(ctx, req.ID, symbols)
+}
+
+func (s *Server) handleTextDocumentSemanticTokensFull(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, &SemanticTokens{Data: []int{}})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetSemanticTokens(doc))
+}
+
+func (s *Server) handleTextDocumentInlayHint(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Range        Range                  `json:"range"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists || !s.inlayHints {
+		conn.Reply(ctx, req.ID, []InlayHint{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetInlayHints(doc, params.Range))
+}
+
+func (s *Server) handleTextDocumentSelectionRange(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		Positions    []Position             `json:"positions"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []SelectionRange{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetSelectionRanges(doc, params.Positions))
+}
+
+func (s *Server) handleTextDocumentDocumentLink(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    jsonrpc2.CodeInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	doc, exists := s.documents[params.TextDocument.URI]
+	if !exists {
+		conn.Reply(ctx, req.ID, []DocumentLink{})
+		return
+	}
+
+	conn.Reply(ctx, req.ID, s.analyzer.GetDocumentLinks(doc, s.rootPath))
+}
+
+func (s *Server) handleShutdown(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	s.logf(MessageTypeInfo, "Shutdown requested")
+	s.shuttingDown = true
+	s.cancelIndex()
+	s.cancelChecks()
+	conn.Reply(ctx, req.ID, nil)
+}
+
+// handleExit ends the process, successfully only if shutdown came first
+func (s *Server) handleExit(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	code := 0
+	if !s.shuttingDown {
+		code = 1
+	}
+	s.logf(MessageTypeInfo, "Exit requested")
+	s.cancelIndex()
+
+	// The connection stays open: closing it would let Serve return and the
+	// process end with status 0 before exit runs. Writes are flushed as
+	// they are made, so nothing is left buffered for the client.
+	s.exit(code)
+}
+
+// pullConfiguration asks the client for the `crystal` settings section. The
+// answer is queued as a didChangeConfiguration notification, so it is
+// applied in order with the other messages, on top of the settings the
+// server already has.
+func (s *Server) pullConfiguration(ctx context.Context, conn *jsonrpc2.Conn) {
+	params := map[string]any{
+		"items": []map[string]any{{"section": "crystal"}},
+	}
+	var result []json.RawMessage
+	if err := conn.Call(ctx, "workspace/configuration", params, &result); err != nil {
+		s.logf(MessageTypeError, "Error requesting configuration: %v", err)
+		return
+	}
+	if len(result) == 0 || string(result[0]) == "null" {
+		return
+	}
+
+	settings, err := json.Marshal(map[string]any{
+		"settings": map[string]json.RawMessage{"crystal": result[0]},
+	})
+	if err != nil {
+		s.logf(MessageTypeError, "Error applying configuration: %v", err)
+		return
+	}
+	raw := json.RawMessage(settings)
+	s.queue <- queuedRequest{ctx: ctx, conn: conn, req: &jsonrpc2.Request{
+		Method: "workspace/didChangeConfiguration",
+		Params: &raw,
+		Notif:  true,
+	}}
+}
+
+func (s *Server) handleWorkspaceDidChangeConfiguration(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		Settings struct {
+			Crystal *InitializationOptions `json:"crystal"`
+		} `json:"settings"`
+	}
+
+	s.logf(MessageTypeInfo, "Workspace configuration changed")
+	if req.Params != nil {
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			s.logf(MessageTypeError, "Error parsing configuration: %v", err)
+			return
+		}
+	}
+
+	// Clients using the pull model send an empty notification and expect
+	// the server to ask for the settings
+	settings := params.Settings.Crystal
+	if settings == nil {
+		if s.clientCapabilities.Workspace.Configuration {
+			go s.pullConfiguration(ctx, conn)
+		}
+		return
+	}
+
+	if settings.CrystalPath != "" {
+		s.crystalTool.SetCrystalPath(settings.CrystalPath)
+	}
+
+	options := s.analyzer.DiagnosticOptions().Apply(settings.Diagnostics)
+	if options != s.analyzer.DiagnosticOptions() {
+		s.analyzer.SetDiagnosticOptions(options)
+		for uri, doc := range s.documents {
+			s.publishDiagnostics(ctx, conn, uri, s.analyzer.AnalyzeDocument(doc))
+		}
+	}
+
+	if enabled := settings.InlayHints; enabled != nil && *enabled != s.inlayHints {
+		s.inlayHints = *enabled
+		// Ask the client to pull hints again with the new setting, if it
+		// supports being asked
+		if s.clientCapabilities.Workspace.InlayHint.RefreshSupport {
+			go func() {
+				if err := conn.Call(ctx, "workspace/inlayHint/refresh", nil, nil); err != nil {
+					s.logf(MessageTypeError, "Error refreshing inlay hints: %v", err)
+				}
+			}()
+		}
+	}
+}
+
+func (s *Server) handleSetTrace(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		Value string `json:"value"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		s.logf(MessageTypeError, "Error unmarshaling setTrace params: %v", err)
+		return
+	}
+
+	switch params.Value {
+	case TraceOff, TraceMessages, TraceVerbose:
+		s.setTraceLevel(params.Value)
+	default:
+		s.logf(MessageTypeWarning, "Unknown trace level: %s", params.Value)
+	}
+}
+
+func (s *Server) handleCancelRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	var params struct {
+		ID jsonrpc2.ID `json:"id"`
+	}
+
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		s.logf(MessageTypeError, "Error unmarshaling cancelRequest params: %v", err)
+		return
+	}
+
+	// Requests that already finished have nothing left to cancel
+	s.cancelMu.Lock()
+	if cancel, ok := s.cancels[params.ID]; ok {
+		cancel()
+	}
+	s.cancelMu.Unlock()
+}
+
+func (s *Server) publishDiagnostics(ctx context.Context, conn *jsonrpc2.Conn, uri string, diagnostics []Diagnostic) {
+	params := map[string]any{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	}
+
+	conn.Notify(ctx, "textDocument/publishDiagnostics", params)
+}
+
+func (s *Server) applyTextChange(text string, change TextDocumentContentChangeEvent) string {
+	// This is a simplified implementation
+	// In a real implementation, you'd need to properly handle line/character positions
+	if change.Range == nil {
+		return change.Text
+	}
+
+	lines := splitLines(text)
+
+	// Calculate start and end offsets
+	startOffset := 0
+	for i := 0; i < change.Range.Start.Line && i < len(lines); i++ {
+		startOffset += len(lines[i]) + 1 // +1 for newline
+	}
+	if change.Range.Start.Line < len(lines) {
+		startOffset += byteOffset(lines[change.Range.Start.Line], change.Range.Start.Character)
+	}
+
+	endOffset := 0
+	for i := 0; i < change.Range.End.Line && i < len(lines); i++ {
+		endOffset += len(lines[i]) + 1 // +1 for newline
+	}
+	if change.Range.End.Line < len(lines) {
+		endOffset += byteOffset(lines[change.Range.End.Line], change.Range.End.Character)
+	}
+
+	if startOffset > len(text) {
+		startOffset = len(text)
+	}
+	if endOffset > len(text) {
+		endOffset = len(text)
+	}
+
+	return text[:startOffset] + change.Text + text[endOffset:]
+}
+
+func splitLines(text string) []string {
+	var lines []string
+	start := 0
+
+	for i, r := range text {
+		if r == '\n' {
 			lines = append(lines, text[start:i])
 			start = i + 1
 		}
@@ -429,3 +1685,40 @@ func (stdrwc) Close() error {
 	}
 	return os.Stdout.Close()
 }
+
+// workDoneProgress reports the progress of a long-running server task. It is
+// a no-op for clients that do not support work done progress.
+type workDoneProgress struct {
+	conn  *jsonrpc2.Conn
+	token string
+}
+
+// beginProgress creates a progress token on the client and starts reporting
+func (s *Server) beginProgress(ctx context.Context, conn *jsonrpc2.Conn, token, title string) *workDoneProgress {
+	if !s.clientCapabilities.Window.WorkDoneProgress {
+		return &workDoneProgress{}
+	}
+	if err := conn.Call(ctx, "window/workDoneProgress/create", map[string]any{"token": token}, nil); err != nil {
+		s.logf(MessageTypeError, "Error creating progress: %v", err)
+		return &workDoneProgress{}
+	}
+
+	progress := &workDoneProgress{conn: conn, token: token}
+	progress.notify(ctx, map[string]any{"kind": "begin", "title": title, "percentage": 0})
+	return progress
+}
+
+func (p *workDoneProgress) report(ctx context.Context, message string, percentage int) {
+	p.notify(ctx, map[string]any{"kind": "report", "message": message, "percentage": percentage})
+}
+
+func (p *workDoneProgress) end(ctx context.Context, message string) {
+	p.notify(ctx, map[string]any{"kind": "end", "message": message})
+}
+
+func (p *workDoneProgress) notify(ctx context.Context, value map[string]any) {
+	if p.conn == nil {
+		return
+	}
+	p.conn.Notify(ctx, "$/progress", map[string]any{"token": p.token, "value": value})
+}
@@ -0,0 +1,759 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// clientHandler answers the requests and notifications the server sends
+type clientHandler func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error)
+
+// newTestClient returns a client connected over a pipe, and the end of the
+// pipe the server is to use. A nil handle ignores what the server sends.
+// The client is closed when the test ends.
+func newTestClient(t *testing.T, handle clientHandler) (*jsonrpc2.Conn, net.Conn) {
+	t.Helper()
+	if handle == nil {
+		handle = func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+			return nil, nil
+		}
+	}
+
+	clientSide, serverSide := net.Pipe()
+	client := jsonrpc2.NewConn(context.Background(),
+		jsonrpc2.NewBufferedStream(clientSide, jsonrpc2.VSCodeObjectCodec{}),
+		jsonrpc2.HandlerWithError(handle))
+	t.Cleanup(func() { client.Close() })
+	return client, serverSide
+}
+
+// newTestConns connects server to a test client; see newTestClient. Both
+// connections are closed when the test ends.
+func newTestConns(t *testing.T, server *Server, handle clientHandler) (client, conn *jsonrpc2.Conn) {
+	t.Helper()
+	client, serverSide := newTestClient(t, handle)
+	conn = jsonrpc2.NewConn(context.Background(),
+		jsonrpc2.NewBufferedStream(serverSide, jsonrpc2.VSCodeObjectCodec{}), server)
+	t.Cleanup(func() { conn.Close() })
+	return client, conn
+}
+
+func TestFormatContextHover(t *testing.T) {
+	hover := formatContextHover(&ContextInfo{
+		Type:        "String",
+		Name:        "greeting",
+		Ancestors:   []string{"Reference", "Object"},
+		Description: "A local variable",
+	})
+	if hover == nil {
+		t.Fatal("Expected a hover")
+	}
+
+	expected := []string{"**greeting** : String", "Ancestors: Reference < Object", "A local variable"}
+	if len(hover.Contents) != len(expected) {
+		t.Fatalf("Expected %d lines, got %v", len(expected), hover.Contents)
+	}
+	for i, line := range expected {
+		if hover.Contents[i] != line {
+			t.Errorf("Expected %q, got %q", line, hover.Contents[i])
+		}
+	}
+
+	if formatContextHover(&ContextInfo{}) != nil {
+		t.Error("Expected no hover for empty context information")
+	}
+}
+
+func TestServer_TraceAllows(t *testing.T) {
+	server := NewServer()
+
+	tests := []struct {
+		level    string
+		allowed  []int
+		filtered []int
+	}{
+		{TraceOff, []int{MessageTypeError, MessageTypeWarning}, []int{MessageTypeInfo, MessageTypeLog}},
+		{TraceMessages, []int{MessageTypeError, MessageTypeInfo}, []int{MessageTypeLog}},
+		{TraceVerbose, []int{MessageTypeError, MessageTypeInfo, MessageTypeLog}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			server.setTraceLevel(tt.level)
+			for _, messageType := range tt.allowed {
+				if !server.traceAllows(messageType) {
+					t.Errorf("Expected message type %d to be logged", messageType)
+				}
+			}
+			for _, messageType := range tt.filtered {
+				if server.traceAllows(messageType) {
+					t.Errorf("Expected message type %d to be filtered", messageType)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_SetTraceWhileLogging(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+
+	logged := make(chan struct{}, 64)
+	client, conn := newTestConns(t, server, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+		if req.Method == "window/logMessage" {
+			logged <- struct{}{}
+		}
+		return nil, nil
+	})
+
+	server.conn = conn
+	server.initialized = true
+	server.initializationOptions.LogToClient = true
+
+	// Background work such as indexing logs while the client changes the
+	// trace level; run with -race to check the two don't conflict
+	const count = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			server.logf(MessageTypeWarning, "indexing %d", i)
+		}
+	}()
+	for i := 0; i < count; i++ {
+		if err := client.Notify(ctx, "$/setTrace", map[string]any{"value": TraceVerbose}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-logged:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d warnings to reach the client, got %d", count, i)
+		}
+	}
+}
+
+func TestServer_LogTrace(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+
+	traces := make(chan map[string]string, 4)
+	client, _ := newTestConns(t, server, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+		if req.Method == "$/logTrace" {
+			var params map[string]string
+			json.Unmarshal(*req.Params, &params)
+			traces <- params
+		}
+		return nil, nil
+	})
+
+	receive := func() map[string]string {
+		select {
+		case params := <-traces:
+			return params
+		case <-time.After(time.Second):
+			t.Fatal("Expected a $/logTrace notification")
+			return nil
+		}
+	}
+
+	if err := client.Notify(ctx, "$/setTrace", map[string]string{"value": TraceMessages}); err != nil {
+		t.Fatal(err)
+	}
+	if params := receive(); !strings.Contains(params["message"], "$/setTrace") || params["verbose"] != "" {
+		t.Errorf("Expected a message-only trace, got %v", params)
+	}
+
+	if err := client.Notify(ctx, "$/setTrace", map[string]string{"value": TraceVerbose}); err != nil {
+		t.Fatal(err)
+	}
+	if params := receive(); !strings.Contains(params["verbose"], TraceVerbose) {
+		t.Errorf("Expected the params in a verbose trace, got %v", params)
+	}
+}
+
+func TestServer_CancelRequest(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+
+	// Hold the worker back so the request is still queued when cancelled
+	server.startOnce.Do(func() {})
+
+	client, _ := newTestConns(t, server, nil)
+
+	id := jsonrpc2.ID{Num: 42}
+	call, err := client.DispatchCall(ctx, "textDocument/hover", map[string]any{
+		"textDocument": map[string]string{"uri": "file:///missing.cr"},
+		"position":     Position{},
+	}, jsonrpc2.PickID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Notify(ctx, "$/cancelRequest", map[string]any{"id": id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cancellation reaches the queued request before it is handled
+	var queued queuedRequest
+	select {
+	case queued = <-server.queue:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be queued")
+	}
+	select {
+	case <-queued.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request context to be cancelled")
+	}
+	server.queue <- queued
+	go server.processQueue()
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err = call.Wait(waitCtx, nil)
+	var rpcErr *jsonrpc2.Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeRequestCancelled {
+		t.Errorf("Expected a RequestCancelled error, got %v", err)
+	}
+
+	// The entry is removed just after the reply is sent
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		server.cancelMu.Lock()
+		pending := len(server.cancels)
+		server.cancelMu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected finished requests to be forgotten, got %d", pending)
+		}
+	}
+}
+
+func TestServer_SetLogLevel(t *testing.T) {
+	server := NewServer()
+	var output strings.Builder
+	server.SetLogOutput(&output)
+
+	if err := server.SetLogLevel("loud"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+	if err := server.SetLogLevel(TraceOff); err != nil {
+		t.Fatal(err)
+	}
+
+	server.logf(MessageTypeInfo, "indexed files")
+	server.logf(MessageTypeError, "index failed")
+	if strings.Contains(output.String(), "indexed files") || !strings.Contains(output.String(), "index failed") {
+		t.Errorf("Expected only the error to be logged, got %q", output.String())
+	}
+}
+
+func TestServer_ShutdownExit(t *testing.T) {
+	tests := []struct {
+		name     string
+		shutdown bool
+		code     int
+	}{
+		{"after shutdown", true, 0},
+		{"without shutdown", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			exited := make(chan int, 1)
+			server.exit = func(code int) { exited <- code }
+			ctx := context.Background()
+
+			client, _ := newTestConns(t, server, nil)
+
+			if tt.shutdown {
+				if err := client.Call(ctx, "shutdown", nil, nil); err != nil {
+					t.Fatalf("Expected shutdown to succeed, got %v", err)
+				}
+
+				// Requests other than exit are rejected from now on
+				err := client.Call(ctx, "textDocument/hover", map[string]any{
+					"textDocument": map[string]string{"uri": "file:///main.cr"},
+					"position":     Position{},
+				}, nil)
+				var rpcErr *jsonrpc2.Error
+				if !errors.As(err, &rpcErr) || rpcErr.Code != jsonrpc2.CodeInvalidRequest {
+					t.Errorf("Expected an InvalidRequest error after shutdown, got %v", err)
+				}
+			}
+
+			if err := client.Notify(ctx, "exit", nil); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case code := <-exited:
+				if code != tt.code {
+					t.Errorf("Expected exit code %d, got %d", tt.code, code)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected the server to exit")
+			}
+		})
+	}
+
+	// Through Serve, as main runs it: once the connection is closed Serve
+	// returns, and the process ends with status 0 before exit can report 1
+	t.Run("served without shutdown", func(t *testing.T) {
+		server := NewServer()
+		served := make(chan struct{})
+		exited := make(chan int, 1)
+		server.exit = func(code int) {
+			select {
+			case <-server.conn.DisconnectNotify():
+				exited <- 0
+			default:
+				exited <- code
+			}
+		}
+		ctx := context.Background()
+
+		client, serverSide := newTestClient(t, nil)
+		go func() {
+			server.Serve(ctx, serverSide)
+			close(served)
+		}()
+		defer func() {
+			client.Close()
+			<-served
+		}()
+
+		if err := client.Notify(ctx, "exit", nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case code := <-exited:
+			if code != 1 {
+				t.Errorf("Expected the process to exit with 1, got %d", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the server to exit")
+		}
+	})
+}
+
+func TestServer_CompletionResolve(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+
+	uri := "file:///greeter.cr"
+	server.documents[uri] = &TextDocumentItem{
+		URI:  uri,
+		Text: "class Greeter\n  def greet\n  end\nend\n\nGreeter.new.",
+	}
+
+	client, _ := newTestConns(t, server, nil)
+
+	var list CompletionList
+	err := client.Call(ctx, "textDocument/completion", map[string]any{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     Position{Line: 5, Character: 12},
+	}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var greet *CompletionItem
+	for i := range list.Items {
+		if list.Items[i].Documentation != "" {
+			t.Errorf("Expected documentation to be deferred, got %q on %s", list.Items[i].Documentation, list.Items[i].Label)
+		}
+		if list.Items[i].Label == "greet" {
+			greet = &list.Items[i]
+		}
+	}
+	if greet == nil || greet.Data == nil || greet.Data.URI != uri {
+		t.Fatalf("Expected greet with resolve data, got %+v", greet)
+	}
+
+	var resolved CompletionItem
+	if err := client.Call(ctx, "completionItem/resolve", greet, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Documentation != "Method of Greeter" {
+		t.Errorf("Expected resolved documentation, got %q", resolved.Documentation)
+	}
+}
+
+func TestServer_DidChangeWatchedFiles(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "animal.cr")
+	if err := os.WriteFile(path, []byte("class Animal\nend\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fileURI := pathToURI(path)
+
+	// Only open documents that require the file and match what is on disk
+	// are checked again
+	open := func(name, text, buffer string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		uri := pathToURI(path)
+		server.documents[uri] = &TextDocumentItem{URI: uri, Text: buffer}
+		return uri
+	}
+	dogText := "require \"./animal\"\nclass Dog < Animal\nend\n"
+	openURI := open("dog.cr", dogText, dogText)
+	open("cat.cr", dogText, dogText+"class Cat < Animal\nend\n")
+	open("plant.cr", "class Plant\nend\n", "class Plant\nend\n")
+
+	published := make(chan string, 4)
+	client, _ := newTestConns(t, server, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+		if req.Method == "textDocument/publishDiagnostics" {
+			var params struct {
+				URI string `json:"uri"`
+			}
+			json.Unmarshal(*req.Params, &params)
+			published <- params.URI
+		}
+		return nil, nil
+	})
+
+	notify := func(changeType int) {
+		t.Helper()
+		err := client.Notify(ctx, "workspace/didChangeWatchedFiles", map[string]any{
+			"changes": []map[string]any{{"uri": fileURI, "type": changeType}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case uri := <-published:
+			if uri != openURI {
+				t.Errorf("Expected diagnostics for the open document, got %s", uri)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected diagnostics to be republished")
+		}
+	}
+
+	notify(FileChangeTypeCreated)
+	if _, ok := server.index.FindClass("Animal", ""); !ok {
+		t.Errorf("Expected the created file to be indexed")
+	}
+
+	// Temporary copies of unsaved documents are neither indexed nor
+	// trigger diagnostics
+	copyPath := filepath.Join(dir, ".crystal-ls-1.cr")
+	if err := os.WriteFile(copyPath, []byte("class Copy\nend\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := client.Notify(ctx, "workspace/didChangeWatchedFiles", map[string]any{
+		"changes": []map[string]any{{"uri": pathToURI(copyPath), "type": FileChangeTypeCreated}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case uri := <-published:
+		t.Errorf("Expected no diagnostics for a temporary copy, got %s", uri)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := server.index.FindClass("Copy", ""); ok {
+		t.Errorf("Expected the temporary copy not to be indexed")
+	}
+
+	notify(FileChangeTypeDeleted)
+	if _, ok := server.index.FindClass("Animal", ""); ok {
+		t.Errorf("Expected the deleted file to be dropped from the index")
+	}
+	select {
+	case uri := <-published:
+		t.Errorf("Expected only the document requiring the file to be checked, got %s", uri)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_DidSaveCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in compiler is a shell script")
+	}
+
+	// Stand-ins for `crystal build`: one reports an error at once, the
+	// other takes long enough to be cancelled
+	dir := t.TempDir()
+	compiler := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	failing := compiler("failing", `echo "$4:1:1: undefined constant Animal"`)
+	slow := compiler("slow", "exec sleep 10")
+
+	path := filepath.Join(dir, "dog.cr")
+	text := "class Dog < Animal\nend\n"
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uri := pathToURI(path)
+
+	tests := []struct {
+		name     string
+		compiler string
+		// Sent while the build runs; its own diagnostics come first
+		method   string
+		params   map[string]any
+		expected []string
+	}{
+		{"published when done", failing, "", nil, []string{"undefined constant Animal"}},
+		{"cancelled by a change", slow, "textDocument/didChange", map[string]any{
+			"textDocument":   map[string]any{"uri": uri, "version": 2},
+			"contentChanges": []map[string]any{{"text": text}},
+		}, []string{`"uri":"` + uri + `"`}},
+		{"cancelled by closing", slow, "textDocument/didClose", map[string]any{
+			"textDocument": map[string]any{"uri": uri},
+		}, []string{`"uri":"` + uri + `"`}},
+		{"cancelled by shutdown", slow, "shutdown", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			server.crystalTool.SetCrystalPath(tt.compiler)
+			server.documents[uri] = &TextDocumentItem{URI: uri, Version: 1, Text: text}
+			ctx := context.Background()
+
+			published := make(chan string, 4)
+			client, _ := newTestConns(t, server, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+				if req.Method == "textDocument/publishDiagnostics" {
+					published <- string(*req.Params)
+				}
+				return nil, nil
+			})
+
+			err := client.Notify(ctx, "textDocument/didSave", map[string]any{
+				"textDocument": map[string]any{"uri": uri},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.method == "shutdown":
+				err = client.Call(ctx, tt.method, nil, nil)
+			case tt.method != "":
+				err = client.Notify(ctx, tt.method, tt.params)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tt.expected {
+				select {
+				case params := <-published:
+					if !strings.Contains(params, want) {
+						t.Errorf("Expected diagnostics with %s, got %s", want, params)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("Expected diagnostics with %s", want)
+				}
+			}
+			select {
+			case params := <-published:
+				t.Errorf("Expected nothing more to be published, got %s", params)
+			case <-time.After(200 * time.Millisecond):
+			}
+
+			server.checkMu.Lock()
+			defer server.checkMu.Unlock()
+			if len(server.checks) != 0 {
+				t.Errorf("Expected no checks left running, got %d", len(server.checks))
+			}
+		})
+	}
+}
+
+func TestServer_DidCloseClearsDiagnostics(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+
+	uri := "file:///open.cr"
+	server.documents[uri] = &TextDocumentItem{URI: uri, Text: "if x = 1\nend\n"}
+
+	published := make(chan string, 1)
+	client, _ := newTestConns(t, server, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+		if req.Method == "textDocument/publishDiagnostics" {
+			published <- string(*req.Params)
+		}
+		return nil, nil
+	})
+
+	err := client.Notify(ctx, "textDocument/didClose", map[string]any{
+		"textDocument": map[string]any{"uri": uri},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case params := <-published:
+		if !strings.Contains(params, `"uri":"`+uri+`"`) || !strings.Contains(params, `"diagnostics":[]`) {
+			t.Errorf("Expected an empty diagnostics array for the closed document, got %s", params)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected diagnostics to be cleared on close")
+	}
+}
+
+func TestServer_PullConfiguration(t *testing.T) {
+	server := NewServer()
+	server.clientCapabilities.Workspace.Configuration = true
+	ctx := context.Background()
+
+	uri := "file:///open.cr"
+	server.documents[uri] = &TextDocumentItem{URI: uri, Text: "if x = 1\nend\n"}
+
+	requested := make(chan string, 1)
+	published := make(chan int, 1)
+	client, _ := newTestConns(t, server, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+		switch req.Method {
+		case "workspace/configuration":
+			requested <- string(*req.Params)
+			return []any{map[string]any{
+				"diagnostics": map[string]any{"assignmentInCondition": false},
+			}}, nil
+		case "textDocument/publishDiagnostics":
+			var params struct {
+				Diagnostics []Diagnostic `json:"diagnostics"`
+			}
+			json.Unmarshal(*req.Params, &params)
+			published <- len(params.Diagnostics)
+		}
+		return nil, nil
+	})
+
+	if err := client.Notify(ctx, "initialized", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case params := <-requested:
+		if !strings.Contains(params, `"section":"crystal"`) {
+			t.Errorf("Expected the crystal section to be requested, got %s", params)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the server to request its configuration")
+	}
+
+	// The pulled settings switch the check off and diagnostics are redone
+	select {
+	case count := <-published:
+		if count != 0 {
+			t.Errorf("Expected the assignment warning to be gone, got %d diagnostics", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected diagnostics to be republished with the pulled settings")
+	}
+}
+
+func TestServer_InlayHintRefresh(t *testing.T) {
+	for _, refreshSupport := range []bool{true, false} {
+		server := NewServer()
+		server.clientCapabilities.Workspace.InlayHint.RefreshSupport = refreshSupport
+		ctx := context.Background()
+
+		refreshed := make(chan struct{}, 1)
+		client, _ := newTestConns(t, server, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+			if req.Method == "workspace/inlayHint/refresh" {
+				refreshed <- struct{}{}
+			}
+			return nil, nil
+		})
+
+		err := client.Notify(ctx, "workspace/didChangeConfiguration", map[string]any{
+			"settings": map[string]any{"crystal": map[string]any{"inlayHints": false}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-refreshed:
+			if !refreshSupport {
+				t.Error("Expected no refresh for a client without refresh support")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if refreshSupport {
+				t.Error("Expected the client to be asked to refresh inlay hints")
+			}
+		}
+	}
+}
+
+func TestServer_InitializeCapabilities(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities map[string]any
+		rename       string
+		codeAction   string
+	}{
+		{
+			name:         "minimal client",
+			capabilities: map[string]any{},
+			rename:       `true`,
+			codeAction:   `true`,
+		},
+		{
+			name: "full client",
+			capabilities: map[string]any{
+				"textDocument": map[string]any{
+					"rename":     map[string]any{"prepareSupport": true},
+					"codeAction": map[string]any{"codeActionLiteralSupport": map[string]any{}},
+				},
+			},
+			rename:     `{"prepareProvider":true}`,
+			codeAction: `{"codeActionKinds":["quickfix"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			ctx := context.Background()
+
+			client, _ := newTestConns(t, server, nil)
+
+			var result struct {
+				Capabilities struct {
+					RenameProvider     json.RawMessage `json:"renameProvider"`
+					CodeActionProvider json.RawMessage `json:"codeActionProvider"`
+				} `json:"capabilities"`
+			}
+			if err := client.Call(ctx, "initialize", map[string]any{"capabilities": tt.capabilities}, &result); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(result.Capabilities.RenameProvider); got != tt.rename {
+				t.Errorf("Expected renameProvider %s, got %s", tt.rename, got)
+			}
+			if got := string(result.Capabilities.CodeActionProvider); got != tt.codeAction {
+				t.Errorf("Expected codeActionProvider %s, got %s", tt.codeAction, got)
+			}
+		})
+	}
+}
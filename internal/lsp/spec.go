@@ -0,0 +1,180 @@
+package lsp
+
+import "strings"
+
+// specGroups are the spec DSL calls that group examples, specExamples the
+// ones that declare a single example
+var (
+	specGroups   = map[string]bool{"describe": true, "context": true}
+	specExamples = map[string]bool{"it": true, "pending": true}
+)
+
+// specMethods are the spec DSL calls offered in spec files
+var specMethods = []BuiltinMethod{
+	{"describe", "describe(description, &block)", "Groups related examples under a description."},
+	{"context", "context(description, &block)", "Groups examples that share a situation."},
+	{"it", "it(description, &block)", "Declares an example."},
+	{"pending", "pending(description, &block)", "Declares an example that is reported but not run."},
+	{"before_each", "before_each(&block)", "Runs the block before each example in the group."},
+	{"after_each", "after_each(&block)", "Runs the block after each example in the group."},
+	{"before_all", "before_all(&block)", "Runs the block once before the examples in the group."},
+	{"after_all", "after_all(&block)", "Runs the block once after the examples in the group."},
+	{"around_each", "around_each(&block : Spec::Example::Procsy ->)", "Wraps each example in the group."},
+	{"expect_raises", "expect_raises(klass, message = nil, &block)", "Fails unless the block raises klass."},
+	{"fail", "fail(message)", "Fails the current example."},
+	{"eq", "eq(value)", "Expects the actual value to equal value."},
+	{"be", "be(value)", "Expects the actual value to be the same object as value."},
+	{"be_true", "be_true", "Expects the actual value to be true."},
+	{"be_false", "be_false", "Expects the actual value to be false."},
+	{"be_truthy", "be_truthy", "Expects the actual value to be truthy."},
+	{"be_falsey", "be_falsey", "Expects the actual value to be falsey."},
+	{"be_nil", "be_nil", "Expects the actual value to be nil."},
+	{"be_empty", "be_empty", "Expects the actual value to be empty."},
+	{"be_a", "be_a(type)", "Expects the actual value to be an instance of type."},
+	{"be_close", "be_close(expected, delta)", "Expects the actual value to be within delta of expected."},
+	{"contain", "contain(expected)", "Expects the actual value to include expected."},
+	{"match", "match(pattern)", "Expects the actual value to match pattern."},
+	{"start_with", "start_with(expected)", "Expects the actual value to start with expected."},
+	{"end_with", "end_with(expected)", "Expects the actual value to end with expected."},
+}
+
+// specExpectations are the methods spec adds to every object
+var specExpectations = []BuiltinMethod{
+	{"should", "should(expectation)", "Fails unless the object satisfies the expectation."},
+	{"should_not", "should_not(expectation)", "Fails if the object satisfies the expectation."},
+}
+
+// isSpecDocument reports whether doc is written against the spec library:
+// it is named like `foo_spec.cr` or requires spec or a spec helper
+func isSpecDocument(doc *TextDocumentItem) bool {
+	if strings.HasSuffix(doc.URI, "_spec.cr") {
+		return true
+	}
+	for _, line := range strings.Split(doc.Text, "\n") {
+		match := requireRegexp.FindStringSubmatch(line)
+		if match != nil && (match[1] == "spec" || strings.HasSuffix(match[1], "spec_helper")) {
+			return true
+		}
+	}
+	return false
+}
+
+// specCompletions returns the spec DSL calls and matchers matching word
+func specCompletions(word string, methods []BuiltinMethod) []CompletionItem {
+	var items []CompletionItem
+	for _, method := range methods {
+		if fuzzyMatch(word, method.Name) {
+			items = append(items, CompletionItem{
+				Label:         method.Name,
+				Kind:          CompletionItemKindFunction,
+				Detail:        method.Signature,
+				Documentation: method.Doc,
+			})
+		}
+	}
+	return items
+}
+
+// specSymbols returns the describe and context groups of a spec document
+// with the examples they contain. Each symbol is named by its description
+// and spans its block.
+func specSymbols(tokens []Token, lines []string) []DocumentSymbol {
+	// The line of the `end` closing each `do` block, keyed by the line the
+	// block starts on
+	blockEnds := make(map[int]int)
+	var stack []blockEvent
+	for _, event := range scanBlockEvents(tokens) {
+		if event.Keyword != "end" {
+			stack = append(stack, event)
+			continue
+		}
+		if len(stack) == 0 {
+			continue
+		}
+		opener := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, seen := blockEnds[opener.Line]; opener.Keyword == "do" && !seen {
+			blockEnds[opener.Line] = event.Line
+		}
+	}
+
+	type specEntry struct {
+		symbol  DocumentSymbol
+		endLine int
+	}
+	var entries []specEntry
+	for i, token := range tokens {
+		if token.Type != TokenIdentifier || !specGroups[token.Value] && !specExamples[token.Value] {
+			continue
+		}
+		if i > 0 && tokens[i-1].Position.Line == token.Position.Line && tokens[i-1].Value != ";" {
+			continue
+		}
+
+		line := lines[token.Position.Line]
+		description := specDescription(line[byteOffset(line, token.Position.Character+token.Length):])
+		if description == "" {
+			continue
+		}
+
+		endLine, isBlock := blockEnds[token.Position.Line]
+		if !isBlock {
+			endLine = token.Position.Line
+		}
+		kind := SymbolKindMethod
+		if specGroups[token.Value] {
+			kind = SymbolKindNamespace
+		}
+		entries = append(entries, specEntry{
+			symbol: DocumentSymbol{
+				Name:   description,
+				Detail: token.Value,
+				Kind:   kind,
+				Range:  blockRange(token.Position.Line, endLine, lines),
+				SelectionRange: Range{
+					Start: token.Position,
+					End:   Position{Line: token.Position.Line, Character: token.Position.Character + token.Length},
+				},
+			},
+			endLine: endLine,
+		})
+	}
+
+	// Entries are in document order, so each one's children are the
+	// entries that follow it up to its end line
+	next := 0
+	var nest func(endLine int) []DocumentSymbol
+	nest = func(endLine int) []DocumentSymbol {
+		var symbols []DocumentSymbol
+		for next < len(entries) && entries[next].symbol.Range.Start.Line <= endLine {
+			entry := entries[next]
+			next++
+			entry.symbol.Children = nest(entry.endLine)
+			symbols = append(symbols, entry.symbol)
+		}
+		return symbols
+	}
+	return nest(len(lines))
+}
+
+// specDescription returns the description passed to a spec DSL call, given
+// the text after its name: the contents of a string literal or the written
+// type, e.g. `Foo` for `describe Foo do`
+func specDescription(args string) string {
+	args = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args), "("))
+
+	if strings.HasPrefix(args, `"`) {
+		if end := strings.Index(args[1:], `"`); end >= 0 {
+			return args[1 : end+1]
+		}
+		return ""
+	}
+
+	if idx := strings.IndexAny(args, " ,{)"); idx >= 0 {
+		args = args[:idx]
+	}
+	if typeNameRegexp.MatchString(args) {
+		return args
+	}
+	return ""
+}
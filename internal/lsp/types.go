@@ -53,6 +53,19 @@ type CompletionItem struct {
 	Detail        string `json:"detail,omitempty"`
 	Documentation string `json:"documentation,omitempty"`
 	InsertText    string `json:"insertText,omitempty"`
+	// InsertTextFormat is InsertTextFormatPlainText or InsertTextFormatSnippet
+	InsertTextFormat int    `json:"insertTextFormat,omitempty"`
+	SortText         string `json:"sortText,omitempty"`
+	FilterText       string `json:"filterText,omitempty"`
+	Preselect        bool   `json:"preselect,omitempty"`
+	// Data lets completionItem/resolve find the item again
+	Data *CompletionItemData `json:"data,omitempty"`
+}
+
+// CompletionItemData records where a completion item was offered
+type CompletionItemData struct {
+	URI      string   `json:"uri"`
+	Position Position `json:"position"`
 }
 
 // CompletionList represents a list of completion items
@@ -63,11 +76,18 @@ type CompletionList struct {
 
 // Diagnostic represents a diagnostic message
 type Diagnostic struct {
-	Range    Range  `json:"range"`
-	Severity int    `json:"severity"`
-	Code     string `json:"code,omitempty"`
-	Source   string `json:"source,omitempty"`
-	Message  string `json:"message"`
+	Range              Range                          `json:"range"`
+	Severity           int                            `json:"severity"`
+	Code               string                         `json:"code,omitempty"`
+	Source             string                         `json:"source,omitempty"`
+	Message            string                         `json:"message"`
+	RelatedInformation []DiagnosticRelatedInformation `json:"relatedInformation,omitempty"`
+}
+
+// DiagnosticRelatedInformation points at code related to a diagnostic
+type DiagnosticRelatedInformation struct {
+	Location Location `json:"location"`
+	Message  string   `json:"message"`
 }
 
 // SymbolInformation represents symbol information
@@ -78,16 +98,220 @@ type SymbolInformation struct {
 	ContainerName string   `json:"containerName,omitempty"`
 }
 
+// DocumentSymbol represents a symbol with its nested children
+type DocumentSymbol struct {
+	Name           string           `json:"name"`
+	Detail         string           `json:"detail,omitempty"`
+	Kind           int              `json:"kind"`
+	Range          Range            `json:"range"`
+	SelectionRange Range            `json:"selectionRange"`
+	Children       []DocumentSymbol `json:"children,omitempty"`
+}
+
+// TextEdit replaces the text in a range
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// FoldingRange is a range of lines the editor can collapse
+type FoldingRange struct {
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+	Kind      string `json:"kind,omitempty"`
+}
+
+// Constants for folding range kinds
+const (
+	FoldingRangeKindRegion = "region"
+)
+
+// DocumentHighlight marks an occurrence of the symbol under the cursor
+type DocumentHighlight struct {
+	Range Range `json:"range"`
+	Kind  int   `json:"kind,omitempty"`
+}
+
+// Constants for document highlight kinds
+const (
+	DocumentHighlightKindText  = 1
+	DocumentHighlightKindRead  = 2
+	DocumentHighlightKindWrite = 3
+)
+
+// WorkspaceEdit groups text edits by document URI
+type WorkspaceEdit struct {
+	Changes map[string][]TextEdit `json:"changes"`
+}
+
+// CodeAction represents a change that can be performed in code
+type CodeAction struct {
+	Title       string         `json:"title"`
+	Kind        string         `json:"kind,omitempty"`
+	Diagnostics []Diagnostic   `json:"diagnostics,omitempty"`
+	IsPreferred bool           `json:"isPreferred,omitempty"`
+	Edit        *WorkspaceEdit `json:"edit,omitempty"`
+}
+
+// Constants for code action kinds
+const (
+	CodeActionKindQuickFix = "quickfix"
+)
+
+// InlayHint is an inline annotation shown in the editor
+type InlayHint struct {
+	Position Position `json:"position"`
+	Label    string   `json:"label"`
+	Kind     int      `json:"kind,omitempty"`
+}
+
+// Constants for inlay hint kinds
+const (
+	InlayHintKindType      = 1
+	InlayHintKindParameter = 2
+)
+
+// SelectionRange is a range the selection can grow to, linked to the range
+// enclosing it
+type SelectionRange struct {
+	Range  Range           `json:"range"`
+	Parent *SelectionRange `json:"parent,omitempty"`
+}
+
+// DocumentLink is a range of a document that links to another file
+type DocumentLink struct {
+	Range  Range  `json:"range"`
+	Target string `json:"target,omitempty"`
+}
+
+// SemanticTokens holds the encoded semantic tokens of a document
+type SemanticTokens struct {
+	Data []int `json:"data"`
+}
+
+// TypeHierarchyItem represents a type in a type hierarchy
+type TypeHierarchyItem struct {
+	Name           string `json:"name"`
+	Kind           int    `json:"kind"`
+	Detail         string `json:"detail,omitempty"`
+	URI            string `json:"uri"`
+	Range          Range  `json:"range"`
+	SelectionRange Range  `json:"selectionRange"`
+	// Data carries the qualified type name between requests
+	Data string `json:"data,omitempty"`
+}
+
+// ClientCapabilities holds the client capabilities the server acts on
+type ClientCapabilities struct {
+	TextDocument struct {
+		Completion struct {
+			CompletionItem struct {
+				SnippetSupport bool `json:"snippetSupport"`
+			} `json:"completionItem"`
+		} `json:"completion"`
+		DocumentSymbol struct {
+			HierarchicalDocumentSymbolSupport bool `json:"hierarchicalDocumentSymbolSupport"`
+		} `json:"documentSymbol"`
+		Rename struct {
+			PrepareSupport bool `json:"prepareSupport"`
+		} `json:"rename"`
+		CodeAction struct {
+			// CodeActionLiteralSupport is set when the client accepts code
+			// action literals and the options describing their kinds
+			CodeActionLiteralSupport *struct{} `json:"codeActionLiteralSupport"`
+		} `json:"codeAction"`
+	} `json:"textDocument"`
+	Workspace struct {
+		DidChangeWatchedFiles struct {
+			DynamicRegistration bool `json:"dynamicRegistration"`
+		} `json:"didChangeWatchedFiles"`
+		// Configuration means the client answers workspace/configuration
+		Configuration bool `json:"configuration"`
+		InlayHint     struct {
+			RefreshSupport bool `json:"refreshSupport"`
+		} `json:"inlayHint"`
+	} `json:"workspace"`
+	Window struct {
+		WorkDoneProgress bool `json:"workDoneProgress"`
+	} `json:"window"`
+	General struct {
+		PositionEncodings []string `json:"positionEncodings"`
+	} `json:"general"`
+}
+
+// InitializationOptions are the server settings a client may pass in
+// initialize
+type InitializationOptions struct {
+	// IndexLib includes the shards `lib` directory in the workspace index
+	IndexLib bool `json:"indexLib"`
+
+	// InlayHints turns inferred type hints on or off; they are on by default
+	InlayHints *bool `json:"inlayHints,omitempty"`
+
+	// CrystalPath is the compiler executable to use instead of the one
+	// found on PATH
+	CrystalPath string `json:"crystalPath,omitempty"`
+
+	// LogToClient sends server logs to the editor as window/logMessage
+	// instead of stderr
+	LogToClient bool `json:"logToClient,omitempty"`
+
+	// Diagnostics turns individual checks on or off
+	Diagnostics DiagnosticSettings `json:"diagnostics"`
+}
+
+// DiagnosticSettings enables or disables individual checks. Checks that are
+// not mentioned keep their current setting.
+type DiagnosticSettings struct {
+	SyntaxErrors      *bool `json:"syntaxErrors,omitempty"`
+	UndefinedVariable *bool `json:"undefinedVariable,omitempty"`
+	StructureBalance  *bool `json:"structureBalance,omitempty"`
+	BracketBalance    *bool `json:"bracketBalance,omitempty"`
+
+	AssignmentInCondition *bool `json:"assignmentInCondition,omitempty"`
+}
+
+// FileEvent describes a change to a watched file
+type FileEvent struct {
+	URI  string `json:"uri"`
+	Type int    `json:"type"`
+}
+
+// Constants for file change types
+const (
+	FileChangeTypeCreated = 1
+	FileChangeTypeChanged = 2
+	FileChangeTypeDeleted = 3
+)
+
+// CodeRequestCancelled is the LSP error code for a request the client
+// cancelled with $/cancelRequest
+const CodeRequestCancelled = -32800
+
+// Constants for window/showMessage and window/logMessage types
+const (
+	MessageTypeError   = 1
+	MessageTypeWarning = 2
+	MessageTypeInfo    = 3
+	MessageTypeLog     = 4
+)
+
 // Hover information
 type Hover struct {
 	Contents []string `json:"contents"`
 	Range    *Range   `json:"range,omitempty"`
 }
 
+// ParameterInformation represents a parameter of a signature
+type ParameterInformation struct {
+	Label string `json:"label"`
+}
+
 // SignatureInformation represents signature information
 type SignatureInformation struct {
-	Label         string `json:"label"`
-	Documentation string `json:"documentation,omitempty"`
+	Label         string                 `json:"label"`
+	Documentation string                 `json:"documentation,omitempty"`
+	Parameters    []ParameterInformation `json:"parameters,omitempty"`
 }
 
 // SignatureHelp represents signature help
@@ -126,6 +350,12 @@ const (
 	CompletionItemKindTypeParameter = 25
 )
 
+// Constants for completion item insert text formats
+const (
+	InsertTextFormatPlainText = 1
+	InsertTextFormatSnippet   = 2
+)
+
 // Constants for symbol kinds
 const (
 	SymbolKindFile          = 1
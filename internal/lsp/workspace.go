@@ -0,0 +1,100 @@
+package lsp
+
+import (
+	"sort"
+	"strings"
+)
+
+// GetWorkspaceSymbols returns the classes, modules, methods and constants of
+// every given document whose name contains query, ignoring case. Names that
+// start with the query are ranked before other matches, each group sorted
+// by name.
+func (a *CrystalAnalyzer) GetWorkspaceSymbols(docs []*TextDocumentItem, query string) []SymbolInformation {
+	query = strings.ToLower(query)
+	symbols := []SymbolInformation{}
+
+	for _, doc := range docs {
+		for _, symbol := range a.documentSymbolsForSearch(doc) {
+			if strings.Contains(strings.ToLower(symbol.Name), query) {
+				symbols = append(symbols, symbol)
+			}
+		}
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		iPrefix := strings.HasPrefix(strings.ToLower(symbols[i].Name), query)
+		jPrefix := strings.HasPrefix(strings.ToLower(symbols[j].Name), query)
+		if iPrefix != jPrefix {
+			return iPrefix
+		}
+		iName, jName := strings.ToLower(symbols[i].Name), strings.ToLower(symbols[j].Name)
+		if iName != jName {
+			return iName < jName
+		}
+		if symbols[i].Location.URI != symbols[j].Location.URI {
+			return symbols[i].Location.URI < symbols[j].Location.URI
+		}
+		return symbols[i].Location.Range.Start.Line < symbols[j].Location.Range.Start.Line
+	})
+
+	return symbols
+}
+
+// documentSymbolsForSearch lists the searchable symbols of one document
+func (a *CrystalAnalyzer) documentSymbolsForSearch(doc *TextDocumentItem) []SymbolInformation {
+	var symbols []SymbolInformation
+
+	a.parseDocumentStructure(doc)
+	context := a.documentContext(doc)
+
+	nameRange := func(start Position, name string) Range {
+		return Range{
+			Start: start,
+			End:   Position{Line: start.Line, Character: start.Character + encodedLen(name)},
+		}
+	}
+	containerOf := func(line int) string {
+		if classInfo := a.findEnclosingClass(line); classInfo != nil {
+			return classInfo.QualifiedName
+		}
+		return ""
+	}
+
+	for _, classInfo := range context.Classes {
+		symbols = append(symbols, SymbolInformation{
+			Name:          classInfo.Name,
+			Kind:          classInfo.SymbolKind(),
+			Location:      Location{URI: doc.URI, Range: nameRange(classInfo.Location, classInfo.Name)},
+			ContainerName: strings.TrimSuffix(strings.TrimSuffix(classInfo.QualifiedName, classInfo.Name), "::"),
+		})
+	}
+
+	for owner, methods := range context.Methods {
+		for _, method := range methods {
+			symbols = append(symbols, SymbolInformation{
+				Name:          method.Name,
+				Kind:          SymbolKindMethod,
+				Location:      Location{URI: doc.URI, Range: nameRange(method.Location, method.Name)},
+				ContainerName: owner,
+			})
+		}
+	}
+
+	// Constants are assignments to a capitalized name at the start of a line
+	for i, token := range context.Tokens {
+		if token.Type != TokenConstant || i+1 >= len(context.Tokens) || context.Tokens[i+1].Value != "=" {
+			continue
+		}
+		if i > 0 && context.Tokens[i-1].Position.Line == token.Position.Line {
+			continue
+		}
+		symbols = append(symbols, SymbolInformation{
+			Name:          token.Value,
+			Kind:          SymbolKindConstant,
+			Location:      Location{URI: doc.URI, Range: nameRange(token.Position, token.Value)},
+			ContainerName: containerOf(token.Position.Line),
+		})
+	}
+
+	return symbols
+}
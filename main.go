@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
 
 	"crystal-ls/internal/lsp"
 )
@@ -13,7 +16,14 @@ import (
 var version = "dev"
 
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "--version" {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	socket := flag.String("socket", "", "listen on a TCP `port` (or host:port) instead of stdio")
+	pipe := flag.String("pipe", "", "listen on a Unix socket at `path` instead of stdio")
+	logFile := flag.String("log-file", "", "append server logs to `path` instead of stderr")
+	logLevel := flag.String("log-level", "", "log `level`: off, messages or verbose")
+	flag.Parse()
+
+	if *showVersion {
 		fmt.Printf("Crystal Language Server %s\n", version)
 		return
 	}
@@ -21,9 +31,55 @@ func main() {
 	// Create a new Crystal LSP server
 	server := lsp.NewServer()
 
-	// Start the server
-	log.Println("Starting Crystal Language Server...")
-	if err := server.Start(context.Background()); err != nil {
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		// Writes are unbuffered, so nothing is lost if exit ends the process
+		defer file.Close()
+		log.SetOutput(file)
+		server.SetLogOutput(file)
+	}
+	if *logLevel != "" {
+		if err := server.SetLogLevel(*logLevel); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var err error
+	switch {
+	case *socket != "":
+		address := *socket
+		if !strings.Contains(address, ":") {
+			address = "127.0.0.1:" + address
+		}
+		err = serveOnce(server, "tcp", address)
+	case *pipe != "":
+		err = serveOnce(server, "unix", *pipe)
+	default:
+		log.Println("Starting Crystal Language Server...")
+		err = server.Start(context.Background())
+	}
+	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// serveOnce listens on address, serves the first client that connects and
+// returns when that connection closes
+func serveOnce(server *lsp.Server, network, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Starting Crystal Language Server on %s %s...", network, listener.Addr())
+	conn, err := listener.Accept()
+	listener.Close()
+	if err != nil {
+		return err
+	}
+
+	return server.Serve(context.Background(), conn)
+}